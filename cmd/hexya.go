@@ -71,6 +71,12 @@ func init() {
 	viper.BindPFlag("DB.Password", HexyaCmd.PersistentFlags().Lookup("db-password"))
 	HexyaCmd.PersistentFlags().String("db-name", "hexya", "Database name")
 	viper.BindPFlag("DB.Name", HexyaCmd.PersistentFlags().Lookup("db-name"))
+	HexyaCmd.PersistentFlags().Int("db-max-open-conns", 0, "Maximum number of open connections to the database. 0 means unlimited")
+	viper.BindPFlag("DB.MaxOpenConns", HexyaCmd.PersistentFlags().Lookup("db-max-open-conns"))
+	HexyaCmd.PersistentFlags().Int("db-max-idle-conns", 0, "Maximum number of idle connections kept in the pool. 0 keeps the default")
+	viper.BindPFlag("DB.MaxIdleConns", HexyaCmd.PersistentFlags().Lookup("db-max-idle-conns"))
+	HexyaCmd.PersistentFlags().Duration("db-conn-max-lifetime", 0, "Maximum amount of time a database connection may be reused (ex: 1h). 0 means forever")
+	viper.BindPFlag("DB.ConnMaxLifetime", HexyaCmd.PersistentFlags().Lookup("db-conn-max-lifetime"))
 }
 
 func initConfig() {
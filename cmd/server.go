@@ -88,6 +88,7 @@ func StartServer(config map[string]interface{}) {
 	controllers.BootStrap()
 	menus.BootStrap()
 	server.PostInit()
+	models.StartCronJobs()
 	srv := server.GetServer()
 	address := fmt.Sprintf("%s:%s", viper.GetString("Server.Interface"), viper.GetString("Server.Port"))
 	cert := viper.GetString("Server.Certificate")
@@ -132,6 +133,11 @@ func connectToDB() {
 		connectString += fmt.Sprintf(" port=%s", viper.GetString("DB.Port"))
 	}
 	models.DBConnect(viper.GetString("DB.Driver"), connectString)
+	models.DBConfigurePool(models.DBPoolParams{
+		MaxOpenConns:    viper.GetInt("DB.MaxOpenConns"),
+		MaxIdleConns:    viper.GetInt("DB.MaxIdleConns"),
+		ConnMaxLifetime: viper.GetDuration("DB.ConnMaxLifetime"),
+	})
 }
 
 func init() {
@@ -0,0 +1,108 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import "github.com/hexya-erp/hexya/hexya/models/security"
+
+// ReasonSudo is the reason of the PrivilegeEvents fired for RecordSets
+// whose user has been changed with Sudo.
+const ReasonSudo = "sudo"
+
+// A PrivilegeEvent describes an operation on records that was executed
+// with the privileges of another user than the one of the transaction,
+// who has more rights, so that the record rules of this other user applied
+// instead.
+type PrivilegeEvent struct {
+	// Model is the name of the model of the records
+	Model string
+	// Operation is the operation executed: "read", "write" or "unlink"
+	Operation string
+	// UID is the id of the user whose privileges were used
+	UID int64
+	// RealUID is the id of the user of the transaction
+	RealUID int64
+	// Reason is the cause of the privilege change, e.g. ReasonSudo
+	Reason string
+}
+
+// An AuditHook is a function called for each PrivilegeEvent.
+//
+// It is called synchronously from the goroutine executing the operation,
+// so it must be fast and safe for concurrent use.
+type AuditHook func(event PrivilegeEvent)
+
+// auditHook is the AuditHook in use. It is nil when no hook is set.
+var auditHook AuditHook
+
+// SetAuditHook sets the AuditHook that the ORM calls whenever records are
+// accessed with the privileges of another user that has more rights than the
+// user of the transaction, for instance through Sudo.
+// Passing nil disables the audit.
+//
+// This function must be called at startup before any transaction is opened.
+func SetAuditHook(hook AuditHook) {
+	auditHook = hook
+}
+
+// LogAuditHook is an AuditHook that logs the PrivilegeEvents it receives.
+func LogAuditHook(event PrivilegeEvent) {
+	log.Info("Privileged access to records", "model", event.Model, "operation", event.Operation,
+		"uid", event.UID, "real_uid", event.RealUID, "reason", event.Reason)
+}
+
+// auditPrivileges fires a PrivilegeEvent for the given operation if the
+// user of this RecordCollection has privileges that the user of the
+// transaction does not have. Switching to a user with the same or fewer
+// privileges is not audited. It does nothing if no AuditHook is set.
+func (rc *RecordCollection) auditPrivileges(perm security.Permission) {
+	if auditHook == nil || rc.env.realUID == 0 || !addsPrivileges(rc.env.realUID, rc.env.uid) {
+		return
+	}
+	var operation string
+	switch perm {
+	case security.Read:
+		operation = "read"
+	case security.Write:
+		operation = "write"
+	case security.Unlink:
+		operation = "unlink"
+	}
+	auditHook(PrivilegeEvent{
+		Model:     rc.ModelName(),
+		Operation: operation,
+		UID:       rc.env.uid,
+		RealUID:   rc.env.realUID,
+		Reason:    ReasonSudo,
+	})
+}
+
+// addsPrivileges returns true if the user with the given uid has privileges
+// that the user with the given realUID does not have, that is if uid is the
+// superuser or belongs to a group that realUID does not belong to.
+func addsPrivileges(realUID, uid int64) bool {
+	switch {
+	case realUID == uid, realUID == security.SuperUserID:
+		return false
+	case uid == security.SuperUserID:
+		return true
+	}
+	realGroups := security.Registry.UserGroups(realUID)
+	for group := range security.Registry.UserGroups(uid) {
+		if _, ok := realGroups[group]; !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -42,6 +42,9 @@ const (
 	ManualModel
 	// SystemModel is a model that is used internally by the Hexya Framework
 	SystemModel
+	// SQLViewModel is a read only model backed by an SQL view which is
+	// created from its query when the database is synchronized.
+	SQLViewModel
 )
 
 //  declareCommonMixin creates the common mixin that is needed for all models
@@ -59,10 +62,10 @@ func declareBaseMixin() {
 	baseMixin := NewMixinModel("BaseMixin")
 	declareBaseComputeMethods()
 	baseMixin.AddFields(map[string]FieldDefinition{
-		"CreateDate": DateTimeField{NoCopy: true},
-		"CreateUID":  IntegerField{NoCopy: true},
-		"WriteDate":  DateTimeField{NoCopy: true},
-		"WriteUID":   IntegerField{NoCopy: true},
+		"CreateDate": DateTimeField{NoCopy: true, ReadOnly: true},
+		"CreateUID":  IntegerField{NoCopy: true, ReadOnly: true},
+		"WriteDate":  DateTimeField{NoCopy: true, ReadOnly: true},
+		"WriteUID":   IntegerField{NoCopy: true, ReadOnly: true},
 		"LastUpdate": DateTimeField{JSON: "__last_update", Compute: baseMixin.Methods().MustGet("ComputeLastUpdate"),
 			Depends: []string{"WriteDate", "CreateDate"}},
 		"DisplayName": CharField{Compute: baseMixin.Methods().MustGet("ComputeDisplayName"), Depends: []string{""}},
@@ -121,16 +124,24 @@ func declareCRUDMethods() {
 		})
 
 	commonMixin.AddMethod("Read",
-		`Read reads the database and returns a slice of FieldMap of the given model`,
+		`Read reads the database and returns a slice of FieldMap of the given model.
+		fields can be paths through relation fields, such as "Profile.Age".
+		Null values of scalar fields are returned according to the RecordSet's NullPolicy.`,
 		func(rc *RecordCollection, fields []string) []FieldMap {
 			var res []FieldMap
 			// Check if we have id in fields, and add it otherwise
 			fields = addIDIfNotPresent(fields)
+			keepNulls := rc.readNullPolicy() == NullAsNil
 			// Do the actual reading
 			for _, rec := range rc.Records() {
 				fData := make(FieldMap)
 				for _, fName := range fields {
-					fData[fName] = rec.Get(fName)
+					target, field := rec.followPath(fName)
+					if keepNulls && !rc.model.getRelatedFieldInfo(fName).isRelationField() && target.IsNull(field) {
+						fData[fName] = nil
+						continue
+					}
+					fData[fName] = target.Get(field)
 				}
 				res = append(res, fData)
 			}
@@ -155,6 +166,14 @@ func declareCRUDMethods() {
 			return rc.update(data, fieldsToUnset...)
 		})
 
+	commonMixin.AddMethod("WriteIfChanged",
+		`WriteIfChanged updates records in the database with the fields of data
+		that differ from their current value. Records for which no field has
+		changed are not updated at all. It returns the number of updated records.`,
+		func(rc *RecordCollection, data FieldMapper, fieldsToUnset ...FieldNamer) int64 {
+			return rc.writeIfChanged(data, fieldsToUnset...)
+		})
+
 	commonMixin.AddMethod("Unlink",
 		`Unlink deletes the given records in the database.`,
 		func(rc *RecordCollection) int64 {
@@ -169,7 +188,7 @@ func declareCRUDMethods() {
 
 			var fields []string
 			for _, fi := range rc.model.fields.registryByName {
-				if fi.noCopy || fi.fieldType.IsReverseRelationType() || fi.isComputedField() {
+				if fi.noCopy || fi.fieldType.IsReverseRelationType() || fi.isComputedField() || fi.sqlGenerated {
 					continue
 				}
 				fields = append(fields, fi.json)
@@ -185,7 +204,7 @@ func declareCRUDMethods() {
 			fMap.MergeWith(overrides.FieldMap(fieldsToUnset...), rc.model)
 			// Reload original record to prevent cache discrepancies
 			rc.Load()
-			newRs := rc.WithContext("hexya_force_compute_write", true).Call("Create", fMap).(RecordSet).Collection()
+			newRs := rc.WithReadOnlyWrite().WithContext("hexya_force_compute_write", true).Call("Create", fMap).(RecordSet).Collection()
 			return newRs
 		})
 
@@ -271,7 +290,7 @@ func declareRecordSetMethods() {
 					Required:   fInfo.required,
 					Selection:  i18n.Registry.TranslateFieldSelection(lang, fInfo.model.name, fInfo.name, fInfo.selection),
 					Domain:     filter,
-					ReadOnly:   fInfo.isReadOnly(),
+					ReadOnly:   fInfo.isReadOnly() || fInfo.readOnly,
 					ReverseFK:  fInfo.jsonReverseFK,
 					OnChange:   fInfo.onChange != "",
 				}
@@ -410,6 +429,15 @@ func declareSearchMethods() {
 			return rc.SearchCount()
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("SearchAndCount",
+		`SearchAndCount fetches the records of this RecordSet and returns them with
+		the total number of records matching its conditions, regardless of its limit
+		and offset. If the limit has been set to zero with Limit, only the total is
+		computed and an empty RecordSet is returned.`,
+		func(rc *RecordCollection) (*RecordCollection, int) {
+			return rc.SearchAndCount()
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Fetch",
 		`Fetch query the database with the current filter and returns a RecordSet
 		with the queries ids.
@@ -432,6 +460,13 @@ func declareSearchMethods() {
 			return rc.GroupBy(exprs...)
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("Having",
+		`Having returns a new grouped RecordSet whose groups are filtered with the given condition
+		on their aggregated values.`,
+		func(rc *RecordCollection, cond Conditioner) *RecordCollection {
+			return rc.Having(cond.Underlying())
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Aggregates",
 		`Aggregates returns the result of this RecordSet query, which must by a grouped query.`,
 		func(rc *RecordCollection, exprs ...FieldNamer) []GroupAggregateRow {
@@ -459,6 +494,14 @@ func declareSearchMethods() {
 			return rc.OrderBy(exprs...)
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("Collate",
+		`Collate returns a new RecordSet whose text fields are sorted with the collation
+		of the given locale, such as "fr_FR". If locale is empty, the 'lang' key of the
+		context is used.`,
+		func(rc *RecordCollection, locale string) *RecordCollection {
+			return rc.Collate(locale)
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Union",
 		`Union returns a new RecordSet that is the union of this RecordSet and the given
 		"other" RecordSet. The result is guaranteed to be a set of unique records.`,
@@ -474,6 +517,21 @@ func declareSearchMethods() {
 			return rc.Subtract(other)
 		}).AllowGroup(security.GroupEveryone)
 
+	commonMixin.AddMethod("AddIds",
+		`AddIds returns a new RecordSet with the records of this RecordSet and
+		the records with the given ids. Ids already in this RecordSet are not
+		added twice.`,
+		func(rc *RecordCollection, ids ...int64) *RecordCollection {
+			return rc.AddIds(ids...)
+		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("SubtractIds",
+		`SubtractIds returns a new RecordSet with the records of this RecordSet
+		except those with the given ids.`,
+		func(rc *RecordCollection, ids ...int64) *RecordCollection {
+			return rc.SubtractIds(ids...)
+		}).AllowGroup(security.GroupEveryone)
+
 	commonMixin.AddMethod("Intersect",
 		`Intersect returns a new RecordCollection with only the records that are both
 		in this RecordCollection and in the other RecordSet.`,
@@ -493,6 +551,13 @@ func declareSearchMethods() {
 		func(rc *RecordCollection, other RecordSet) bool {
 			return rc.Equals(other)
 		}).AllowGroup(security.GroupEveryone)
+
+	commonMixin.AddMethod("Hash",
+		`Hash returns a stable hash of this RecordSet computed from its model
+		name and its sorted ids, that can be used as a cache key.`,
+		func(rc *RecordCollection) string {
+			return rc.Hash()
+		}).AllowGroup(security.GroupEveryone)
 }
 
 func declareEnvironmentMethods() {
@@ -16,6 +16,7 @@ package models
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
 	"github.com/hexya-erp/hexya/hexya/models/security"
@@ -45,13 +46,69 @@ func BootStrap() {
 	createModelLinks()
 	inflateEmbeddings()
 	syncRelatedFieldInfo()
+	setupSQLComputedFields()
+	setupInboundReferences()
 	bootStrapMethods()
+	setDisplayNameDepends()
 	processDepends()
 	checkFieldMethodsExist()
+	checkFieldSets()
 	checkComputeMethodsSignature()
 	setupSecurity()
 }
 
+// setupInboundReferences marks the models that are pointed to by a stored
+// relation field of another model, including M2M link models.
+func setupInboundReferences() {
+	for _, mi := range Registry.registryByTableName {
+		if mi.isMixin() || mi.isManual() {
+			continue
+		}
+		for _, fi := range mi.fields.registryByJSON {
+			if !fi.fieldType.IsFKRelationType() {
+				continue
+			}
+			if relatedMI, ok := Registry.registryByName[fi.relatedModelName]; ok {
+				relatedMI.inboundRefs = true
+			}
+		}
+	}
+}
+
+// setDisplayNameDepends makes the DisplayName field of the models that have a
+// Name field and the default NameGet method depend on Name, unless its
+// dependencies have been set explicitly, so that the cached display names are
+// invalidated when the name changes.
+func setDisplayNameDepends() {
+	for _, mi := range Registry.registryByName {
+		fi, ok := mi.fields.Get("DisplayName")
+		if !ok || !fi.isComputedField() || !hasDefaultNameGet(mi) {
+			continue
+		}
+		if len(fi.depends) > 1 || (len(fi.depends) == 1 && fi.depends[0] != "") {
+			continue
+		}
+		if _, ok := mi.fields.Get("Name"); ok {
+			fi.depends = []string{"Name"}
+		}
+	}
+}
+
+// hasDefaultNameGet returns true if the NameGet method of the given model
+// has not been overridden, i.e. if all its layers are declared in CommonMixin.
+func hasDefaultNameGet(mi *Model) bool {
+	meth, ok := mi.methods.get("NameGet")
+	if !ok {
+		return false
+	}
+	for _, layer := range meth.invertedLayers() {
+		if layer.declaredIn.name != "CommonMixin" {
+			return false
+		}
+	}
+	return true
+}
+
 // createModelLinks create links with related Model
 // where applicable. Also populates jsonReverseFK field
 func createModelLinks() {
@@ -125,9 +182,10 @@ func addMixinMethods(mixinModel, model *Model) {
 			}
 			for _, lf := range layersInv {
 				ml := methodLayer{
-					funcValue: wrapFunctionForMethodLayer(lf.funcValue),
-					mixedIn:   true,
-					method:    emi,
+					funcValue:  wrapFunctionForMethodLayer(lf.funcValue),
+					mixedIn:    true,
+					method:     emi,
+					declaredIn: lf.declaredIn,
 				}
 				emi.nextLayer[&ml] = firstMixedLayer
 				firstMixedLayer = &ml
@@ -144,6 +202,7 @@ func addMixinMethods(mixinModel, model *Model) {
 			newMethInfo := copyMethod(model, methInfo)
 			for i := 0; i < len(layersInv); i++ {
 				newMethInfo.addMethodLayer(layersInv[i].funcValue, layersInv[i].doc)
+				newMethInfo.topLayer.declaredIn = layersInv[i].declaredIn
 			}
 			model.methods.set(methName, newMethInfo)
 		}
@@ -227,6 +286,8 @@ func syncRelatedFieldInfo() {
 			newFI.onChange = ""
 			newFI.index = false
 			newFI.compute = ""
+			newFI.computeSQL = ""
+			newFI.sqlGenerated = false
 			newFI.constraint = ""
 			newFI.inverse = ""
 			newFI.depends = nil
@@ -235,6 +296,28 @@ func syncRelatedFieldInfo() {
 	}
 }
 
+// setupSQLComputedFields turns the fields that have an SQL expression into
+// columns generated by the database if it supports them. Otherwise, these
+// fields are computed in Go by their Compute method, which is then required.
+func setupSQLComputedFields() {
+	supported := db != nil && adapters[db.DriverName()].supportsGeneratedColumns()
+	for _, mi := range Registry.registryByName {
+		for _, fi := range mi.fields.registryByName {
+			if fi.computeSQL == "" {
+				continue
+			}
+			if !supported {
+				if fi.compute == "" {
+					log.Panic("Generated columns are not supported by the database and field has no Compute method",
+						"model", mi.name, "field", fi.name)
+				}
+				continue
+			}
+			mi.fields.setSQLGenerated(fi)
+		}
+	}
+}
+
 // runInit runs the Init function of the given model if it exists
 func runInit(model *Model) {
 	if _, exists := model.methods.get("Init"); exists {
@@ -250,6 +333,8 @@ func SyncDatabase() {
 	dbTables := adapter.tables()
 	// Create or update sequences
 	updateDBSequences()
+	// Drop SQL views so that the columns they use can be altered
+	dropDBViews()
 	// Create or update existing tables
 	for tableName, model := range Registry.registryByTableName {
 		if model.isMixin() {
@@ -277,7 +362,10 @@ func SyncDatabase() {
 		buildSQLErrorSubstitutionMap(model)
 		updateDBForeignKeyConstraints(model)
 		updateDBConstraints(model)
+		updateDBUniqueIndexes(model)
 	}
+	// Create SQL views
+	createDBViews()
 	// Run init method on each model
 	for _, model := range Registry.registryByTableName {
 		if model.isMixin() {
@@ -306,6 +394,64 @@ func SyncDatabase() {
 	}
 }
 
+// storeComputedFieldBatchSize is the number of records that are
+// recomputed in each transaction by StoreComputedField.
+const storeComputedFieldBatchSize = 1000
+
+// StoreComputedField turns the given computed field of this model into a
+// stored field. The column is created in the database if it does not exist
+// yet and the value of the field is computed and written for all existing
+// records, in batches of one transaction each. From then on, the field is
+// recomputed and persisted whenever one of its dependencies is modified.
+//
+// This is a maintenance operation meant to be run once after bootstrap.
+// It is safe to run it again, in which case it only recomputes the values
+// that changed.
+func (m *Model) StoreComputedField(field string) error {
+	fi, ok := m.fields.Get(field)
+	if !ok {
+		return fmt.Errorf("unknown field %s in model %s", field, m.name)
+	}
+	if !fi.isComputedField() {
+		return fmt.Errorf("field %s of model %s is not a computed field", field, m.name)
+	}
+	if fi.fieldType.IsNonStoredRelationType() {
+		return fmt.Errorf("field %s of model %s is of type %s which cannot be stored", field, m.name, fi.fieldType)
+	}
+	// The column must exist before the field is marked as stored,
+	// since queries on this model select all stored fields.
+	err := TryCall(func() {
+		adapter := adapters[db.DriverName()]
+		if _, exists := adapter.columns(m.tableName)[fi.json]; !exists {
+			addDBColumn(fi)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	m.fields.setStored(fi)
+	var ids []int64
+	err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		ids = env.Pool(m.name).SearchAll().OrderBy("ID").Ids()
+	})
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += storeComputedFieldBatchSize {
+		end := start + storeComputedFieldBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err = ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			updateStoredFields(env.Pool(m.name).Browse(ids[start:end]...), fi.compute)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // buildSQLErrorSubstitutionMap populates the sqlErrors map of the
 // model with the appropriate error message substitution
 func buildSQLErrorSubstitutionMap(model *Model) {
@@ -368,6 +514,32 @@ func createDBTable(tableName string) {
 	dbExecuteNoTx(query)
 }
 
+// dropDBViews drops the views of the SQL view models, together with the views
+// that depend on them. It is called before the tables are synchronized, so that
+// the columns used by the views can be altered or dropped, and so that views
+// can be recreated by createDBViews even if their columns changed. The query
+// of an SQL view model must therefore not reference another SQL view model.
+func dropDBViews() {
+	adapter := adapters[db.DriverName()]
+	for _, model := range Registry.registryByTableName {
+		if !model.isSQLView() {
+			continue
+		}
+		dbExecuteNoTx(fmt.Sprintf(`DROP VIEW IF EXISTS %s CASCADE`, adapter.quoteTableName(model.tableName)))
+	}
+}
+
+// createDBViews creates the views of the SQL view models.
+func createDBViews() {
+	adapter := adapters[db.DriverName()]
+	for _, model := range Registry.registryByTableName {
+		if !model.isSQLView() {
+			continue
+		}
+		dbExecuteNoTx(fmt.Sprintf(`CREATE VIEW %s AS (%s)`, adapter.quoteTableName(model.tableName), model.viewQuery))
+	}
+}
+
 // dropDBTable drops the given table in the database
 func dropDBTable(tableName string) {
 	adapter := adapters[db.DriverName()]
@@ -381,11 +553,30 @@ func updateDBColumns(mi *Model) {
 	adapter := adapters[db.DriverName()]
 	dbColumns := adapter.columns(mi.tableName)
 	// create or update columns from registry data
+	var generatedFields []*Field
 	for colName, fi := range mi.fields.registryByJSON {
 		if colName == "id" || !fi.isStored() {
 			continue
 		}
 		dbColData, ok := dbColumns[colName]
+		if ok && dbColData.IsGenerated != fi.sqlGenerated {
+			// A column cannot be turned into a generated column or back
+			dropDBColumn(mi.tableName, colName)
+			ok = false
+		}
+		if ok && fi.sqlGenerated && adapter.generationExpressionChanged(fi, dbColData.GenerationExpression.String) {
+			// The expression of a generated column cannot be altered
+			dropDBColumn(mi.tableName, colName)
+			ok = false
+		}
+		if fi.sqlGenerated {
+			// Generated columns are created last, since they
+			// may reference the other columns of the table.
+			if !ok {
+				generatedFields = append(generatedFields, fi)
+			}
+			continue
+		}
 		if !ok {
 			createDBColumn(fi)
 		}
@@ -401,6 +592,9 @@ func updateDBColumns(mi *Model) {
 			updateDBColumnDefault(fi)
 		}
 	}
+	for _, fi := range generatedFields {
+		createDBColumn(fi)
+	}
 	// drop columns that no longer exist
 	for colName := range dbColumns {
 		if _, ok := mi.fields.registryByJSON[colName]; !ok {
@@ -414,6 +608,12 @@ func createDBColumn(fi *Field) {
 	if !fi.isStored() {
 		log.Panic("createDBColumn should not be called on non stored fields", "model", fi.model.name, "field", fi.json)
 	}
+	addDBColumn(fi)
+}
+
+// addDBColumn adds the column of the given Field to its table in database,
+// whether the field is already stored or not.
+func addDBColumn(fi *Field) {
 	adapter := adapters[db.DriverName()]
 	query := fmt.Sprintf(`
 		ALTER TABLE %s
@@ -513,6 +713,63 @@ dbConLoop:
 	}
 }
 
+// updateDBUniqueIndexes synchronizes the partial unique indexes of the
+// database with those of the given Model.
+func updateDBUniqueIndexes(m *Model) {
+	adapter := adapters[db.DriverName()]
+	if !adapter.supportsPartialIndexes() {
+		for indexName := range m.uniqueIndexes {
+			log.Warn("Partial unique constraints are not supported by the database driver", "model", m.name,
+				"index", indexName, "driver", db.DriverName())
+		}
+		return
+	}
+	for indexName, index := range m.uniqueIndexes {
+		if adapter.indexExists(m.tableName, indexName) {
+			if !adapter.partialIndexChanged(m.tableName, indexName, uniqueIndexColumns(m, index), index.where) {
+				continue
+			}
+			dropIndex(indexName)
+		}
+		createUniqueIndex(m, index)
+	}
+dbIdxLoop:
+	for _, dbIndexName := range adapter.indexes(m.tableName, fmt.Sprintf("%%_%s_manidx", m.tableName)) {
+		for indexName := range m.uniqueIndexes {
+			if indexName == dbIndexName {
+				continue dbIdxLoop
+			}
+		}
+		dropIndex(dbIndexName)
+	}
+}
+
+// uniqueIndexColumns returns the column names of the fields of the given index
+func uniqueIndexColumns(m *Model, index uniqueIndex) []string {
+	cols := make([]string, len(index.fields))
+	for i, f := range index.fields {
+		cols[i] = m.fields.MustGet(f).json
+	}
+	return cols
+}
+
+// createUniqueIndex creates the given partial unique index on the table of m
+func createUniqueIndex(m *Model, index uniqueIndex) {
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`
+		CREATE UNIQUE INDEX %s ON %s (%s) WHERE %s
+	`, index.name, adapter.quoteTableName(m.tableName), strings.Join(uniqueIndexColumns(m, index), ", "), index.where)
+	dbExecuteNoTx(query)
+}
+
+// dropIndex drops the index with the given name
+func dropIndex(indexName string) {
+	query := fmt.Sprintf(`
+		DROP INDEX IF EXISTS %s
+	`, indexName)
+	dbExecuteNoTx(query)
+}
+
 // createFKConstraint creates an FK constraint for the given column that references the given targetTable
 func createFKConstraint(tableName, colName, targetTable, ondelete string) {
 	adapter := adapters[db.DriverName()]
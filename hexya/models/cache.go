@@ -15,7 +15,11 @@
 package models
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
@@ -35,6 +39,9 @@ type cache struct {
 	m2mLinks        map[*Model]map[[2]int64]bool
 	scheduledInsert map[cacheRef]cacheRef
 	scheduledUpdate map[cacheRef]map[string]bool
+	userGroups      map[int64][]string
+	// writeBatch is the number of nested WriteBatch calls being executed
+	writeBatch int
 }
 
 func (c *cache) isInDb(ref cacheRef) bool {
@@ -89,23 +96,29 @@ func (c *cache) initWithData(ref cacheRef, data FieldMap) FieldMap {
 // and a field json name (no path).
 func (c *cache) updateEntryByRef(ref cacheRef, jsonName string, value interface{}) {
 	c.getData(ref)
-	if ref.id > 0 {
+	fi := ref.model.fields.MustGet(jsonName)
+	if ref.id > 0 && jsonName != "id" && fi.isStored() && !fi.sqlGenerated {
+		// Non stored fields such as computed fields are only cached
 		if _, ok := c.scheduledUpdate[ref]; !ok {
 			c.scheduledUpdate[ref] = make(map[string]bool)
 		}
 		c.scheduledUpdate[ref][jsonName] = true
 	}
-	fi := ref.model.fields.MustGet(jsonName)
 	switch fi.fieldType {
 	case fieldtype.One2Many:
 		ids := value.([]int64)
 		for _, id := range ids {
+			if c.hasOtherParent(fi, id, ref.id) {
+				continue
+			}
 			c.updateEntry(fi.relatedModel, id, fi.jsonReverseFK, ref.id)
 		}
 		c.getData(ref)[jsonName] = true
 	case fieldtype.Rev2One:
 		id := value.(int64)
-		c.updateEntry(fi.relatedModel, id, fi.jsonReverseFK, ref.id)
+		if !c.hasOtherParent(fi, id, ref.id) {
+			c.updateEntry(fi.relatedModel, id, fi.jsonReverseFK, ref.id)
+		}
 		c.getData(ref)[jsonName] = true
 	case fieldtype.Many2Many:
 		ids := value.([]int64)
@@ -117,13 +130,75 @@ func (c *cache) updateEntryByRef(ref cacheRef, jsonName string, value interface{
 	}
 }
 
+// hasOtherParent returns true if the record with the given id of the related
+// model of the given one2many or rev2one field has a reverse FK in cache that
+// does not point at parentID.
+//
+// Such a record has been given another parent in cache and its reverse FK must
+// not be overwritten when loading the relation of parentID, since the database
+// does not know about the change until the cache is flushed. One2many values
+// are computed from the reverse FKs of the cached records, so that the record
+// will show up in the relation of its new parent only.
+func (c *cache) hasOtherParent(fi *Field, id, parentID int64) bool {
+	data, ok := c.data[c.getCacheRef(fi.relatedModel, id)]
+	if !ok {
+		return false
+	}
+	fk, ok := (*data)[fi.jsonReverseFK]
+	if !ok {
+		return false
+	}
+	return fk != parentID
+}
+
+// invalidateParentRelations removes from the cache the one2many and rev2one
+// fields computed from the given FK field of the record with the given ref on
+// the parent record it points at, so that they are loaded again from the
+// database. It must be called before the FK value of the record is removed
+// from the cache, otherwise the record would silently disappear from these
+// relations.
+func (c *cache) invalidateParentRelations(ref cacheRef, fi *Field) {
+	data, ok := c.data[ref]
+	if !ok {
+		return
+	}
+	parentID, ok := (*data)[fi.json].(int64)
+	if !ok || parentID == 0 {
+		return
+	}
+	parentData, ok := c.data[c.getCacheRef(fi.relatedModel, parentID)]
+	if !ok {
+		return
+	}
+	for _, pfi := range fi.relatedModel.fields.registryByJSON {
+		if pfi.fieldType != fieldtype.One2Many && pfi.fieldType != fieldtype.Rev2One {
+			continue
+		}
+		if pfi.relatedModel == ref.model && pfi.jsonReverseFK == fi.json {
+			delete(*parentData, pfi.json)
+		}
+	}
+}
+
+// m2mLinkIndexes returns the positions in the M2M links of the cache of the
+// id of our record and of the id of their record for the given M2M field.
+//
+// Positions are given by the fields of the link model, so that the two fields
+// of a relation and of its reverse relation on the other model agree on them.
+// They do not depend on the related models, which are the same for both sides
+// of a self-referential relation, nor on the names of the fields: they are set
+// once and for all when the link model is created.
+func m2mLinkIndexes(fi *Field) (int, int) {
+	return fi.m2mOurField.m2mLinkIndex, fi.m2mTheirField.m2mLinkIndex
+}
+
 // removeM2MLinks removes all M2M links associated with the record with
 // the given id on the given field
 func (c *cache) removeM2MLinks(fi *Field, id int64) {
 	if _, exists := c.m2mLinks[fi.m2mRelModel]; !exists {
 		return
 	}
-	index := (strings.Compare(fi.m2mOurField.name, fi.m2mTheirField.name) + 1) / 2
+	index, _ := m2mLinkIndexes(fi)
 	for link := range c.m2mLinks[fi.m2mRelModel] {
 		if link[index] == id {
 			delete(c.m2mLinks[fi.m2mRelModel], link)
@@ -137,8 +212,7 @@ func (c *cache) addM2MLink(fi *Field, id int64, values []int64) {
 	if _, exists := c.m2mLinks[fi.m2mRelModel]; !exists {
 		c.m2mLinks[fi.m2mRelModel] = make(map[[2]int64]bool)
 	}
-	ourIndex := (strings.Compare(fi.m2mOurField.name, fi.m2mTheirField.name) + 1) / 2
-	theirIndex := (ourIndex + 1) % 2
+	ourIndex, theirIndex := m2mLinkIndexes(fi)
 	for _, val := range values {
 		var newLink [2]int64
 		newLink[ourIndex] = id
@@ -153,8 +227,7 @@ func (c *cache) getM2MLinks(fi *Field, id int64) []int64 {
 		return []int64{}
 	}
 	var res []int64
-	ourIndex := (strings.Compare(fi.m2mOurField.name, fi.m2mTheirField.name) + 1) / 2
-	theirIndex := (ourIndex + 1) % 2
+	ourIndex, theirIndex := m2mLinkIndexes(fi)
 	for link := range c.m2mLinks[fi.m2mRelModel] {
 		if link[ourIndex] == id {
 			res = append(res, link[theirIndex])
@@ -190,6 +263,11 @@ func (c *cache) addRecord(mi *Model, id int64, fMap FieldMap) {
 // this method, since this will bring discrepancies in the other
 // records references (One2Many and Many2Many fields).
 func (c *cache) invalidateRecord(mi *Model, id int64) {
+	for _, fi := range mi.fields.registryByJSON {
+		if fi.fieldType.IsFKRelationType() {
+			c.invalidateParentRelations(c.getCacheRef(mi, id), fi)
+		}
+	}
 	delete(c.data, c.getCacheRef(mi, id))
 	for _, fi := range mi.fields.registryByJSON {
 		if fi.fieldType == fieldtype.Many2Many {
@@ -198,13 +276,126 @@ func (c *cache) invalidateRecord(mi *Model, id int64) {
 	}
 }
 
+// invalidateRecords removes the records of the given model with the given ids
+// from the cache, together with their scheduled inserts and updates and their
+// M2M links. Contrary to calling invalidateRecord on each id, the M2M links of
+// the model are scanned only once.
+func (c *cache) invalidateRecords(mi *Model, ids []int64) {
+	idsSet := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		idsSet[id] = true
+		ref := c.getCacheRef(mi, id)
+		for _, fi := range mi.fields.registryByJSON {
+			if fi.fieldType.IsFKRelationType() {
+				c.invalidateParentRelations(ref, fi)
+			}
+		}
+		delete(c.data, ref)
+		delete(c.scheduledUpdate, ref)
+		delete(c.scheduledInsert, ref)
+	}
+	for _, fi := range mi.fields.registryByJSON {
+		if fi.fieldType != fieldtype.Many2Many {
+			continue
+		}
+		links, exists := c.m2mLinks[fi.m2mRelModel]
+		if !exists {
+			continue
+		}
+		index, _ := m2mLinkIndexes(fi)
+		for link := range links {
+			if idsSet[link[index]] {
+				delete(links, link)
+			}
+		}
+	}
+}
+
+// invalidateModel removes all the records of the given model from the cache,
+// as well as the M2M links of its many2many fields. Scheduled updates of
+// these records are discarded.
+//
+// It panics if some records of this model have not been inserted in the
+// database yet, since they would be lost.
+func (c *cache) invalidateModel(mi *Model) {
+	for ref, insertedRef := range c.scheduledInsert {
+		if ref.model == mi && insertedRef.id <= 0 {
+			log.Panic("Trying to invalidate a model with pending inserts", "model", mi.name, "record", ref)
+		}
+	}
+	for ref := range c.data {
+		if ref.model == mi {
+			delete(c.data, ref)
+		}
+	}
+	for ref := range c.scheduledUpdate {
+		if ref.model == mi {
+			delete(c.scheduledUpdate, ref)
+		}
+	}
+	for _, fi := range mi.fields.registryByJSON {
+		if fi.fieldType == fieldtype.Many2Many {
+			delete(c.m2mLinks, fi.m2mRelModel)
+		}
+	}
+}
+
+// clear removes from this cache the data of all the records and all the
+// many2many links, so that they are fetched again from the database. This
+// cache must have been flushed beforehand.
+//
+// Records created in this cache are kept, so that they can still be found
+// by their temporary ids.
+func (c *cache) clear() {
+	kept := make(map[cacheRef]bool)
+	for ref, insertedRef := range c.scheduledInsert {
+		kept[ref] = true
+		kept[insertedRef] = true
+	}
+	for ref := range c.data {
+		if !kept[ref] {
+			delete(c.data, ref)
+		}
+	}
+	c.m2mLinks = make(map[*Model]map[[2]int64]bool)
+}
+
+// removeGeneratedFields removes from the cache the values of the fields of
+// the record with the given ref that are generated by the database, so that
+// they are read again after the record has been written.
+func (c *cache) removeGeneratedFields(ref cacheRef) {
+	data, ok := c.data[ref]
+	if !ok {
+		return
+	}
+	for jsonName, fi := range ref.model.fields.registryByJSON {
+		if fi.sqlGenerated {
+			delete(*data, jsonName)
+		}
+	}
+}
+
+// hasBatchedUpdate returns true if an update of the given field of the record
+// with the given model and id is pending in a write batch. Such a value must
+// not be overwritten by loading the record from the database, since it would
+// then be lost when the batch is flushed.
+func (c *cache) hasBatchedUpdate(mi *Model, id int64, fieldName string) bool {
+	if c.writeBatch == 0 {
+		return false
+	}
+	return c.scheduledUpdate[c.getCacheRef(mi, id)][fieldName]
+}
+
 // removeEntry removes the given entry from cache
 func (c *cache) removeEntry(mi *Model, id int64, fieldName string) {
 	if !c.checkIfInCache(mi, []int64{id}, []string{fieldName}) {
 		return
 	}
-	delete(c.getData(c.getCacheRef(mi, id)), fieldName)
 	fi := mi.fields.MustGet(fieldName)
+	if fi.fieldType.IsFKRelationType() {
+		c.invalidateParentRelations(c.getCacheRef(mi, id), fi)
+	}
+	delete(c.getData(c.getCacheRef(mi, id)), fi.json)
 	if fi.fieldType == fieldtype.Many2Many {
 		c.removeM2MLinks(fi, id)
 	}
@@ -306,6 +497,200 @@ func (c *cache) getCacheRef(mi *Model, id int64) cacheRef {
 	return cacheRef{model: mi, id: id}
 }
 
+// copy returns a deep copy of this cache. Records that share the same
+// data in this cache (after being inserted in the database) also share
+// it in the copy.
+func (c *cache) copy() *cache {
+	res := newCache()
+	res.counterID = c.counterID
+	res.writeBatch = c.writeBatch
+	copies := make(map[*FieldMap]*FieldMap)
+	for ref, data := range c.data {
+		dataCopy, ok := copies[data]
+		if !ok {
+			fMap := make(FieldMap, len(*data))
+			for k, v := range *data {
+				fMap[k] = v
+			}
+			dataCopy = &fMap
+			copies[data] = dataCopy
+		}
+		res.data[ref] = dataCopy
+	}
+	for model, links := range c.m2mLinks {
+		res.m2mLinks[model] = make(map[[2]int64]bool, len(links))
+		for link, val := range links {
+			res.m2mLinks[model][link] = val
+		}
+	}
+	for ref, insertedRef := range c.scheduledInsert {
+		res.scheduledInsert[ref] = insertedRef
+	}
+	for ref, fields := range c.scheduledUpdate {
+		res.scheduledUpdate[ref] = make(map[string]bool, len(fields))
+		for field, val := range fields {
+			res.scheduledUpdate[ref][field] = val
+		}
+	}
+	return res
+}
+
+// sortedRefs returns the given cacheRefs sorted by model name and id
+func sortedRefs(refs []cacheRef) []cacheRef {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].model.name != refs[j].model.name {
+			return refs[i].model.name < refs[j].model.name
+		}
+		return refs[i].id < refs[j].id
+	})
+	return refs
+}
+
+// String returns the string representation of a cacheRef
+func (ref cacheRef) String() string {
+	return fmt.Sprintf("%s(%d)", ref.model.name, ref.id)
+}
+
+// dump returns a human readable representation of the content of this
+// cache, keyed by model and id. It does not modify the cache.
+func (c *cache) dump() string {
+	var buf bytes.Buffer
+	buf.WriteString("Data:\n")
+	dataRefs := make([]cacheRef, 0, len(c.data))
+	for ref := range c.data {
+		dataRefs = append(dataRefs, ref)
+	}
+	for _, ref := range sortedRefs(dataRefs) {
+		fields := (*c.data[ref]).Keys()
+		sort.Strings(fields)
+		values := make([]string, len(fields))
+		for i, field := range fields {
+			values[i] = fmt.Sprintf("%s: %v", field, (*c.data[ref])[field])
+		}
+		fmt.Fprintf(&buf, "  %s: {%s}\n", ref, strings.Join(values, ", "))
+	}
+	buf.WriteString("M2M links:\n")
+	models := make([]*Model, 0, len(c.m2mLinks))
+	for model := range c.m2mLinks {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].name < models[j].name })
+	for _, model := range models {
+		links := make([]string, 0, len(c.m2mLinks[model]))
+		for link := range c.m2mLinks[model] {
+			links = append(links, fmt.Sprintf("%v", link))
+		}
+		sort.Strings(links)
+		fmt.Fprintf(&buf, "  %s: %s\n", model.name, strings.Join(links, ", "))
+	}
+	buf.WriteString("Scheduled inserts:\n")
+	insertRefs := make([]cacheRef, 0, len(c.scheduledInsert))
+	for ref := range c.scheduledInsert {
+		insertRefs = append(insertRefs, ref)
+	}
+	for _, ref := range sortedRefs(insertRefs) {
+		status := "pending"
+		if insertedRef := c.scheduledInsert[ref]; insertedRef.id > 0 {
+			status = fmt.Sprintf("inserted as %s", insertedRef)
+		}
+		fmt.Fprintf(&buf, "  %s: %s\n", ref, status)
+	}
+	buf.WriteString("Scheduled updates:\n")
+	updateRefs := make([]cacheRef, 0, len(c.scheduledUpdate))
+	for ref := range c.scheduledUpdate {
+		updateRefs = append(updateRefs, ref)
+	}
+	for _, ref := range sortedRefs(updateRefs) {
+		fields := make([]string, 0, len(c.scheduledUpdate[ref]))
+		for field := range c.scheduledUpdate[ref] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(&buf, "  %s: %s\n", ref, strings.Join(fields, ", "))
+	}
+	return buf.String()
+}
+
+// Approximate memory sizes in bytes used to estimate the size of a cache.
+const (
+	// cacheEntrySize is the size of a map entry with a cacheRef or a string key,
+	// including the overhead of the map.
+	cacheEntrySize = 48
+	// cacheInterfaceSize is the size of an interface value, before its data.
+	cacheInterfaceSize = 16
+)
+
+// CacheStats gives the number of entries and an estimate of the memory used
+// by the cache of an Environment.
+type CacheStats struct {
+	// Records is the number of records in the cache.
+	Records int
+	// Values is the number of field values of these records.
+	Values int
+	// M2MLinks is the number of many2many links in the cache.
+	M2MLinks int
+	// ScheduledInserts is the number of records created in the cache,
+	// whether they have already been inserted in the database or not.
+	ScheduledInserts int
+	// ScheduledUpdates is the number of records with pending updates.
+	ScheduledUpdates int
+	// Bytes is a rough estimate of the memory used by the cache, based on
+	// the number of entries and the size of the values.
+	Bytes int64
+}
+
+// estimatedSize returns the number of entries of this cache and a rough
+// estimate of its memory usage.
+//
+// Records that have been inserted in the database are referenced by both
+// their temporary and their new id but share the same data, so that they
+// are only counted once.
+func (c *cache) estimatedSize() CacheStats {
+	var res CacheStats
+	counted := make(map[*FieldMap]bool)
+	for _, data := range c.data {
+		res.Bytes += cacheEntrySize
+		if counted[data] {
+			continue
+		}
+		counted[data] = true
+		res.Records++
+		res.Values += len(*data)
+		for field, value := range *data {
+			res.Bytes += cacheEntrySize + int64(len(field)) + estimatedValueSize(value)
+		}
+	}
+	for _, links := range c.m2mLinks {
+		res.M2MLinks += len(links)
+		res.Bytes += int64(len(links)) * cacheEntrySize
+	}
+	res.ScheduledInserts = len(c.scheduledInsert)
+	res.Bytes += int64(len(c.scheduledInsert)) * cacheEntrySize
+	res.ScheduledUpdates = len(c.scheduledUpdate)
+	for _, fields := range c.scheduledUpdate {
+		res.Bytes += int64(len(fields)+1) * cacheEntrySize
+	}
+	return res
+}
+
+// estimatedValueSize returns an estimate of the memory used by the given
+// cached field value.
+func estimatedValueSize(value interface{}) int64 {
+	res := int64(cacheInterfaceSize)
+	switch v := value.(type) {
+	case nil:
+	case string:
+		res += int64(len(v))
+	case []byte:
+		res += int64(cap(v))
+	case []int64:
+		res += int64(cap(v)) * 8
+	default:
+		res += int64(reflect.TypeOf(v).Size())
+	}
+	return res
+}
+
 // newCache creates a pointer to a new cache instance.
 func newCache() *cache {
 	res := cache{
@@ -313,6 +698,7 @@ func newCache() *cache {
 		m2mLinks:        make(map[*Model]map[[2]int64]bool),
 		scheduledInsert: make(map[cacheRef]cacheRef),
 		scheduledUpdate: make(map[cacheRef]map[string]bool),
+		userGroups:      make(map[int64][]string),
 	}
 	return &res
 }
@@ -31,6 +31,7 @@ type predicate struct {
 	exprs    []string
 	operator operator.Operator
 	arg      interface{}
+	argModel string
 	cond     *Condition
 	isOr     bool
 	isNot    bool
@@ -188,13 +189,19 @@ var _ FieldNamer = ConditionField{}
 // AddOperator adds a condition value to the condition with the given operator and data
 // If multi is true, a recordset will be converted into a slice of int64
 // otherwise, it will return an int64 and panic if the recordset is not
-// a singleton.
+// a singleton. With the In and NotIn operators, a RecordSet whose ids have not
+// been fetched yet is inserted as a subquery instead.
 //
 // This method is low level and should be avoided. Use operator methods such as Equals()
 // instead.
 func (c ConditionField) AddOperator(op operator.Operator, data interface{}) *Condition {
 	cond := c.cs.cond
-	data = sanitizeArgs(data, op.IsMulti())
+	argModel := recordSetModelName(data)
+	if subQuery, ok := subQueryArg(op, data); ok {
+		data = subQuery
+	} else {
+		data = sanitizeArgs(data, op.IsMulti())
+	}
 	if data != nil && op.IsMulti() && reflect.ValueOf(data).Kind() == reflect.Slice && reflect.ValueOf(data).Len() == 0 {
 		return &cond
 	}
@@ -202,6 +209,7 @@ func (c ConditionField) AddOperator(op operator.Operator, data interface{}) *Con
 		exprs:    c.exprs,
 		operator: op,
 		arg:      data,
+		argModel: argModel,
 		isNot:    c.cs.nextIsNot,
 		isOr:     c.cs.nextIsOr,
 	})
@@ -229,6 +237,34 @@ func sanitizeArgs(args interface{}, multi bool) interface{} {
 	return args
 }
 
+// subQueryArg returns the given args as a RecordCollection to be inserted
+// as a subquery, if op is In or NotIn and args is a RecordSet whose ids have
+// not been fetched yet. The second returned value is false otherwise, in
+// which case args must be expanded to ids.
+func subQueryArg(op operator.Operator, args interface{}) (*RecordCollection, bool) {
+	if op != operator.In && op != operator.NotIn {
+		return nil, false
+	}
+	rs, ok := args.(RecordSet)
+	if !ok {
+		return nil, false
+	}
+	rc := rs.Collection()
+	if rc.fetched || rc.query.isEmpty() || len(rc.query.groups) > 0 {
+		return nil, false
+	}
+	return rc, true
+}
+
+// recordSetModelName returns the model name of args if it is a RecordSet
+// or an empty string otherwise.
+func recordSetModelName(args interface{}) string {
+	if rs, ok := args.(RecordSet); ok {
+		return rs.ModelName()
+	}
+	return ""
+}
+
 // Equals appends the '=' operator to the current Condition
 func (c ConditionField) Equals(data interface{}) *Condition {
 	return c.AddOperator(operator.Equals, data)
@@ -398,6 +434,11 @@ func (c *Condition) evaluateArgFunctions(rc *RecordCollection) {
 		}
 		argValue := reflect.ValueOf(rc.Collection())
 		res := fnctVal.Call([]reflect.Value{argValue})
+		c.predicates[i].argModel = recordSetModelName(res[0].Interface())
+		if subQuery, ok := subQueryArg(p.operator, res[0].Interface()); ok {
+			c.predicates[i].arg = subQuery
+			continue
+		}
 		c.predicates[i].arg = sanitizeArgs(res[0].Interface(), p.operator.IsMulti())
 	}
 }
@@ -0,0 +1,180 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+)
+
+// A Schedule gives the execution times of a cron job.
+type Schedule interface {
+	// Next returns the next execution time after t.
+	Next(t time.Time) time.Time
+}
+
+// everySchedule is a Schedule with a fixed interval between executions
+type everySchedule time.Duration
+
+// Next returns the next execution time after t.
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// Every returns a Schedule that executes a job every d.
+func Every(d time.Duration) Schedule {
+	if d <= 0 {
+		log.Panic("Schedule interval must be strictly positive", "interval", d)
+	}
+	return everySchedule(d)
+}
+
+// A CronJob is a model method that is executed periodically.
+type CronJob struct {
+	// Name uniquely identifies the job.
+	Name string
+	// Model and Method are the names of the model and of the method to
+	// call on an empty RecordSet of this model, with Args as arguments.
+	Model  string
+	Method string
+	Args   []interface{}
+	// Schedule gives the execution times of the job.
+	Schedule Schedule
+	// UID is the id of the user the job is executed as.
+	// Defaults to security.SuperUserID.
+	UID int64
+}
+
+// cronScheduler holds the registered cron jobs and the
+// state of the goroutines that execute them.
+type cronScheduler struct {
+	sync.Mutex
+	jobs    map[string]*CronJob
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+// cron is the scheduler of the application
+var cron = &cronScheduler{
+	jobs: make(map[string]*CronJob),
+}
+
+// RegisterCronJob registers the given job so that it is executed according to
+// its Schedule once StartCronJobs has been called.
+//
+// It panics if the job has no name or no schedule, or if a job with the same
+// name has already been registered.
+func RegisterCronJob(job CronJob) {
+	if job.Name == "" || job.Model == "" || job.Method == "" {
+		log.Panic("Cron jobs must have a name, a model and a method", "job", job.Name, "model", job.Model, "method", job.Method)
+	}
+	if job.Schedule == nil {
+		log.Panic("Cron jobs must have a schedule", "job", job.Name)
+	}
+	if job.UID == 0 {
+		job.UID = security.SuperUserID
+	}
+	cron.Lock()
+	defer cron.Unlock()
+	if _, exists := cron.jobs[job.Name]; exists {
+		log.Panic("Cron job already registered", "job", job.Name)
+	}
+	cron.jobs[job.Name] = &job
+	if cron.stop != nil {
+		cron.start(&job)
+	}
+}
+
+// RunCronJob executes the registered job with the given name once, now, and
+// returns the error of the execution if any.
+//
+// The job is executed with ExecuteInNewEnvironment as the job's UID. The
+// transaction first acquires an advisory lock on the job's name, so that
+// executions of the same job, in this process or in any other process using
+// the same database, are serialized.
+func RunCronJob(name string) error {
+	cron.Lock()
+	job, ok := cron.jobs[name]
+	cron.Unlock()
+	if !ok {
+		log.Panic("Unknown cron job", "job", name)
+	}
+	return job.run()
+}
+
+// StartCronJobs starts executing the registered jobs according to their
+// Schedule, each in its own goroutine. Jobs registered afterwards are started
+// at registration. It does nothing if the jobs are already started.
+//
+// A failed execution is logged and does not prevent the next ones.
+func StartCronJobs() {
+	cron.Lock()
+	defer cron.Unlock()
+	if cron.stop != nil {
+		return
+	}
+	cron.stop = make(chan struct{})
+	for _, job := range cron.jobs {
+		cron.start(job)
+	}
+}
+
+// StopCronJobs stops executing the registered jobs and waits
+// for the running executions to complete.
+func StopCronJobs() {
+	cron.Lock()
+	if cron.stop == nil {
+		cron.Unlock()
+		return
+	}
+	close(cron.stop)
+	cron.stop = nil
+	cron.Unlock()
+	cron.running.Wait()
+}
+
+// start launches the goroutine that executes the given job until the
+// scheduler is stopped. It must be called with the scheduler locked.
+func (cs *cronScheduler) start(job *CronJob) {
+	cs.running.Add(1)
+	go func(stop <-chan struct{}) {
+		defer cs.running.Done()
+		for {
+			timer := time.NewTimer(time.Until(job.Schedule.Next(time.Now())))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if err := job.run(); err != nil {
+				log.Warn("Cron job failed", "job", job.Name, "error", err)
+			}
+		}
+	}(cs.stop)
+}
+
+// run executes this job once in a new Environment, holding the
+// advisory lock of the job during the whole transaction.
+func (job *CronJob) run() error {
+	return ExecuteInNewEnvironment(job.UID, func(env Environment) {
+		if _, err := env.AdvisoryLock("cron:" + job.Name); err != nil {
+			log.Panic("Unable to acquire cron job lock", "job", job.Name, "error", err)
+		}
+		env.Pool(job.Model).Call(job.Method, job.Args...)
+	})
+}
@@ -6,6 +6,8 @@ package models
 import (
 	"encoding/base64"
 	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
 	"github.com/hexya-erp/hexya/hexya/models/security"
+	"gopkg.in/yaml.v3"
 )
 
 // LoadCSVDataFile loads the data of the given file into the database.
@@ -143,3 +146,136 @@ func getRecordValuesMap(headers []string, modelName string, record []string, env
 	}
 	return values
 }
+
+// A dataRecord is a record of a data file loaded with LoadData
+type dataRecord struct {
+	Model  string                 `json:"model" yaml:"model"`
+	ID     string                 `json:"id" yaml:"id"`
+	Values map[string]interface{} `json:"values" yaml:"values"`
+}
+
+// LoadData loads the records of the given YAML or JSON data into the
+// database in a new transaction. format is either "yaml" or "json".
+//
+// The data is a list of records, each with the name of its "model", its
+// external "id" and its field "values", keyed by field name. The value of a
+// many2one or one2one field is the external ID of the related record and the
+// value of a one2many or many2many field is a list of external IDs. Records
+// whose external ID already exists are updated, the others are created.
+//
+// Relation fields are set in a second pass, once all the records have been
+// created or updated, so that records can reference records defined after
+// them. Required relation fields are set when the record is created and must
+// thus reference records that already exist.
+func LoadData(r io.Reader, format string) error {
+	var records []dataRecord
+	var err error
+	switch strings.ToLower(format) {
+	case "json":
+		err = json.NewDecoder(r).Decode(&records)
+	case "yaml", "yml":
+		err = yaml.NewDecoder(r).Decode(&records)
+	default:
+		return fmt.Errorf("unknown data format %q", format)
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("unable to decode %s data: %s", format, err)
+	}
+	return ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		recs := make([]*RecordCollection, len(records))
+		relations := make([]FieldMap, len(records))
+		for i, record := range records {
+			if record.ID == "" {
+				log.Panic("Data record without external ID", "model", record.Model, "index", i)
+			}
+			model := Registry.MustGet(record.Model)
+			values := make(FieldMap)
+			relations[i] = make(FieldMap)
+			for field, value := range record.Values {
+				fi := model.fields.MustGet(field)
+				switch {
+				case fi.isRelationField() && !fi.required:
+					relations[i][fi.name] = value
+				case fi.isRelationField():
+					values[fi.name] = dataRelationValue(env, fi, value)
+				default:
+					values[fi.name] = value
+				}
+			}
+			rec := recordByExternalID(env, model, record.ID)
+			switch {
+			case rec.IsEmpty():
+				values["HexyaExternalID"] = record.ID
+				rec = env.Pool(model.name).Call("Create", values).(RecordSet).Collection()
+			case len(values) > 0:
+				rec.Call("Write", values)
+			}
+			recs[i] = rec
+		}
+		for i, rec := range recs {
+			if len(relations[i]) == 0 {
+				continue
+			}
+			values := make(FieldMap)
+			for field, value := range relations[i] {
+				values[field] = dataRelationValue(env, rec.model.fields.MustGet(field), value)
+			}
+			rec.Call("Write", values)
+		}
+	})
+}
+
+// dataRelationValue returns the value to write in the given relation field
+// for the given external ID, or list of external IDs for one2many and
+// many2many fields, read from a data file.
+func dataRelationValue(env Environment, fi *Field, value interface{}) interface{} {
+	switch {
+	case fi.fieldType.IsFKRelationType():
+		if value == nil || value == "" {
+			return nil
+		}
+		externalID, ok := value.(string)
+		if !ok {
+			log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: fi.model.name},
+				"Relation value must be an external ID", "field", fi.name, "value", value)
+		}
+		return mustGetRecordByExternalID(env, fi, externalID).ids[0]
+	case fi.fieldType == fieldtype.One2Many || fi.fieldType == fieldtype.Many2Many:
+		externalIDs, ok := value.([]interface{})
+		if value != nil && !ok {
+			log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: fi.model.name},
+				"Relation value must be a list of external IDs", "field", fi.name, "value", value)
+		}
+		ids := make([]int64, len(externalIDs))
+		for i, extID := range externalIDs {
+			externalID, ok := extID.(string)
+			if !ok {
+				log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: fi.model.name},
+					"Relation value must be a list of external IDs", "field", fi.name, "value", value)
+			}
+			ids[i] = mustGetRecordByExternalID(env, fi, externalID).ids[0]
+		}
+		return ids
+	default:
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: fi.model.name},
+			"Relation field cannot be loaded from data", "field", fi.name, "type", fi.fieldType)
+	}
+	return nil
+}
+
+// mustGetRecordByExternalID returns the record of the related model of the
+// given relation field with the given external ID. It panics if there is none.
+func mustGetRecordByExternalID(env Environment, fi *Field, externalID string) *RecordCollection {
+	rec := recordByExternalID(env, fi.relatedModel, externalID)
+	if rec.IsEmpty() {
+		log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: fi.relatedModelName},
+			"Unable to find related record from external ID", "field", fi.name, "externalID", externalID)
+	}
+	return rec
+}
+
+// recordByExternalID returns the record of the given model with the given
+// external ID, or an empty RecordCollection if there is none.
+func recordByExternalID(env Environment, model *Model, externalID string) *RecordCollection {
+	return env.Pool(model.name).Search(model.Field("HexyaExternalID").Equals(externalID)).Limit(1).Fetch()
+}
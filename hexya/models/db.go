@@ -15,7 +15,13 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/hexya-erp/hexya/hexya/models/operator"
@@ -24,6 +30,7 @@ import (
 
 var (
 	db       *sqlx.DB
+	replica  *sqlx.DB
 	adapters map[string]dbAdapter
 )
 
@@ -33,6 +40,9 @@ type ColumnData struct {
 	DataType      string
 	IsNullable    string
 	ColumnDefault sql.NullString
+	IsGenerated   bool
+	// GenerationExpression is the SQL expression of a generated column
+	GenerationExpression sql.NullString
 }
 
 type dbAdapter interface {
@@ -53,8 +63,29 @@ type dbAdapter interface {
 	fieldIsNotNull(fi *Field) bool
 	// quoteTableName returns the given table name with sql quotes
 	quoteTableName(string) string
+	// collation returns the name of the collation to sort text in the given
+	// locale, or in the default locale of the database if locale is empty.
+	// It returns an empty string if the database has no such collation.
+	collation(locale string) string
+	// supportsWindowFunctions returns true if the database supports
+	// window functions with an OVER clause.
+	supportsWindowFunctions() bool
 	// indexExists returns true if an index with the given name exists in the given table
 	indexExists(table string, name string) bool
+	// indexes returns a list of all indexes of the given table matching the given SQL pattern
+	indexes(table string, pattern string) []string
+	// partialIndexChanged returns true if the existing index with the given name
+	// is not defined on the given columns with the given WHERE clause
+	partialIndexChanged(table, name string, cols []string, where string) bool
+	// supportsPartialIndexes returns true if the database supports
+	// indexes with a WHERE clause.
+	supportsPartialIndexes() bool
+	// supportsGeneratedColumns returns true if the database supports
+	// columns computed from an SQL expression of the other columns.
+	supportsGeneratedColumns() bool
+	// generationExpressionChanged returns true if the given expression of
+	// a generated column in database differs from the one of the field.
+	generationExpressionChanged(fi *Field, dbExpression string) bool
 	// constraintExists returns true if a constraint with the given name exists
 	constraintExists(name string) bool
 	// constraints returns a list of all constraints matching the given SQL pattern
@@ -62,6 +93,15 @@ type dbAdapter interface {
 	// setTransactionIsolation returns the SQL string to set the transaction isolation
 	// level to serializable
 	setTransactionIsolation() string
+	// setTransactionReadOnly returns the SQL string to make the transaction
+	// read only. The isolation level must be supported by read replicas.
+	setTransactionReadOnly() string
+	// setSessionReadOnly returns the SQL string to make the transactions of
+	// the session read only, or writable again if readOnly is false.
+	setSessionReadOnly(readOnly bool) string
+	// transactionHasWrites returns the SQL query returning true if the
+	// current transaction has written to the database.
+	transactionHasWrites() string
 	// createSequence creates a DB sequence with the given name
 	createSequence(name string)
 	// dropSequence drop the DB sequence with the given name
@@ -79,6 +119,18 @@ type dbAdapter interface {
 	// isSerializationError returns true if the given error is a serialization error
 	// and that the failed transaction should be retried.
 	isSerializationError(err error) bool
+	// isDeadlockError returns true if the given error is due to a deadlock
+	// and that the failed transaction should be retried.
+	isDeadlockError(err error) bool
+	// advisoryLockQuery returns the SQL query to acquire the advisory lock whose
+	// integer key is given as placeholder. The query must return a single boolean
+	// telling whether the lock has been acquired. If session is true, the lock must
+	// be held until explicitly released, otherwise until the end of the transaction.
+	// If try is true, the query must not wait for the lock to be available.
+	advisoryLockQuery(session, try bool) string
+	// advisoryUnlockQuery returns the SQL query to release the session advisory
+	// lock whose integer key is given as placeholder.
+	advisoryUnlockQuery() string
 }
 
 // registerDBAdapter adds a adapter to the adapters registry
@@ -87,37 +139,312 @@ func registerDBAdapter(name string, adapter dbAdapter) {
 	adapters[name] = adapter
 }
 
-// Cursor is a wrapper around a database transaction
+// DBConnectMaxRetries defines the number of times a dead connection
+// is replaced when opening a new cursor before giving up.
+const DBConnectMaxRetries uint8 = 3
+
+// DBPreparedStatements defines whether the DML queries executed through a
+// Cursor are prepared once and reused for the lifetime of its transaction.
+//
+// It is disabled by default since preparing a statement costs an extra round
+// trip to the database, which only pays off for transactions executing the
+// same queries many times.
+var DBPreparedStatements = false
+
+// Collations maps locales, such as "fr_FR", to the database collations used to
+// sort text fields by RecordCollection.Collate. Locales that are not in this map
+// are sorted with the collation given by the database driver for the locale.
+var Collations = map[string]string{}
+
+// collationRegexp matches the valid collation names
+var collationRegexp = regexp.MustCompile(`^[A-Za-z0-9_@.-]+$`)
+
+// schemaVersion is incremented each time a DDL query is executed so
+// that cursors can drop the statements prepared on the old schema.
+var schemaVersion uint64
+
+// A dbQueryer executes queries, either inside a transaction or directly on a
+// connection in autocommit mode.
+type dbQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
+}
+
+// Cursor is a wrapper around a database transaction, or around a connection
+// in autocommit mode for read only cursors created with newAutocommitCursor.
 type Cursor struct {
-	tx *sqlx.Tx
+	ctx           context.Context
+	conn          *sqlx.Conn
+	tx            *sqlx.Tx
+	readOnly      bool
+	savepoints    int
+	stmts         map[string]*sqlx.Stmt
+	schemaVersion uint64
 }
 
 // Execute a query without returning any rows. It panics in case of error.
 // The args are for any placeholder parameters in the query.
 func (c *Cursor) Execute(query string, args ...interface{}) sql.Result {
-	return dbExecute(c.tx, query, args...)
+	return c.ExecuteContext(c.ctx, query, args...)
+}
+
+// ExecuteContext executes a query without returning any rows, as Execute,
+// but the query is cancelled if the given context is done before it ends.
+func (c *Cursor) ExecuteContext(ctx context.Context, query string, args ...interface{}) sql.Result {
+	if !c.usePreparedStatement(query) {
+		return dbExecute(ctx, c.queryer(), query, args...)
+	}
+	query, args = sanitizeQuery(query, args...)
+	t := startQuery(query)
+	res, err := c.stmt(ctx, query).ExecContext(ctx, args...)
+	logSQLResult(err, t, query, args...)
+	return res
 }
 
 // Get queries a row into the database and maps the result into dest.
 // The query must return only one row. Get panics on errors
 func (c *Cursor) Get(dest interface{}, query string, args ...interface{}) {
-	dbGet(c.tx, dest, query, args...)
+	c.GetContext(c.ctx, dest, query, args...)
+}
+
+// GetContext queries a row into the database and maps the result into dest,
+// as Get, but the query is cancelled if the given context is done before it ends.
+func (c *Cursor) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) {
+	if !c.usePreparedStatement(query) {
+		dbGet(ctx, c.queryer(), dest, query, args...)
+		return
+	}
+	query, args = sanitizeQuery(query, args...)
+	t := startQuery(query)
+	err := c.stmt(ctx, query).GetContext(ctx, dest, args...)
+	logSQLResult(err, t, query, args...)
 }
 
 // Select queries multiple rows and map the result into dest which must be a slice.
 // Select panics on errors.
 func (c *Cursor) Select(dest interface{}, query string, args ...interface{}) {
-	dbSelect(c.tx, dest, query, args...)
+	c.SelectContext(c.ctx, dest, query, args...)
+}
+
+// SelectContext queries multiple rows and map the result into dest, as Select,
+// but the query is cancelled if the given context is done before it ends.
+func (c *Cursor) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) {
+	if !c.usePreparedStatement(query) {
+		dbSelect(ctx, c.queryer(), dest, query, args...)
+		return
+	}
+	query, args = sanitizeQuery(query, args...)
+	t := startQuery(query)
+	err := c.stmt(ctx, query).SelectContext(ctx, dest, args...)
+	logSQLResult(err, t, query, args...)
+}
+
+// query returns the rows found by the given query and arguments.
+// It panics in case of error.
+func (c *Cursor) query(query string, args ...interface{}) *sqlx.Rows {
+	if !c.usePreparedStatement(query) {
+		return dbQuery(c.ctx, c.queryer(), query, args...)
+	}
+	query, args = sanitizeQuery(query, args...)
+	t := startQuery(query)
+	rows, err := c.stmt(c.ctx, query).QueryxContext(c.ctx, args...)
+	logSQLResult(err, t, query, args...)
+	return rows
+}
+
+// queryer returns the transaction of this cursor, or its connection
+// if it is in autocommit mode.
+func (c *Cursor) queryer() dbQueryer {
+	if c.tx == nil {
+		return c.conn
+	}
+	return c.tx
+}
+
+// usePreparedStatement returns true if the given query should be
+// executed through a cached prepared statement. Statements are only
+// prepared inside transactions, which close them when they end.
+func (c *Cursor) usePreparedStatement(query string) bool {
+	if !DBPreparedStatements || c.tx == nil {
+		return false
+	}
+	switch queryVerb(query) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH":
+		return true
+	}
+	return false
+}
+
+// stmt returns the prepared statement of the given sanitized query,
+// preparing it on first use. Statements prepared before a schema change
+// are discarded. Prepared statements are closed by the database driver
+// when the transaction ends.
+func (c *Cursor) stmt(ctx context.Context, query string) *sqlx.Stmt {
+	if version := atomic.LoadUint64(&schemaVersion); c.stmts == nil || c.schemaVersion != version {
+		for _, st := range c.stmts {
+			st.Close()
+		}
+		c.stmts = make(map[string]*sqlx.Stmt)
+		c.schemaVersion = version
+	}
+	if st, ok := c.stmts[query]; ok {
+		return st
+	}
+	t := startQuery(query)
+	st, err := c.tx.PreparexContext(ctx, query)
+	logSQLResult(err, t, query)
+	c.stmts[query] = st
+	return st
+}
+
+// savepoint creates a new savepoint in the transaction and returns its name
+func (c *Cursor) savepoint() string {
+	if c.tx == nil {
+		log.Panic("Savepoints cannot be created in autocommit mode")
+	}
+	c.savepoints++
+	name := fmt.Sprintf("hexya_savepoint_%d", c.savepoints)
+	c.Execute(fmt.Sprintf("SAVEPOINT %s", name))
+	return name
+}
+
+// rollbackToSavepoint rolls back the transaction to the savepoint with the
+// given name and releases it.
+func (c *Cursor) rollbackToSavepoint(name string) {
+	c.Execute(fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", name))
+	c.Execute(fmt.Sprintf("RELEASE SAVEPOINT %s", name))
+}
+
+// releaseSavepoint releases the savepoint with the given name, keeping
+// the changes made since it was created.
+func (c *Cursor) releaseSavepoint(name string) {
+	c.Execute(fmt.Sprintf("RELEASE SAVEPOINT %s", name))
 }
 
-// newCursor returns a new db cursor on the given database
-func newCursor(db *sqlx.DB) *Cursor {
+// commit commits the transaction of this cursor and
+// releases its connection to the pool.
+func (c *Cursor) commit() error {
+	if c.tx == nil {
+		return c.release()
+	}
+	defer c.conn.Close()
+	if metrics != nil {
+		metrics.TransactionCommitted()
+	}
+	return c.tx.Commit()
+}
+
+// rollback rolls back the transaction of this cursor and
+// releases its connection to the pool.
+func (c *Cursor) rollback() error {
+	if c.tx == nil {
+		return c.release()
+	}
+	defer c.conn.Close()
+	if metrics != nil {
+		metrics.TransactionRolledBack()
+	}
+	return c.tx.Rollback()
+}
+
+// release releases the connection of this autocommit cursor to the pool after
+// having made its session writable again. The connection is discarded if
+// its session cannot be restored.
+func (c *Cursor) release() error {
+	adapter := adapters[db.DriverName()]
+	if _, err := c.conn.ExecContext(context.Background(), adapter.setSessionReadOnly(false)); err != nil {
+		log.Warn("Unable to restore database session, discarding connection", "error", err)
+		discardConn(c.conn)
+		return err
+	}
+	return c.conn.Close()
+}
+
+// newAutocommitCursor returns a new read only db cursor on the given
+// database, whose queries are executed without an explicit transaction.
+// Its session is made read only so that the database rejects any write.
+//
+// Callers must call rollback on the returned cursor to release
+// its connection.
+func newAutocommitCursor(ctx context.Context, db *sqlx.DB) *Cursor {
+	adapter := adapters[db.DriverName()]
+	conn := acquireConn(ctx, db, func(conn *sqlx.Conn) error {
+		_, err := conn.ExecContext(ctx, adapter.setSessionReadOnly(true))
+		return err
+	})
+	c := &Cursor{
+		ctx:           ctx,
+		conn:          conn,
+		readOnly:      true,
+		schemaVersion: atomic.LoadUint64(&schemaVersion),
+	}
+	return c
+}
+
+// newCursor returns a new db cursor on the given database.
+// If readOnly is true, the transaction of the cursor is read only.
+//
+// The queries of the cursor are executed with the given context. If
+// the context is done, the running query is cancelled and the
+// transaction is rolled back.
+func newCursor(ctx context.Context, db *sqlx.DB, readOnly bool) *Cursor {
 	adapter := adapters[db.DriverName()]
-	tx := db.MustBegin()
-	dbExecute(tx, adapter.setTransactionIsolation())
+	var tx *sqlx.Tx
+	conn := acquireConn(ctx, db, func(conn *sqlx.Conn) (err error) {
+		tx, err = conn.BeginTxx(ctx, nil)
+		return err
+	})
+	if metrics != nil {
+		metrics.TransactionBegun()
+	}
+	if readOnly {
+		dbExecute(ctx, tx, adapter.setTransactionReadOnly())
+	} else {
+		dbExecute(ctx, tx, adapter.setTransactionIsolation())
+	}
 	return &Cursor{
-		tx: tx,
+		ctx:           ctx,
+		conn:          conn,
+		tx:            tx,
+		readOnly:      readOnly,
+		schemaVersion: atomic.LoadUint64(&schemaVersion),
+	}
+}
+
+// acquireConn returns a connection from the pool of the given database on
+// which the given start function, that executes the first statement of the
+// connection, succeeded. Dead connections, for instance after a database
+// restart, are thus detected without an extra round trip to the database.
+// They are discarded and transparently replaced by new ones.
+func acquireConn(ctx context.Context, db *sqlx.DB, start func(*sqlx.Conn) error) *sqlx.Conn {
+	var err error
+	for i := uint8(0); i <= DBConnectMaxRetries; i++ {
+		var conn *sqlx.Conn
+		conn, err = db.Connx(ctx)
+		if err != nil {
+			continue
+		}
+		if err = start(conn); err == nil {
+			return conn
+		}
+		log.Warn("Discarding dead database connection", "error", err)
+		discardConn(conn)
+		if ctx.Err() != nil {
+			break
+		}
 	}
+	log.Panic("Unable to get a database connection", "error", err)
+	return nil
+}
+
+// discardConn closes the given connection and removes it from the pool
+func discardConn(conn *sqlx.Conn) {
+	conn.Raw(func(driverConn interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
 }
 
 // DBConnect is a wrapper around sqlx.MustConnect
@@ -128,40 +455,79 @@ func DBConnect(driver, connData string) {
 	log.Info("Connected to database", "driver", driver, "connData", connData)
 }
 
+// DBPoolParams holds the tuning parameters of the database connection pool.
+// Zero values leave the database/sql defaults unchanged.
+type DBPoolParams struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DBConfigurePool applies the given parameters to the connection
+// pool of the database. It must be called after DBConnect.
+func DBConfigurePool(params DBPoolParams) {
+	if params.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(params.MaxOpenConns)
+	}
+	if params.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(params.MaxIdleConns)
+	}
+	if params.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(params.ConnMaxLifetime)
+	}
+	log.Info("Configured database connection pool", "maxOpenConns", params.MaxOpenConns,
+		"maxIdleConns", params.MaxIdleConns, "connMaxLifetime", params.ConnMaxLifetime)
+}
+
+// DBConnectReplica connects to a read only replica of the database
+// using the given driver and connection data. Once connected, read
+// only environments query the replica instead of the main database.
+func DBConnectReplica(driver, connData string) {
+	replica = sqlx.MustConnect(driver, connData)
+	log.Info("Connected to database replica", "driver", driver, "connData", connData)
+}
+
 // DBClose is a wrapper around sqlx.Close
-// It closes the connection to the database
+// It closes the connection to the database and to its replica if any
 func DBClose() {
 	err := db.Close()
 	log.Info("Closed database", "error", err)
+	if replica != nil {
+		err = replica.Close()
+		replica = nil
+		log.Info("Closed database replica", "error", err)
+	}
 }
 
 // dbExecute is a wrapper around sqlx.MustExec
 // It executes a query that returns no row
-func dbExecute(cr *sqlx.Tx, query string, args ...interface{}) sql.Result {
+func dbExecute(ctx context.Context, cr dbQueryer, query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
-	res, err := cr.Exec(query, args...)
+	t := startQuery(query)
+	res, err := cr.ExecContext(ctx, query, args...)
 	logSQLResult(err, t, query, args...)
+	checkSchemaChange(query)
 	return res
 }
 
 // dbExecuteNoTx simply executes the given query in the database without any transaction
 func dbExecuteNoTx(query string, args ...interface{}) sql.Result {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
+	t := startQuery(query)
 	res, err := db.Exec(query, args...)
 	logSQLResult(err, t, query, args...)
+	checkSchemaChange(query)
 	return res
 }
 
 // dbGet is a wrapper around sqlx.Get
 // It gets the value of a single row found by the given query and arguments
 // It panics in case of error
-func dbGet(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbGet(ctx context.Context, cr dbQueryer, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
-	err := cr.Get(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	t := startQuery(query)
+	err := cr.GetContext(ctx, dest, query, args...)
+	logSQLResult(err, t, query, args...)
 }
 
 // dbGetNoTx is a wrapper around sqlx.Get outside a transaction
@@ -169,19 +535,19 @@ func dbGet(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
 // given query and arguments
 func dbGetNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
+	t := startQuery(query)
 	err := db.Get(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(err, t, query, args...)
 }
 
 // dbSelect is a wrapper around sqlx.Select
 // It gets the value of a multiple rows found by the given query and arguments
 // dest must be a slice. It panics in case of error
-func dbSelect(cr *sqlx.Tx, dest interface{}, query string, args ...interface{}) {
+func dbSelect(ctx context.Context, cr dbQueryer, dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
-	err := cr.Select(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	t := startQuery(query)
+	err := cr.SelectContext(ctx, dest, query, args...)
+	logSQLResult(err, t, query, args...)
 }
 
 // dbSelect is a wrapper around sqlx.Select outside a transaction
@@ -189,24 +555,52 @@ func dbSelect(cr *sqlx.Tx, dest interface{}, query string, args ...interface{})
 // dest must be a slice. It panics in case of error
 func dbSelectNoTx(dest interface{}, query string, args ...interface{}) {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
+	t := startQuery(query)
 	err := db.Select(dest, query, args...)
-	logSQLResult(err, t, query, args)
+	logSQLResult(err, t, query, args...)
 }
 
 // dbQuery is a wrapper around sqlx.Queryx
 // It returns a sqlx.Rowsx found by the given query and arguments
 // It panics in case of error
-func dbQuery(cr *sqlx.Tx, query string, args ...interface{}) *sqlx.Rows {
+func dbQuery(ctx context.Context, cr dbQueryer, query string, args ...interface{}) *sqlx.Rows {
 	query, args = sanitizeQuery(query, args...)
-	t := time.Now()
-	rows, err := cr.Queryx(query, args...)
-	logSQLResult(err, t, query, args)
+	t := startQuery(query)
+	rows, err := cr.QueryxContext(ctx, query, args...)
+	logSQLResult(err, t, query, args...)
 	return rows
 }
 
-// sanitizeQuery calls 'In' expansion and 'Rebind' on the given query and
-// returns the new values to use. It panics in case of error
+// queryVerb returns the first keyword of the given query in upper case,
+// skipping leading comments such as those added by a QueryInterceptor.
+func queryVerb(query string) string {
+	query = strings.TrimSpace(query)
+	for strings.HasPrefix(query, "/*") {
+		end := strings.Index(query, "*/")
+		if end < 0 {
+			return ""
+		}
+		query = strings.TrimSpace(query[end+2:])
+	}
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// checkSchemaChange increments the schema version if the given query
+// modifies the database schema, so that prepared statements are renewed.
+func checkSchemaChange(query string) {
+	switch queryVerb(query) {
+	case "CREATE", "ALTER", "DROP", "TRUNCATE":
+		atomic.AddUint64(&schemaVersion, 1)
+	}
+}
+
+// sanitizeQuery calls 'In' expansion and 'Rebind' on the given query, then
+// the registered QueryInterceptor functions, and returns the new values to
+// use. It panics in case of error
 func sanitizeQuery(query string, args ...interface{}) (string, []interface{}) {
 	originalArgs := args
 	q, args, err := sqlx.In(query, args...)
@@ -214,17 +608,22 @@ func sanitizeQuery(query string, args ...interface{}) (string, []interface{}) {
 		log.Panic("Unable to expand 'IN' statement", "error", err, "query", query, "args", originalArgs)
 	}
 	q = sqlx.Rebind(sqlx.BindType(db.DriverName()), q)
+	q = interceptQuery(q, args)
 	return q, args
 }
 
 // Log the result of the given sql query started at start time with the
 // given args, and error. This function panics after logging if error is not nil.
 func logSQLResult(err error, start time.Time, query string, args ...interface{}) {
-	logCtx := log.New("query", query, "args", args, "duration", time.Now().Sub(start))
+	duration := time.Now().Sub(start)
+	if metrics != nil {
+		metrics.QueryFinished(query, duration, err)
+	}
+	logCtx := log.New("query", query, "args", args, "duration", duration)
 	if err != nil {
 		// We don't log.Panic to keep db error information in recovery
 		logCtx.Error("Error while executing query", "error", err, "query", query, "args", args)
-		panic(err)
+		panic(newDatabaseError(err))
 	}
 	logCtx.Debug("Query executed")
 }
@@ -15,7 +15,11 @@
 package models
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
 	"github.com/hexya-erp/hexya/hexya/models/operator"
@@ -23,7 +27,12 @@ import (
 	"github.com/lib/pq"
 )
 
-type postgresAdapter struct{}
+type postgresAdapter struct {
+	versionOnce    sync.Once
+	version        int
+	collationsLock sync.RWMutex
+	collations     map[string]bool
+}
 
 var pgOperators = map[operator.Operator]string{
 	operator.Equals:         "= ?",
@@ -106,6 +115,9 @@ func (d *postgresAdapter) columnSQLDefinition(fi *Field) string {
 			res = fmt.Sprintf("numeric(%d, %d)", fi.digits.Precision, fi.digits.Scale)
 		}
 	}
+	if fi.sqlGenerated {
+		return fmt.Sprintf("%s GENERATED ALWAYS AS (%s) STORED", res, fi.computeSQL)
+	}
 	if d.fieldIsNotNull(fi) {
 		res += " NOT NULL"
 	}
@@ -124,6 +136,9 @@ func (d *postgresAdapter) columnSQLDefinition(fi *Field) string {
 // fieldIsNull returns true if the given Field results in a
 // NOT NULL column in database.
 func (d *postgresAdapter) fieldIsNotNull(fi *Field) bool {
+	if fi.sqlGenerated {
+		return false
+	}
 	if fi.fieldType.IsFKRelationType() {
 		if fi.required {
 			return true
@@ -135,6 +150,9 @@ func (d *postgresAdapter) fieldIsNotNull(fi *Field) bool {
 
 // fieldSQLDefault returns the SQL default value of the Field
 func (d *postgresAdapter) fieldSQLDefault(fi *Field) string {
+	if fi.sqlGenerated {
+		return ""
+	}
 	return pgDefaultValues[fi.fieldType]
 }
 
@@ -157,13 +175,61 @@ func (d *postgresAdapter) quoteTableName(tableName string) string {
 	return fmt.Sprintf(`"%s"`, tableName)
 }
 
+// collation returns the name of the collation to sort text in the given
+// locale, or in the default locale of the database if locale is empty.
+//
+// ICU collations are used, so that text is sorted case and accent
+// insensitively. They are available on PostgreSQL 10+ built with ICU.
+// If the ICU collation does not exist in the database, an empty string is
+// returned so that the default collation is used.
+func (d *postgresAdapter) collation(locale string) string {
+	name := "und-x-icu"
+	if locale != "" {
+		name = fmt.Sprintf("%s-x-icu", strings.Replace(locale, "_", "-", -1))
+	}
+	if !d.collationExists(name) {
+		return ""
+	}
+	return name
+}
+
+// collationExists returns true if the collation with the given
+// name exists in the database. Each name is only looked up once.
+func (d *postgresAdapter) collationExists(name string) bool {
+	d.collationsLock.RLock()
+	exists, ok := d.collations[name]
+	d.collationsLock.RUnlock()
+	if ok {
+		return exists
+	}
+	dbGetNoTx(&exists, "SELECT EXISTS (SELECT 1 FROM pg_collation WHERE collname = ?)", name)
+	d.collationsLock.Lock()
+	defer d.collationsLock.Unlock()
+	if d.collations == nil {
+		d.collations = make(map[string]bool)
+	}
+	d.collations[name] = exists
+	return exists
+}
+
+// supportsWindowFunctions returns true if the database supports
+// window functions with an OVER clause.
+func (d *postgresAdapter) supportsWindowFunctions() bool {
+	return true
+}
+
 // columns returns a list of ColumnData for the given tableName
 func (d *postgresAdapter) columns(tableName string) map[string]ColumnData {
+	isGenerated, generationExpression := "FALSE", "NULL"
+	if d.supportsGeneratedColumns() {
+		isGenerated, generationExpression = "is_generated = 'ALWAYS'", "generation_expression"
+	}
 	query := fmt.Sprintf(`
-		SELECT column_name, data_type, is_nullable, column_default
+		SELECT column_name, data_type, is_nullable, column_default,
+			%s AS is_generated, %s AS generation_expression
 		FROM information_schema.columns
 		WHERE table_schema NOT IN ('pg_catalog', 'information_schema') AND table_name = '%s'
-	`, tableName)
+	`, isGenerated, generationExpression, tableName)
 	var colData []ColumnData
 	if err := db.Select(&colData, query); err != nil {
 		log.Panic("Unable to get list of columns for table", "table", tableName, "error", err)
@@ -183,6 +249,74 @@ func (d *postgresAdapter) indexExists(table string, name string) bool {
 	return cnt > 0
 }
 
+// indexes returns a list of all indexes of the given table matching the given SQL pattern
+func (d *postgresAdapter) indexes(table string, pattern string) []string {
+	query := "SELECT indexname FROM pg_indexes WHERE tablename = ? AND indexname ILIKE ?"
+	var res []string
+	dbSelectNoTx(&res, query, table, pattern)
+	return res
+}
+
+// pgIndexColumnsAndWhere matches the part of an index definition
+// of pg_indexes that follows the index method.
+var pgIndexColumnsAndWhere = regexp.MustCompile(`(?s) USING \w+ (.*)$`)
+
+// partialIndexChanged returns true if the existing index with the given name
+// is not defined on the given columns with the given WHERE clause
+func (d *postgresAdapter) partialIndexChanged(table, name string, cols []string, where string) bool {
+	var indexDef string
+	dbGetNoTx(&indexDef, "SELECT indexdef FROM pg_indexes WHERE tablename = ? AND indexname = ?", table, name)
+	match := pgIndexColumnsAndWhere.FindStringSubmatch(indexDef)
+	if match == nil {
+		return true
+	}
+	expected := fmt.Sprintf("(%s) WHERE %s", strings.Join(cols, ", "), where)
+	return normalizeSQLExpression(match[1]) != normalizeSQLExpression(expected)
+}
+
+// supportsPartialIndexes returns true if the database supports
+// indexes with a WHERE clause.
+func (d *postgresAdapter) supportsPartialIndexes() bool {
+	return true
+}
+
+// serverVersion returns the version number of the database server,
+// such as 120004 for PostgreSQL 12.4.
+//
+// The server version is only queried the first time.
+func (d *postgresAdapter) serverVersion() int {
+	d.versionOnce.Do(func() {
+		dbGetNoTx(&d.version, "SHOW server_version_num")
+	})
+	return d.version
+}
+
+// supportsGeneratedColumns returns true if the database supports
+// columns computed from an SQL expression of the other columns.
+// Stored generated columns are available from PostgreSQL 12.
+func (d *postgresAdapter) supportsGeneratedColumns() bool {
+	return d.serverVersion() >= 120000
+}
+
+// pgExpressionCasts matches the type casts that PostgreSQL adds
+// when it stores an expression, once whitespaces have been removed.
+var pgExpressionCasts = regexp.MustCompile(`::[a-z_]+(\[\])?`)
+
+// normalizeSQLExpression returns the given SQL expression without
+// whitespaces, parentheses and type casts, so that an expression
+// can be compared with the one deparsed by PostgreSQL.
+func normalizeSQLExpression(expr string) string {
+	expr = strings.ToLower(strings.Join(strings.Fields(expr), ""))
+	expr = pgExpressionCasts.ReplaceAllString(expr, "")
+	return strings.NewReplacer("(", "", ")", "", `"`, "").Replace(expr)
+}
+
+// generationExpressionChanged returns true if the given SQL expression
+// of a generated column in database differs from the one of the field.
+func (d *postgresAdapter) generationExpressionChanged(fi *Field, dbExpression string) bool {
+	return normalizeSQLExpression(fi.computeSQL) != normalizeSQLExpression(dbExpression)
+}
+
 // constraintExists returns true if a constraint with the given name exists in the given table
 func (d *postgresAdapter) constraintExists(name string) bool {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM pg_constraint WHERE conname = '%s'", name)
@@ -233,6 +367,40 @@ func (d *postgresAdapter) setTransactionIsolation() string {
 	return "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE"
 }
 
+// setTransactionReadOnly returns the SQL string to make the
+// transaction read only. Serializable isolation level is not
+// available on hot standby servers, so repeatable read is used.
+func (d *postgresAdapter) setTransactionReadOnly() string {
+	return "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"
+}
+
+// setSessionReadOnly returns the SQL string to make the transactions of the
+// session read only, including the implicit ones of autocommit mode, or
+// writable again if readOnly is false.
+func (d *postgresAdapter) setSessionReadOnly(readOnly bool) string {
+	if readOnly {
+		return "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY"
+	}
+	return "SET SESSION CHARACTERISTICS AS TRANSACTION READ WRITE"
+}
+
+// transactionHasWrites returns the SQL query returning true if the current
+// transaction has written to the database. A transaction id is only assigned
+// to a transaction when it modifies or locks rows.
+//
+// txid_current_if_assigned is only available from PostgreSQL 10. On older
+// servers, the lock that a transaction holds on its own id once it has been
+// assigned is looked up instead.
+func (d *postgresAdapter) transactionHasWrites() string {
+	if d.serverVersion() >= 100000 {
+		return "SELECT txid_current_if_assigned() IS NOT NULL"
+	}
+	return `SELECT EXISTS (
+		SELECT 1 FROM pg_locks
+		WHERE locktype = 'transactionid' AND mode = 'ExclusiveLock' AND pid = pg_backend_pid()
+	)`
+}
+
 // childrenIdsQuery returns a query that finds all descendant of the given
 // a record from table including itself. The query has a placeholder for the
 // record's ID
@@ -256,21 +424,53 @@ FROM    recursive_query_children_ids`, d.quoteTableName(table), d.quoteTableName
 
 // substituteErrorMessage substitutes the given error's message by newMsg
 func (d *postgresAdapter) substituteErrorMessage(err error, newMsg string) error {
-	pgError, ok := err.(*pq.Error)
-	if !ok {
+	var pgError *pq.Error
+	if !errors.As(err, &pgError) {
 		return err
 	}
 	pgError.Message = newMsg
-	return pgError
+	return err
 }
 
 // isSerializationError returns true if the given error is a serialization error
 // and that the failed transaction should be retried.
 func (d *postgresAdapter) isSerializationError(err error) bool {
-	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Class() == "40" {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "40001" {
 		return true
 	}
 	return false
 }
 
+// isDeadlockError returns true if the given error is due to a deadlock
+// and that the failed transaction should be retried.
+func (d *postgresAdapter) isDeadlockError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "40P01" {
+		return true
+	}
+	return false
+}
+
+// advisoryLockQuery returns the SQL query to acquire the advisory lock whose
+// integer key is given as placeholder.
+func (d *postgresAdapter) advisoryLockQuery(session, try bool) string {
+	switch {
+	case session && try:
+		return "SELECT pg_try_advisory_lock(?)"
+	case session:
+		return "SELECT TRUE FROM pg_advisory_lock(?)"
+	case try:
+		return "SELECT pg_try_advisory_xact_lock(?)"
+	default:
+		return "SELECT TRUE FROM pg_advisory_xact_lock(?)"
+	}
+}
+
+// advisoryUnlockQuery returns the SQL query to release the session advisory
+// lock whose integer key is given as placeholder.
+func (d *postgresAdapter) advisoryUnlockQuery() string {
+	return "SELECT pg_advisory_unlock(?)"
+}
+
 var _ dbAdapter = new(postgresAdapter)
@@ -0,0 +1,94 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+
+	"github.com/hexya-erp/hexya/hexya/models/operator"
+)
+
+// Domain logical operators in polish notation
+const (
+	domainAnd = "&"
+	domainOr  = "|"
+	domainNot = "!"
+)
+
+// ParseDomain returns the Condition corresponding to the given domain.
+//
+// A domain is a list in polish notation of logical operators ("&", "|" and "!")
+// and of terms, each term being a list of a field path, an operator and a value.
+// Successive terms without explicit logical operator are joined with "&".
+//
+// This is the inverse operation of Condition.Serialize. It panics if the
+// domain is not well formed.
+func ParseDomain(domain []interface{}) *Condition {
+	res := newCondition()
+	pos := 0
+	for pos < len(domain) {
+		var cond *Condition
+		cond, pos = parseDomainTerm(domain, pos)
+		res = res.AndCond(cond)
+	}
+	return res
+}
+
+// parseDomainTerm parses the domain term or logical operator at position pos
+// of domain and returns the corresponding Condition and the position of the
+// next term.
+func parseDomainTerm(domain []interface{}, pos int) (*Condition, int) {
+	if pos >= len(domain) {
+		log.Panic("Missing operand in domain", "domain", domain)
+	}
+	switch term := domain[pos].(type) {
+	case string, operator.Operator:
+		switch fmt.Sprint(term) {
+		case domainAnd:
+			left, next := parseDomainTerm(domain, pos+1)
+			right, next := parseDomainTerm(domain, next)
+			return newCondition().AndCond(left).AndCond(right), next
+		case domainOr:
+			left, next := parseDomainTerm(domain, pos+1)
+			right, next := parseDomainTerm(domain, next)
+			// Operands are swapped so that Serialize gives back the same domain
+			return newCondition().AndCond(right).OrCond(left), next
+		case domainNot:
+			cond, next := parseDomainTerm(domain, pos+1)
+			return newCondition().AndNotCond(cond), next
+		}
+	case []interface{}:
+		return parseDomainLeaf(term), pos + 1
+	}
+	log.Panic("Invalid term in domain", "domain", domain, "term", domain[pos])
+	return nil, pos
+}
+
+// parseDomainLeaf returns the Condition of the given domain leaf, which must
+// be a list of a field path, an operator and a value.
+func parseDomainLeaf(leaf []interface{}) *Condition {
+	if len(leaf) != 3 {
+		log.Panic("Domain leaf must have exactly 3 elements", "leaf", leaf)
+	}
+	field, ok := leaf[0].(string)
+	if !ok {
+		log.Panic("Domain leaf field must be a string", "leaf", leaf)
+	}
+	op := operator.Operator(fmt.Sprint(leaf[1]))
+	if !op.IsValid() {
+		log.Panic("Unknown operator in domain leaf", "leaf", leaf, "operator", op)
+	}
+	return newCondition().And().Field(field).AddOperator(op, leaf[2])
+}
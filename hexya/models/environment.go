@@ -15,15 +15,26 @@
 package models
 
 import (
+	stdcontext "context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
 	"github.com/hexya-erp/hexya/hexya/models/types"
 	"github.com/hexya-erp/hexya/hexya/tools/logging"
 )
 
-// DBSerializationMaxRetries defines the number of time a
+// DBSerializationMaxRetries defines the default number of time a
 // transaction that failed due to serialization error should
-// be retried.
+// be retried. See DefaultRetryPolicy.
 const DBSerializationMaxRetries uint8 = 5
 
+// DBDeadlockMaxRetries defines the default number of time a
+// transaction that failed because of a deadlock should be
+// retried. See DefaultRetryPolicy.
+const DBDeadlockMaxRetries uint8 = 3
+
 // An Environment stores various contextual data used by the models:
 // - the database cursor (current open transaction),
 // - the current user ID (for access rights checking)
@@ -37,6 +48,13 @@ type Environment struct {
 	callStack []*methodLayer
 	super     *methodLayer
 	retries   uint8
+	// realUID is the uid of the transaction if uid has been changed with Sudo
+	realUID int64
+	// allowReadOnlyWrite is set by WithReadOnlyWrite to allow writing ReadOnly fields
+	allowReadOnlyWrite bool
+	// maxLimit is the cap of the query limits, set to MaxLimit for RPC calls.
+	// Zero means no cap.
+	maxLimit int
 }
 
 // Cr returns a pointer to the Cursor of the Environment
@@ -59,21 +77,124 @@ func (env Environment) Flush() {
 	env.flush()
 }
 
+// WriteBatch executes fnct with this Environment in write batch mode and
+// flushes the Environment at the end.
+//
+// In write batch mode, Write calls only update the cache and schedule the
+// updates, even for records that are not in cache yet, so that all the
+// changes made by fnct are written to the database by the final flush.
+// Fields read in between are served from the cache and reflect the changes
+// made so far. Note that queries such as Search are executed against the
+// database and do not see the changes that are not flushed yet.
+//
+// Nested calls to WriteBatch are part of the outermost batch. If fnct panics,
+// the pending changes are not flushed.
+func (env Environment) WriteBatch(fnct func(Environment)) {
+	env.cache.writeBatch++
+	defer func() {
+		env.cache.writeBatch--
+	}()
+	fnct(env)
+	if env.cache.writeBatch == 1 {
+		env.flush()
+	}
+}
+
 func (env Environment) flush() {
-	for e := range env.cache.scheduledInsert {
-		env.insertData(e)
+	for ref := range env.cache.scheduledInsert {
+		env.insertData(ref)
 	}
-	for ref, fields := range env.cache.scheduledUpdate {
-		rc := env.Pool(ref.model.name).withIds([]int64{ref.id})
-		fMap := make(FieldMap)
-		for fieldName := range fields {
-			fMap[fieldName] = env.cache.getData(ref)[fieldName]
+	// Records of the same model with the same pending values are updated
+	// together with a single query.
+	type updateGroup struct {
+		model *Model
+		fMap  FieldMap
+		ids   []int64
+	}
+	var groups []*updateGroup
+	buckets := make(map[string][]*updateGroup)
+	for ref := range env.cache.scheduledUpdate {
+		fMap := env.scheduledValues(ref)
+		key := updateGroupKey(ref.model, fMap)
+		var group *updateGroup
+		for _, grp := range buckets[key] {
+			if reflect.DeepEqual(grp.fMap, fMap) {
+				group = grp
+				break
+			}
+		}
+		if group == nil {
+			group = &updateGroup{model: ref.model, fMap: fMap}
+			buckets[key] = append(buckets[key], group)
+			groups = append(groups, group)
 		}
-		sql, args := rc.query.updateQuery(fMap)
-		res := rc.env.cr.Execute(sql, args...)
-		if num, _ := res.RowsAffected(); num == 0 {
-			log.Panic("Trying to update an empty RecordSet", "model", rc.ModelName(), "values", fMap)
+		group.ids = append(group.ids, ref.id)
+	}
+	for _, group := range groups {
+		env.updateRecords(group.model, group.ids, group.fMap)
+	}
+}
+
+// updateGroupKey returns a string identifying the model and the values of
+// the given FieldMap, so that records updated with equal values usually share
+// the same key.
+func updateGroupKey(mi *Model, fMap FieldMap) string {
+	fields := fMap.Keys()
+	sort.Strings(fields)
+	var buf strings.Builder
+	buf.WriteString(mi.name)
+	for _, field := range fields {
+		fmt.Fprintf(&buf, "|%s=%#v", field, fMap[field])
+	}
+	return buf.String()
+}
+
+// scheduledValues returns the values in cache of the fields of the record
+// with the given ref that are scheduled to be written to the database.
+func (env Environment) scheduledValues(ref cacheRef) FieldMap {
+	fMap := make(FieldMap)
+	for fieldName := range env.cache.scheduledUpdate[ref] {
+		fMap[fieldName] = env.cache.getData(ref)[fieldName]
+	}
+	return fMap
+}
+
+// updateData writes the scheduled updates of the record with the
+// given ref to the database and removes them from the schedule.
+func (env Environment) updateData(ref cacheRef) {
+	if _, ok := env.cache.scheduledUpdate[ref]; !ok {
+		return
+	}
+	env.updateRecords(ref.model, []int64{ref.id}, env.scheduledValues(ref))
+}
+
+// updateRecords writes the given values to the records of the given model
+// with the given ids and removes their scheduled updates.
+func (env Environment) updateRecords(mi *Model, ids []int64, fMap FieldMap) {
+	rc := env.Pool(mi.name).withIds(ids)
+	defer func() {
+		if r := recover(); r != nil {
+			panic(rc.substituteSQLErrorMessage(r))
 		}
+	}()
+	tracked := mi.trackedFields(fMap.Keys())
+	var oldValues map[int64]FieldMap
+	if len(tracked) > 0 {
+		oldValues = env.trackedValues(mi, ids, tracked)
+	}
+	sql, args := rc.query.updateQuery(fMap)
+	res := rc.env.cr.Execute(sql, args...)
+	if num, _ := res.RowsAffected(); num < int64(len(ids)) {
+		log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: rc.ModelName()},
+			"Trying to update an empty RecordSet", "model", rc.ModelName(), "values", fMap)
+	}
+	for _, id := range ids {
+		ref := mi.toRef(id)
+		delete(env.cache.scheduledUpdate, ref)
+		env.cache.removeGeneratedFields(ref)
+	}
+	if len(tracked) > 0 {
+		env.logTrackingValues(mi, tracked, oldValues, fMap)
 	}
 }
 
@@ -83,6 +204,11 @@ func (env Environment) insertData(ref cacheRef) {
 	}
 	//force the external id ?
 	rc := env.Pool(ref.model.name).withIds([]int64{ref.id})
+	defer func() {
+		if r := recover(); r != nil {
+			panic(rc.substituteSQLErrorMessage(r))
+		}
+	}()
 	for field, value := range env.cache.getData(ref) {
 		fi := rc.query.recordSet.model.fields.MustGet(field)
 		if fi.fieldType.IsFKRelationType() && value != nil {
@@ -93,12 +219,37 @@ func (env Environment) insertData(ref cacheRef) {
 			env.cache.updateEntryByRef(ref, field, env.cache.scheduledInsert[fkRef].id)
 		}
 	}
+	env.checkRequiredFields(ref)
 	var createdId int64
 	sql, args := rc.query.insertQuery(env.cache.getData(ref))
 	rc.env.cr.Get(&createdId, sql, args...)
 	newRef := ref.model.toRef(createdId)
 	env.cache.copyPointer(ref, newRef)
 	env.cache.scheduledInsert[ref] = newRef
+	env.cache.removeGeneratedFields(newRef)
+}
+
+// checkRequiredFields sets the required fields of the record with the given
+// ref that have no value to their default value if they have one. It panics
+// with a descriptive error if a required field has still no value.
+func (env Environment) checkRequiredFields(ref cacheRef) {
+	data := env.cache.getData(ref)
+	for _, fi := range ref.model.fields.registryByJSON {
+		if !fi.required || !fi.isStored() {
+			continue
+		}
+		if val, ok := data.Get(fi.name, ref.model); ok && !isNullValue(val) {
+			continue
+		}
+		if fi.defaultFunc != nil {
+			defMap := FieldMap{fi.json: fi.defaultFunc(env)}
+			ref.model.convertValuesToFieldType(&defMap)
+			data[fi.json] = defMap[fi.json]
+			continue
+		}
+		log.PanicWithError(&Error{Kind: ErrRequiredFieldMissing, Model: ref.model.name},
+			"Missing value for required field", "model", ref.model.name, "field", fi.name)
+	}
 }
 
 // commit the transaction of this environment.
@@ -108,7 +259,7 @@ func (env Environment) insertData(ref cacheRef) {
 // automatically commit the Environment.
 func (env Environment) commit() {
 	env.Flush()
-	env.Cr().tx.Commit()
+	env.Cr().commit()
 }
 
 // rollback the transaction of this environment.
@@ -117,7 +268,7 @@ func (env Environment) commit() {
 // did not create yourself with NewEnvironment. Just panic instead
 // for the framework to roll back automatically for you.
 func (env Environment) rollback() {
-	env.Cr().tx.Rollback()
+	env.Cr().rollback()
 }
 
 // newEnvironment returns a new Environment with the given parameters
@@ -127,12 +278,20 @@ func (env Environment) rollback() {
 // or Rollback() on the returned Environment after operation to release
 // the database connection.
 func newEnvironment(uid int64, context ...types.Context) Environment {
+	return newEnvironmentWithContext(stdcontext.Background(), uid, context...)
+}
+
+// newEnvironmentWithContext returns a new Environment with the given
+// parameters in a new DB transaction whose queries are executed with ctx.
+// If ctx is done, the running query is cancelled and the transaction
+// is rolled back.
+func newEnvironmentWithContext(cancelCtx stdcontext.Context, uid int64, context ...types.Context) Environment {
 	var ctx types.Context
 	if len(context) > 0 {
 		ctx = context[0]
 	}
 	env := Environment{
-		cr:      newCursor(db),
+		cr:      newCursor(cancelCtx, db, false),
 		uid:     uid,
 		context: &ctx,
 		cache:   newCache(),
@@ -140,36 +299,206 @@ func newEnvironment(uid int64, context ...types.Context) Environment {
 	return env
 }
 
+// newReadOnlyEnvironment returns a new Environment for the given user on a
+// read only connection to the database replica if any. If autocommit is
+// true, its queries are executed without an explicit transaction. Otherwise,
+// they are executed in a new read only DB transaction.
+//
+// Callers should call rollback on the returned Environment to release
+// the database connection.
+func newReadOnlyEnvironment(uid int64, autocommit bool) Environment {
+	database := db
+	if replica != nil {
+		database = replica
+	}
+	var cr *Cursor
+	if autocommit {
+		cr = newAutocommitCursor(stdcontext.Background(), database)
+	} else {
+		cr = newCursor(stdcontext.Background(), database, true)
+	}
+	env := Environment{
+		cr:      cr,
+		uid:     uid,
+		context: new(types.Context),
+		cache:   newCache(),
+	}
+	return env
+}
+
+// checkWritable panics if this Environment is read only.
+// modelName is the name of the model that was to be modified.
+func (env Environment) checkWritable(modelName string) {
+	if !env.cr.readOnly {
+		return
+	}
+	log.PanicWithError(&Error{Kind: ErrReadOnly, Model: modelName},
+		"Write operation attempted in a read only environment", "model", modelName)
+}
+
+// ExecuteReadOnly executes the given fnct in a new read only Environment.
+// Search, SearchCount, Read and Values operations are sent to the database
+// replica registered with DBConnectReplica if any, or to the main database
+// otherwise. Create, Write and Unlink operations panic with ErrReadOnly.
+//
+// Queries are executed in a read only transaction, so that they all see the
+// same snapshot of the database. Use ExecuteReadOnlyAutocommit for simple
+// lookups that do not need it.
+//
+// Note that the replica may lag behind the main database: records committed
+// by a transaction that just ended may not be visible yet. The Environment
+// has its own cache which is discarded at the end of fnct, so that data read
+// from the replica never ends up in a writable Environment.
+//
+// This function returns an error only if fnct panicked during its execution.
+func ExecuteReadOnly(uid int64, fnct func(Environment)) error {
+	return executeReadOnly(newReadOnlyEnvironment(uid, false), fnct)
+}
+
+// ExecuteReadOnlyAutocommit executes the given fnct in a new read only
+// Environment, like ExecuteReadOnly, but its queries are executed in
+// autocommit mode, without opening a transaction, which makes simple
+// lookups cheaper.
+//
+// As a consequence, successive queries may see data committed in between by
+// other transactions, and savepoints, Simulate and transaction advisory locks
+// are not available. The database session is read only, so that writes made
+// with raw SQL are rejected as well.
+func ExecuteReadOnlyAutocommit(uid int64, fnct func(Environment)) error {
+	return executeReadOnly(newReadOnlyEnvironment(uid, true), fnct)
+}
+
+// executeReadOnly executes the given fnct in the given read only
+// Environment and releases its database connection afterwards.
+func executeReadOnly(env Environment, fnct func(Environment)) (rError error) {
+	defer func() {
+		env.rollback()
+		if r := recover(); r != nil {
+			rError = logging.LogPanicData(r)
+			return
+		}
+	}()
+	fnct(env)
+	return
+}
+
 // ExecuteInNewEnvironment executes the given fnct in a new Environment
 // within a new transaction.
 //
 // This function commits the transaction if everything went right or
 // rolls it back otherwise, returning an arror. Database serialization
-// errors are automatically retried several times before returning an
-// error if they still occur.
-func ExecuteInNewEnvironment(uid int64, fnct func(Environment)) (error) {
-	env := newEnvironment(uid)
-	var rError error
+// errors and deadlocks are automatically retried several times with an increasing
+// delay before returning an error if they still occur.
+//
+// If a context is given, the transaction is executed as with
+// ExecuteInNewEnvironmentCtx.
+func ExecuteInNewEnvironment(uid int64, fnct func(Environment), ctx ...stdcontext.Context) error {
+	cancelCtx := stdcontext.Background()
+	if len(ctx) > 0 {
+		cancelCtx = ctx[0]
+	}
+	return ExecuteInNewEnvironmentCtx(cancelCtx, uid, fnct)
+}
+
+// ExecuteInNewEnvironmentCtx executes the given fnct in a new Environment
+// within a new transaction, like ExecuteInNewEnvironment, but stops as soon
+// as the given context is done.
+//
+// The queries of the transaction are executed with ctx, so that a running
+// query is cancelled when ctx is done, and ctx is checked before each method
+// call on a RecordSet. On cancellation, the transaction is rolled back and
+// ctx.Err() is returned. Serialization errors and deadlocks are not retried
+// anymore once ctx is done.
+func ExecuteInNewEnvironmentCtx(ctx stdcontext.Context, uid int64, fnct func(Environment)) error {
+	return ExecuteInNewEnvironmentWithPolicy(ctx, uid, DefaultRetryPolicy, fnct)
+}
+
+// ExecuteInNewEnvironmentWithPolicy executes the given fnct in a new Environment
+// within a new transaction, like ExecuteInNewEnvironmentCtx, but transactions
+// failing with a serialization error or because of a deadlock are retried
+// according to the given policy.
+//
+// If the transaction still fails after the maximum number of retries, the
+// returned error is a *RetryError holding the number of attempts.
+func ExecuteInNewEnvironmentWithPolicy(ctx stdcontext.Context, uid int64, policy RetryPolicy, fnct func(Environment)) error {
+	var serializationRetries, deadlockRetries uint8
+	for {
+		err, reason := executeInNewEnvironment(ctx, uid, fnct, serializationRetries+deadlockRetries)
+		attempts := int(serializationRetries) + int(deadlockRetries) + 1
+		var retry uint8
+		switch reason {
+		case serializationRetry:
+			if serializationRetries >= policy.MaxRetries {
+				return &RetryError{Attempts: attempts, Err: err}
+			}
+			serializationRetries++
+			retry = serializationRetries
+			if metrics != nil {
+				metrics.SerializationRetried(retry)
+			}
+		case deadlockRetry:
+			if deadlockRetries >= policy.MaxDeadlockRetries {
+				return &RetryError{Attempts: attempts, Err: err}
+			}
+			deadlockRetries++
+			retry = deadlockRetries
+			if metrics != nil {
+				metrics.DeadlockRetried(retry)
+			}
+		default:
+			return err
+		}
+		log.Debug("Retrying failed transaction", "retry", retry, "error", err)
+		if err := policy.wait(ctx, retry); err != nil {
+			return err
+		}
+	}
+}
+
+// executeInNewEnvironment executes fnct once in a new Environment and
+// commits the transaction or rolls it back if fnct panicked. retries is
+// the number of times the transaction has already been retried.
+//
+// It returns the error raised by fnct if any and the reason why the
+// transaction can be retried, if it can.
+func executeInNewEnvironment(ctx stdcontext.Context, uid int64, fnct func(Environment), retries uint8) (rError error, reason retryReason) {
+	env := newEnvironmentWithContext(ctx, uid)
+	env.retries = retries
 	defer func() {
 		if r := recover(); r != nil {
 			env.rollback()
-			if err, ok := r.(error); ok && adapters[db.DriverName()].isSerializationError(err) {
-				// Transaction error
-				env.retries++
-				if env.retries < DBSerializationMaxRetries {
-					if ExecuteInNewEnvironment(uid, fnct) == nil {
-						rError = nil
-						return
-					}
+			if ctx.Err() != nil {
+				rError = ctx.Err()
+				return
+			}
+			if err, ok := r.(error); ok {
+				adapter := adapters[db.DriverName()]
+				switch {
+				case adapter.isSerializationError(err):
+					reason = serializationRetry
+				case adapter.isDeadlockError(err):
+					reason = deadlockRetry
 				}
 			}
 			rError = logging.LogPanicData(r)
 			return
 		}
+		if ctx.Err() != nil {
+			env.rollback()
+			rError = ctx.Err()
+			return
+		}
 		env.commit()
 	}()
 	fnct(env)
-	return rError
+	return
+}
+
+// checkCancelled panics if the context of this Environment's transaction is done
+func (env Environment) checkCancelled() {
+	if err := env.cr.ctx.Err(); err != nil {
+		log.PanicWithError(err, "Transaction context is done", "error", err)
+	}
 }
 
 // SimulateInNewEnvironment executes the given fnct in a new Environment
@@ -190,7 +519,157 @@ func SimulateInNewEnvironment(uid int64, fnct func(Environment)) (rError error)
 	return
 }
 
+// DumpCache returns a human readable representation of the cache of this
+// Environment, including the pending inserts and updates. It is meant for
+// debugging and can be safely called at any time since it does not modify
+// the cache.
+func (env Environment) DumpCache() string {
+	return env.cache.dump()
+}
+
+// CacheStats returns the number of entries of the cache of this Environment
+// and an estimate of its memory usage.
+func (env Environment) CacheStats() CacheStats {
+	return env.cache.estimatedSize()
+}
+
+// InvalidateModel removes all the records of the given model from the cache
+// of this Environment, so that they are fetched again from the database.
+// Call this method after modifying the model's table with raw SQL queries.
+//
+// Pending updates on the model's records are discarded, and this method
+// panics if some records of the model are still to be inserted.
+func (env Environment) InvalidateModel(modelName string) {
+	env.cache.invalidateModel(Registry.MustGet(modelName))
+}
+
+// Simulate executes the given fnct inside a savepoint of this Environment's
+// transaction and always rolls back to this savepoint at the end. The cache
+// is also restored to its state before the simulation, so that the outer
+// transaction is left untouched.
+//
+// This function returns an error only if fnct panicked during its execution.
+func (env Environment) Simulate(fnct func(Environment)) (rError error) {
+	cacheCopy := env.cache.copy()
+	savepoint := env.cr.savepoint()
+	defer func() {
+		env.cr.rollbackToSavepoint(savepoint)
+		*env.cache = *cacheCopy
+		if r := recover(); r != nil {
+			rError = logging.LogPanicData(r)
+			return
+		}
+	}()
+	fnct(env)
+	return
+}
+
+// A CallSpec describes a method call of a batch executed with BatchCall.
+//
+// Method is called with Args on the records of Model with the given IDs,
+// or on an empty RecordSet if IDs is empty. If ContinueOnError is set,
+// a panic during the call only rolls back this call and the batch goes on.
+type CallSpec struct {
+	Model           string
+	IDs             []int64
+	Method          string
+	Args            []interface{}
+	ContinueOnError bool
+}
+
+// BatchCall executes the given calls in order in this Environment's
+// transaction and returns their results in the same order. The result
+// of a call is its first returned value, as with RecordCollection.Call.
+//
+// If a call panics, the changes made by all the calls of the batch are
+// rolled back and the error is returned, unless the ContinueOnError flag
+// of the call is set. In this case, only the changes of the failed call
+// are rolled back, its result is the error and the next calls are executed.
+func (env Environment) BatchCall(calls []CallSpec) (res []interface{}, rError error) {
+	cacheCopy := env.cache.copy()
+	savepoint := env.cr.savepoint()
+	defer func() {
+		if r := recover(); r != nil {
+			env.cr.rollbackToSavepoint(savepoint)
+			*env.cache = *cacheCopy
+			res = nil
+			rError = logging.LogPanicData(r)
+			return
+		}
+		env.cr.releaseSavepoint(savepoint)
+	}()
+	res = make([]interface{}, len(calls))
+	for i, call := range calls {
+		if !call.ContinueOnError {
+			res[i] = env.batchCall(call)
+			continue
+		}
+		res[i] = env.batchCallContinueOnError(call)
+	}
+	env.Flush()
+	return
+}
+
+// batchCall executes the given call of a batch and returns its result.
+func (env Environment) batchCall(call CallSpec) interface{} {
+	rs := env.Pool(call.Model)
+	if len(call.IDs) > 0 {
+		rs = rs.Browse(call.IDs...)
+	}
+	return rs.Call(call.Method, call.Args...)
+}
+
+// batchCallContinueOnError executes the given call of a batch inside its own
+// savepoint. It returns the result of the call, or the error if it panicked.
+//
+// Pending changes of the previous calls are flushed before the savepoint and
+// the changes of this call are flushed inside it, so that database errors are
+// reported for the call that caused them and rolled back with it.
+func (env Environment) batchCallContinueOnError(call CallSpec) (res interface{}) {
+	env.Flush()
+	cacheCopy := env.cache.copy()
+	savepoint := env.cr.savepoint()
+	defer func() {
+		if r := recover(); r != nil {
+			env.cr.rollbackToSavepoint(savepoint)
+			*env.cache = *cacheCopy
+			res = logging.LogPanicData(r)
+			return
+		}
+		env.cr.releaseSavepoint(savepoint)
+	}()
+	res = env.batchCall(call)
+	env.Flush()
+	return res
+}
+
+// insertRowsBatchSize is the maximum number of rows inserted by each
+// query of insertRows, so as to stay below the parameters limit of the
+// database driver.
+const insertRowsBatchSize = 500
+
+// insertRows inserts the given rows in the table of the given model with
+// one query per batch of rows, bypassing the ORM. All rows must have the
+// same fields.
+func (env Environment) insertRows(modelName string, rows []FieldMap) {
+	rs := env.Pool(modelName)
+	for start := 0; start < len(rows); start += insertRowsBatchSize {
+		end := start + insertRowsBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		sql, args := rs.query.insertRowsQuery(rows[start:end])
+		env.cr.Execute(sql, args...)
+	}
+}
+
 // Pool returns an empty RecordCollection for the given modelName
 func (env Environment) Pool(modelName string) *RecordCollection {
 	return newRecordCollection(env, modelName)
 }
+
+// Browse returns a new RecordSet of the given model in this Environment
+// with the given ids, without querying the database.
+func (env Environment) Browse(modelName string, ids ...int64) *RecordCollection {
+	return env.Pool(modelName).Browse(ids...)
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/hexya-erp/hexya/hexya/tools/exceptions"
+)
+
+// Kinds of errors raised by the ORM. They can be checked with errors.Is
+// on a recovered panic value or on the error returned by
+// ExecuteInNewEnvironment.
+var (
+	// ErrRecordNotFound is raised when an operation targets records that do not exist.
+	ErrRecordNotFound = errors.New("record not found")
+	// ErrMultipleRecords is raised when a single record is expected but several are found.
+	ErrMultipleRecords = errors.New("multiple records")
+	// ErrTypeMismatch is raised when a value or a RecordSet is not of the expected type.
+	ErrTypeMismatch = errors.New("type mismatch")
+	// ErrAccessDenied is raised when the user is not allowed to perform an operation.
+	ErrAccessDenied = errors.New("access denied")
+	// ErrRequiredFieldMissing is raised when a record is saved without a value for a required field.
+	ErrRequiredFieldMissing = errors.New("required field missing")
+	// ErrDatabase is raised when the database returns an error.
+	ErrDatabase = errors.New("database error")
+	// ErrReadOnly is raised when a write operation is attempted in a read only environment.
+	ErrReadOnly = errors.New("read only environment")
+	// ErrReadOnlyModel is raised when a write operation is attempted on a read only model.
+	ErrReadOnlyModel = errors.New("read only model")
+	// ErrUnknownField is raised when a field name does not match any field of the model.
+	ErrUnknownField = errors.New("unknown field")
+	// ErrReadOnlyField is raised when a value is given for a field that cannot be written.
+	ErrReadOnlyField = errors.New("read only field")
+	// ErrFieldNotLoaded is raised when a field is expected to be in cache but is not.
+	ErrFieldNotLoaded = errors.New("field not loaded")
+)
+
+// An Error is an error raised by the ORM.
+//
+// Kind is one of the ErrXxx values of this package, Model is the name of
+// the model on which the error occurred (if any) and Cause is the underlying
+// error (if any). Use errors.As to retrieve an Error from a recovered panic.
+type Error struct {
+	Kind  error
+	Model string
+	Cause error
+}
+
+// Error returns the message of the underlying cause if any or the kind's message.
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return e.Cause.Error()
+	}
+	return e.Kind.Error()
+}
+
+// Unwrap returns the underlying cause of this Error
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is returns true if target is the kind of this Error
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// A RetryError is returned when a transaction still fails
+// after having been retried. Err is the error of the last attempt.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+// Error returns the error of the last attempt with the number of attempts.
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("transaction failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// A BatchError is returned by BatchIterate when the processing of a batch
+// failed. Processed is the number of records of the previous batches, which
+// have been processed successfully, and LastID is the id of the last of them.
+type BatchError struct {
+	Processed int
+	LastID    int64
+	Err       error
+}
+
+// Error returns the error of the failed batch with the progress made before it.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch processing failed after %d records (last id %d): %s", e.Processed, e.LastID, e.Err)
+}
+
+// Unwrap returns the error of the failed batch
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// newDatabaseError returns an *Error wrapping the given error returned by the database.
+func newDatabaseError(err error) *Error {
+	kind := ErrDatabase
+	if err == sql.ErrNoRows {
+		kind = ErrRecordNotFound
+	}
+	return &Error{Kind: kind, Cause: err}
+}
+
+// TryCall executes fnct and returns the error raised by the ORM if fnct
+// panicked, or nil otherwise. It is meant to be used at call boundaries
+// outside of ExecuteInNewEnvironment.
+//
+// Panics that have not been raised by the ORM, such as runtime errors,
+// are not recovered so as not to hide real bugs.
+func TryCall(fnct func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		switch e := r.(type) {
+		case exceptions.UserError:
+			err = e
+		case *Error:
+			err = e
+		default:
+			panic(r)
+		}
+	}()
+	fnct()
+	return
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"github.com/hexya-erp/hexya/hexya/models/security"
+)
+
+// AddFieldSet registers a named set of fields of this model, such as the
+// fields displayed in a list view, so that they can be read at once with
+// ReadFieldSet. Fields can be paths through many2one or one2one fields, such
+// as "Profile.City".
+//
+// If a field set with this name already exists, the given fields are added
+// to it, so that modules can extend the field sets of other modules. Paths
+// are checked when the models are bootstrapped.
+func (m *Model) AddFieldSet(name string, fields ...FieldNamer) {
+	if Registry.bootstrapped {
+		log.Panic("Field sets must be added before bootstrap", "model", m.name, "fieldSet", name)
+	}
+	set := m.fieldSets[name]
+	existing := make(map[string]bool)
+	for _, f := range set {
+		existing[f] = true
+	}
+	for _, f := range fields {
+		if existing[f.String()] {
+			continue
+		}
+		existing[f.String()] = true
+		set = append(set, f.String())
+	}
+	m.fieldSets[name] = set
+}
+
+// FieldSet returns the fields of the field set with the given name
+// of this model. It panics if there is no such field set.
+func (m *Model) FieldSet(name string) []FieldName {
+	set, ok := m.fieldSets[name]
+	if !ok {
+		log.Panic("Unknown field set", "model", m.name, "fieldSet", name)
+	}
+	res := make([]FieldName, len(set))
+	for i, f := range set {
+		res[i] = FieldName(f)
+	}
+	return res
+}
+
+// checkFieldSets panics if a field set of a model
+// references a field that does not exist.
+func checkFieldSets() {
+	for _, model := range Registry.registryByName {
+		for _, set := range model.fieldSets {
+			for _, path := range set {
+				model.getRelatedFieldInfo(path)
+			}
+		}
+	}
+}
+
+// ReadFieldSet returns a FieldMap for each record of this RecordCollection
+// with the id and the fields of the field set with the given name, keyed by
+// their path as given in the field set. The fields of the set are loaded in
+// a single query if they are not in cache yet.
+//
+// Values are returned as with Get, so that relation fields are RecordSets.
+func (rc *RecordCollection) ReadFieldSet(name string) []FieldMap {
+	rc.checkModelAccess(security.Read)
+	fields, ok := rc.model.fieldSets[name]
+	if !ok {
+		log.Panic("Unknown field set", "model", rc.model.name, "fieldSet", name)
+	}
+	rSet := rc.WithPrefetchFields(fields...)
+	var res []FieldMap
+	for _, rec := range rSet.Records() {
+		fData := FieldMap{"id": rec.ids[0]}
+		for _, path := range fields {
+			target, field := rec.followPath(path)
+			fData[path] = target.Get(field)
+		}
+		res = append(res, fData)
+	}
+	return res
+}
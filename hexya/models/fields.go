@@ -15,6 +15,7 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -25,6 +26,7 @@ import (
 	"github.com/hexya-erp/hexya/hexya/models/types"
 	"github.com/hexya-erp/hexya/hexya/tools/nbutils"
 	"github.com/hexya-erp/hexya/hexya/tools/strutils"
+	"github.com/hexya-erp/hexya/hexya/tools/typesutils"
 )
 
 // An OnDeleteAction defines what to be done with this record when
@@ -82,11 +84,55 @@ func (fc *FieldsCollection) Get(name string) (fi *Field, ok bool) {
 func (fc *FieldsCollection) MustGet(name string) *Field {
 	fi, ok := fc.Get(name)
 	if !ok {
-		log.Panic("Unknown field in model", "model", fc.model.name, "field", name)
+		msg := fmt.Sprintf("Unknown field %s on model %s", name, fc.model.name)
+		log.PanicWithError(&Error{Kind: ErrUnknownField, Model: fc.model.name, Cause: errors.New(msg)},
+			msg, "model", fc.model.name, "field", name)
 	}
 	return fi
 }
 
+// DropReadOnlyFieldValues defines what Create and Write do with values
+// given for fields declared with ReadOnly. If false, they panic with an
+// ErrReadOnlyField error. If true, these values are silently dropped.
+var DropReadOnlyFieldValues = false
+
+// checkWritable returns fMap without the values that must not be written
+// by Create or Write. It panics if a key of fMap is not a field of this
+// collection's model, if it is a computed field without inverse method and
+// with a non zero value, since the value would be silently ignored, or if it
+// is a ReadOnly field with a non zero value (unless DropReadOnlyFieldValues
+// is set, in which case the value is dropped).
+//
+// Zero values of computed and ReadOnly fields are accepted so that FieldMaps
+// built from structs can be written. Those of ReadOnly fields and of fields
+// generated by the database are dropped.
+//
+// If force is true, computed fields are not checked. If allowReadOnly is true,
+// ReadOnly fields are written as any other field.
+func (fc *FieldsCollection) checkWritable(fMap FieldMap, force, allowReadOnly bool) FieldMap {
+	res := make(FieldMap, len(fMap))
+	for field, value := range fMap {
+		fi := fc.model.getRelatedFieldInfo(field)
+		switch {
+		case fi.sqlGenerated:
+			if typesutils.IsZero(value) {
+				continue
+			}
+		case fi.readOnly && !allowReadOnly:
+			if typesutils.IsZero(value) || DropReadOnlyFieldValues {
+				continue
+			}
+		case force || !fi.isComputedField() || fi.inverse != "" || typesutils.IsZero(value):
+			res[field] = value
+			continue
+		}
+		msg := fmt.Sprintf("Field %s on model %s is read only", field, fc.model.name)
+		log.PanicWithError(&Error{Kind: ErrReadOnlyField, Model: fc.model.name, Cause: errors.New(msg)},
+			msg, "model", fc.model.name, "field", field)
+	}
+	return res
+}
+
 // storedFieldNames returns a slice with the names of all the stored fields
 // If fields are given, return only names in the list
 func (fc *FieldsCollection) storedFieldNames(fieldNames ...string) []string {
@@ -110,6 +156,18 @@ func (fc *FieldsCollection) storedFieldNames(fieldNames ...string) []string {
 	return res
 }
 
+// columnFieldNames returns the names of the fields of this collection
+// that are stored in a column of the model's table.
+func (fc *FieldsCollection) columnFieldNames() []string {
+	var res []string
+	for fName, fi := range fc.registryByName {
+		if fi.isStored() && !fi.fieldType.IsNonStoredRelationType() {
+			res = append(res, fName)
+		}
+	}
+	return res
+}
+
 // getComputedFields returns the slice of Field of the computed, but not
 // stored fields of the given modelName.
 // If fields are given, return only Field instances in the list
@@ -169,6 +227,75 @@ func (fc *FieldsCollection) register(fInfo *Field) {
 	}
 }
 
+// setStored marks the given computed field as stored and updates the
+// computeData of the fields it depends on so that it is recomputed and
+// written instead of being invalidated. It does nothing if fInfo is
+// already stored.
+func (fc *FieldsCollection) setStored(fInfo *Field) {
+	fc.Lock()
+	if fInfo.stored {
+		fc.Unlock()
+		return
+	}
+	fInfo.stored = true
+	for i, fi := range fc.computedFields {
+		if fi == fInfo {
+			fc.computedFields = append(fc.computedFields[:i], fc.computedFields[i+1:]...)
+			break
+		}
+	}
+	fc.computedStoredFields = append(fc.computedStoredFields, fInfo)
+	fc.Unlock()
+
+	Registry.RLock()
+	defer Registry.RUnlock()
+	for _, mi := range Registry.registryByName {
+		mi.fields.setDependencyStored(fc.model, fInfo.name)
+	}
+}
+
+// setDependencyStored updates the computeData of the fields of this
+// collection that depend on the given field of the given model, which
+// has just been made stored.
+func (fc *FieldsCollection) setDependencyStored(model *Model, fieldName string) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	for _, fi := range fc.registryByName {
+		for i, dep := range fi.dependencies {
+			if dep.model != model || dep.fieldName != fieldName {
+				continue
+			}
+			fi.dependencies[i].stored = true
+			fi.dependencies[i].fieldName = ""
+		}
+	}
+}
+
+// setSQLGenerated marks the given field with an SQL expression as generated
+// by the database. Its Compute method, if any, is not called anymore and the
+// field is read from its column as any other stored field.
+func (fc *FieldsCollection) setSQLGenerated(fInfo *Field) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fInfo.sqlGenerated = true
+	fInfo.compute = ""
+	fInfo.depends = nil
+	for i, fi := range fc.computedFields {
+		if fi == fInfo {
+			fc.computedFields = append(fc.computedFields[:i], fc.computedFields[i+1:]...)
+			break
+		}
+	}
+	for i, fi := range fc.computedStoredFields {
+		if fi == fInfo {
+			fc.computedStoredFields = append(fc.computedStoredFields[:i], fc.computedStoredFields[i+1:]...)
+			break
+		}
+	}
+}
+
 // Field holds the meta information about a field
 type Field struct {
 	model            *Model
@@ -182,6 +309,8 @@ type Field struct {
 	unique           bool
 	index            bool
 	compute          string
+	computeSQL       string
+	sqlGenerated     bool
 	depends          []string
 	relatedModelName string
 	relatedModel     *Model
@@ -190,6 +319,7 @@ type Field struct {
 	m2mRelModel      *Model
 	m2mOurField      *Field
 	m2mTheirField    *Field
+	m2mLinkIndex     int
 	selection        types.Selection
 	fieldType        fieldtype.Type
 	groupOperator    string
@@ -200,6 +330,8 @@ type Field struct {
 	dependencies     []computeData
 	embed            bool
 	noCopy           bool
+	readOnly         bool
+	tracking         bool
 	defaultFunc      func(Environment) interface{}
 	onDelete         OnDeleteAction
 	onChange         string
@@ -249,6 +381,9 @@ func (f *Field) isReadOnly() bool {
 	if fInfo.compute != "" && fInfo.inverse == "" {
 		return true
 	}
+	if fInfo.sqlGenerated {
+		return true
+	}
 	return false
 }
 
@@ -306,6 +441,10 @@ func createM2MRelModelInfo(relModelName, model1, model2, field1, field2 string,
 				m2 = fi
 			}
 		}
+		if m1 == nil || m2 == nil {
+			log.Panic("Many2many link model does not have the given 'M2MOurField' and 'M2MTheirField'",
+				"linkModel", relModelName, "ours", field1, "theirs", field2)
+		}
 		return relMI, m1, m2
 	}
 
@@ -351,6 +490,7 @@ func createM2MRelModelInfo(relModelName, model1, model2, field1, field2 string,
 		relatedModelName: model2,
 		index:            true,
 		onDelete:         Cascade,
+		m2mLinkIndex:     1,
 		structField: reflect.StructField{
 			Name: field2,
 			Type: reflect.TypeOf(int64(0)),
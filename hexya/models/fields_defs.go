@@ -40,6 +40,8 @@ type BinaryField struct {
 	Depends    []string
 	Related    string
 	NoCopy     bool
+	ReadOnly   bool
+	Tracking   bool
 	GoType     interface{}
 	Translate  bool
 	OnChange   Methoder
@@ -78,6 +80,8 @@ func (bf BinaryField) DeclareField(fc *FieldsCollection, name string) {
 		relatedPath:   bf.Related,
 		groupOperator: "sum",
 		noCopy:        bf.NoCopy,
+		readOnly:      bf.ReadOnly,
+		tracking:      bf.Tracking,
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   bf.Default,
@@ -101,9 +105,12 @@ type BooleanField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	GoType        interface{}
 	Translate     bool
 	OnChange      Methoder
@@ -139,9 +146,12 @@ func (bf BooleanField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       bf.Depends,
+		computeSQL:    bf.ComputeSQL,
 		relatedPath:   bf.Related,
 		groupOperator: strutils.GetDefaultString(bf.GroupOperator, "sum"),
 		noCopy:        bf.NoCopy,
+		readOnly:      bf.ReadOnly,
+		tracking:      bf.Tracking,
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   bf.Default,
@@ -166,9 +176,12 @@ type CharField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	Size          int
 	GoType        interface{}
 	Translate     bool
@@ -205,9 +218,12 @@ func (cf CharField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       cf.Depends,
+		computeSQL:    cf.ComputeSQL,
 		relatedPath:   cf.Related,
 		groupOperator: strutils.GetDefaultString(cf.GroupOperator, "sum"),
 		noCopy:        cf.NoCopy,
+		readOnly:      cf.ReadOnly,
+		tracking:      cf.Tracking,
 		structField:   structField,
 		size:          cf.Size,
 		fieldType:     fieldType,
@@ -232,9 +248,12 @@ type DateField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	GoType        interface{}
 	Translate     bool
 	OnChange      Methoder
@@ -270,9 +289,12 @@ func (df DateField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       df.Depends,
+		computeSQL:    df.ComputeSQL,
 		relatedPath:   df.Related,
 		groupOperator: strutils.GetDefaultString(df.GroupOperator, "sum"),
 		noCopy:        df.NoCopy,
+		readOnly:      df.ReadOnly,
+		tracking:      df.Tracking,
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   df.Default,
@@ -296,9 +318,12 @@ type DateTimeField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	GoType        interface{}
 	Translate     bool
 	OnChange      Methoder
@@ -334,9 +359,12 @@ func (df DateTimeField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       df.Depends,
+		computeSQL:    df.ComputeSQL,
 		relatedPath:   df.Related,
 		groupOperator: strutils.GetDefaultString(df.GroupOperator, "sum"),
 		noCopy:        df.NoCopy,
+		readOnly:      df.ReadOnly,
+		tracking:      df.Tracking,
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   df.Default,
@@ -358,9 +386,12 @@ type FloatField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	Digits        nbutils.Digits
 	GoType        interface{}
 	Translate     bool
@@ -396,9 +427,12 @@ func (ff FloatField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       ff.Depends,
+		computeSQL:    ff.ComputeSQL,
 		relatedPath:   ff.Related,
 		groupOperator: strutils.GetDefaultString(ff.GroupOperator, "sum"),
 		noCopy:        ff.NoCopy,
+		readOnly:      ff.ReadOnly,
+		tracking:      ff.Tracking,
 		structField:   structField,
 		digits:        ff.Digits,
 		fieldType:     fieldtype.Float,
@@ -426,6 +460,8 @@ type HTMLField struct {
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	Size          int
 	GoType        interface{}
 	Translate     bool
@@ -465,6 +501,8 @@ func (tf HTMLField) DeclareField(fc *FieldsCollection, name string) {
 		relatedPath:   tf.Related,
 		groupOperator: strutils.GetDefaultString(tf.GroupOperator, "sum"),
 		noCopy:        tf.NoCopy,
+		readOnly:      tf.ReadOnly,
+		tracking:      tf.Tracking,
 		structField:   structField,
 		size:          tf.Size,
 		fieldType:     fieldType,
@@ -487,9 +525,12 @@ type IntegerField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	GoType        interface{}
 	Translate     bool
 	OnChange      Methoder
@@ -525,9 +566,12 @@ func (i IntegerField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       i.Depends,
+		computeSQL:    i.ComputeSQL,
 		relatedPath:   i.Related,
 		groupOperator: strutils.GetDefaultString(i.GroupOperator, "sum"),
 		noCopy:        i.NoCopy,
+		readOnly:      i.ReadOnly,
+		tracking:      i.Tracking,
 		structField:   structField,
 		fieldType:     fieldType,
 		defaultFunc:   i.Default,
@@ -552,6 +596,7 @@ type Many2ManyField struct {
 	Depends          []string
 	Related          string
 	NoCopy           bool
+	ReadOnly         bool
 	RelationModel    Modeler
 	M2MLinkModelName string
 	M2MOurField      string
@@ -578,7 +623,7 @@ func (mf Many2ManyField) DeclareField(fc *FieldsCollection, name string) {
 	if their == "" {
 		their = mf.RelationModel.Underlying().name
 	}
-	if our == their {
+	if our == their || strutils.SnakeCaseString(our) == strutils.SnakeCaseString(their) {
 		log.Panic("Many2many relation must have different 'M2MOurField' and 'M2MTheirField'",
 			"model", fc.model.name, "field", name, "ours", our, "theirs", their)
 	}
@@ -612,6 +657,7 @@ func (mf Many2ManyField) DeclareField(fc *FieldsCollection, name string) {
 		depends:          mf.Depends,
 		relatedPath:      mf.Related,
 		noCopy:           mf.NoCopy,
+		readOnly:         mf.ReadOnly,
 		structField:      structField,
 		relatedModelName: mf.RelationModel.Underlying().name,
 		m2mRelModel:      m2mRelModel,
@@ -642,6 +688,8 @@ type Many2OneField struct {
 	Depends       []string
 	Related       string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	RelationModel Modeler
 	Embed         bool
 	Translate     bool
@@ -692,6 +740,8 @@ func (mf Many2OneField) DeclareField(fc *FieldsCollection, name string) {
 		depends:          mf.Depends,
 		relatedPath:      mf.Related,
 		noCopy:           noCopy,
+		readOnly:         mf.ReadOnly,
+		tracking:         mf.Tracking,
 		structField:      structField,
 		embed:            mf.Embed,
 		relatedModelName: mf.RelationModel.Underlying().name,
@@ -720,6 +770,7 @@ type One2ManyField struct {
 	Depends       []string
 	Related       string
 	NoCopy        bool
+	ReadOnly      bool
 	RelationModel Modeler
 	ReverseFK     string
 	Translate     bool
@@ -758,6 +809,7 @@ func (of One2ManyField) DeclareField(fc *FieldsCollection, name string) {
 		depends:          of.Depends,
 		relatedPath:      of.Related,
 		noCopy:           of.NoCopy,
+		readOnly:         of.ReadOnly,
 		structField:      structField,
 		relatedModelName: of.RelationModel.Underlying().name,
 		reverseFK:        of.ReverseFK,
@@ -786,6 +838,8 @@ type One2OneField struct {
 	Depends       []string
 	Related       string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	RelationModel Modeler
 	Embed         bool
 	Translate     bool
@@ -836,6 +890,8 @@ func (of One2OneField) DeclareField(fc *FieldsCollection, name string) {
 		depends:          of.Depends,
 		relatedPath:      of.Related,
 		noCopy:           noCopy,
+		readOnly:         of.ReadOnly,
+		tracking:         of.Tracking,
 		structField:      structField,
 		embed:            of.Embed,
 		relatedModelName: of.RelationModel.Underlying().name,
@@ -865,6 +921,7 @@ type Rev2OneField struct {
 	Depends       []string
 	Related       string
 	NoCopy        bool
+	ReadOnly      bool
 	RelationModel Modeler
 	ReverseFK     string
 	Translate     bool
@@ -903,6 +960,7 @@ func (rf Rev2OneField) DeclareField(fc *FieldsCollection, name string) {
 		depends:          rf.Depends,
 		relatedPath:      rf.Related,
 		noCopy:           rf.NoCopy,
+		readOnly:         rf.ReadOnly,
 		structField:      structField,
 		relatedModelName: rf.RelationModel.Underlying().name,
 		reverseFK:        rf.ReverseFK,
@@ -931,6 +989,8 @@ type SelectionField struct {
 	Depends    []string
 	Related    string
 	NoCopy     bool
+	ReadOnly   bool
+	Tracking   bool
 	Selection  types.Selection
 	Translate  bool
 	OnChange   Methoder
@@ -963,6 +1023,8 @@ func (sf SelectionField) DeclareField(fc *FieldsCollection, name string) {
 		depends:     sf.Depends,
 		relatedPath: sf.Related,
 		noCopy:      sf.NoCopy,
+		readOnly:    sf.ReadOnly,
+		tracking:    sf.Tracking,
 		structField: structField,
 		selection:   sf.Selection,
 		fieldType:   fieldtype.Selection,
@@ -988,9 +1050,12 @@ type TextField struct {
 	Index         bool
 	Compute       Methoder
 	Depends       []string
+	ComputeSQL    string
 	Related       string
 	GroupOperator string
 	NoCopy        bool
+	ReadOnly      bool
+	Tracking      bool
 	Size          int
 	GoType        interface{}
 	Translate     bool
@@ -1027,9 +1092,12 @@ func (tf TextField) DeclareField(fc *FieldsCollection, name string) {
 		compute:       compute,
 		inverse:       inverse,
 		depends:       tf.Depends,
+		computeSQL:    tf.ComputeSQL,
 		relatedPath:   tf.Related,
 		groupOperator: strutils.GetDefaultString(tf.GroupOperator, "sum"),
 		noCopy:        tf.NoCopy,
+		readOnly:      tf.ReadOnly,
+		tracking:      tf.Tracking,
 		structField:   structField,
 		size:          tf.Size,
 		fieldType:     fieldType,
@@ -1114,6 +1182,12 @@ func (f *Field) SetCompute(value Methoder) *Field {
 	return f
 }
 
+// SetComputeSQL overrides the value of the ComputeSQL parameter of this Field
+func (f *Field) SetComputeSQL(value string) *Field {
+	f.computeSQL = value
+	return f
+}
+
 // SetDepends overrides the value of the Depends parameter of this Field
 func (f *Field) SetDepends(value []string) *Field {
 	f.depends = value
@@ -1150,6 +1224,18 @@ func (f *Field) SetNoCopy(value bool) *Field {
 	return f
 }
 
+// SetReadOnly overrides the value of the ReadOnly parameter of this Field
+func (f *Field) SetReadOnly(value bool) *Field {
+	f.readOnly = value
+	return f
+}
+
+// SetTracking overrides the value of the Tracking parameter of this Field
+func (f *Field) SetTracking(value bool) *Field {
+	f.tracking = value
+	return f
+}
+
 // SetTranslate overrides the value of the Translate parameter of this Field
 func (f *Field) SetTranslate(value bool) *Field {
 	f.translate = value
@@ -0,0 +1,552 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/hexya/tools/exceptions"
+)
+
+// cursorPrefix is the prefix of the decoded connection cursors
+const cursorPrefix = "cursor:"
+
+// A GraphQLResponse is the result of a GraphQL query.
+type GraphQLResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []GraphQLError         `json:"errors,omitempty"`
+}
+
+// A GraphQLError is an error returned in a GraphQLResponse.
+//
+// If the error has been raised by the ORM, the "kind" and "model" extensions
+// hold the kind of the error and the model on which it occurred.
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// graphQLModels returns the models exposed in the GraphQL schema, sorted by name.
+func graphQLModels() []*Model {
+	var res []*Model
+	for _, mi := range Registry.registryByName {
+		if mi.isMixin() || mi.isM2MLink() || mi.isSystem() {
+			continue
+		}
+		res = append(res, mi)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
+// graphQLFields returns the fields of the given model that are
+// exposed in the GraphQL schema, sorted by JSON name.
+func graphQLFields(mi *Model) []*Field {
+	var res []*Field
+	for _, fi := range mi.fields.registryByJSON {
+		if !isGraphQLField(fi) {
+			continue
+		}
+		res = append(res, fi)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].json < res[j].json
+	})
+	return res
+}
+
+// isGraphQLField returns true if the given field is exposed in the GraphQL schema
+// as a field of the type of its model. The id field is exposed separately.
+func isGraphQLField(fi *Field) bool {
+	if fi.json == "id" {
+		return false
+	}
+	return !fi.isRelationField() || isGraphQLModel(fi.relatedModel)
+}
+
+// isGraphQLModel returns true if the given model is exposed in the GraphQL schema.
+func isGraphQLModel(mi *Model) bool {
+	return mi != nil && !mi.isMixin() && !mi.isM2MLink() && !mi.isSystem()
+}
+
+// graphQLFieldType returns the GraphQL type of the given field.
+func graphQLFieldType(fi *Field) string {
+	switch fi.fieldType {
+	case fieldtype.Boolean:
+		return "Boolean"
+	case fieldtype.Integer:
+		return "Int"
+	case fieldtype.Float:
+		return "Float"
+	case fieldtype.Many2One, fieldtype.One2One, fieldtype.Rev2One:
+		return fi.relatedModelName
+	case fieldtype.One2Many, fieldtype.Many2Many:
+		return fmt.Sprintf("[%s!]!", fi.relatedModelName)
+	}
+	return "String"
+}
+
+// graphQLInputType returns the GraphQL type of the given field in the input
+// type of its model, or an empty string if the field cannot be written.
+func graphQLInputType(fi *Field) string {
+	if !fi.isStored() || fi.isReadOnly() || fi.readOnly {
+		return ""
+	}
+	switch fi.fieldType {
+	case fieldtype.Many2One, fieldtype.One2One:
+		return "ID"
+	case fieldtype.Many2Many:
+		return "[ID!]"
+	case fieldtype.One2Many, fieldtype.Rev2One:
+		return ""
+	}
+	return graphQLFieldType(fi)
+}
+
+// lowerFirst returns the given string with its first letter in lower case.
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// GraphQLSchema returns the GraphQL schema of the models of the registry in
+// the GraphQL schema definition language.
+//
+// Each model is a type whose fields are the model's fields with their JSON
+// name. Relation fields are typed with the related model's type. For each
+// model, the schema defines:
+// - a <model>(id) query returning a single record,
+// - a search<Model>(domain, order, first, after) query returning a connection
+// whose cursors can be used to fetch the next pages,
+// - create<Model>, write<Model> and unlink<Model> mutations. Values of the
+// mutations are given as <Model>Input objects, in which relations are given
+// as ids.
+//
+// Mixins, many2many link models and system models are not exposed.
+func GraphQLSchema() string {
+	var types, queries, mutations []string
+	for _, mi := range graphQLModels() {
+		var fields, inputs []string
+		fields = append(fields, "  id: ID!")
+		for _, fi := range graphQLFields(mi) {
+			fields = append(fields, fmt.Sprintf("  %s: %s", fi.json, graphQLFieldType(fi)))
+			if inputType := graphQLInputType(fi); inputType != "" {
+				inputs = append(inputs, fmt.Sprintf("  %s: %s", fi.json, inputType))
+			}
+		}
+		types = append(types,
+			fmt.Sprintf("type %s {\n%s\n}", mi.name, strings.Join(fields, "\n")),
+			fmt.Sprintf("type %sConnection {\n  edges: [%sEdge!]!\n  pageInfo: PageInfo!\n  totalCount: Int!\n}", mi.name, mi.name),
+			fmt.Sprintf("type %sEdge {\n  node: %s!\n  cursor: String!\n}", mi.name, mi.name))
+		queries = append(queries,
+			fmt.Sprintf("  %s(id: ID!): %s", lowerFirst(mi.name), mi.name),
+			fmt.Sprintf("  search%s(domain: String, order: String, first: Int, after: String): %sConnection!", mi.name, mi.name))
+		if mi.isManual() {
+			continue
+		}
+		if len(inputs) > 0 {
+			types = append(types, fmt.Sprintf("input %sInput {\n%s\n}", mi.name, strings.Join(inputs, "\n")))
+			mutations = append(mutations,
+				fmt.Sprintf("  create%s(values: %sInput!): %s!", mi.name, mi.name, mi.name),
+				fmt.Sprintf("  write%s(id: ID!, values: %sInput!): %s!", mi.name, mi.name, mi.name))
+		}
+		mutations = append(mutations, fmt.Sprintf("  unlink%s(id: ID!): Boolean!", mi.name))
+	}
+	types = append(types,
+		"type PageInfo {\n  hasNextPage: Boolean!\n  hasPreviousPage: Boolean!\n  startCursor: String\n  endCursor: String\n}",
+		fmt.Sprintf("type Query {\n%s\n}", strings.Join(queries, "\n")),
+		fmt.Sprintf("type Mutation {\n%s\n}", strings.Join(mutations, "\n")),
+		"schema {\n  query: Query\n  mutation: Mutation\n}")
+	return strings.Join(types, "\n\n") + "\n"
+}
+
+// ExecuteGraphQL executes the given GraphQL query or mutation against the
+// schema returned by GraphQLSchema, in a new Environment for the given user.
+//
+// Resolvers use the RecordSet API, so that access rights are checked as for
+// any other call. If an error occurs, the transaction is rolled back and the
+// response holds no data.
+//
+// Only a subset of GraphQL is supported: fragments and directives cannot be used.
+func ExecuteGraphQL(uid int64, query string, variables map[string]interface{}) GraphQLResponse {
+	op, err := parseGraphQL(query)
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{{Message: fmt.Sprintf("Syntax error: %s", err)}}}
+	}
+	var data map[string]interface{}
+	err = ExecuteInNewEnvironment(uid, func(env Environment) {
+		ex := gqlExecutor{env: env, variables: variables, defaults: op.defaults}
+		data = ex.resolveRoot(op)
+	})
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{newGraphQLError(err)}}
+	}
+	return GraphQLResponse{Data: data}
+}
+
+// newGraphQLError returns the GraphQLError corresponding to the given error.
+func newGraphQLError(err error) GraphQLError {
+	gqlErr := GraphQLError{Message: err.Error()}
+	var userErr exceptions.UserError
+	if errors.As(err, &userErr) {
+		gqlErr.Message = userErr.Message
+	}
+	var ormErr *Error
+	if errors.As(err, &ormErr) {
+		gqlErr.Extensions = map[string]interface{}{
+			"kind":  ormErr.Kind.Error(),
+			"model": ormErr.Model,
+		}
+	}
+	return gqlErr
+}
+
+// gqlExecutor resolves the fields of a GraphQL operation in an Environment.
+type gqlExecutor struct {
+	env       Environment
+	variables map[string]interface{}
+	defaults  map[string]interface{}
+}
+
+// resolveRoot resolves the root fields of the given operation.
+func (ex *gqlExecutor) resolveRoot(op *gqlOperation) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, field := range op.selections {
+		if field.name == "__typename" {
+			res[field.alias] = strings.Title(op.kind)
+			continue
+		}
+		var found bool
+		for _, mi := range graphQLModels() {
+			if res[field.alias], found = ex.resolveRootField(op.kind, mi, field); found {
+				break
+			}
+		}
+		if !found {
+			log.Panic(fmt.Sprintf("Unknown %s field %s", op.kind, field.name), "field", field.name)
+		}
+	}
+	return res
+}
+
+// resolveRootField resolves the given root field if it is one of the
+// root fields of the given model. The second returned value is false if
+// it is not.
+func (ex *gqlExecutor) resolveRootField(kind string, mi *Model, field *gqlField) (interface{}, bool) {
+	rs := ex.env.Pool(mi.name)
+	switch {
+	case kind == "query" && field.name == lowerFirst(mi.name):
+		rec := rs.Search(mi.Field("ID").Equals(ex.idArg(field, "id")))
+		if rec.IsEmpty() {
+			return nil, true
+		}
+		return ex.resolveRecord(rec, field.selections), true
+	case kind == "query" && field.name == "search"+mi.name:
+		return ex.resolveConnection(rs, field), true
+	case kind == "mutation" && field.name == "create"+mi.name && !mi.isManual():
+		rec := rs.Call("Create", ex.valuesArg(mi, field)).(RecordSet).Collection()
+		return ex.resolveRecord(rec, field.selections), true
+	case kind == "mutation" && field.name == "write"+mi.name && !mi.isManual():
+		rec := rs.Browse(ex.idArg(field, "id"))
+		rec.Call("Write", ex.valuesArg(mi, field))
+		return ex.resolveRecord(rec, field.selections), true
+	case kind == "mutation" && field.name == "unlink"+mi.name && !mi.isManual():
+		rec := rs.Browse(ex.idArg(field, "id"))
+		return rec.Call("Unlink").(int64) > 0, true
+	}
+	return nil, false
+}
+
+// arg returns the value of the given argument of field, with
+// variables substituted by their value.
+func (ex *gqlExecutor) arg(field *gqlField, name string) interface{} {
+	return ex.substituteVariables(field.args[name])
+}
+
+// substituteVariables returns the given value with variables substituted
+// by their value, recursively.
+func (ex *gqlExecutor) substituteVariables(value interface{}) interface{} {
+	switch val := value.(type) {
+	case gqlVariable:
+		if v, ok := ex.variables[string(val)]; ok {
+			return v
+		}
+		return ex.defaults[string(val)]
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, v := range val {
+			res[i] = ex.substituteVariables(v)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{})
+		for k, v := range val {
+			res[k] = ex.substituteVariables(v)
+		}
+		return res
+	}
+	return value
+}
+
+// idArg returns the value of the given ID argument of field.
+func (ex *gqlExecutor) idArg(field *gqlField, name string) int64 {
+	return graphQLID(ex.arg(field, name))
+}
+
+// graphQLID converts the given ID value, which may be given as a string
+// or as a number, to an int64.
+func graphQLID(value interface{}) int64 {
+	switch val := value.(type) {
+	case int64:
+		return val
+	case float64:
+		return int64(val)
+	case string:
+		id, err := strconv.ParseInt(val, 10, 64)
+		if err == nil {
+			return id
+		}
+	}
+	log.Panic("Invalid ID", "value", value)
+	return 0
+}
+
+// valuesArg returns the "values" argument of the given mutation field as a
+// FieldMap suitable for Create and Write on the given model.
+func (ex *gqlExecutor) valuesArg(mi *Model, field *gqlField) FieldMap {
+	values, ok := ex.arg(field, "values").(map[string]interface{})
+	if !ok {
+		log.Panic("Missing values argument", "field", field.name)
+	}
+	res := make(FieldMap)
+	for key, value := range values {
+		fi := mi.fields.MustGet(key)
+		switch fi.fieldType {
+		case fieldtype.Many2One, fieldtype.One2One:
+			if value == nil {
+				res[fi.name] = nil
+				continue
+			}
+			res[fi.name] = ex.env.Pool(fi.relatedModelName).Browse(graphQLID(value))
+		case fieldtype.Many2Many:
+			list, _ := value.([]interface{})
+			ids := make([]int64, len(list))
+			for i, v := range list {
+				ids[i] = graphQLID(v)
+			}
+			res[fi.name] = ex.env.Pool(fi.relatedModelName).Browse(ids...)
+		default:
+			res[fi.name] = value
+		}
+	}
+	return res
+}
+
+// resolveConnection resolves a search<Model> connection field on the given RecordSet.
+func (ex *gqlExecutor) resolveConnection(rs *RecordCollection, field *gqlField) map[string]interface{} {
+	search := rs.SearchAll()
+	if domainStr, ok := ex.arg(field, "domain").(string); ok && domainStr != "" {
+		var domain []interface{}
+		if err := json.Unmarshal([]byte(domainStr), &domain); err != nil {
+			log.Panic("Invalid domain", "domain", domainStr, "error", err)
+		}
+		search = search.SearchDomain(domain)
+	}
+	if order, ok := ex.arg(field, "order").(string); ok && order != "" {
+		exprs := strings.Split(order, ",")
+		for i, expr := range exprs {
+			exprs[i] = strings.TrimSpace(expr)
+		}
+		search = search.OrderBy(exprs...)
+	}
+	var offset int
+	if after, ok := ex.arg(field, "after").(string); ok && after != "" {
+		offset = decodeCursor(after) + 1
+	}
+	first := int(graphQLInt(ex.arg(field, "first")))
+	if MaxLimit > 0 && (first <= 0 || first > MaxLimit) {
+		first = MaxLimit
+	}
+	page := search.Offset(offset)
+	if first > 0 {
+		page = page.Limit(first + 1)
+	}
+	records := page.Records()
+	hasNextPage := first > 0 && len(records) > first
+	if hasNextPage {
+		records = records[:first]
+	}
+
+	res := make(map[string]interface{})
+	for _, sel := range field.selections {
+		switch sel.name {
+		case "__typename":
+			res[sel.alias] = rs.model.name + "Connection"
+		case "totalCount":
+			res[sel.alias] = search.SearchCount()
+		case "edges":
+			edges := make([]interface{}, len(records))
+			for i, rec := range records {
+				edge := make(map[string]interface{})
+				for _, edgeSel := range sel.selections {
+					switch edgeSel.name {
+					case "__typename":
+						edge[edgeSel.alias] = rs.model.name + "Edge"
+					case "cursor":
+						edge[edgeSel.alias] = encodeCursor(offset + i)
+					case "node":
+						edge[edgeSel.alias] = ex.resolveRecord(rec, edgeSel.selections)
+					default:
+						log.Panic("Unknown edge field", "field", edgeSel.name)
+					}
+				}
+				edges[i] = edge
+			}
+			res[sel.alias] = edges
+		case "pageInfo":
+			pageInfo := make(map[string]interface{})
+			for _, piSel := range sel.selections {
+				switch piSel.name {
+				case "__typename":
+					pageInfo[piSel.alias] = "PageInfo"
+				case "hasNextPage":
+					pageInfo[piSel.alias] = hasNextPage
+				case "hasPreviousPage":
+					pageInfo[piSel.alias] = offset > 0
+				case "startCursor", "endCursor":
+					pageInfo[piSel.alias] = nil
+					if len(records) == 0 {
+						continue
+					}
+					pos := offset
+					if piSel.name == "endCursor" {
+						pos = offset + len(records) - 1
+					}
+					pageInfo[piSel.alias] = encodeCursor(pos)
+				default:
+					log.Panic("Unknown page info field", "field", piSel.name)
+				}
+			}
+			res[sel.alias] = pageInfo
+		default:
+			log.Panic("Unknown connection field", "field", sel.name)
+		}
+	}
+	return res
+}
+
+// graphQLInt converts the given Int argument value to an int64.
+// It returns 0 if the value is nil.
+func graphQLInt(value interface{}) int64 {
+	switch val := value.(type) {
+	case nil:
+		return 0
+	case int64:
+		return val
+	case float64:
+		return int64(val)
+	}
+	log.Panic("Invalid Int value", "value", value)
+	return 0
+}
+
+// encodeCursor returns the opaque connection cursor of the given position.
+func encodeCursor(pos int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s%d", cursorPrefix, pos)))
+}
+
+// decodeCursor returns the position of the given connection cursor.
+func decodeCursor(cursor string) int {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(data), cursorPrefix) {
+		var pos int
+		if pos, err = strconv.Atoi(strings.TrimPrefix(string(data), cursorPrefix)); err == nil {
+			return pos
+		}
+	}
+	log.Panic("Invalid cursor", "cursor", cursor)
+	return 0
+}
+
+// resolveRecord resolves the given selections on the given singleton RecordSet.
+func (ex *gqlExecutor) resolveRecord(rec *RecordCollection, selections []*gqlField) map[string]interface{} {
+	res := make(map[string]interface{})
+	for _, sel := range selections {
+		switch sel.name {
+		case "__typename":
+			res[sel.alias] = rec.model.name
+			continue
+		case "id":
+			res[sel.alias] = rec.Ids()[0]
+			continue
+		}
+		fi, ok := rec.model.fields.Get(sel.name)
+		if !ok || fi.json != sel.name || !isGraphQLField(fi) {
+			log.Panic("Unknown field in selection", "model", rec.model.name, "field", sel.name)
+		}
+		if fi.isRelationField() != (sel.selections != nil) {
+			log.Panic("Relation fields, and only them, must have a selection set", "model", rec.model.name, "field", sel.name)
+		}
+		value := rec.Get(fi.name)
+		switch fi.fieldType {
+		case fieldtype.Many2One, fieldtype.One2One, fieldtype.Rev2One:
+			relRS := value.(RecordSet).Collection()
+			if relRS.IsEmpty() {
+				res[sel.alias] = nil
+				continue
+			}
+			res[sel.alias] = ex.resolveRecord(relRS, sel.selections)
+		case fieldtype.One2Many, fieldtype.Many2Many:
+			list := make([]interface{}, 0)
+			for _, relRec := range value.(RecordSet).Collection().Records() {
+				list = append(list, ex.resolveRecord(relRec, sel.selections))
+			}
+			res[sel.alias] = list
+		default:
+			res[sel.alias] = graphQLScalar(value)
+		}
+	}
+	return res
+}
+
+// graphQLScalar returns the given field value as a GraphQL scalar.
+// Dates are returned as strings and zero dates as null.
+func graphQLScalar(value interface{}) interface{} {
+	switch val := value.(type) {
+	case dates.Date:
+		if val.IsZero() {
+			return nil
+		}
+		return val.String()
+	case dates.DateTime:
+		if val.IsZero() {
+			return nil
+		}
+		return val.String()
+	}
+	return value
+}
@@ -0,0 +1,363 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A gqlOperation is a parsed GraphQL query or mutation.
+//
+// Only the subset of GraphQL needed to query the generated schema is
+// supported: a single operation with variables, fields with aliases,
+// arguments and selection sets. Fragments and directives are not supported.
+type gqlOperation struct {
+	kind       string
+	defaults   map[string]interface{}
+	selections []*gqlField
+}
+
+// A gqlField is a field of a selection set of a GraphQL query.
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+// A gqlVariable is a reference to a variable in a GraphQL query.
+type gqlVariable string
+
+// A gqlToken is a lexical token of a GraphQL query.
+//
+// kind is one of "punct", "name", "int", "float", "string" or "eof".
+type gqlToken struct {
+	kind  string
+	value string
+}
+
+// gqlParser is a recursive descent parser of GraphQL queries.
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+// parseGraphQL parses the given GraphQL query.
+func parseGraphQL(query string) (*gqlOperation, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	return p.parseOperation()
+}
+
+// lexGraphQL splits the given GraphQL query into tokens.
+// Commas and comments are ignored, as per the GraphQL specification.
+func lexGraphQL(query string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r) || r == ',' || r == '\uFEFF':
+			i++
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case strings.ContainsRune("!$():=[]{}", r):
+			tokens = append(tokens, gqlToken{kind: "punct", value: string(r)})
+			i++
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind: "name", value: string(runes[start:i])})
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			kind := "int"
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])) {
+				if !unicode.IsDigit(runes[i]) {
+					kind = "float"
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind: kind, value: string(runes[start:i])})
+		case r == '"':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			var str string
+			if err := json.Unmarshal([]byte(string(runes[start:i])), &str); err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %s", start, err)
+			}
+			tokens = append(tokens, gqlToken{kind: "string", value: str})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, gqlToken{kind: "eof"}), nil
+}
+
+// peek returns the current token without consuming it.
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the current token.
+func (p *gqlParser) next() gqlToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+// isPunct returns true if the current token is the given punctuator.
+func (p *gqlParser) isPunct(value string) bool {
+	tok := p.peek()
+	return tok.kind == "punct" && tok.value == value
+}
+
+// expectPunct consumes the current token, which must be the given punctuator.
+func (p *gqlParser) expectPunct(value string) error {
+	if tok := p.next(); tok.kind != "punct" || tok.value != value {
+		return fmt.Errorf("expected %q, got %q", value, tok.value)
+	}
+	return nil
+}
+
+// expectName consumes the current token, which must be a name, and returns it.
+func (p *gqlParser) expectName() (string, error) {
+	tok := p.next()
+	if tok.kind != "name" {
+		return "", fmt.Errorf("expected a name, got %q", tok.value)
+	}
+	return tok.value, nil
+}
+
+// parseOperation parses a whole GraphQL document made of a single operation.
+func (p *gqlParser) parseOperation() (*gqlOperation, error) {
+	op := gqlOperation{kind: "query", defaults: make(map[string]interface{})}
+	if tok := p.peek(); tok.kind == "name" {
+		if tok.value != "query" && tok.value != "mutation" {
+			return nil, fmt.Errorf("unsupported operation %q", tok.value)
+		}
+		op.kind = p.next().value
+		if p.peek().kind == "name" {
+			p.next()
+		}
+		if p.isPunct("(") {
+			if err := p.parseVariableDefinitions(&op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q after operation", tok.value)
+	}
+	return &op, nil
+}
+
+// parseVariableDefinitions parses the variable definitions of an operation
+// and stores their default values in op.
+func (p *gqlParser) parseVariableDefinitions(op *gqlOperation) error {
+	p.next()
+	for !p.isPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if err = p.expectPunct(":"); err != nil {
+			return err
+		}
+		if err = p.parseType(); err != nil {
+			return err
+		}
+		if p.isPunct("=") {
+			p.next()
+			value, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+			op.defaults[name] = value
+		}
+	}
+	p.next()
+	return nil
+}
+
+// parseType parses a type reference of a variable definition.
+// Types are not checked, since arguments are converted when executing the query.
+func (p *gqlParser) parseType() error {
+	if p.isPunct("[") {
+		p.next()
+		if err := p.parseType(); err != nil {
+			return err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return err
+	}
+	if p.isPunct("!") {
+		p.next()
+	}
+	return nil
+}
+
+// parseSelectionSet parses a selection set between braces.
+func (p *gqlParser) parseSelectionSet() ([]*gqlField, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var res []*gqlField
+	for !p.isPunct("}") {
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, field)
+	}
+	p.next()
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return res, nil
+}
+
+// parseField parses a field of a selection set with its alias,
+// its arguments and its own selection set, if any.
+func (p *gqlParser) parseField() (*gqlField, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	field := gqlField{alias: name, name: name, args: make(map[string]interface{})}
+	if p.isPunct(":") {
+		p.next()
+		if field.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		p.next()
+		for !p.isPunct(")") {
+			argName, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			if field.args[argName], err = p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+	}
+	if p.isPunct("{") {
+		if field.selections, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return &field, nil
+}
+
+// parseValue parses an input value, which can be a variable reference.
+// Enum values are returned as strings.
+func (p *gqlParser) parseValue() (interface{}, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "int":
+		return strconv.ParseInt(tok.value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(tok.value, 64)
+	case "string":
+		return tok.value, nil
+	case "name":
+		switch tok.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return tok.value, nil
+	case "punct":
+		switch tok.value {
+		case "$":
+			name, err := p.expectName()
+			return gqlVariable(name), err
+		case "[":
+			res := make([]interface{}, 0)
+			for !p.isPunct("]") {
+				if p.peek().kind == "eof" {
+					return nil, fmt.Errorf("unterminated list")
+				}
+				val, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, val)
+			}
+			p.next()
+			return res, nil
+		case "{":
+			res := make(map[string]interface{})
+			for !p.isPunct("}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expectPunct(":"); err != nil {
+					return nil, err
+				}
+				if res[name], err = p.parseValue(); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q in value", tok.value)
+}
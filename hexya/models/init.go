@@ -34,4 +34,9 @@ func init() {
 	declareCommonMixin()
 	declareBaseMixin()
 	declareModelMixin()
+	declareTrackingModel()
+	declareSavedSearchModel()
+	declareTombstoneModel()
+	declareOutboxModel()
+	declareQueueModel()
 }
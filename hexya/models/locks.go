@@ -0,0 +1,123 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+)
+
+// An AdvisoryLockScope defines how long an advisory lock is held.
+type AdvisoryLockScope uint8
+
+const (
+	// TransactionLockScope locks are held until the end of the
+	// transaction of the Environment that acquired them.
+	TransactionLockScope AdvisoryLockScope = iota
+	// SessionLockScope locks are held on a dedicated database
+	// connection until they are explicitly released.
+	SessionLockScope
+)
+
+// rowQueryer is implemented by objects that can query a single row,
+// such as transactions and connections.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// AdvisoryLock acquires an application level lock with the given key,
+// waiting until it is available. Advisory locks are independent from
+// records and allow to implement mutexes across transactions, such as
+// "only one payment run at a time".
+//
+// By default, the lock is held until the end of this Environment's
+// transaction and the returned unlock function does nothing. If
+// SessionLockScope is given, the lock is held until unlock is called.
+//
+// Waiting for the lock is cancelled with an error if the context of this
+// Environment's transaction is done.
+func (env Environment) AdvisoryLock(key string, scope ...AdvisoryLockScope) (unlock func(), err error) {
+	unlock, _, err = env.advisoryLock(key, false, scope...)
+	return
+}
+
+// TryAdvisoryLock tries to acquire the application level lock with the
+// given key, without waiting. The returned bool is false if the lock is
+// already held by another transaction or session.
+//
+// See AdvisoryLock for the meaning of scope and of the returned unlock function.
+func (env Environment) TryAdvisoryLock(key string, scope ...AdvisoryLockScope) (unlock func(), acquired bool, err error) {
+	return env.advisoryLock(key, true, scope...)
+}
+
+// advisoryLock acquires the advisory lock with the given key. If try is true,
+// it returns immediately whether the lock has been acquired or not.
+func (env Environment) advisoryLock(key string, try bool, scope ...AdvisoryLockScope) (func(), bool, error) {
+	adapter := adapters[db.DriverName()]
+	session := len(scope) > 0 && scope[0] == SessionLockScope
+	lockKey := advisoryLockKey(key)
+	noop := func() {}
+	if !session {
+		if env.cr.tx == nil {
+			log.Panic("Transaction advisory locks cannot be acquired in autocommit mode", "key", key)
+		}
+		acquired, err := queryAdvisoryLock(env.cr.ctx, env.cr.tx, adapter.advisoryLockQuery(false, try), lockKey)
+		return noop, acquired, err
+	}
+	conn, err := db.Conn(env.cr.ctx)
+	if err != nil {
+		return noop, false, err
+	}
+	acquired, err := queryAdvisoryLock(env.cr.ctx, conn, adapter.advisoryLockQuery(true, try), lockKey)
+	if err != nil || !acquired {
+		conn.Close()
+		return noop, acquired, err
+	}
+	var once sync.Once
+	unlock := func() {
+		once.Do(func() {
+			defer conn.Close()
+			query, args := sanitizeQuery(adapter.advisoryUnlockQuery(), lockKey)
+			// The lock may outlive the Environment, so that its context
+			// must not prevent releasing it.
+			if _, err := conn.ExecContext(context.Background(), query, args...); err != nil {
+				log.Warn("Unable to release advisory lock", "key", key, "error", err)
+			}
+		})
+	}
+	return unlock, true, nil
+}
+
+// queryAdvisoryLock executes the given lock query for lockKey on rq and
+// returns whether the lock has been acquired. Waiting for the lock is
+// cancelled if ctx is done.
+func queryAdvisoryLock(ctx context.Context, rq rowQueryer, lockQuery string, lockKey int64) (bool, error) {
+	query, args := sanitizeQuery(lockQuery, lockKey)
+	var acquired bool
+	if err := rq.QueryRowContext(ctx, query, args...).Scan(&acquired); err != nil {
+		log.Warn("Unable to acquire advisory lock", "key", lockKey, "error", err)
+		return false, err
+	}
+	return acquired, nil
+}
+
+// advisoryLockKey returns the integer lock identifier of the given key
+func advisoryLockKey(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
@@ -15,6 +15,9 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
 	"sync"
 
@@ -109,9 +112,10 @@ func (m *Method) addMethodLayer(val reflect.Value, doc string) {
 	m.Lock()
 	defer m.Unlock()
 	ml := methodLayer{
-		funcValue: wrapFunctionForMethodLayer(val),
-		method:    m,
-		doc:       doc,
+		funcValue:  wrapFunctionForMethodLayer(val),
+		method:     m,
+		doc:        doc,
+		declaredIn: m.model,
 	}
 	if m.topLayer != nil {
 		m.nextLayer[&ml] = m.topLayer
@@ -177,6 +181,9 @@ type methodLayer struct {
 	mixedIn   bool
 	funcValue reflect.Value
 	doc       string
+	// declaredIn is the model in which this layer was declared,
+	// which is a mixin for layers that have been mixed in.
+	declaredIn *Model
 }
 
 // copyMethod creates a new method without any method layer for
@@ -282,10 +289,70 @@ func convertFunctionArg(rc *RecordCollection, fnctArgType reflect.Type, arg inte
 		// Given arg is already a struct pointer
 		return reflect.ValueOf(arg), nil
 	default:
+		switch fnctArgType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return convertIntegerArg(rc, fnctArgType, arg), nil
+		}
 		return reflect.ValueOf(arg), nil
 	}
 }
 
+// convertIntegerArg converts the given argument to the integer type fnctArgType.
+// Integers of other types and floats without fractional part, such as numbers
+// decoded from JSON, are converted. It panics with an ErrTypeMismatch error if
+// arg is not an integer or if it does not fit in fnctArgType.
+func convertIntegerArg(rc *RecordCollection, fnctArgType reflect.Type, arg interface{}) reflect.Value {
+	val := reflect.ValueOf(arg)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !integerOverflows(fnctArgType, val) {
+			return val.Convert(fnctArgType)
+		}
+	case reflect.Float32, reflect.Float64:
+		if f := val.Float(); f == math.Trunc(f) && !math.IsInf(f, 0) && !integerOverflows(fnctArgType, val) {
+			return val.Convert(fnctArgType)
+		}
+	}
+	msg := fmt.Sprintf("Expected an integer argument of type %s, got %T (%v)", fnctArgType, arg, arg)
+	log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName(), Cause: errors.New(msg)}, msg,
+		"model", rc.ModelName(), "type", fnctArgType, "argument", arg)
+	return val
+}
+
+// integerOverflows returns true if the given integer or float value cannot
+// be represented by the integer type typ.
+func integerOverflows(typ reflect.Type, val reflect.Value) bool {
+	zero := reflect.Zero(typ)
+	var signed bool
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		signed = true
+	}
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := val.Int()
+		if signed {
+			return zero.OverflowInt(i)
+		}
+		return i < 0 || zero.OverflowUint(uint64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := val.Uint()
+		if signed {
+			return u > math.MaxInt64 || zero.OverflowInt(int64(u))
+		}
+		return zero.OverflowUint(u)
+	case reflect.Float32, reflect.Float64:
+		f := val.Float()
+		if signed {
+			return f < math.MinInt64 || f >= math.MaxInt64 || zero.OverflowInt(int64(f))
+		}
+		return f < 0 || f >= math.MaxUint64 || zero.OverflowUint(uint64(f))
+	}
+	return true
+}
+
 // AddMethod creates a new method on given model name and adds the given fnct
 // as first layer for this method. Given fnct function must have a RecordSet as
 // first argument.
@@ -317,6 +384,24 @@ func (m *Model) AddEmptyMethod(methodName string) *Method {
 	return meth
 }
 
+// MethodSignature returns the parameter and return types of the method with
+// the given name, as declared by its first layer. The RecordSet receiver is
+// not included in params. ok is false if the method does not exist or has
+// not been declared yet.
+func (m *Model) MethodSignature(name string) (params []reflect.Type, returns []reflect.Type, ok bool) {
+	meth, exists := m.methods.get(name)
+	if !exists || meth.methodType == nil {
+		return nil, nil, false
+	}
+	for i := 1; i < meth.methodType.NumIn(); i++ {
+		params = append(params, meth.methodType.In(i))
+	}
+	for i := 0; i < meth.methodType.NumOut(); i++ {
+		returns = append(returns, meth.methodType.Out(i))
+	}
+	return params, returns, true
+}
+
 // DeclareMethod overrides the given Method by :
 // - setting documentation string to doc
 // - setting fnct as the first layer
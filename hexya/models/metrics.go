@@ -0,0 +1,65 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import "time"
+
+// A MetricsCollector receives events from the ORM at key points of
+// query and transaction execution. It can be used to export counters
+// and latencies to Prometheus or any other monitoring system.
+//
+// Methods of a MetricsCollector are called synchronously from the
+// goroutine executing the query or transaction, so they must be fast
+// and safe for concurrent use.
+type MetricsCollector interface {
+	// QueryStarted is called before the given query is sent to the database.
+	QueryStarted(query string)
+	// QueryFinished is called after the given query has been executed.
+	// err is the error returned by the database, if any.
+	QueryFinished(query string, duration time.Duration, err error)
+	// TransactionBegun is called when a new transaction is opened.
+	TransactionBegun()
+	// TransactionCommitted is called when a transaction is committed.
+	TransactionCommitted()
+	// TransactionRolledBack is called when a transaction is rolled back.
+	TransactionRolledBack()
+	// SerializationRetried is called when a transaction that failed with a
+	// serialization error is retried. attempt is the number of the retry,
+	// starting at 1.
+	SerializationRetried(attempt uint8)
+	// DeadlockRetried is called when a transaction that failed because of a
+	// deadlock is retried. attempt is the number of the retry, starting at 1.
+	DeadlockRetried(attempt uint8)
+}
+
+// metrics is the MetricsCollector in use. It is nil when no collector is set.
+var metrics MetricsCollector
+
+// SetMetricsCollector sets the MetricsCollector that the ORM calls when
+// executing queries and transactions. Passing nil disables metrics.
+//
+// This function must be called at startup before any transaction is opened.
+func SetMetricsCollector(collector MetricsCollector) {
+	metrics = collector
+}
+
+// startQuery notifies the metrics collector that the given query is about
+// to be executed and returns the current time.
+func startQuery(query string) time.Time {
+	if metrics != nil {
+		metrics.QueryStarted(query)
+	}
+	return time.Now()
+}
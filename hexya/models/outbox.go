@@ -0,0 +1,160 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// An OutboxEvent is an event to be published to an external system,
+// stored with EmitEvent in the transaction of the change it notifies.
+//
+// Payload is the JSON encoding of the payload given to EmitEvent.
+type OutboxEvent struct {
+	ID      int64
+	Topic   string
+	Payload string
+	UID     int64
+	Date    dates.DateTime
+}
+
+// declareOutboxModel creates the OutboxEvent model which stores the events
+// emitted with EmitEvent until they are relayed.
+func declareOutboxModel() {
+	outbox := createModel("OutboxEvent", SystemModel)
+	outbox.InheritModel(Registry.MustGet("CommonMixin"))
+	outbox.AddFields(map[string]FieldDefinition{
+		"Topic":    CharField{Required: true, Index: true},
+		"Payload":  TextField{},
+		"UID":      IntegerField{},
+		"Date":     DateTimeField{Index: true},
+		"Sent":     BooleanField{Index: true},
+		"SentDate": DateTimeField{},
+	})
+	outbox.SetDefaultOrder("id")
+}
+
+// EmitEvent stores an event with the given topic and payload in the outbox, in
+// the transaction of this Environment. payload must be serializable to JSON.
+// It returns the id of the event.
+//
+// The event is inserted directly in the database, so that it is committed or
+// rolled back together with the changes of the transaction, and is eventually
+// relayed to the external system with RelayOutboxEvents.
+func (env Environment) EmitEvent(topic string, payload interface{}) int64 {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Panic("Unable to serialize event payload", "topic", topic, "error", err)
+	}
+	sql, args := env.Pool("OutboxEvent").query.insertQuery(FieldMap{
+		"Topic":   topic,
+		"Payload": string(data),
+		"UID":     env.uid,
+		"Date":    dates.Now(),
+	})
+	var eventID int64
+	env.cr.Get(&eventID, sql, args...)
+	return eventID
+}
+
+// PendingOutboxEvents returns at most limit events of the outbox that have
+// not been sent yet, in the order they have been emitted.
+func (env Environment) PendingOutboxEvents(limit int) []OutboxEvent {
+	outboxModel := Registry.MustGet("OutboxEvent")
+	events := env.Pool("OutboxEvent").Sudo().Search(outboxModel.Field("Sent").Equals(false)).
+		OrderBy("ID").Limit(limit)
+	var res []OutboxEvent
+	for _, rec := range events.Records() {
+		res = append(res, OutboxEvent{
+			ID:      rec.ids[0],
+			Topic:   rec.Get("Topic").(string),
+			Payload: rec.Get("Payload").(string),
+			UID:     rec.Get("UID").(int64),
+			Date:    rec.Get("Date").(dates.DateTime),
+		})
+	}
+	return res
+}
+
+// MarkOutboxEventsSent marks the outbox events with the given ids as sent,
+// so that they are not returned by PendingOutboxEvents anymore.
+func (env Environment) MarkOutboxEventsSent(ids ...int64) {
+	if len(ids) == 0 {
+		return
+	}
+	env.Pool("OutboxEvent").Sudo().Browse(ids...).Call("Write", FieldMap{
+		"Sent":     true,
+		"SentDate": dates.Now(),
+	})
+}
+
+// PruneOutboxEvents deletes the sent outbox events that are older than the
+// given age and returns the number of deleted events.
+func (env Environment) PruneOutboxEvents(age time.Duration) int64 {
+	outboxModel := Registry.MustGet("OutboxEvent")
+	limit := dates.DateTime{Time: time.Now().Add(-age)}
+	return env.Pool("OutboxEvent").Sudo().Search(outboxModel.Field("Sent").Equals(true).
+		And().Field("Date").Lower(limit)).Call("Unlink").(int64)
+}
+
+// RelayOutboxEvents sends the pending outbox events with send, in the order
+// they have been emitted, by batches of at most batchSize events. Each batch
+// is processed in a new transaction, in which the events successfully sent
+// are marked as sent. It returns the number of sent events.
+//
+// The relay stops at the first event for which send returns an error and
+// returns this error: this event and the next ones are left pending, to be
+// sent by the next relay. Events are delivered at least once: an event may be
+// sent again if its transaction fails to commit after send, or if several
+// relays run concurrently.
+func RelayOutboxEvents(batchSize int, send func(OutboxEvent) error) (int, error) {
+	if batchSize <= 0 {
+		log.Panic("Batch size must be strictly positive", "batchSize", batchSize)
+	}
+	var total int
+	for {
+		var (
+			sent    int
+			pending int
+			sendErr error
+		)
+		err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			sent = 0
+			events := env.PendingOutboxEvents(batchSize)
+			pending = len(events)
+			for _, event := range events {
+				if sendErr = send(event); sendErr != nil {
+					break
+				}
+				env.MarkOutboxEventsSent(event.ID)
+				sent++
+			}
+		})
+		if err != nil {
+			return total, err
+		}
+		total += sent
+		if sendErr != nil {
+			return total, sendErr
+		}
+		if pending < batchSize {
+			return total, nil
+		}
+	}
+}
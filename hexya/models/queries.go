@@ -38,6 +38,17 @@ func (p SQLParams) Extend(p2 SQLParams) SQLParams {
 	return SQLParams(res)
 }
 
+// MaxLimit is the maximum number of records that a query can be limited to
+// in methods called through RPC with Dispatch. Greater limits given to
+// RecordCollection.Limit are capped at MaxLimit there, as well as a zero limit
+// which would otherwise mean no limit, so that clients cannot dump a whole
+// table by asking for a huge page or for no limit. It is also the maximum
+// size of the pages of GraphQL connections.
+//
+// Limits of server side code are not capped. Zero or negative values
+// disable the cap.
+var MaxLimit = 10000
+
 // A Query defines the common part an SQL Query, i.e. all that come
 // after the FROM keyword.
 type Query struct {
@@ -48,7 +59,11 @@ type Query struct {
 	offset     int
 	noDistinct bool
 	groups     []string
+	having     *Condition
 	orders     []string
+	collation  string
+	maxLimit   int
+	hasLimit   bool
 }
 
 // clone returns a pointer to a deep copy of this Query
@@ -71,8 +86,9 @@ func (q *Query) sqlWhereClause() (string, SQLParams) {
 }
 
 // sqlClauses returns the sql string and parameters corresponding to the
-// WHERE clause of this Condition.
-func (q *Query) conditionSQLClause(c *Condition) (string, SQLParams) {
+// WHERE clause of this Condition. If having is given and true, the clause is
+// built for the HAVING clause of a grouped query.
+func (q *Query) conditionSQLClause(c *Condition, having ...bool) (string, SQLParams) {
 	if c.IsEmpty() {
 		return "", SQLParams{}
 	}
@@ -83,7 +99,7 @@ func (q *Query) conditionSQLClause(c *Condition) (string, SQLParams) {
 
 	first := true
 	for _, val := range c.predicates {
-		vSQL, vArgs := q.predicateSQLClause(val, first)
+		vSQL, vArgs := q.predicateSQLClause(val, first, len(having) > 0 && having[0])
 		first = false
 		sql += vSQL
 		args = args.Extend(vArgs)
@@ -92,18 +108,15 @@ func (q *Query) conditionSQLClause(c *Condition) (string, SQLParams) {
 }
 
 // sqlClause returns the sql WHERE clause for this predicate.
-// If 'first' is given and true, then the sql clause is not prefixed with
-// 'AND' and panics if isOr is true.
-func (q *Query) predicateSQLClause(p predicate, first ...bool) (string, SQLParams) {
+// If 'first' is true, then the sql clause is not prefixed with
+// 'AND' and panics if isOr is true. If having is true, fields are
+// replaced by their aggregate as in the HAVING clause of a grouped query.
+func (q *Query) predicateSQLClause(p predicate, isFirst, having bool) (string, SQLParams) {
 	var (
 		sql     string
 		args    SQLParams
-		isFirst bool
 		adapter = adapters[db.DriverName()]
 	)
-	if len(first) > 0 {
-		isFirst = first[0]
-	}
 	if p.isOr && !isFirst {
 		sql += "OR "
 	} else if !isFirst {
@@ -114,21 +127,40 @@ func (q *Query) predicateSQLClause(p predicate, first ...bool) (string, SQLParam
 	}
 
 	if p.isCond {
-		subSQL, subArgs := q.conditionSQLClause(p.cond)
+		subSQL, subArgs := q.conditionSQLClause(p.cond, having)
 		sql += fmt.Sprintf(`(%s) `, subSQL)
 		args = args.Extend(subArgs)
 		return sql, args
 	}
 
-	exprs := jsonizeExpr(q.recordSet.model, p.exprs)
-	fi := q.recordSet.model.getRelatedFieldInfo(strings.Join(exprs, ExprSep))
-	if fi.fieldType.IsFKRelationType() {
-		// If we have a relation type with a 0 as foreign key, we substitute for nil
-		if valInt, err := nbutils.CastToInteger(p.arg); err == nil && valInt == 0 {
-			p.arg = nil
+	var field string
+	if having {
+		field = q.aggregateFieldExpression(p.exprs)
+	} else {
+		exprs := jsonizeExpr(q.recordSet.model, p.exprs)
+		fi := q.recordSet.model.getRelatedFieldInfo(strings.Join(exprs, ExprSep))
+		q.checkArgModel(p, fi)
+		if fi.fieldType.IsFKRelationType() {
+			// If we have a relation type with a 0 as foreign key, we substitute for nil
+			if valInt, err := nbutils.CastToInteger(p.arg); err == nil && valInt == 0 {
+				p.arg = nil
+			}
 		}
+		p.arg = resolveRelativeDateArg(q.recordSet.env, fi, p.arg)
+		field = q.joinedFieldExpression(exprs)
+	}
+	if isNullValue(p.arg) {
+		// Typed nil pointers must be compared with IS NULL too,
+		// since "= NULL" never matches in SQL.
+		p.arg = nil
+	}
+	if subQuery, ok := p.arg.(*RecordCollection); ok {
+		opSql, _ := adapter.operatorSQL(p.operator, nil)
+		subSQL, subArgs := subQuery.subQuery()
+		sql += fmt.Sprintf(`%s %s `, field, strings.Replace(opSql, "?", subSQL, 1))
+		args = args.Extend(subArgs)
+		return sql, args
 	}
-	field := q.joinedFieldExpression(exprs)
 	if p.arg == nil {
 		switch p.operator {
 		case operator.Equals:
@@ -147,12 +179,103 @@ func (q *Query) predicateSQLClause(p predicate, first ...bool) (string, SQLParam
 	return sql, args
 }
 
+// aggregateFieldExpression returns the SQL expression of the given field
+// expressions in the HAVING clause of this grouped query, that is the grouped
+// column for grouped fields, the aggregate of the column for numeric fields
+// or the number of records of the group for GroupCount.
+func (q *Query) aggregateFieldExpression(exprs []string) string {
+	if len(exprs) == 1 && exprs[0] == GroupCount {
+		return "count(1)"
+	}
+	jsonExprs := jsonizeExpr(q.recordSet.model, exprs)
+	if !q.isAggregateExpression(jsonExprs) {
+		return q.joinedFieldExpression(jsonExprs)
+	}
+	path := strings.Join(jsonExprs, ExprSep)
+	fi := q.recordSet.model.getRelatedFieldInfo(path)
+	if fi.fieldType != fieldtype.Float && fi.fieldType != fieldtype.Integer {
+		log.Panic("HAVING conditions can only be set on grouped or numeric fields", "model", q.recordSet.model.name, "field", path)
+	}
+	return fmt.Sprintf("%s(%s)", fi.groupOperator, q.joinedFieldExpression(jsonExprs))
+}
+
+// isAggregateExpression returns true if the given field expression of this
+// grouped query is GroupCount or a field that is not grouped, and is thus
+// aggregated in the select clause.
+func (q *Query) isAggregateExpression(exprs []string) bool {
+	if len(exprs) == 1 && exprs[0] == GroupCount {
+		return true
+	}
+	path := strings.Join(exprs, ExprSep)
+	for _, group := range q.groups {
+		if jsonizePath(q.recordSet.model, group) == path {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregateOperator returns the SQL aggregate function of the given field
+// expression in this grouped query, or an empty string if it is grouped.
+// It panics if the field is neither grouped nor numeric.
+func (q *Query) aggregateOperator(exprs []string) string {
+	if !q.isAggregateExpression(exprs) {
+		return ""
+	}
+	path := strings.Join(exprs, ExprSep)
+	fi := q.recordSet.model.getRelatedFieldInfo(path)
+	if fi.fieldType != fieldtype.Float && fi.fieldType != fieldtype.Integer {
+		log.Panic("Grouped queries can only be ordered by grouped or numeric fields", "model", q.recordSet.model.name, "field", path)
+	}
+	return fi.groupOperator
+}
+
+// havingExpressions returns the expressions of the fields used in the
+// given HAVING condition, except GroupCount.
+func (q *Query) havingExpressions(c *Condition) [][]string {
+	var res [][]string
+	for _, p := range c.predicates {
+		if p.cond != nil {
+			res = append(res, q.havingExpressions(p.cond)...)
+		}
+		if len(p.exprs) == 0 || (len(p.exprs) == 1 && p.exprs[0] == GroupCount) {
+			continue
+		}
+		res = append(res, jsonizeExpr(q.recordSet.model, p.exprs))
+	}
+	return res
+}
+
+// checkArgModel panics if the argument of the given predicate on the given
+// field is a RecordSet whose model is not the model referenced by the field,
+// that is the related model for relation fields or the field's own model for
+// the id field.
+func (q *Query) checkArgModel(p predicate, fi *Field) {
+	if p.argModel == "" {
+		return
+	}
+	var expected string
+	switch {
+	case fi.isRelationField():
+		expected = fi.relatedModelName
+	case fi.json == "id":
+		expected = fi.model.name
+	default:
+		return
+	}
+	if p.argModel != expected {
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: q.recordSet.model.name},
+			"RecordSet argument does not match the model of the field", "field", fi.name,
+			"expected", expected, "model", p.argModel)
+	}
+}
+
 // sqlLimitClause returns the sql string for the LIMIT and OFFSET clauses
 // of this Query
 func (q *Query) sqlLimitOffsetClause() string {
 	var res string
-	if q.limit > 0 {
-		res = fmt.Sprintf(`LIMIT %d `, q.limit)
+	if limit := q.cappedLimit(); limit > 0 {
+		res = fmt.Sprintf(`LIMIT %d `, limit)
 	}
 	if q.offset > 0 {
 		res += fmt.Sprintf(`OFFSET %d`, q.offset)
@@ -160,22 +283,53 @@ func (q *Query) sqlLimitOffsetClause() string {
 	return res
 }
 
+// cappedLimit returns the limit of this Query, capped at its maximum limit.
+//
+// The maximum limit is the one of the Environment of the query, which is
+// only set for RPC calls, unless it has been overridden with
+// RecordCollection.WithMaxLimit. A negative maxLimit means no cap.
+//
+// If the limit has been set with RecordCollection.Limit, a zero limit is
+// capped too. Queries whose limit has never been set are not capped.
+func (q *Query) cappedLimit() int {
+	if !q.hasLimit {
+		return q.limit
+	}
+	maxLimit := q.maxLimit
+	if maxLimit == 0 && q.recordSet != nil && q.recordSet.env != nil {
+		maxLimit = q.recordSet.env.maxLimit
+	}
+	if maxLimit > 0 && (q.limit <= 0 || q.limit > maxLimit) {
+		return maxLimit
+	}
+	return q.limit
+}
+
 // sqlOrderByClause returns the sql string for the ORDER BY clause
 // of this Query
 func (q *Query) sqlOrderByClause() string {
 	var fExprs [][]string
-	directions := make([]string, len(q.orders))
-	for i, order := range q.orders {
-		fieldOrder := strings.Split(strings.TrimSpace(order), " ")
-		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(fieldOrder[0], ExprSep))
-		fExprs = append(fExprs, oExprs)
-		if len(fieldOrder) > 1 {
-			directions[i] = fieldOrder[1]
+	orders := q.orderExprs()
+	directions := make([]string, len(orders))
+	for i, order := range orders {
+		var path string
+		path, directions[i] = parseOrderExpr(order)
+		if path == GroupCount {
+			fExprs = append(fExprs, []string{GroupCount})
+			continue
 		}
+		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(path, ExprSep))
+		fExprs = append(fExprs, oExprs)
 	}
-	resSlice := make([]string, len(q.orders))
+	resSlice := make([]string, len(orders))
 	for i, field := range fExprs {
-		resSlice[i] = q.joinedFieldExpression(field)
+		switch {
+		case len(q.groups) > 0 && q.isAggregateExpression(field):
+			// Aggregates are ordered by their alias in the select clause
+			resSlice[i] = strings.Join(field, sqlSep)
+		default:
+			resSlice[i] = q.collatedExpression(field, q.joinedFieldExpression(field))
+		}
 		resSlice[i] += fmt.Sprintf(" %s", directions[i])
 	}
 	if len(resSlice) == 0 {
@@ -184,6 +338,56 @@ func (q *Query) sqlOrderByClause() string {
 	return fmt.Sprintf("ORDER BY %s", strings.Join(resSlice, ", "))
 }
 
+// orderExprs returns the ORDER BY expressions of this Query.
+//
+// Unless the query is grouped or already ordered by id, "id" is appended as a
+// last tie-breaker so that records with equal sort keys always come in the
+// same order. Otherwise, pages of a paginated search may overlap or skip
+// records.
+func (q *Query) orderExprs() []string {
+	if len(q.orders) == 0 || len(q.groups) > 0 {
+		return q.orders
+	}
+	for _, order := range q.orders {
+		path, _ := parseOrderExpr(order)
+		if jsonizePath(q.recordSet.model, path) == "id" {
+			return q.orders
+		}
+	}
+	res := make([]string, len(q.orders), len(q.orders)+1)
+	copy(res, q.orders)
+	return append(res, "id")
+}
+
+// parseOrderExpr parses the given ORDER BY expression, made of a field path
+// optionally followed by a direction (ASC or DESC) and by NULLS FIRST or
+// NULLS LAST. It returns the path and the SQL modifiers of the expression.
+// It panics if the expression is not valid.
+func parseOrderExpr(order string) (string, string) {
+	tokens := strings.Fields(order)
+	if len(tokens) == 0 {
+		log.Panic("Empty ORDER BY expression")
+	}
+	var modifiers []string
+	rest := tokens[1:]
+	if len(rest) > 0 {
+		if dir := strings.ToUpper(rest[0]); dir == "ASC" || dir == "DESC" {
+			modifiers = append(modifiers, dir)
+			rest = rest[1:]
+		}
+	}
+	if len(rest) == 2 && strings.ToUpper(rest[0]) == "NULLS" {
+		if nulls := strings.ToUpper(rest[1]); nulls == "FIRST" || nulls == "LAST" {
+			modifiers = append(modifiers, "NULLS", nulls)
+			rest = nil
+		}
+	}
+	if len(rest) > 0 {
+		log.Panic("Invalid ORDER BY expression", "expression", order)
+	}
+	return tokens[0], strings.Join(modifiers, " ")
+}
+
 // sqlGroupByClause returns the sql string for the GROUP BY clause
 // of this Query
 func (q *Query) sqlGroupByClause() string {
@@ -199,6 +403,20 @@ func (q *Query) sqlGroupByClause() string {
 	return fmt.Sprintf("GROUP BY %s", strings.Join(resSlice, ", "))
 }
 
+// sqlHavingClause returns the sql string and parameters corresponding to
+// the HAVING clause of this Query
+func (q *Query) sqlHavingClause() (string, SQLParams) {
+	if q.having == nil {
+		return "", SQLParams{}
+	}
+	q.having.evaluateArgFunctions(q.recordSet)
+	sql, args := q.conditionSQLClause(q.having, true)
+	if sql != "" {
+		sql = "HAVING " + sql
+	}
+	return sql, args
+}
+
 // deleteQuery returns the SQL query string and parameters to unlink
 // the rows pointed at by this Query object.
 func (q *Query) deleteQuery() (string, SQLParams) {
@@ -208,6 +426,13 @@ func (q *Query) deleteQuery() (string, SQLParams) {
 	return delQuery, args
 }
 
+// deleteReturningIdsQuery returns the SQL query string and parameters to
+// delete the rows pointed at by this Query object and return their ids.
+func (q *Query) deleteReturningIdsQuery() (string, SQLParams) {
+	sql, args := q.deleteQuery()
+	return sql + " RETURNING id", args
+}
+
 // insertQuery returns the SQL query string and parameters to insert
 // a row with the given data.
 func (q *Query) insertQuery(data FieldMap) (string, SQLParams) {
@@ -221,7 +446,8 @@ func (q *Query) insertQuery(data FieldMap) (string, SQLParams) {
 		i    int
 		sql  string
 	)
-	for field, value := range data {
+	for _, field := range sortedFieldMapKeys(q.recordSet.model, data) {
+		value := data[field]
 		fi := q.recordSet.model.fields.MustGet(field)
 		if fi.fieldType.IsFKRelationType() && !fi.required {
 			if _, ok := value.(*interface{}); ok {
@@ -243,6 +469,42 @@ func (q *Query) insertQuery(data FieldMap) (string, SQLParams) {
 	return sql, vals
 }
 
+// insertRowsQuery returns the SQL query string and parameters to insert
+// all the given rows in a single query. All rows must have the same fields.
+func (q *Query) insertRowsQuery(rows []FieldMap) (string, SQLParams) {
+	adapter := adapters[db.DriverName()]
+	if len(rows) == 0 {
+		log.Panic("No data given for insert")
+	}
+	var fields, cols []string
+	for _, field := range sortedFieldMapKeys(q.recordSet.model, rows[0]) {
+		if field == "id" {
+			continue
+		}
+		fields = append(fields, field)
+		cols = append(cols, q.recordSet.model.fields.MustGet(field).json)
+	}
+	var (
+		vals   SQLParams
+		tuples []string
+	)
+	placeholders := "(?" + strings.Repeat(", ?", len(fields)-1) + ")"
+	for _, row := range rows {
+		for _, field := range fields {
+			value := row[field]
+			if _, ok := value.(*interface{}); ok {
+				// We have a null fk field
+				value = nil
+			}
+			vals = append(vals, value)
+		}
+		tuples = append(tuples, placeholders)
+	}
+	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tableName, strings.Join(cols, ", "), strings.Join(tuples, ", "))
+	return sql, vals
+}
+
 // countQuery returns the SQL query string and parameters to count
 // the rows pointed at by this Query object.
 func (q *Query) countQuery() (string, SQLParams) {
@@ -303,6 +565,9 @@ func (q *Query) selectGroupQuery(fields map[string]string) (string, SQLParams) {
 		i++
 	}
 	fieldExprs, allExprs := q.selectData(fieldsList)
+	if q.having != nil {
+		allExprs = append(allExprs, q.havingExpressions(q.having)...)
+	}
 	// Build up the query
 	// Fields
 	fieldsSQL := q.fieldsGroupSQL(fieldExprs, fields)
@@ -312,9 +577,11 @@ func (q *Query) selectGroupQuery(fields map[string]string) (string, SQLParams) {
 	whereSQL, args := q.sqlWhereClause()
 	// Group by clause
 	groupSQL := q.sqlGroupByClause()
+	havingSQL, havingArgs := q.sqlHavingClause()
+	args = args.Extend(havingArgs)
 	orderSQL := q.sqlOrderByClause()
 	limitSQL := q.sqlLimitOffsetClause()
-	selQuery := fmt.Sprintf(`SELECT DISTINCT %s FROM %s %s %s %s %s`, fieldsSQL, tablesSQL, whereSQL, groupSQL, orderSQL, limitSQL)
+	selQuery := fmt.Sprintf(`SELECT DISTINCT %s FROM %s %s %s %s %s %s`, fieldsSQL, tablesSQL, whereSQL, groupSQL, havingSQL, orderSQL, limitSQL)
 	selQuery = strutils.Substitute(selQuery, joinsMap)
 	return selQuery, args
 }
@@ -355,10 +622,10 @@ func (q *Query) updateQuery(data FieldMap) (string, SQLParams) {
 		i   int
 		sql string
 	)
-	for k, v := range data {
+	for _, k := range sortedFieldMapKeys(q.recordSet.model, data) {
 		fi := q.recordSet.model.fields.MustGet(k)
 		cols[i] = fmt.Sprintf("%s = ?", fi.json)
-		vals[i] = v
+		vals[i] = data[k]
 		i++
 	}
 	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
@@ -369,17 +636,57 @@ func (q *Query) updateQuery(data FieldMap) (string, SQLParams) {
 	return sql, vals
 }
 
+// resequenceQuery returns the SQL update string and parameters to set the
+// given field of the rows pointed at by this Query object to their position
+// in orderedIds, starting at 1. Other fields of data are set to the same
+// value for all rows.
+func (q *Query) resequenceQuery(fi *Field, orderedIds []int64, data FieldMap) (string, SQLParams) {
+	adapter := adapters[db.DriverName()]
+	cases := make([]string, len(orderedIds))
+	vals := make(SQLParams, 0, 2*len(orderedIds)+len(data))
+	for i, id := range orderedIds {
+		cases[i] = "WHEN ? THEN ?"
+		vals = append(vals, id, i+1)
+	}
+	cols := []string{fmt.Sprintf("%s = CASE id %s END", fi.json, strings.Join(cases, " "))}
+	for _, k := range sortedFieldMapKeys(q.recordSet.model, data) {
+		f := q.recordSet.model.fields.MustGet(k)
+		cols = append(cols, fmt.Sprintf("%s = ?", f.json))
+		vals = append(vals, data[k])
+	}
+	tableName := adapter.quoteTableName(q.recordSet.model.tableName)
+	whereSQL, args := q.sqlWhereClause()
+	sql := fmt.Sprintf("UPDATE %s SET %s %s", tableName, strings.Join(cols, ", "), whereSQL)
+	vals = append(vals, args...)
+	return sql, vals
+}
+
 // fieldsSQL returns the SQL string for the given field expressions
 // parameter must be with the following format (column names):
 // [['user_id', 'name'] ['id'] ['profile_id', 'age']]
 func (q *Query) fieldsSQL(fieldExprs [][]string) string {
 	fStr := make([]string, len(fieldExprs))
 	for i, field := range fieldExprs {
-		fStr[i] = q.joinedFieldExpression(field, true)
+		fStr[i] = fmt.Sprintf("%s AS %s", q.collatedExpression(field, q.joinedFieldExpression(field)), strings.Join(field, sqlSep))
 	}
 	return strings.Join(fStr, ", ")
 }
 
+// collatedExpression returns the given SQL expression of the field pointed at
+// by exprs with the collation of this Query, if it has one and if the field is
+// a text field. Selected fields and ORDER BY expressions must be collated alike
+// for SELECT DISTINCT queries.
+func (q *Query) collatedExpression(exprs []string, sql string) string {
+	if q.collation == "" {
+		return sql
+	}
+	switch q.recordSet.model.getRelatedFieldInfo(strings.Join(exprs, ExprSep)).fieldType {
+	case fieldtype.Char, fieldtype.Text, fieldtype.HTML, fieldtype.Selection:
+		return fmt.Sprintf(`%s COLLATE "%s"`, sql, q.collation)
+	}
+	return sql
+}
+
 // fieldsGroupSQL returns the SQL string for the given field expressions
 // in a select query with a GROUP BY clause.
 // Parameter must be with the following format (column names):
@@ -387,12 +694,16 @@ func (q *Query) fieldsSQL(fieldExprs [][]string) string {
 func (q *Query) fieldsGroupSQL(fieldExprs [][]string, fields map[string]string) string {
 	fStr := make([]string, len(fieldExprs)+1)
 	for i, exprs := range fieldExprs {
-		aggFnct := fields[strings.Join(exprs, ExprSep)]
+		aggFnct, ok := fields[strings.Join(exprs, ExprSep)]
+		if !ok {
+			// This is a field of the order by clause
+			aggFnct = q.aggregateOperator(exprs)
+		}
 		joins := q.generateTableJoins(exprs)
 		lastJoin := joins[len(joins)-1]
 		fStr[i] = fmt.Sprintf("%s(%s.%s) AS %s", aggFnct, lastJoin.alias, lastJoin.expr, strings.Join(exprs, sqlSep))
 	}
-	fStr[len(fieldExprs)] = "count(1) AS __count"
+	fStr[len(fieldExprs)] = fmt.Sprintf("count(1) AS %s", GroupCount)
 	return strings.Join(fStr, ", ")
 }
 
@@ -565,7 +876,7 @@ func (q *Query) sideDataIsEmpty() bool {
 func (q *Query) substituteConditionExprs(substMap map[string][]string) {
 	q.cond.substituteExprs(q.recordSet.model, substMap)
 	for i, order := range q.orders {
-		orderPath := strings.Split(strings.TrimSpace(order), " ")[0]
+		orderPath, _ := parseOrderExpr(order)
 		jsonPath := jsonizePath(q.recordSet.model, orderPath)
 		for k, v := range substMap {
 			if jsonPath == k {
@@ -591,8 +902,12 @@ func (q *Query) getAllExpressions() [][]string {
 // getOrderByExpressions returns all expressions used in order by clause of this query.
 func (q *Query) getOrderByExpressions() [][]string {
 	var exprs [][]string
-	for _, order := range q.orders {
-		orderField := strings.Split(strings.TrimSpace(order), " ")[0]
+	for _, order := range q.orderExprs() {
+		orderField, _ := parseOrderExpr(order)
+		if orderField == GroupCount {
+			// GroupCount is always in the select clause of grouped queries
+			continue
+		}
 		oExprs := jsonizeExpr(q.recordSet.model, strings.Split(orderField, ExprSep))
 		exprs = append(exprs, oExprs)
 	}
@@ -0,0 +1,49 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+// A QueryInterceptor receives each SQL query with its arguments just before
+// it is sent to the database and returns the query to execute instead. It can
+// be used for cross-cutting concerns such as tagging queries with a comment
+// for pg_stat_statements.
+//
+// The query has already its placeholders rebound for the database driver.
+// Interceptors must not modify the semantics of the query nor the number of
+// its placeholders, since the arguments are passed unchanged. They are called
+// synchronously from the goroutine executing the query, so they must be fast
+// and safe for concurrent use.
+type QueryInterceptor func(query string, args []interface{}) string
+
+// queryInterceptors are the QueryInterceptor functions in registration order
+var queryInterceptors []QueryInterceptor
+
+// RegisterQueryInterceptor adds the given QueryInterceptor to the list of
+// interceptors called on each query. Interceptors are called in the order
+// they have been registered, each one receiving the query returned by the
+// previous one.
+//
+// This function must be called at startup before any transaction is opened.
+func RegisterQueryInterceptor(interceptor QueryInterceptor) {
+	queryInterceptors = append(queryInterceptors, interceptor)
+}
+
+// interceptQuery returns the given query rewritten by all the registered
+// QueryInterceptor functions.
+func interceptQuery(query string, args []interface{}) string {
+	for _, interceptor := range queryInterceptors {
+		query = interceptor(query, args)
+	}
+	return query
+}
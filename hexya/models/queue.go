@@ -0,0 +1,321 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// States of the QueueJob records
+const (
+	QueueJobPending = "pending"
+	QueueJobDone    = "done"
+	QueueJobFailed  = "failed"
+)
+
+// DefaultQueueJobMaxRetries is the number of times a failed queue job
+// is retried before being marked as failed.
+var DefaultQueueJobMaxRetries int64 = 3
+
+// declareQueueModel creates the QueueJob model which stores the method
+// calls enqueued with Enqueue until they are executed by a worker.
+func declareQueueModel() {
+	queueJob := createModel("QueueJob", SystemModel)
+	queueJob.InheritModel(Registry.MustGet("CommonMixin"))
+	queueJob.AddFields(map[string]FieldDefinition{
+		"ResModel": CharField{Required: true},
+		"ResIDs":   TextField{},
+		"Method":   CharField{Required: true},
+		"Args":     TextField{},
+		"UID":      IntegerField{},
+		"State": SelectionField{Selection: types.Selection{
+			QueueJobPending: "Pending",
+			QueueJobDone:    "Done",
+			QueueJobFailed:  "Failed",
+		}, Index: true},
+		"Priority":   IntegerField{Index: true},
+		"ETA":        DateTimeField{},
+		"DedupKey":   CharField{Index: true},
+		"MaxRetries": IntegerField{},
+		"Attempts":   IntegerField{},
+		"Error":      TextField{},
+		"Date":       DateTimeField{},
+		"DoneDate":   DateTimeField{},
+	})
+	queueJob.SetDefaultOrder("id")
+}
+
+// DelayOptions are the options of the queue jobs enqueued with WithDelay.
+type DelayOptions struct {
+	// Priority of the job. Jobs with a higher priority are executed first.
+	Priority int64
+	// ETA is the time before which the job must not be executed.
+	// The job can be executed at once if ETA is zero.
+	ETA dates.DateTime
+	// MaxRetries is the number of times the job is retried if it fails.
+	// 0 means DefaultQueueJobMaxRetries and a negative value no retry.
+	MaxRetries int64
+	// DedupKey identifies duplicate jobs. If a pending job with the same
+	// DedupKey already exists, no new job is enqueued.
+	DedupKey string
+}
+
+// A DelayedRecordCollection enqueues the method calls on its
+// RecordCollection in the job queue instead of executing them.
+type DelayedRecordCollection struct {
+	rc      *RecordCollection
+	options DelayOptions
+}
+
+// WithDelay returns a DelayedRecordCollection whose method calls are
+// enqueued in the job queue with the given options, instead of being
+// executed immediately.
+func (rc *RecordCollection) WithDelay(opts ...DelayOptions) *DelayedRecordCollection {
+	var options DelayOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	return &DelayedRecordCollection{rc: rc, options: options}
+}
+
+// Call enqueues a call to the method methName of the RecordCollection with
+// the given args and returns the id of the queue job. See Enqueue for details.
+//
+// If a pending job with the same DedupKey already exists, its id is returned
+// instead and no new job is enqueued.
+func (drc *DelayedRecordCollection) Call(methName string, args ...interface{}) int64 {
+	return drc.rc.enqueue(drc.options, methName, args)
+}
+
+// Enqueue stores a call to the method methName of this RecordCollection with
+// the given args in the job queue, in the transaction of this RecordCollection,
+// and returns the id of the queue job. The Environment is flushed beforehand,
+// so that records created in cache can be enqueued.
+//
+// The method is executed later by RunQueueJobs, on the same records, in a new
+// Environment for the current user. Arguments are serialized to JSON:
+// RecordSets are stored as their ids, Conditioners as domains and FieldMappers
+// as FieldMaps. They are decoded against the parameter types of the method
+// as with CallJSON.
+//
+// It panics if the method does not exist or if the arguments do not match its
+// parameters, so that errors are detected when enqueuing the job.
+func (rc *RecordCollection) Enqueue(methName string, args ...interface{}) int64 {
+	return rc.enqueue(DelayOptions{}, methName, args)
+}
+
+// enqueue stores a call to the method methName of this RecordCollection with
+// the given args in the job queue, with the given options.
+func (rc *RecordCollection) enqueue(options DelayOptions, methName string, args []interface{}) int64 {
+	methType := rc.MethodType(methName)
+	rawArgs, err := encodeJSONArgs(args)
+	if err == nil {
+		_, err = rc.decodeJSONArgs(methType, rawArgs)
+	}
+	if err != nil {
+		log.Panic("Invalid method arguments", "model", rc.ModelName(), "method", methName, "error", err)
+	}
+	data, err := json.Marshal(rawArgs)
+	if err != nil {
+		log.Panic("Unable to serialize method arguments", "model", rc.ModelName(), "method", methName, "error", err)
+	}
+	if options.DedupKey != "" {
+		if _, err := rc.env.AdvisoryLock("queue-dedup:" + options.DedupKey); err != nil {
+			log.Panic("Unable to acquire queue job dedup lock", "key", options.DedupKey, "error", err)
+		}
+		queueModel := Registry.MustGet("QueueJob")
+		existing := rc.env.Pool("QueueJob").Sudo().Search(queueModel.Field("DedupKey").Equals(options.DedupKey).
+			And().Field("State").Equals(QueueJobPending)).Limit(1)
+		if !existing.IsEmpty() {
+			return existing.ids[0]
+		}
+	}
+	maxRetries := options.MaxRetries
+	switch {
+	case maxRetries == 0:
+		maxRetries = DefaultQueueJobMaxRetries
+	case maxRetries < 0:
+		maxRetries = 0
+	}
+	rc.env.Flush()
+	ids, _ := json.Marshal(rc.persistedIds())
+	values := FieldMap{
+		"ResModel":   rc.ModelName(),
+		"ResIDs":     string(ids),
+		"Method":     methName,
+		"Args":       string(data),
+		"UID":        rc.env.uid,
+		"State":      QueueJobPending,
+		"Priority":   options.Priority,
+		"MaxRetries": maxRetries,
+		"Attempts":   0,
+		"Date":       dates.Now(),
+	}
+	if options.DedupKey != "" {
+		values["DedupKey"] = options.DedupKey
+	}
+	if !options.ETA.IsZero() {
+		values["ETA"] = options.ETA
+	}
+	sql, sqlArgs := rc.env.Pool("QueueJob").query.insertQuery(values)
+	var jobID int64
+	rc.env.cr.Get(&jobID, sql, sqlArgs...)
+	return jobID
+}
+
+// encodeJSONArgs encodes the given method arguments to JSON so that they can
+// be decoded with decodeJSONArgs.
+func encodeJSONArgs(args []interface{}) ([]json.RawMessage, error) {
+	res := make([]json.RawMessage, len(args))
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case RecordSet:
+			arg = a.Ids()
+		case Conditioner:
+			arg = a.Underlying().Serialize()
+		case FieldMapper:
+			fMap := a.FieldMap()
+			for k, v := range fMap {
+				if rs, ok := v.(RecordSet); ok {
+					fMap[k] = rs.Ids()
+				}
+			}
+			arg = fMap
+		}
+		data, err := json.Marshal(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		res[i] = data
+	}
+	return res, nil
+}
+
+// RunQueueJobs executes at most limit pending queue jobs whose ETA is passed,
+// by decreasing priority and in the order they have been enqueued, and returns
+// the number of jobs that have been executed successfully.
+//
+// Each job is executed in a new Environment for the user who enqueued it with
+// ExecuteInNewEnvironment, so that the transaction is retried on serialization
+// errors and deadlocks. The job is marked as done in the same transaction. A
+// job that fails is retried by the next runs until it has failed MaxRetries
+// times more, after which it is marked as failed.
+//
+// Jobs being executed by another worker are skipped.
+func RunQueueJobs(limit int) int {
+	var ids []int64
+	ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		queueModel := Registry.MustGet("QueueJob")
+		ids = env.Pool("QueueJob").Search(queueModel.Field("State").Equals(QueueJobPending).
+			AndCond(queueModel.Field("ETA").IsNull().Or().Field("ETA").LowerOrEqual(dates.Now()))).
+			OrderBy("Priority DESC", "ID").Limit(limit).Ids()
+	})
+	var done int
+	for _, id := range ids {
+		if runQueueJob(id) {
+			done++
+		}
+	}
+	return done
+}
+
+// RunQueueWorker executes the pending queue jobs by batches of batchSize,
+// polling for new jobs every pollInterval, until ctx is done.
+func RunQueueWorker(ctx context.Context, batchSize int, pollInterval time.Duration) {
+	for {
+		for ctx.Err() == nil {
+			if RunQueueJobs(batchSize) == 0 {
+				break
+			}
+		}
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// runQueueJob executes the queue job with the given id and returns
+// true if it has been executed successfully.
+func runQueueJob(id int64) bool {
+	var (
+		uid      int64
+		executed bool
+	)
+	ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		uid = env.Pool("QueueJob").Browse(id).Get("UID").(int64)
+	})
+	if uid == 0 {
+		uid = security.SuperUserID
+	}
+	err := ExecuteInNewEnvironment(uid, func(env Environment) {
+		executed = false
+		_, acquired, err := env.TryAdvisoryLock(fmt.Sprintf("queue-job:%d", id))
+		if err != nil {
+			log.Panic("Unable to acquire queue job lock", "job", id, "error", err)
+		}
+		jobRS := env.Pool("QueueJob").Sudo().Browse(id)
+		if !acquired || jobRS.Get("State") != QueueJobPending {
+			return
+		}
+		var (
+			ids     []int64
+			rawArgs []json.RawMessage
+		)
+		if err := json.Unmarshal([]byte(jobRS.Get("ResIDs").(string)), &ids); err != nil {
+			log.Panic("Unable to decode queue job records", "job", id, "error", err)
+		}
+		if err := json.Unmarshal([]byte(jobRS.Get("Args").(string)), &rawArgs); err != nil {
+			log.Panic("Unable to decode queue job arguments", "job", id, "error", err)
+		}
+		rs := env.Pool(jobRS.Get("ResModel").(string))
+		if len(ids) > 0 {
+			rs = rs.Browse(ids...)
+		}
+		if _, err := rs.callMultiJSON(jobRS.Get("Method").(string), rawArgs); err != nil {
+			log.Panic("Unable to decode queue job arguments", "job", id, "error", err)
+		}
+		jobRS.Set("State", QueueJobDone)
+		jobRS.Set("DoneDate", dates.Now())
+		executed = true
+	})
+	if err == nil {
+		return executed
+	}
+	log.Warn("Queue job failed", "job", id, "error", err)
+	ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+		jobRS := env.Pool("QueueJob").Browse(id)
+		attempts := jobRS.Get("Attempts").(int64) + 1
+		values := FieldMap{
+			"Attempts": attempts,
+			"Error":    err.Error(),
+		}
+		if attempts > jobRS.Get("MaxRetries").(int64) {
+			values["State"] = QueueJobFailed
+		}
+		jobRS.Call("Write", values)
+	})
+	return false
+}
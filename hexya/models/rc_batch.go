@@ -0,0 +1,182 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import "github.com/hexya-erp/hexya/hexya/tools/logging"
+
+// batchCondition returns the condition matching all the records of this
+// RecordCollection, to be iterated on with BatchIterate.
+func (rc *RecordCollection) batchCondition() *Condition {
+	if rc.fetched {
+		ids := rc.persistedIds()
+		if len(ids) == 0 {
+			return nil
+		}
+		return rc.model.Field("ID").In(ids)
+	}
+	if rc.query.isEmpty() {
+		return nil
+	}
+	if rc.query.cond.IsEmpty() {
+		return rc.model.Field("ID").Greater(0)
+	}
+	return rc.query.cond
+}
+
+// nextBatchIds returns the ids of at most size records of the given model
+// in the given environment matching cond, and whose id is greater than lastID.
+func nextBatchIds(env Environment, modelName string, cond *Condition, lastID int64, size int) []int64 {
+	pool := env.Pool(modelName)
+	return pool.Search(cond).Search(pool.model.Field("ID").Greater(lastID)).
+		OrderBy("ID").WithMaxLimit(0).Limit(size).Ids()
+}
+
+// BatchIterate calls fn with the records of this RecordCollection by batches
+// of at most batchSize records, in ascending id order. This is meant to process
+// a large number of records with a bounded memory usage.
+//
+// Batches are paged through by id, so that records processed by fn may be
+// modified without shifting the next batches. The order, limit and offset of
+// this RecordCollection are ignored. The cache of the Environment is flushed
+// and cleared after each batch.
+//
+// If fn returns an error, the iteration stops and a *BatchError wrapping it
+// is returned, with the number of records that have been processed before.
+func (rc *RecordCollection) BatchIterate(batchSize int, fn func(RecordSet) error) error {
+	if batchSize <= 0 {
+		log.Panic("Batch size must be strictly positive", "model", rc.ModelName(), "batchSize", batchSize)
+	}
+	rc.env.Flush()
+	cond := rc.batchCondition()
+	if cond == nil {
+		return nil
+	}
+	var (
+		processed int
+		lastID    int64
+	)
+	for {
+		ids := nextBatchIds(*rc.env, rc.ModelName(), cond, lastID, batchSize)
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := fn(rc.env.Pool(rc.ModelName()).Browse(ids...)); err != nil {
+			return &BatchError{Processed: processed, LastID: lastID, Err: err}
+		}
+		processed += len(ids)
+		lastID = ids[len(ids)-1]
+		rc.env.Flush()
+		rc.env.cache.clear()
+	}
+}
+
+// BatchIterateCommit calls fn with the records of this RecordCollection by
+// batches like BatchIterate, but each batch is processed in its own Environment
+// and transaction, which is committed at the end of the batch. The new
+// Environments have the user and the context of this RecordCollection.
+//
+// If fn returns an error or panics, the transaction of its batch is rolled back
+// and a *BatchError is returned. The previous batches remain committed.
+//
+// Since batches are processed in other transactions, they would not see the
+// uncommitted changes of this RecordCollection's Environment and could wait
+// for the locks of its transaction forever. BatchIterateCommit therefore panics
+// if this Environment has created records or written to the database. Other
+// pending changes in its cache are neither flushed nor seen by the batches.
+func (rc *RecordCollection) BatchIterateCommit(batchSize int, fn func(RecordSet) error) error {
+	if batchSize <= 0 {
+		log.Panic("Batch size must be strictly positive", "model", rc.ModelName(), "batchSize", batchSize)
+	}
+	rc.checkNoUncommittedWrites()
+	cond := rc.batchCondition()
+	if cond == nil {
+		return nil
+	}
+	var (
+		processed int
+		lastID    int64
+	)
+	for {
+		var (
+			ids   []int64
+			fnErr error
+		)
+		err := ExecuteInNewEnvironmentCtx(rc.env.cr.ctx, rc.env.uid, func(env Environment) {
+			env.context = rc.env.context.Copy()
+			ids = nextBatchIds(env, rc.ModelName(), cond, lastID, batchSize)
+			if len(ids) == 0 {
+				return
+			}
+			if fnErr = fn(env.Pool(rc.ModelName()).Browse(ids...)); fnErr != nil {
+				log.PanicWithError(fnErr, "Batch processing failed", "model", rc.ModelName(), "lastID", lastID)
+			}
+		})
+		if fnErr != nil {
+			err = fnErr
+		}
+		if err != nil {
+			return &BatchError{Processed: processed, LastID: lastID, Err: err}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		processed += len(ids)
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// checkNoUncommittedWrites panics if the Environment of this RecordCollection
+// has records to create or if its transaction has written to the database.
+func (rc *RecordCollection) checkNoUncommittedWrites() {
+	var hasWrites bool
+	rc.env.cr.Get(&hasWrites, adapters[db.DriverName()].transactionHasWrites())
+	if hasWrites || len(rc.env.cache.scheduledInsert) > 0 {
+		log.Panic("BatchIterateCommit must not be called in an Environment with uncommitted changes",
+			"model", rc.ModelName(), "uid", rc.env.uid)
+	}
+}
+
+// CreateMany creates a record from each element of data by calling the Create
+// method, and returns the ids of the created records in the order of data, so
+// that each record can be matched with the element it has been created from.
+// The Environment is flushed, so that the returned ids are database ids.
+//
+// Records are created inside a savepoint of the Environment's transaction: if
+// the creation of one of them fails, none of them is created and the error is
+// returned.
+func (rc *RecordCollection) CreateMany(data []FieldMapper) (ids []int64, rError error) {
+	cacheCopy := rc.env.cache.copy()
+	savepoint := rc.env.cr.savepoint()
+	defer func() {
+		if r := recover(); r != nil {
+			rc.env.cr.rollbackToSavepoint(savepoint)
+			*rc.env.cache = *cacheCopy
+			ids = nil
+			rError = logging.LogPanicData(r)
+			return
+		}
+		rc.env.cr.releaseSavepoint(savepoint)
+	}()
+	created := make([]*RecordCollection, len(data))
+	for i, values := range data {
+		created[i] = rc.Call("Create", values).(RecordSet).Collection()
+	}
+	rc.env.Flush()
+	ids = make([]int64, len(data))
+	for i, rec := range created {
+		ids[i] = rec.persistedIds()[0]
+	}
+	return ids, nil
+}
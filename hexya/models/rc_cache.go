@@ -10,6 +10,35 @@ func (rc *RecordCollection) createInCache(data FieldMapper) int64 {
 	return id.id
 }
 
+// Flush writes to the database the pending inserts and updates of the
+// records of this RecordCollection, without committing the transaction.
+// Pending changes of other records are left in the cache.
+func (rc *RecordCollection) Flush() {
+	for _, id := range rc.Ids() {
+		ref := rc.getCacheRef(id)
+		rc.env.insertData(ref)
+		rc.env.updateData(ref)
+	}
+}
+
+// persistedIds returns the ids of this RecordCollection in which the ids of the
+// records created in cache are replaced by the ids they have been inserted with.
+// It panics if some of the records have not been inserted in the database yet.
+func (rc *RecordCollection) persistedIds() []int64 {
+	res := make([]int64, len(rc.ids))
+	for i, id := range rc.ids {
+		ref := rc.getCacheRef(id)
+		if rc.env.cache.isNotInDb(ref) {
+			log.Panic("Record has not been inserted in the database yet", "model", rc.ModelName(), "id", id)
+		}
+		res[i] = id
+		if id < 0 {
+			res[i] = rc.env.cache.scheduledInsert[ref].id
+		}
+	}
+	return res
+}
+
 func (rc *RecordCollection) getCacheRef(id int64) cacheRef {
 	return cacheRef{model: rc.model, id: id}
 }
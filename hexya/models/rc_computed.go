@@ -16,7 +16,6 @@ package models
 
 import (
 	"github.com/hexya-erp/hexya/hexya/models/security"
-	"github.com/hexya-erp/hexya/hexya/tools/typesutils"
 )
 
 // computeFieldValues updates the given params with the given computed (non stored) fields
@@ -112,18 +111,118 @@ func updateStoredFields(recs *RecordCollection, computeMethod string) {
 			}
 		}
 		if doUpdate {
-			rec.WithContext("hexya_force_compute_write", true).Call("Write", vals, toUnset)
+			rec.WithReadOnlyWrite().WithContext("hexya_force_compute_write", true).Call("Write", vals, toUnset)
 		}
 	}
 }
 
+// recomputeBatchSize is the number of records that are
+// recomputed together by Recompute.
+const recomputeBatchSize = 1000
+
+// Recompute runs again the compute methods of the given stored computed
+// fields on the records of this RecordCollection and writes the values that
+// changed. If no field is given, all the stored computed fields of the model
+// are recomputed. Fields that depend on other recomputed fields are computed
+// after them.
+//
+// It returns the number of records that have been updated.
+func (rc *RecordCollection) Recompute(fields ...string) int64 {
+	fInfos := rc.model.fields.computedStoredFields
+	if len(fields) > 0 {
+		fInfos = make([]*Field, len(fields))
+		for i, field := range fields {
+			fi := rc.model.fields.MustGet(field)
+			if !fi.isComputedField() || !fi.stored {
+				log.Panic("Field is not a stored computed field", "model", rc.model.name, "field", field)
+			}
+			fInfos[i] = fi
+		}
+	}
+	fInfos = sortByDependencies(fInfos)
+	updated := make(map[int64]bool)
+	ids := rc.Fetch().Ids()
+	for start := 0; start < len(ids); start += recomputeBatchSize {
+		end := start + recomputeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		for _, rec := range rc.Browse(ids[start:end]...).Records() {
+			if rec.recomputeFields(fInfos) {
+				updated[rec.ids[0]] = true
+			}
+		}
+	}
+	return int64(len(updated))
+}
+
+// recomputeFields calls the compute methods of the given stored fields on this
+// record and writes the values that changed. It returns true if the record has
+// been updated. This RecordCollection must be a singleton.
+func (rc *RecordCollection) recomputeFields(fInfos []*Field) bool {
+	var res bool
+	done := make(map[string]bool)
+	for _, fi := range fInfos {
+		if done[fi.compute] {
+			continue
+		}
+		done[fi.compute] = true
+		retVal := rc.CallMulti(fi.compute)
+		toUnset := retVal[1].([]FieldNamer)
+		vals := make(FieldMap)
+		for f, v := range retVal[0].(FieldMapper).FieldMap(toUnset...) {
+			cfi, ok := rc.model.fields.Get(f)
+			if !ok || !cfi.isComputedField() || !cfi.isStored() {
+				continue
+			}
+			vals[f] = v
+		}
+		changed := rc.changedFields(vals)
+		if len(changed) == 0 {
+			continue
+		}
+		rc.WithReadOnlyWrite().WithContext("hexya_force_compute_write", true).Call("Write", changed)
+		res = true
+	}
+	return res
+}
+
+// sortByDependencies returns the given fields sorted so that each field
+// comes after the fields of the list it depends on.
+func sortByDependencies(fInfos []*Field) []*Field {
+	inList := make(map[string]*Field)
+	for _, fi := range fInfos {
+		inList[fi.name] = fi
+		inList[fi.json] = fi
+	}
+	res := make([]*Field, 0, len(fInfos))
+	visited := make(map[*Field]bool)
+	var visit func(fi *Field)
+	visit = func(fi *Field) {
+		if visited[fi] {
+			return
+		}
+		visited[fi] = true
+		for _, dep := range fi.depends {
+			if depFi, ok := inList[dep]; ok {
+				visit(depFi)
+			}
+		}
+		res = append(res, fi)
+	}
+	for _, fi := range fInfos {
+		visit(fi)
+	}
+	return res
+}
+
 // processInverseMethods executes inverse methods of fields in the given
 // FieldMap if it exists. It returns a new FieldMap to be used by Create/Write
 // instead of the original one.
 func (rc *RecordCollection) processInverseMethods(fMap FieldMap) {
 	for fieldName := range fMap {
 		fi := rc.model.getRelatedFieldInfo(fieldName)
-		if !fi.isComputedField() || rc.Env().Context().HasKey("hexya_force_compute_write") {
+		if !fi.isComputedField() || rc.Env().Context().GetBool("hexya_force_compute_write") {
 			continue
 		}
 		val, exists := fMap.Get(fi.json, fi.model)
@@ -131,14 +230,23 @@ func (rc *RecordCollection) processInverseMethods(fMap FieldMap) {
 			continue
 		}
 		if fi.inverse == "" {
-			if rc.Env().Context().GetBool("hexya_allow_without_inverse") {
-				continue
-			}
-			if typesutils.IsZero(val) {
-				continue
-			}
-			log.Panic("Trying to write a computed field without inverse method", "model", rc.model.name, "field", fieldName)
+			// Values of computed fields without inverse method have
+			// already been rejected or allowed by checkWritable.
+			continue
 		}
 		rc.CallMulti(fi.inverse, val)
 	}
 }
+
+// getSQLGenerated returns the value of the given field generated by the
+// database for the first record of this RecordCollection. The pending
+// changes of the record are flushed first, so that the value is computed
+// by the database from up to date data.
+func (rc *RecordCollection) getSQLGenerated(fi *Field) interface{} {
+	rec := rc.withIds(rc.ids[:1])
+	rec.Flush()
+	if !rc.env.cache.checkIfInCache(rc.model, rec.ids, []string{fi.json}) {
+		rc.env.Pool(rc.ModelName()).withIds(rec.persistedIds()).Load(fi.name)
+	}
+	return rc.env.cache.get(rc.model, rec.ids[0], fi.json)
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import "strings"
+
+// DisplayNames returns the result of NameGet for each record of this
+// RecordCollection, indexed by id.
+//
+// For models with a DisplayName field, the names are computed with
+// ComputeDisplayNames and read from the cache. Otherwise, the records are
+// loaded with a single query beforehand, so that NameGet finds their fields
+// in the cache instead of querying records one by one.
+func (rc *RecordCollection) DisplayNames() map[int64]string {
+	res := make(map[int64]string)
+	if rc.IsEmpty() {
+		return res
+	}
+	if fi, ok := rc.model.fields.Get("DisplayName"); ok && fi.isComputedField() {
+		rc.ComputeDisplayNames()
+		for _, id := range rc.Ids() {
+			res[id], _ = rc.env.cache.get(rc.model, id, fi.json).(string)
+		}
+		return res
+	}
+	for _, rec := range rc.Records() {
+		res[rec.ids[0]] = rec.Call("NameGet").(string)
+	}
+	return res
+}
+
+// ComputeDisplayNames computes the DisplayName field of the records of this
+// RecordCollection that do not have it in cache yet and stores it in the
+// cache, where it is read from until one of the fields it depends on is
+// modified. It returns this RecordCollection.
+//
+// The fields the DisplayName depends on are loaded with a single query for
+// all the records beforehand. By default, DisplayName depends on the Name
+// field of the model, if any, unless NameGet has been overridden. Models
+// that override NameGet should declare the fields it uses with SetDepends
+// on their DisplayName field.
+func (rc *RecordCollection) ComputeDisplayNames() *RecordCollection {
+	fi, ok := rc.model.fields.Get("DisplayName")
+	if !ok || !fi.isComputedField() || rc.IsEmpty() {
+		return rc
+	}
+	var toCompute []int64
+	for _, id := range rc.Ids() {
+		if !rc.env.cache.checkIfInCache(rc.model, []int64{id}, []string{fi.json}) {
+			toCompute = append(toCompute, id)
+		}
+	}
+	if len(toCompute) == 0 {
+		return rc
+	}
+	var depends []string
+	for _, dep := range fi.depends {
+		if dep != "" && !strings.Contains(dep, ExprSep) {
+			depends = append(depends, dep)
+		}
+	}
+	if len(depends) > 0 && !rc.env.cache.checkIfInCache(rc.model, toCompute, depends) {
+		rc.env.Pool(rc.ModelName()).withIds(toCompute).Load(depends...)
+	}
+	for _, id := range toCompute {
+		rc.env.Pool(rc.ModelName()).withIds([]int64{id}).Get(fi.name)
+	}
+	return rc
+}
+
+// ReadDisplay reads the given fields of the records of this RecordCollection
+// like Read, but returns relation fields as display values: a FieldMap with
+// "id" and "name" keys for many2one and one2one fields, or nil if they are
+// empty, and a slice of such FieldMaps for one2many and many2many fields.
+//
+// Names are resolved with DisplayNames, i.e. with a single query per related
+// model for all the relation fields of all the records.
+func (rc *RecordCollection) ReadDisplay(fields []string) []FieldMap {
+	res := rc.Call("Read", fields).([]FieldMap)
+	relFields := make(map[string]*Field)
+	relIds := make(map[string][]int64)
+	for _, f := range fields {
+		fi := rc.model.getRelatedFieldInfo(f)
+		if !fi.fieldType.IsRelationType() {
+			continue
+		}
+		relFields[f] = fi
+		for _, line := range res {
+			if rs, ok := line[f].(RecordSet); ok {
+				relIds[fi.relatedModelName] = append(relIds[fi.relatedModelName], rs.Ids()...)
+			}
+		}
+	}
+	names := make(map[string]map[int64]string)
+	for modelName, ids := range relIds {
+		names[modelName] = rc.env.Pool(modelName).Browse(ids...).DisplayNames()
+	}
+	for f, fi := range relFields {
+		for _, line := range res {
+			var ids []int64
+			if rs, ok := line[f].(RecordSet); ok {
+				ids = rs.Ids()
+			}
+			values := make([]FieldMap, len(ids))
+			for i, id := range ids {
+				values[i] = FieldMap{"id": id, "name": names[fi.relatedModelName][id]}
+			}
+			switch {
+			case fi.fieldType.Is2ManyRelationType():
+				line[f] = values
+			case len(values) == 0:
+				line[f] = nil
+			default:
+				line[f] = values[0]
+			}
+		}
+	}
+	return res
+}
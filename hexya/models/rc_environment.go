@@ -20,8 +20,16 @@ import (
 )
 
 // WithEnv returns a copy of the current RecordCollection with the given Environment.
+//
+// If env does not share the cache of the current Environment, for instance if it
+// runs another transaction, the returned RecordCollection only uses the cursor and
+// the cache of env: no cached value is carried over. In this case, records created
+// in the current Environment must have been flushed to the database beforehand.
 func (rc *RecordCollection) WithEnv(env Environment) *RecordCollection {
 	rSet := *rc
+	if rc.env != nil && rc.env.cache != env.cache {
+		rSet.ids = rc.persistedIds()
+	}
 	rSet.env = &env
 	return &rSet
 }
@@ -43,6 +51,17 @@ func (rc *RecordCollection) WithNewContext(context *types.Context) *RecordCollec
 	return rc.WithEnv(newEnv)
 }
 
+// WithReadOnlyWrite returns a copy of the current RecordCollection in which
+// fields declared with ReadOnly can be written by Create and Write.
+//
+// This is only meant to be used by server side code and cannot be enabled
+// through the context.
+func (rc *RecordCollection) WithReadOnlyWrite() *RecordCollection {
+	newEnv := *rc.env
+	newEnv.allowReadOnlyWrite = true
+	return rc.WithEnv(newEnv)
+}
+
 // Sudo returns a new RecordCollection with the given userId
 // or the superuser id if not specified
 func (rc *RecordCollection) Sudo(userId ...int64) *RecordCollection {
@@ -51,6 +70,9 @@ func (rc *RecordCollection) Sudo(userId ...int64) *RecordCollection {
 		uid = userId[0]
 	}
 	newEnv := *rc.env
+	if newEnv.realUID == 0 {
+		newEnv.realUID = newEnv.uid
+	}
 	newEnv.uid = uid
 	return rc.WithEnv(newEnv)
 }
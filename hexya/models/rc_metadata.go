@@ -0,0 +1,83 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// metadataFields are the fields read by GetMetadata, when they exist on the model.
+var metadataFields = []string{"CreateUID", "CreateDate", "WriteUID", "WriteDate", "HexyaExternalID"}
+
+// RecordMetadata holds the audit information of a record.
+//
+// Fields that do not exist on the record's model are left to their zero value.
+type RecordMetadata struct {
+	ID         int64
+	CreateUID  int64
+	CreateDate dates.DateTime
+	WriteUID   int64
+	WriteDate  dates.DateTime
+	ExternalID string
+}
+
+// GetMetadata returns the creation and last modification users and dates,
+// as well as the external ID of each record of this RecordCollection.
+// The result is indexed by the ids of this RecordCollection.
+//
+// Pending changes of these records are flushed to the database first and all
+// metadata are then read in a single query.
+func (rc *RecordCollection) GetMetadata() map[int64]RecordMetadata {
+	rc.checkModelAccess(security.Read)
+	res := make(map[int64]RecordMetadata)
+	if rc.IsEmpty() {
+		return res
+	}
+	rc.Flush()
+	dbIds := rc.persistedIds()
+	rcIds := make(map[int64]int64)
+	for i, id := range dbIds {
+		rcIds[id] = rc.ids[i]
+	}
+	fields := []string{"id"}
+	for _, f := range metadataFields {
+		if _, ok := rc.model.fields.Get(f); ok {
+			fields = append(fields, f)
+		}
+	}
+	rSet := rc.env.Pool(rc.ModelName()).Browse(dbIds...).addRecordRuleConditions(rc.env.uid, security.Read)
+	fields = filterOnAuthorizedFields(rSet.model, rSet.env.uid, fields, security.Read)
+	dbFields := filterOnDBFields(rSet.model, fields)
+	sql, args := rSet.query.selectQuery(dbFields)
+	rows := rSet.env.cr.query(sql, args...)
+	defer rows.Close()
+	for rows.Next() {
+		line := make(FieldMap)
+		if err := rSet.model.scanToFieldMap(rows, &line); err != nil {
+			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
+		}
+		id := line["id"].(int64)
+		meta := RecordMetadata{ID: rcIds[id]}
+		// Columns may be NULL, in which case the field is left to its zero value
+		meta.CreateUID, _ = line["create_uid"].(int64)
+		meta.CreateDate, _ = line["create_date"].(dates.DateTime)
+		meta.WriteUID, _ = line["write_uid"].(int64)
+		meta.WriteDate, _ = line["write_date"].(dates.DateTime)
+		meta.ExternalID, _ = line["hexya_external_id"].(string)
+		res[meta.ID] = meta
+	}
+	return res
+}
@@ -15,7 +15,10 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
 )
@@ -33,8 +36,13 @@ func (rc *RecordCollection) Call(methName string, args ...interface{}) interface
 // CallMulti calls the given method name methName on the given RecordCollection
 // with the given arguments and return the result as []interface{}.
 func (rc *RecordCollection) CallMulti(methName string, args ...interface{}) []interface{} {
+	rc.env.checkCancelled()
 	methInfo, ok := rc.model.methods.get(methName)
 	if !ok {
+		if _, hasFallback := rc.model.methods.get(methodFallbackName); hasFallback {
+			// The fallback is called as a regular method so that execution permissions apply
+			return rc.CallMulti(methodFallbackName, methName, args)[0].([]interface{})
+		}
 		log.Panic("Unknown method in model", "method", methName, "model", rc.model.name)
 	}
 
@@ -53,6 +61,117 @@ func (rc *RecordCollection) CallMulti(methName string, args ...interface{}) []in
 	return rSet.callMulti(methLayer, args...)
 }
 
+// CallJSON calls the given method name methName on the given RecordCollection
+// with the given JSON encoded arguments and returns (only) the first result.
+//
+// Each argument is decoded into the type of the corresponding parameter of the
+// method:
+// - Conditioner parameters are given as domains,
+// - FieldMapper parameters, including model data structs, are given as objects,
+// - RecordSet parameters are given as a list of ids or a single id,
+// - the variadic parameter, if any, is given as a single list and can be omitted.
+//
+// An error of kind ErrTypeMismatch is returned if the arguments cannot be
+// decoded. Errors raised by the method itself are not recovered.
+func (rc *RecordCollection) CallJSON(methName string, rawArgs []json.RawMessage) (interface{}, error) {
+	res, err := rc.callMultiJSON(methName, rawArgs)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// callMultiJSON calls the given method name methName on the given RecordCollection
+// with the given JSON encoded arguments and return the result as []interface{}.
+func (rc *RecordCollection) callMultiJSON(methName string, rawArgs []json.RawMessage) ([]interface{}, error) {
+	args, err := rc.decodeJSONArgs(rc.MethodType(methName), rawArgs)
+	if err != nil {
+		return nil, &Error{Kind: ErrTypeMismatch, Model: rc.ModelName(), Cause: err}
+	}
+	return rc.CallMulti(methName, args...), nil
+}
+
+// decodeJSONArgs decodes the given JSON encoded arguments into values of the
+// parameter types of the given method type, whose first parameter is the
+// RecordSet receiver.
+func (rc *RecordCollection) decodeJSONArgs(methType reflect.Type, rawArgs []json.RawMessage) ([]interface{}, error) {
+	nParams := methType.NumIn() - 1
+	minParams := nParams
+	if methType.IsVariadic() {
+		minParams--
+	}
+	if len(rawArgs) < minParams || len(rawArgs) > nParams {
+		return nil, fmt.Errorf("expected %d arguments, received %d", nParams, len(rawArgs))
+	}
+	args := make([]interface{}, len(rawArgs))
+	for i, rawArg := range rawArgs {
+		arg, err := rc.decodeJSONArg(methType.In(i+1), rawArg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		args[i] = arg
+	}
+	return args, nil
+}
+
+// decodeJSONArg decodes the given JSON encoded argument into a value
+// suitable for a method parameter of type argType.
+func (rc *RecordCollection) decodeJSONArg(argType reflect.Type, rawArg json.RawMessage) (interface{}, error) {
+	switch {
+	case argType.Implements(reflect.TypeOf((*RecordSet)(nil)).Elem()):
+		return rc.decodeJSONRecordSet(argType, rawArg)
+	case argType.Implements(reflect.TypeOf((*Conditioner)(nil)).Elem()):
+		var domain []interface{}
+		if err := json.Unmarshal(rawArg, &domain); err != nil {
+			return nil, err
+		}
+		var cond *Condition
+		if err := TryCall(func() { cond = ParseDomain(domain) }); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	case argType.Implements(reflect.TypeOf((*FieldMapper)(nil)).Elem()):
+		// FieldMaps are converted to the actual type when calling the method.
+		var fMap FieldMap
+		if err := json.Unmarshal(rawArg, &fMap); err != nil {
+			return nil, err
+		}
+		return fMap, nil
+	}
+	val := reflect.New(argType)
+	if err := json.Unmarshal(rawArg, val.Interface()); err != nil {
+		return nil, err
+	}
+	return val.Elem().Interface(), nil
+}
+
+// decodeJSONRecordSet decodes the given list of ids or single id into
+// a RecordSet of type argType.
+//
+// The model of the RecordSet is deduced from the name of argType if it is
+// a typed RecordSet such as UserSet. Otherwise, it is the model of rc.
+func (rc *RecordCollection) decodeJSONRecordSet(argType reflect.Type, rawArg json.RawMessage) (interface{}, error) {
+	var ids []int64
+	if err := json.Unmarshal(rawArg, &ids); err != nil {
+		var id int64
+		if json.Unmarshal(rawArg, &id) != nil {
+			return nil, err
+		}
+		ids = []int64{id}
+	}
+	modelName := rc.ModelName()
+	if mi, ok := Registry.Get(strings.TrimSuffix(argType.Name(), "Set")); ok && strings.HasSuffix(argType.Name(), "Set") {
+		modelName = mi.name
+	}
+	rSet := rc.env.Pool(modelName).Browse(ids...)
+	if argType.Kind() != reflect.Struct {
+		return rSet, nil
+	}
+	val := reflect.New(argType).Elem()
+	val.Field(0).Set(reflect.ValueOf(rSet))
+	return val.Interface(), nil
+}
+
 // Super returns a RecordSet with a modified callstack so that call to the current
 // method will execute the next method layer.
 //
@@ -140,7 +259,8 @@ func (rc *RecordCollection) CheckExecutionPermission(method *Method, dontPanic .
 	if len(dontPanic) > 0 && dontPanic[0] {
 		return false
 	}
-	log.Panic("You are not allowed to execute this method", "model", rc.ModelName(), "method", method.name, "uid", rc.env.uid)
+	log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: rc.ModelName()}, "You are not allowed to execute this method",
+		"model", rc.ModelName(), "method", method.name, "uid", rc.env.uid)
 	// Unreachable
 	return false
 }
@@ -0,0 +1,119 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+// A prefetchGroup holds the records that are loaded together with a record
+// when one of its fields is not in cache, so that iterating over a RecordSet
+// does not load its records one by one.
+//
+// A prefetchGroup is either given by a list of ids, which are the records of
+// the RecordSet a record has been taken from, or by the records pointed at by
+// a many2one or one2one field of the records of a parent group. In the latter
+// case, the ids are computed from the cache only when they are needed.
+type prefetchGroup struct {
+	ids    []int64
+	parent *prefetchGroup
+	model  *Model
+	field  string
+}
+
+// relatedGroup returns a new prefetchGroup with the records pointed at by
+// the given many2one or one2one field of the records of this group, which
+// belong to the given model.
+func (pg *prefetchGroup) relatedGroup(model *Model, field string) *prefetchGroup {
+	return &prefetchGroup{
+		parent: pg,
+		model:  model,
+		field:  field,
+	}
+}
+
+// resolve returns the ids of the records of this prefetchGroup. The ids of
+// a related group are those of the records pointed at by the field of the
+// parent records that are in cache.
+func (pg *prefetchGroup) resolve(c *cache) []int64 {
+	if pg.parent == nil {
+		return pg.ids
+	}
+	var res []int64
+	seen := make(map[int64]bool)
+	for _, id := range pg.parent.resolve(c) {
+		data, ok := c.data[c.getCacheRef(pg.model, id)]
+		if !ok {
+			continue
+		}
+		relID, ok := (*data)[pg.field].(int64)
+		if !ok || relID == 0 || seen[relID] {
+			continue
+		}
+		seen[relID] = true
+		res = append(res, relID)
+	}
+	return res
+}
+
+// prefetchSet returns the RecordCollection to load when the given field of
+// this RecordCollection is not in cache, that is this RecordCollection with
+// the records of its prefetchGroup that have not been loaded yet.
+//
+// Records of the group that have other fields in cache are not loaded again,
+// so that values changed in cache and not flushed yet are not overwritten.
+func (rc *RecordCollection) prefetchSet() *RecordCollection {
+	if rc.prefetch == nil {
+		return rc
+	}
+	ids := append([]int64{}, rc.ids...)
+	seen := make(map[int64]bool)
+	for _, id := range rc.ids {
+		seen[id] = true
+	}
+	for _, id := range rc.prefetch.resolve(rc.env.cache) {
+		if id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if data, ok := rc.env.cache.data[rc.env.cache.getCacheRef(rc.model, id)]; ok && len(*data) > 1 {
+			// The record has been loaded already, possibly only partially
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == len(rc.ids) {
+		return rc
+	}
+	rSet := rc.env.Pool(rc.ModelName()).withIds(ids)
+	rSet.prefetchFields = rc.prefetchFields
+	rSet.nullPolicy = rc.nullPolicy
+	return rSet
+}
+
+// relatedPrefetchGroup returns the prefetchGroup of the records pointed at by
+// the given many2one or one2one field of this RecordCollection, which is the
+// related group of the prefetchGroup of this RecordCollection, or of its own
+// records if it has none. It returns nil if fi is not a many2one or one2one
+// field or if a single record would be loaded.
+func (rc *RecordCollection) relatedPrefetchGroup(fi *Field) *prefetchGroup {
+	if !fi.fieldType.IsFKRelationType() {
+		return nil
+	}
+	group := rc.prefetch
+	if group == nil {
+		if len(rc.ids) < 2 {
+			return nil
+		}
+		group = &prefetchGroup{ids: rc.ids}
+	}
+	return group.relatedGroup(rc.model, fi.json)
+}
@@ -14,7 +14,39 @@
 
 package models
 
-import "github.com/hexya-erp/hexya/hexya/models/security"
+import (
+	"fmt"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+)
+
+// An accessOperation defines the method, the model permission and the
+// record rule permission that control an operation of CheckAccessRights
+// and CheckAccessRule.
+type accessOperation struct {
+	method    string
+	modelPerm security.Permission
+	perm      security.Permission
+}
+
+// accessOperations are the operations that can be checked with
+// CheckAccessRights and CheckAccessRule.
+var accessOperations = map[string]accessOperation{
+	"create": {method: "Create", modelPerm: security.Create},
+	"read":   {method: "Load", modelPerm: security.Read, perm: security.Read},
+	"write":  {method: "Write", modelPerm: security.Write, perm: security.Write},
+	"unlink": {method: "Unlink", modelPerm: security.Unlink, perm: security.Unlink},
+}
+
+// getAccessOperation returns the accessOperation with the given name.
+// It panics if there is no such operation.
+func getAccessOperation(operation string) accessOperation {
+	op, ok := accessOperations[operation]
+	if !ok {
+		log.Panic("Unknown access operation", "operation", operation)
+	}
+	return op
+}
 
 // addRecordRuleConditions adds the RecordRule conditions on the query of this
 // RecordSet for the user with the given uid and for the given perm Permission.
@@ -22,11 +54,12 @@ func (rc *RecordCollection) addRecordRuleConditions(uid int64, perm security.Per
 	if rc.filtered {
 		return rc
 	}
+	rc.auditPrivileges(perm)
 	rSet := rc
 	// Add global rules
 	for _, rule := range rSet.model.rulesRegistry.globalRules {
 		if perm&rule.Perms > 0 {
-			rSet = rSet.Search(rule.Condition)
+			rSet = rSet.search(rule.Condition)
 		}
 	}
 	// Add groups rules
@@ -40,9 +73,49 @@ func (rc *RecordCollection) addRecordRuleConditions(uid int64, perm security.Per
 		}
 	}
 	if !groupCondition.IsEmpty() {
-		rSet = rSet.Search(groupCondition)
+		rSet = rSet.search(groupCondition)
 	}
 	rSet.filtered = true
 	*rc = *rSet
 	return rc
 }
+
+// CheckAccessRights returns true if the current user is allowed to execute
+// the given operation on the model of this RecordCollection, regardless of
+// the records. operation is one of "create", "read", "write" or "unlink".
+//
+// This method does not panic if access is denied, so that it can be used to
+// check beforehand whether an operation will be allowed.
+func (rc *RecordCollection) CheckAccessRights(operation string) bool {
+	op := getAccessOperation(operation)
+	return checkModelPermission(rc.model, rc.env.uid, op.modelPerm) &&
+		rc.CheckExecutionPermission(rc.model.methods.MustGet(op.method), true)
+}
+
+// CheckAccessRule returns an ErrAccessDenied error if the record rules of the
+// current user do not allow the given operation on all the records of this
+// RecordCollection. operation is one of "create", "read", "write" or "unlink".
+// Record rules do not apply to "create", for which nil is always returned.
+//
+// Pending changes of these records are flushed to the database first.
+func (rc *RecordCollection) CheckAccessRule(operation string) error {
+	op := getAccessOperation(operation)
+	if op.perm == 0 || rc.IsEmpty() {
+		return nil
+	}
+	rc.Flush()
+	idMap := make(map[int64]bool)
+	for _, id := range rc.persistedIds() {
+		idMap[id] = true
+	}
+	ids := make([]int64, 0, len(idMap))
+	for id := range idMap {
+		ids = append(ids, id)
+	}
+	rSet := rc.env.Pool(rc.ModelName()).Browse(ids...).addRecordRuleConditions(rc.env.uid, op.perm)
+	if rSet.SearchCount() < len(ids) {
+		return &Error{Kind: ErrAccessDenied, Model: rc.ModelName(),
+			Cause: fmt.Errorf("you are not allowed to %s these %s records", operation, rc.ModelName())}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// checkAuditFields panics with an ErrUnknownField error if the model of this
+// RecordCollection does not have the CreateDate and WriteDate audit fields.
+func (rc *RecordCollection) checkAuditFields() {
+	for _, f := range []string{"CreateDate", "WriteDate"} {
+		if _, ok := rc.model.fields.Get(f); !ok {
+			log.PanicWithError(&Error{Kind: ErrUnknownField, Model: rc.ModelName()},
+				"Model has no audit fields", "model", rc.ModelName(), "field", f)
+		}
+	}
+}
+
+// modifiedSinceCondition returns the condition matching the records that
+// have been written after t, or created after t if they have never been written.
+func (rc *RecordCollection) modifiedSinceCondition(t time.Time) *Condition {
+	dt := dates.DateTime{Time: t}
+	return rc.model.Field("WriteDate").Greater(dt).
+		OrCond(rc.model.Field("WriteDate").IsNull().And().Field("CreateDate").Greater(dt))
+}
+
+// ModifiedSince returns the subset of the records of this RecordCollection
+// that have been modified after t, i.e. written after t, or created after t
+// if they have never been written. The records are filtered with a single query.
+//
+// Pending changes of these records are flushed to the database first.
+// It panics if the model has no CreateDate and WriteDate fields.
+func (rc *RecordCollection) ModifiedSince(t time.Time) *RecordCollection {
+	rc.checkAuditFields()
+	if rc.IsEmpty() {
+		return rc.env.Pool(rc.ModelName())
+	}
+	rc.Flush()
+	dbIds := rc.persistedIds()
+	rcIds := make(map[int64]int64)
+	for i, id := range dbIds {
+		rcIds[id] = rc.ids[i]
+	}
+	modified := rc.env.Pool(rc.ModelName()).Browse(dbIds...).Search(rc.modifiedSinceCondition(t))
+	var ids []int64
+	for _, id := range modified.Ids() {
+		ids = append(ids, rcIds[id])
+	}
+	return rc.env.Pool(rc.ModelName()).withIds(ids)
+}
+
+// changeTime returns the time at which the given record has been modified
+// for the last time, rounded to the precision of the database.
+func changeTime(rec *RecordCollection) time.Time {
+	t := rec.Get("WriteDate").(dates.DateTime)
+	if t.IsZero() {
+		t = rec.Get("CreateDate").(dates.DateTime)
+	}
+	return t.Round(time.Microsecond)
+}
+
+// changedRecords returns the records of the model of this RecordCollection
+// whose change time matches the given condition on a datetime field, ordered
+// by change time and id. If limit is strictly positive, at most limit records
+// are returned.
+func (rc *RecordCollection) changedRecords(cond func(field string) *Condition, limit int) []*RecordCollection {
+	written := rc.SearchAll().Search(cond("WriteDate")).OrderBy("WriteDate", "id")
+	created := rc.SearchAll().Search(rc.model.Field("WriteDate").IsNull().AndCond(cond("CreateDate"))).
+		OrderBy("CreateDate", "id")
+	if limit > 0 {
+		written = written.Limit(limit)
+		created = created.Limit(limit)
+	}
+	recs := append(written.Records(), created.Records()...)
+	sort.SliceStable(recs, func(i, j int) bool {
+		ti, tj := changeTime(recs[i]), changeTime(recs[j])
+		if ti.Equal(tj) {
+			return recs[i].ids[0] < recs[j].ids[0]
+		}
+		return ti.Before(tj)
+	})
+	if limit > 0 && len(recs) > limit {
+		recs = recs[:limit]
+	}
+	return recs
+}
+
+// ChangesSince returns the stored fields of the records of this RecordCollection's
+// model that have been modified after t, ordered by modification time and id,
+// as well as the modification time of the last returned record. This time is the
+// high-water mark to pass as t to get the next changes. If there are no changes,
+// t itself is returned.
+//
+// If limit is strictly positive, about limit records are returned. In order not
+// to skip any record when resuming, records modified at the same time as the
+// last record are always returned together, so that the result may hold more
+// than limit records.
+//
+// Pending changes are flushed to the database first. Deleted records are not
+// reported by this method. It panics if the model has no CreateDate and
+// WriteDate fields.
+func (rc *RecordCollection) ChangesSince(t time.Time, limit int) ([]FieldMap, time.Time) {
+	rc.checkAuditFields()
+	rc.env.Flush()
+	since := dates.DateTime{Time: t}
+	recs := rc.changedRecords(func(field string) *Condition {
+		return rc.model.Field(field).Greater(since)
+	}, limit)
+	if len(recs) == 0 {
+		return nil, t
+	}
+	mark := changeTime(recs[len(recs)-1])
+	if limit > 0 && len(recs) == limit {
+		// Replace the records modified at the same time as the last one
+		// by all the records modified at this time.
+		for len(recs) > 0 && changeTime(recs[len(recs)-1]).Equal(mark) {
+			recs = recs[:len(recs)-1]
+		}
+		recs = append(recs, rc.changedRecords(func(field string) *Condition {
+			return rc.model.Field(field).Equals(dates.DateTime{Time: mark})
+		}, 0)...)
+	}
+	ids := make([]int64, len(recs))
+	for i, rec := range recs {
+		ids[i] = rec.ids[0]
+	}
+	fields := rc.model.fields.storedFieldNames()
+	res := rc.env.Pool(rc.ModelName()).withIds(ids).Call("Read", fields).([]FieldMap)
+	return res, mark
+}
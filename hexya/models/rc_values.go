@@ -0,0 +1,378 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/tools/strutils"
+	"github.com/jmoiron/sqlx"
+)
+
+// valueAliasRegexp matches the valid aliases of value expressions
+var valueAliasRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// valueFunctions are the SQL functions that can be used in value expressions
+var valueFunctions = map[string]bool{
+	"ABS":      true,
+	"COALESCE": true,
+	"GREATEST": true,
+	"LEAST":    true,
+	"LENGTH":   true,
+	"LOWER":    true,
+	"NULLIF":   true,
+	"ROUND":    true,
+	"UPPER":    true,
+}
+
+// windowFunctions are the SQL functions that can be used in value
+// expressions as window functions, i.e. followed by an OVER clause.
+var windowFunctions = map[string]bool{
+	"AVG":        true,
+	"COUNT":      true,
+	"DENSE_RANK": true,
+	"MAX":        true,
+	"MIN":        true,
+	"RANK":       true,
+	"ROW_NUMBER": true,
+	"SUM":        true,
+}
+
+// valueKeywords are the SQL keywords that can be used in the OVER clause
+// of window functions in value expressions. They must be upper case.
+var valueKeywords = map[string]bool{
+	"ASC":       true,
+	"BY":        true,
+	"DESC":      true,
+	"FIRST":     true,
+	"LAST":      true,
+	"NULLS":     true,
+	"ORDER":     true,
+	"OVER":      true,
+	"PARTITION": true,
+}
+
+// A valueExpr is a parsed value expression of Values.
+//
+// tokens are the SQL tokens of the expression, in which field paths are
+// given by their index in paths as "$<index>".
+type valueExpr struct {
+	alias  string
+	tokens []string
+	paths  []string
+	params int
+	window bool
+}
+
+// parseValueExpr parses the given value specification of Values on the given
+// model. The specification is either a field path or an expression followed by
+// "AS alias".
+func parseValueExpr(mi *Model, spec string) valueExpr {
+	expr, alias := spec, strings.TrimSpace(spec)
+	if i := strings.LastIndex(strings.ToUpper(spec), " AS "); i >= 0 {
+		expr, alias = spec[:i], strings.TrimSpace(spec[i+4:])
+		if !valueAliasRegexp.MatchString(alias) {
+			log.Panic("Invalid alias in value expression", "model", mi.name, "spec", spec, "alias", alias)
+		}
+	}
+	res := valueExpr{alias: alias}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("+-*/%(),", r):
+			res.tokens = append(res.tokens, string(r))
+			i++
+		case r == '?':
+			res.tokens = append(res.tokens, "?")
+			res.params++
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			res.tokens = append(res.tokens, string(runes[start:i]))
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			name := string(runes[start:i])
+			if valueKeywords[name] {
+				res.tokens = append(res.tokens, name)
+				continue
+			}
+			j := i
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+			if j < len(runes) && runes[j] == '(' {
+				if windowFunctions[strings.ToUpper(name)] {
+					res.window = true
+					res.tokens = append(res.tokens, strings.ToUpper(name))
+					continue
+				}
+				if !valueFunctions[strings.ToUpper(name)] {
+					log.Panic("Unknown function in value expression", "model", mi.name, "spec", spec, "function", name)
+				}
+				res.tokens = append(res.tokens, strings.ToUpper(name))
+				continue
+			}
+			mi.checkValuePath(name)
+			res.tokens = append(res.tokens, fmt.Sprintf("$%d", len(res.paths)))
+			res.paths = append(res.paths, name)
+		default:
+			log.Panic("Invalid character in value expression", "model", mi.name, "spec", spec, "character", string(r))
+		}
+	}
+	if len(res.tokens) == 0 {
+		log.Panic("Empty value expression", "model", mi.name, "spec", spec)
+	}
+	if alias == strings.TrimSpace(spec) && (len(res.paths) != 1 || len(res.tokens) != 1) {
+		log.Panic("Value expressions must be given an alias", "model", mi.name, "spec", spec)
+	}
+	res.checkWindowFunctions(spec)
+	return res
+}
+
+// checkWindowFunctions panics if a window function of this value
+// expression is not followed by an OVER clause.
+func (ve valueExpr) checkWindowFunctions(spec string) {
+	for i, tok := range ve.tokens {
+		if !windowFunctions[tok] {
+			continue
+		}
+		depth := 0
+		for j := i + 1; j < len(ve.tokens); j++ {
+			switch ve.tokens[j] {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			if depth > 0 {
+				continue
+			}
+			if j+1 < len(ve.tokens) && ve.tokens[j+1] == "OVER" {
+				break
+			}
+			log.Panic("Window functions must be followed by an OVER clause", "spec", spec, "function", tok)
+		}
+	}
+}
+
+// checkValuePath panics if the given path of this model does not point
+// through many2one or one2one fields to a field stored in a column.
+func (m *Model) checkValuePath(path string) {
+	exprs := strings.Split(path, ExprSep)
+	relModel := m
+	if len(exprs) > 1 {
+		relModel = m.joinedModel(strings.Join(exprs[:len(exprs)-1], ExprSep))
+	}
+	fi, ok := relModel.fields.Get(exprs[len(exprs)-1])
+	if !ok || !fi.isStored() || fi.fieldType.IsNonStoredRelationType() {
+		log.PanicWithError(&Error{Kind: ErrUnknownField, Model: relModel.name}, "Unknown column in value expression",
+			"model", m.name, "path", path)
+	}
+}
+
+// checkValuePathAccess panics with ErrAccessDenied if the user of this
+// RecordCollection is not allowed to read one of the fields of the given path.
+func (rc *RecordCollection) checkValuePathAccess(path string) {
+	curModel := rc.model
+	for _, step := range strings.Split(path, ExprSep) {
+		fi := curModel.fields.MustGet(step)
+		if !checkFieldPermission(fi, rc.env.uid, security.Read) {
+			log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: curModel.name},
+				"You are not allowed to read this field", "model", rc.model.name, "path", path, "field", fi.name, "uid", rc.env.uid)
+		}
+		curModel = fi.relatedModel
+	}
+}
+
+// relationPaths returns the paths of the relations that must be
+// joined to read the given value expressions, without duplicates.
+func relationPaths(exprs []valueExpr) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, expr := range exprs {
+		for _, path := range expr.paths {
+			steps := strings.Split(path, ExprSep)
+			for i := 1; i < len(steps); i++ {
+				prefix := strings.Join(steps[:i], ExprSep)
+				if seen[prefix] {
+					continue
+				}
+				seen[prefix] = true
+				res = append(res, prefix)
+			}
+		}
+	}
+	return res
+}
+
+// checkRelatedRecordsAccess panics with ErrAccessDenied if some of the records
+// with the given ids of the model at the end of the given relation path are
+// filtered out by the record rules of the user of this RecordCollection.
+func (rc *RecordCollection) checkRelatedRecordsAccess(relPath string, ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	relModel := rc.model.joinedModel(relPath)
+	visible := rc.env.Pool(relModel.name).Search(relModel.Field("ID").In(ids)).Ids()
+	if len(visible) == len(ids) {
+		return
+	}
+	log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: relModel.name},
+		"You are not allowed to read some related records", "model", rc.model.name, "path", relPath, "uid", rc.env.uid)
+}
+
+// Values returns a FieldMap for each record of this RecordCollection, in the
+// order of the RecordCollection, with the values of the given specifications.
+//
+// Each specification is either a field path, such as "Profile.Age", in which
+// case the value is keyed by the path, or an SQL expression followed by
+// "AS alias", such as "Price * Quantity AS total", in which case the value is
+// keyed by the alias. Expressions are made of field paths through many2one or
+// one2one fields, numbers, arithmetic operators, a few SQL functions (ABS,
+// COALESCE, GREATEST, LEAST, LENGTH, LOWER, NULLIF, ROUND and UPPER) and '?'
+// placeholders. Placeholders are replaced by args in order. Values panics if a
+// specification contains anything else.
+//
+// Expressions can also hold window functions (ROW_NUMBER, RANK, DENSE_RANK,
+// SUM, AVG, COUNT, MIN and MAX) with an OVER clause, such as
+// "RANK() OVER (PARTITION BY Category ORDER BY Amount DESC) AS rank". The
+// window is computed over the records of this RecordCollection only. Keywords
+// of the OVER clause must be upper case. Values panics if the database driver
+// does not support window functions.
+//
+// Values panics with ErrAccessDenied if the user is not allowed to read one of
+// the fields of the paths, or one of the related records reached through them.
+// Records of this RecordCollection filtered out by the record rules get a nil
+// FieldMap. Aliases must not start with "__", which is reserved.
+//
+// Pending changes of these records are flushed to the database first.
+// Values are returned as given by the database driver.
+func (rc *RecordCollection) Values(specs []string, args ...interface{}) []FieldMap {
+	exprs := make([]valueExpr, len(specs))
+	aliases := make(map[string]bool)
+	var params int
+	for i, spec := range specs {
+		exprs[i] = parseValueExpr(rc.model, spec)
+		if aliases[exprs[i].alias] {
+			log.Panic("Duplicate alias in value expressions", "model", rc.model.name, "alias", exprs[i].alias)
+		}
+		if strings.HasPrefix(exprs[i].alias, "__") {
+			log.Panic("Reserved alias in value expressions", "model", rc.model.name, "alias", exprs[i].alias)
+		}
+		aliases[exprs[i].alias] = true
+		params += exprs[i].params
+	}
+	if params != len(args) {
+		log.Panic("Wrong number of arguments for value expressions", "model", rc.model.name, "expected", params, "given", len(args))
+	}
+	adapter := adapters[db.DriverName()]
+	for _, expr := range exprs {
+		if expr.window && !adapter.supportsWindowFunctions() {
+			log.Panic("Window functions are not supported by the database driver", "model", rc.model.name, "driver", db.DriverName())
+		}
+	}
+	rc.checkModelAccess(security.Read)
+	for _, expr := range exprs {
+		for _, path := range expr.paths {
+			rc.checkValuePathAccess(path)
+		}
+	}
+	if rc.IsEmpty() {
+		return nil
+	}
+	rc.Flush()
+	ids := rc.persistedIds()
+	rSet := rc.env.Pool(rc.ModelName()).Search(rc.model.Field("ID").In(ids))
+	rSet = rSet.addRecordRuleConditions(rc.env.uid, security.Read)
+	q := rSet.query
+	var fieldExprs [][]string
+	for _, expr := range exprs {
+		for _, path := range expr.paths {
+			fieldExprs = append(fieldExprs, jsonizeExpr(rc.model, strings.Split(path, ExprSep)))
+		}
+	}
+	cols := []string{fmt.Sprintf("%s AS __id", q.joinedFieldExpression([]string{"id"}))}
+	var pathIndex int
+	for _, expr := range exprs {
+		tokens := make([]string, len(expr.tokens))
+		for i, tok := range expr.tokens {
+			tokens[i] = tok
+			if strings.HasPrefix(tok, "$") {
+				tokens[i] = q.joinedFieldExpression(fieldExprs[pathIndex])
+				pathIndex++
+			}
+		}
+		cols = append(cols, fmt.Sprintf(`%s AS "%s"`, strings.Join(tokens, " "), expr.alias))
+	}
+	relPaths := relationPaths(exprs)
+	for i, relPath := range relPaths {
+		relExpr := jsonizeExpr(rc.model, strings.Split(relPath, ExprSep))
+		fieldExprs = append(fieldExprs, relExpr)
+		cols = append(cols, fmt.Sprintf(`%s AS "__rel%d"`, q.joinedFieldExpression(relExpr), i))
+	}
+	_, allExprs := q.selectData(nil)
+	tablesSQL, joinsMap := q.tablesSQL(append(fieldExprs, allExprs...))
+	whereSQL, whereArgs := q.sqlWhereClause()
+	sql := fmt.Sprintf(`SELECT %s FROM %s %s`, strings.Join(cols, ", "), tablesSQL, whereSQL)
+	sql = strutils.Substitute(sql, joinsMap)
+	rows := rc.env.cr.query(sql, append(SQLParams(args), whereArgs...)...)
+	defer rows.Close()
+	values := make(map[int64]FieldMap)
+	relIds := make([]map[int64]bool, len(relPaths))
+	for i := range relIds {
+		relIds[i] = make(map[int64]bool)
+	}
+	for rows.Next() {
+		vals := make(map[string]interface{})
+		if err := sqlx.MapScan(rows, vals); err != nil {
+			log.Panic(err.Error(), "model", rc.model.name, "specs", specs)
+		}
+		id := vals["__id"].(int64)
+		delete(vals, "__id")
+		for i := range relPaths {
+			key := fmt.Sprintf("__rel%d", i)
+			if relID, ok := vals[key].(int64); ok {
+				relIds[i][relID] = true
+			}
+			delete(vals, key)
+		}
+		values[id] = vals
+	}
+	for i, relPath := range relPaths {
+		rIds := make([]int64, 0, len(relIds[i]))
+		for relID := range relIds[i] {
+			rIds = append(rIds, relID)
+		}
+		rc.checkRelatedRecordsAccess(relPath, rIds)
+	}
+	res := make([]FieldMap, len(ids))
+	for i, id := range ids {
+		res[i] = values[id]
+	}
+	return res
+}
@@ -15,8 +15,11 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,18 +27,22 @@ import (
 	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/hexya-erp/hexya/hexya/tools/nbutils"
 	"github.com/jmoiron/sqlx"
 )
 
 // RecordCollection is a generic struct representing several
 // records of a model.
 type RecordCollection struct {
-	model    *Model
-	query    *Query
-	env      *Environment
-	ids      []int64
-	fetched  bool
-	filtered bool
+	model          *Model
+	query          *Query
+	env            *Environment
+	ids            []int64
+	fetched        bool
+	filtered       bool
+	prefetchFields []string
+	prefetch       *prefetchGroup
+	nullPolicy     NullPolicy
 }
 
 // String returns the string representation of a RecordSet
@@ -66,6 +73,46 @@ func (rc *RecordCollection) Ids() []int64 {
 	return rc.ids
 }
 
+// IdsPage returns at most limit ids of the RecordSet starting at position
+// offset, in the order of the RecordSet. A limit of 0 means no limit.
+//
+// If the RecordSet has not been fetched yet, only the ids of the page are
+// queried from the database, so that very large RecordSets can be paged
+// through without loading all their ids at once. The page limit is not
+// capped at MaxLimit.
+func (rc *RecordCollection) IdsPage(offset, limit int) []int64 {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit < 0 {
+		log.Panic("Limit must not be negative", "model", rc.ModelName(), "limit", limit)
+	}
+	if rc.fetched {
+		if offset >= len(rc.ids) {
+			return []int64{}
+		}
+		end := len(rc.ids)
+		if limit > 0 && offset+limit < end {
+			end = offset + limit
+		}
+		return append([]int64{}, rc.ids[offset:end]...)
+	}
+	if rc.query.isEmpty() {
+		return []int64{}
+	}
+	if rsLimit := rc.query.cappedLimit(); rsLimit > 0 {
+		// The page must not go beyond the limit of the RecordSet itself
+		if offset >= rsLimit {
+			return []int64{}
+		}
+		if limit == 0 || offset+limit > rsLimit {
+			limit = rsLimit - offset
+		}
+	}
+	page := rc.WithMaxLimit(0).Offset(rc.query.offset + offset).Limit(limit)
+	return page.Fetch().ids
+}
+
 // create inserts a new record in the database with the given data.
 // data can be either a FieldMap or a struct pointer of the same model as rs.
 // This function is private and low level. It should not be called directly.
@@ -76,8 +123,12 @@ func (rc *RecordCollection) create(data FieldMapper) *RecordCollection {
 			panic(rc.substituteSQLErrorMessage(r))
 		}
 	}()
+	rc.env.checkWritable(rc.model.name)
+	rc.model.checkWritable()
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Create"))
+	rc.checkModelAccess(security.Create)
 	fMap := data.FieldMap()
+	fMap = rc.model.fields.checkWritable(fMap, rc.forceComputeWrite(), rc.allowReadOnlyWrite())
 	fMap = filterMapOnAuthorizedFields(rc.model, fMap, rc.env.uid, security.Write)
 	rc.applyDefaults(&fMap, true)
 	rc.addAccessFieldsCreateData(&fMap)
@@ -166,6 +217,17 @@ func (rc *RecordCollection) applyDefaults(fMap *FieldMap, requiredOnly bool) {
 	}
 }
 
+// hasConstraints returns true if a constraint method is defined
+// on one of the fields of this model.
+func (m *Model) hasConstraints() bool {
+	for _, fi := range m.fields.registryByJSON {
+		if fi.constraint != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // checkConstraints executes the constraint method for each field defined
 // in the given fMap with the corresponding value.
 // Each method is only executed once, even if it is called by several fields.
@@ -196,13 +258,37 @@ func (rc *RecordCollection) addAccessFieldsCreateData(fMap *FieldMap) {
 	}
 }
 
+// WriteR updates the records of this RecordCollection with the given data by
+// calling the Write method, and returns a RecordCollection of exactly the
+// records that have been updated.
+//
+// If this RecordCollection has not been fetched yet, its query is resolved
+// first, with the record rules of the Write operation, so that the returned
+// records are those matching the query at the time of the update.
+func (rc *RecordCollection) WriteR(data FieldMapper, fieldsToUnset ...FieldNamer) *RecordCollection {
+	ids := rc.ids
+	if !rc.fetched {
+		ids = rc.addRecordRuleConditions(rc.env.uid, security.Write).Fetch().ids
+	}
+	updated := rc.env.Pool(rc.ModelName()).withIds(ids)
+	if updated.IsEmpty() {
+		return updated
+	}
+	updated.Call("Write", data, fieldsToUnset)
+	return updated
+}
+
 // update updates the database with the given data and returns the number of updated rows.
 // It panics in case of error.
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Call("Write")
 func (rc *RecordCollection) update(data FieldMapper, fieldsToUnset ...FieldNamer) bool {
-	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write)
+	rc.env.checkWritable(rc.model.name)
+	rc.model.checkWritable()
+	rc.checkModelAccess(security.Write)
 	fMap := data.FieldMap(fieldsToUnset...)
+	fMap = rc.model.fields.checkWritable(fMap, rc.forceComputeWrite(), rc.allowReadOnlyWrite())
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Write)
 	rSet.addAccessFieldsUpdateData(&fMap)
 	// We process inverse method before we convert RecordSets to ids
 	rSet.processInverseMethods(fMap)
@@ -223,6 +309,99 @@ func (rc *RecordCollection) update(data FieldMapper, fieldsToUnset ...FieldNamer
 	return true
 }
 
+// Resequence sets the given integer field of the records with the given ids
+// to 1, 2, 3... following their order in orderedIds, so that gaps and
+// duplicates in the previous values are normalized. This is typically used to
+// save the order of a list rearranged by the user.
+//
+// Ids of records that do not exist or that the current user is not allowed to
+// write are ignored and do not take a position: the remaining records are
+// numbered 1, 2, 3... without gaps, so that their values may be equal to the
+// ones of records that are filtered out by record rules. It returns the number
+// of updated records.
+//
+// Records are updated with a single query, unless the field is tracked or the
+// model has constraints, in which case each record is updated with Write.
+func (rc *RecordCollection) Resequence(orderedIds []int64, field string) int64 {
+	rc.env.checkWritable(rc.model.name)
+	rc.model.checkWritable()
+	rc.checkModelAccess(security.Write)
+	rc.CheckExecutionPermission(rc.model.methods.MustGet("Write"))
+	fi := rc.model.fields.MustGet(field)
+	if fi.fieldType != fieldtype.Integer || !fi.isStored() {
+		log.Panic("Resequence can only be used on stored integer fields", "model", rc.model.name, "field", field)
+	}
+	if !checkFieldPermission(fi, rc.env.uid, security.Write) {
+		log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: rc.model.name},
+			"You are not allowed to write this field", "model", rc.model.name, "field", field, "uid", rc.env.uid)
+	}
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, id := range orderedIds {
+		if id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+	// Pending changes must be in the DB before we update it directly
+	rc.env.Flush()
+	ids = rc.writableIds(ids)
+	if len(ids) == 0 {
+		return 0
+	}
+	if rc.model.hasConstraints() || len(rc.model.trackedFields([]string{fi.name})) > 0 {
+		for i, id := range ids {
+			rc.env.Pool(rc.ModelName()).withIds([]int64{id}).Call("Write", FieldMap{fi.name: i + 1})
+		}
+		return int64(len(ids))
+	}
+	rSet := rc.env.Pool(rc.ModelName()).withIds(ids)
+	fMap := make(FieldMap)
+	rSet.addAccessFieldsUpdateData(&fMap)
+	rSet.model.convertValuesToFieldType(&fMap)
+	sql, args := rSet.query.resequenceQuery(fi, ids, fMap)
+	res := rc.env.cr.Execute(sql, args...)
+	rc.env.cache.invalidateRecords(rc.model, ids)
+	rSet.processTriggers(FieldMap{fi.json: nil})
+	num, _ := res.RowsAffected()
+	return num
+}
+
+// writableIds returns the given ids without the ids of records that do not
+// exist or that the current user is not allowed to write, in the same order.
+func (rc *RecordCollection) writableIds(ids []int64) []int64 {
+	rSet := rc.env.Pool(rc.ModelName()).Search(rc.model.Field("ID").In(ids))
+	writable := make(map[int64]bool)
+	for _, id := range rSet.addRecordRuleConditions(rc.env.uid, security.Write).Fetch().ids {
+		writable[id] = true
+	}
+	var res []int64
+	for _, id := range ids {
+		if writable[id] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// forceComputeWrite returns true if computed fields without inverse method
+// can be written in the context of this RecordCollection.
+func (rc *RecordCollection) forceComputeWrite() bool {
+	ctx := rc.env.context
+	return ctx.GetBool("hexya_force_compute_write") || ctx.GetBool("hexya_allow_without_inverse")
+}
+
+// allowReadOnlyWrite returns true if fields declared with ReadOnly can be
+// written in the context of this RecordCollection. This is only the case when
+// it has been obtained with WithReadOnlyWrite, whatever its context.
+func (rc *RecordCollection) allowReadOnlyWrite() bool {
+	return rc.env.allowReadOnlyWrite
+}
+
 // addAccessFieldsUpdateData adds appropriate WriteDate and WriteUID fields to
 // the given FieldMap.
 func (rc *RecordCollection) addAccessFieldsUpdateData(fMap *FieldMap) {
@@ -232,6 +411,134 @@ func (rc *RecordCollection) addAccessFieldsUpdateData(fMap *FieldMap) {
 	}
 }
 
+// writeIfChanged updates each record of this RecordCollection with the fields
+// of data whose value differs from the record's current value. Records with
+// no changed field are not written at all, so that no UPDATE query is issued
+// and WriteDate is not modified. Records with the same changed fields are
+// updated together. It returns the number of updated records.
+func (rc *RecordCollection) writeIfChanged(data FieldMapper, fieldsToUnset ...FieldNamer) int64 {
+	fMap := data.FieldMap(fieldsToUnset...)
+	fMap.RemovePK()
+	var (
+		keys    []string
+		groups  = make(map[string][]int64)
+		changes = make(map[string]FieldMap)
+		count   int64
+	)
+	for _, rec := range rc.Records() {
+		changed := rec.changedFields(fMap)
+		if len(changed) == 0 {
+			continue
+		}
+		fields := changed.Keys()
+		sort.Strings(fields)
+		key := strings.Join(fields, ",")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			changes[key] = changed
+		}
+		groups[key] = append(groups[key], rec.ids[0])
+		count++
+	}
+	for _, key := range keys {
+		rc.Browse(groups[key]...).Call("Write", changes[key])
+	}
+	return count
+}
+
+// changedFields returns a FieldMap with the entries of fMap whose value is
+// different from the current value of this record.
+// This RecordCollection must be a singleton.
+func (rc *RecordCollection) changedFields(fMap FieldMap) FieldMap {
+	rc.EnsureOne()
+	res := make(FieldMap)
+	for field, value := range fMap {
+		fi := rc.model.fields.MustGet(field)
+		current := rc.Get(fi.name)
+		if fi.isRelationField() {
+			if !sameIds(current.(RecordSet).Ids(), relationValueIds(value)) {
+				res[field] = value
+			}
+			continue
+		}
+		newVal := FieldMap{fi.json: value}
+		rc.model.convertValuesToFieldType(&newVal)
+		if !reflect.DeepEqual(current, newVal[fi.json]) {
+			res[field] = value
+		}
+	}
+	return res
+}
+
+// relationValueIds returns the ids referenced by the given value of a relation
+// field. value can be a RecordSet, an id, a slice of ids or nil.
+func relationValueIds(value interface{}) []int64 {
+	switch v := value.(type) {
+	case RecordSet:
+		return v.Ids()
+	case []int64:
+		return v
+	case nil, bool, *interface{}, []interface{}:
+		return nil
+	default:
+		id, err := nbutils.CastToInteger(v)
+		if err != nil {
+			log.PanicWithError(&Error{Kind: ErrTypeMismatch, Cause: err},
+				"Unable to cast relation value to id", "value", value, "error", err)
+		}
+		if id == 0 {
+			return nil
+		}
+		return []int64{id}
+	}
+}
+
+// sameIds returns true if ids1 and ids2 hold the same ids, regardless of order.
+func sameIds(ids1, ids2 []int64) bool {
+	if len(ids1) != len(ids2) {
+		return false
+	}
+	idsMap := make(map[int64]bool)
+	for _, id := range ids1 {
+		idsMap[id] = true
+	}
+	for _, id := range ids2 {
+		if !idsMap[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRecordsExist panics with an ErrRecordNotFound error if some records
+// of this RecordCollection do not exist in the database.
+func (rc *RecordCollection) checkRecordsExist(fMap FieldMap) {
+	if missing := rc.env.missingIds(rc.model, rc.ids); len(missing) > 0 {
+		log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: rc.ModelName()},
+			"Trying to update non existent records", "model", rc.ModelName(), "ids", missing, "values", fMap)
+	}
+}
+
+// missingIds returns the ids among the given ids for which there is no
+// record of the given model in the database.
+func (env Environment) missingIds(mi *Model, ids []int64) []int64 {
+	adapter := adapters[db.DriverName()]
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE id IN (?)`, adapter.quoteTableName(mi.tableName))
+	var existing []int64
+	env.cr.Select(&existing, query, ids)
+	found := make(map[int64]bool, len(existing))
+	for _, id := range existing {
+		found[id] = true
+	}
+	var res []int64
+	for _, id := range ids {
+		if !found[id] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
 // doUpdate just updates the database records pointed at by
 // this RecordCollection with the given fieldMap. It also
 // invalidates the cache for the record
@@ -244,13 +551,25 @@ func (rc *RecordCollection) doUpdate(fMap FieldMap) {
 	}()
 	fMap = filterMapOnAuthorizedFields(rc.model, fMap, rc.env.uid, security.Write)
 	var rcInCache, rcNotInCache = rc.env.cache.filterIdInCache(rc)
+	if rc.env.cache.writeBatch > 0 && rcNotInCache.Len() > 0 {
+		// In a write batch, all records are put in cache so that they are flushed at the end
+		rcNotInCache.checkRecordsExist(fMap)
+		rcInCache, rcNotInCache = rc.env.Pool(rc.ModelName()).withIds(rc.ids), rc.env.Pool(rc.ModelName())
+	}
 	// update DB only the record not in cache
 	if len(fMap) > 0 && rcNotInCache.Len() > 0 {
+		tracked := rc.model.trackedFields(fMap.Keys())
+		var oldValues map[int64]FieldMap
+		if len(tracked) > 0 {
+			oldValues = rc.env.trackedValues(rc.model, rcNotInCache.ids, tracked)
+		}
 		sql, args := rcNotInCache.query.updateQuery(fMap)
 		res := rcNotInCache.env.cr.Execute(sql, args...)
 		if num, _ := res.RowsAffected(); num == 0 {
-			log.Panic("Trying to update an empty RecordSet", "model", rcNotInCache.ModelName(), "values", fMap)
+			log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: rcNotInCache.ModelName()},
+				"Trying to update an empty RecordSet", "model", rcNotInCache.ModelName(), "values", fMap)
 		}
+		rc.env.logTrackingValues(rc.model, tracked, oldValues, fMap)
 	}
 	for _, rec := range rcInCache.Records() {
 		for k, v := range fMap {
@@ -365,6 +684,11 @@ func (rc *RecordCollection) substituteSQLErrorMessage(r interface{}) interface{}
 			return res
 		}
 	}
+	for indexName, index := range rc.model.uniqueIndexes {
+		if strings.Contains(err.Error(), indexName) {
+			return adapters[db.DriverName()].substituteErrorMessage(err, index.errorString)
+		}
+	}
 	return r
 }
 
@@ -372,27 +696,170 @@ func (rc *RecordCollection) substituteSQLErrorMessage(r interface{}) interface{}
 // This function is private and low level. It should not be called directly.
 // Instead use rs.Unlink() or rs.Call("Unlink")
 func (rc *RecordCollection) unlink() int64 {
+	rc.env.checkWritable(rc.model.name)
+	rc.model.checkWritable()
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Unlink"))
+	rc.checkModelAccess(security.Unlink)
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Unlink)
+	if rc.model.deletionPolicy == ArchiveOnUnlink {
+		if !rc.env.context.GetBool("hexya_hard_delete") {
+			return rSet.archive()
+		}
+		if !security.Registry.HasMembership(rc.env.uid, security.GroupAdmin) {
+			log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: rc.model.name},
+				"Only admins can delete records of archivable models", "model", rc.model.name, "uid", rc.env.uid)
+		}
+	}
+	if !rc.model.hasInboundReferences() {
+		return rSet.unlinkWithoutCascade()
+	}
 	ids := rSet.Ids()
-	sql, args := rSet.query.deleteQuery()
-	res := rSet.env.cr.Execute(sql, args...)
-	num, _ := res.RowsAffected()
-	for _, id := range ids {
-		rc.env.cache.invalidateRecord(rc.model, id)
+	sql, args := rSet.query.deleteReturningIdsQuery()
+	var deleted []int64
+	rSet.env.cr.Select(&deleted, sql, args...)
+	rc.env.cache.invalidateRecords(rc.model, append(deleted, ids...))
+	rc.env.forgetCascadeDeletedRecords()
+	rc.env.logDeletions(rc.model, deleted)
+	return int64(len(deleted))
+}
+
+// forgetCascadeDeletedRecords removes from the cache the records with pending
+// updates that have been deleted by the database through an ON DELETE CASCADE
+// constraint, so that they are not updated when the cache is flushed.
+func (env Environment) forgetCascadeDeletedRecords() {
+	pending := make(map[*Model][]int64)
+	for ref := range env.cache.scheduledUpdate {
+		if ref.model.hasCascadeReferences() {
+			pending[ref.model] = append(pending[ref.model], ref.id)
+		}
 	}
-	return num
+	for mi, ids := range pending {
+		if missing := env.missingIds(mi, ids); len(missing) > 0 {
+			env.cache.invalidateRecords(mi, missing)
+		}
+	}
+}
+
+// archive sets the Active field of the records of this RecordCollection
+// to false instead of deleting them. It returns the number of archived records.
+func (rc *RecordCollection) archive() int64 {
+	if _, ok := rc.model.fields.Get("Active"); !ok {
+		log.Panic("Model with ArchiveOnUnlink deletion policy has no Active field", "model", rc.model.name)
+	}
+	ids := rc.Ids()
+	if len(ids) == 0 {
+		return 0
+	}
+	rc.update(FieldMap{"Active": false})
+	return int64(len(ids))
+}
+
+// unlinkWithoutCascade deletes the records of this RecordCollection with a
+// single DELETE query and removes them from the cache in one pass.
+//
+// It must only be called on models that are not referenced by other models,
+// since the records deleted by cascade would not be removed from the cache.
+func (rc *RecordCollection) unlinkWithoutCascade() int64 {
+	if rc.query.isEmpty() {
+		return 0
+	}
+	sql, args := rc.query.deleteReturningIdsQuery()
+	var ids []int64
+	rc.env.cr.Select(&ids, sql, args...)
+	// rc.ids may hold records that only exist in the cache and that must
+	// not be inserted anymore.
+	rc.env.cache.invalidateRecords(rc.model, append(ids, rc.ids...))
+	rc.env.logDeletions(rc.model, ids)
+	return int64(len(ids))
 }
 
 // Search returns a new RecordSet filtering on the current one with the
-// additional given Condition
+// additional given Condition.
+//
+// The returned RecordSet is lazy: its ids are resolved from the database
+// the first time they are needed, for instance when reading a field or
+// iterating on its records. Searching in an explicitly empty RecordSet
+// returns an empty RecordSet.
 func (rc *RecordCollection) Search(cond *Condition) *RecordCollection {
+	rSet := rc.search(cond)
+	rSet.unfetch()
+	return rSet
+}
+
+// SearchDomain returns a new lazy RecordSet filtering on the current one with
+// the condition given as a domain. See ParseDomain for the domain format.
+func (rc *RecordCollection) SearchDomain(domain []interface{}) *RecordCollection {
+	return rc.Search(ParseDomain(domain))
+}
+
+// FilterTrue returns a new lazy RecordSet filtering on the current one with
+// the records whose given boolean field is true. field can be a path through
+// relation fields, such as "User.IsStaff".
+func (rc *RecordCollection) FilterTrue(field string) *RecordCollection {
+	rc.checkBooleanFilter(field)
+	return rc.Search(rc.model.Field(field).Equals(true))
+}
+
+// FilterFalse returns a new lazy RecordSet filtering on the current one with
+// the records whose given boolean field is false. Null values are considered
+// false.
+func (rc *RecordCollection) FilterFalse(field string) *RecordCollection {
+	rc.checkBooleanFilter(field)
+	return rc.Search(rc.model.Field(field).Equals(false).Or().Field(field).IsNull())
+}
+
+// FilterNull returns a new lazy RecordSet filtering on the current one with
+// the records whose given field is null in the database, that is with an
+// IS NULL condition. Relation fields are null when they point to no record.
+func (rc *RecordCollection) FilterNull(field string) *RecordCollection {
+	rc.model.getRelatedFieldInfo(field)
+	return rc.Search(rc.model.Field(field).IsNull())
+}
+
+// FilterNotNull returns a new lazy RecordSet filtering on the current one
+// with the records whose given field is not null in the database, that is
+// with an IS NOT NULL condition.
+func (rc *RecordCollection) FilterNotNull(field string) *RecordCollection {
+	rc.model.getRelatedFieldInfo(field)
+	return rc.Search(rc.model.Field(field).IsNotNull())
+}
+
+// checkBooleanFilter panics if the given field path does
+// not lead to a boolean field of this RecordCollection's model.
+func (rc *RecordCollection) checkBooleanFilter(field string) {
+	if fi := rc.model.getRelatedFieldInfo(field); fi.fieldType != fieldtype.Boolean {
+		log.Panic("Boolean filters can only be used on boolean fields", "model", rc.model.name, "field", field)
+	}
+}
+
+// search returns a new RecordSet filtering on the current one with the
+// additional given Condition. Contrary to Search, the ids of rc are kept
+// if they have already been fetched.
+func (rc *RecordCollection) search(cond *Condition) *RecordCollection {
 	rSetVal := *rc
 	rSetVal.query = rc.query.clone()
 	rSetVal.query.cond = rSetVal.query.cond.AndCond(cond)
 	return &rSetVal
 }
 
+// unfetch marks this RecordCollection as filtered but not searched yet, so
+// that its ids are resolved again from its query when they are needed.
+//
+// Explicitly empty RecordCollections are left empty, and RecordCollections
+// with records that only exist in the cache are left unchanged.
+func (rc *RecordCollection) unfetch() {
+	if !rc.fetched || len(rc.ids) == 0 {
+		return
+	}
+	for _, id := range rc.ids {
+		if id <= 0 {
+			return
+		}
+	}
+	rc.fetched = false
+	rc.ids = nil
+}
+
 // NoDistinct removes the DISTINCT keyword from this RecordSet query.
 // By default, all queries are distinct.
 func (rc *RecordCollection) NoDistinct() *RecordCollection {
@@ -403,26 +870,102 @@ func (rc *RecordCollection) NoDistinct() *RecordCollection {
 }
 
 // Limit returns a new RecordSet with only the first 'limit' records.
+// A zero limit means no limit, except for SearchAndCount which then
+// only counts the records.
+//
+// In methods called through RPC, limits above MaxLimit, as well as a zero
+// limit, are capped at MaxLimit when the query is executed, unless the cap has
+// been overridden with WithMaxLimit. Limit panics if limit is negative.
 func (rc *RecordCollection) Limit(limit int) *RecordCollection {
+	if limit < 0 {
+		log.Panic("Limit must not be negative", "model", rc.ModelName(), "limit", limit)
+	}
 	rSet := *rc
 	rSet.query = rSet.query.clone()
 	rSet.query.limit = limit
+	rSet.query.hasLimit = true
+	rSet.unfetch()
 	return &rSet
 }
 
-// Offset returns a new RecordSet with only the records starting at offset
+// Offset returns a new RecordSet with only the records starting at offset.
+// Negative offsets are taken as zero.
 func (rc *RecordCollection) Offset(offset int) *RecordCollection {
+	if offset < 0 {
+		offset = 0
+	}
 	rSet := *rc
 	rSet.query = rSet.query.clone()
 	rSet.query.offset = offset
+	rSet.unfetch()
+	return &rSet
+}
+
+// WithMaxLimit returns a new RecordSet whose limit is capped at maxLimit
+// instead of the maximum limit of its Environment. If maxLimit is zero or
+// negative, the limit is not capped at all.
+//
+// This is meant for trusted callers that need larger pages than the ones
+// allowed to RPC clients.
+func (rc *RecordCollection) WithMaxLimit(maxLimit int) *RecordCollection {
+	if maxLimit <= 0 {
+		maxLimit = -1
+	}
+	rSet := *rc
+	rSet.query = rSet.query.clone()
+	rSet.query.maxLimit = maxLimit
+	rSet.unfetch()
 	return &rSet
 }
 
-// OrderBy returns a new RecordSet ordered by the given ORDER BY expressions
+// OrderBy returns a new RecordSet ordered by the given ORDER BY expressions.
+//
+// Each expression is a field path, which may go through relation fields such
+// as "Profile.Age", optionally followed by ASC or DESC and by NULLS FIRST or
+// NULLS LAST. Without NULLS modifier, the placement of null values depends on
+// the database: PostgreSQL sorts them last in ascending order and first in
+// descending order.
+//
+// Records with equal sort keys are finally ordered by id, unless id is already
+// one of the expressions, so that paginated searches are stable.
+//
+// In grouped queries, groups can also be ordered by the aggregate of a
+// numeric field that is not grouped, or by their number of records with
+// GroupCount, e.g. OrderBy("Amount DESC") orders groups by the sum of Amount.
 func (rc *RecordCollection) OrderBy(exprs ...string) *RecordCollection {
+	for _, expr := range exprs {
+		parseOrderExpr(expr)
+	}
 	rSet := *rc
 	rSet.query = rSet.query.clone()
 	rSet.query.orders = append(rSet.query.orders, exprs...)
+	rSet.unfetch()
+	return &rSet
+}
+
+// Collate returns a new RecordSet whose text fields are sorted with the collation
+// of the given locale, such as "fr_FR", instead of the bytewise order. This gives
+// human-friendly ordering, where case and accents do not come first. If locale is
+// empty, the 'lang' key of the context is used.
+//
+// The collation of a locale is taken from Collations if it is set there, or else
+// given by the database driver. If the database has no collation for the locale,
+// the default collation of the database is used.
+func (rc *RecordCollection) Collate(locale string) *RecordCollection {
+	if locale == "" {
+		locale = rc.Env().Context().GetString("lang")
+	}
+	collation, ok := Collations[locale]
+	if !ok {
+		collation = adapters[db.DriverName()].collation(locale)
+	}
+	if collation != "" && !collationRegexp.MatchString(collation) {
+		log.Panic("Invalid collation", "model", rc.ModelName(), "locale", locale, "collation", collation)
+	}
+	rSet := *rc
+	rSet.query = rSet.query.clone()
+	rSet.query.collation = collation
+	rSet.unfetch()
 	return &rSet
 }
 
@@ -438,12 +981,30 @@ func (rc *RecordCollection) GroupBy(fields ...FieldNamer) *RecordCollection {
 	return &rSet
 }
 
+// Having returns a new grouped RecordSet whose groups are filtered with the
+// given condition on their aggregated values, in an SQL HAVING clause.
+//
+// In the condition, grouped fields stand for their value, numeric fields for
+// their aggregate (e.g. the sum of the values of the group) and the GroupCount
+// pseudo field for the number of records of the group.
+func (rc *RecordCollection) Having(cond *Condition) *RecordCollection {
+	rSet := *rc
+	rSet.query = rSet.query.clone()
+	if rSet.query.having == nil {
+		rSet.query.having = cond
+	} else {
+		rSet.query.having = rSet.query.having.AndCond(cond)
+	}
+	return &rSet
+}
+
 // Fetch query the database with the current filter and returns a RecordSet
 // with the queries ids.
 //
 // Fetch is lazy and only return ids. Use Load() instead
 // if you want to fetch all fields.
 func (rc *RecordCollection) Fetch() *RecordCollection {
+	rc.checkModelAccess(security.Read)
 	if rc.fetched {
 		return rc
 	}
@@ -466,7 +1027,8 @@ func (rc *RecordCollection) SearchAll() *RecordCollection {
 // SearchCount fetch from the database the number of records that match the RecordSet conditions
 // It panics in case of error
 func (rc *RecordCollection) SearchCount() int {
-	rSet := rc.Limit(0)
+	rc.checkModelAccess(security.Read)
+	rSet := rc.WithMaxLimit(0).Limit(0)
 	addNameSearchesToCondition(rSet.model, rSet.query.cond)
 	sql, args := rSet.query.countQuery()
 	var res int
@@ -474,6 +1036,75 @@ func (rc *RecordCollection) SearchCount() int {
 	return res
 }
 
+// SearchAndCount fetches the records of this RecordSet and returns them with
+// the total number of records matching its conditions, regardless of its limit
+// and offset. Record rules are applied to both.
+//
+// If the limit of this RecordSet has been set to zero with Limit, no record is
+// fetched: an empty RecordSet is returned with the total, which is computed in
+// a single query. This is meant for callers that only need the number of
+// records matching a filter.
+func (rc *RecordCollection) SearchAndCount() (*RecordCollection, int) {
+	if rc.query.isEmpty() {
+		return rc, 0
+	}
+	countOnly := rc.query.hasLimit && rc.query.limit == 0
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
+	total := rSet.SearchCount()
+	if countOnly {
+		return rc.env.Pool(rc.ModelName()), total
+	}
+	return rSet.Fetch(), total
+}
+
+// subQuery returns the SQL query string and parameters selecting the ids of
+// this RecordCollection, to be inserted as a subquery in another query.
+//
+// Record rules are applied as if the records were loaded.
+func (rc *RecordCollection) subQuery() (string, SQLParams) {
+	rc.checkModelAccess(security.Read)
+	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
+	addNameSearchesToCondition(rSet.model, rSet.query.cond)
+	return rSet.query.selectQuery([]string{"id"})
+}
+
+// SearchRead searches the records matching the given domain, and returns the
+// given fields of the page of these records defined by offset and limit, as well
+// as the total number of matching records regardless of offset and limit.
+//
+// order is a comma separated list of ORDER BY expressions, such as "Name desc, id".
+// The model's default order is used if order is empty. A negative limit means no
+// limit. A zero limit means that only the total is wanted: no record is read and
+// an empty slice is returned with the total, which is computed in a single query.
+// An empty domain matches all records.
+func (rc *RecordCollection) SearchRead(domain []interface{}, fields []string, offset, limit int, order string) ([]FieldMap, int64) {
+	rSet := rc
+	if rSet.query.isEmpty() {
+		rSet = rSet.SearchAll()
+	}
+	rSet = rSet.SearchDomain(domain)
+	if limit == 0 {
+		_, total := rSet.Limit(0).SearchAndCount()
+		return []FieldMap{}, int64(total)
+	}
+	rSet = rSet.addRecordRuleConditions(rSet.env.uid, security.Read)
+	total := int64(rSet.SearchCount())
+	if order != "" {
+		exprs := strings.Split(order, ",")
+		for i, expr := range exprs {
+			exprs[i] = strings.TrimSpace(expr)
+		}
+		rSet = rSet.OrderBy(exprs...)
+	}
+	rSet = rSet.Offset(offset)
+	if limit < 0 {
+		limit = 0
+	}
+	rSet = rSet.Limit(limit)
+	records := rSet.WithPrefetchFields(fields...).Call("Read", fields).([]FieldMap)
+	return records, total
+}
+
 // Load query all data of the RecordCollection and store in cache.
 // fields are the fields to retrieve in the path format,
 // i.e. "User.Profile.Age" or "user_id.profile_id.age".
@@ -483,6 +1114,7 @@ func (rc *RecordCollection) SearchCount() int {
 // fields to be retrieved.
 func (rc *RecordCollection) Load(fields ...string) *RecordCollection {
 	rc.CheckExecutionPermission(rc.model.methods.MustGet("Load"))
+	rc.checkModelAccess(security.Read)
 	if rc.query.isEmpty() {
 		// Never load RecordSets without query.
 		return rc
@@ -491,9 +1123,6 @@ func (rc *RecordCollection) Load(fields ...string) *RecordCollection {
 		log.Panic("Trying to load a grouped query", "model", rc.model, "groups", rc.query.groups)
 	}
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
-	if len(rSet.query.orders) == 0 {
-		rSet.query.orders = rSet.model.defaultOrder
-	}
 	var results []FieldMap
 	if len(fields) == 0 {
 		fields = rSet.model.fields.storedFieldNames()
@@ -502,8 +1131,16 @@ func (rc *RecordCollection) Load(fields ...string) *RecordCollection {
 	addNameSearchesToCondition(rSet.model, rSet.query.cond)
 	subFields, rSet := rSet.substituteRelatedFields(fields)
 	dbFields := filterOnDBFields(rSet.model, subFields)
-	sql, args := rSet.query.selectQuery(dbFields)
-	rows := dbQuery(rSet.env.cr.tx, sql, args...)
+	query := rSet.query
+	if len(query.orders) == 0 {
+		// Apply the default order on a copy of the query, so that
+		// a later OrderBy on this RecordCollection overrides it.
+		defQuery := *query
+		defQuery.orders = rSet.model.defaultOrder
+		query = &defQuery
+	}
+	sql, args := query.selectQuery(dbFields)
+	rows := rSet.env.cr.query(sql, args...)
 	defer rows.Close()
 	var ids []int64
 	for rows.Next() {
@@ -513,6 +1150,11 @@ func (rc *RecordCollection) Load(fields ...string) *RecordCollection {
 			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
 		}
 		results = append(results, line)
+		for fName := range line {
+			if rSet.env.cache.hasBatchedUpdate(rSet.model, line["id"].(int64), fName) {
+				delete(line, fName)
+			}
+		}
 		rSet.env.cache.addRecord(rSet.model, line["id"].(int64), line)
 		ids = append(ids, line["id"].(int64))
 	}
@@ -529,6 +1171,9 @@ func (rc *RecordCollection) loadRelationFields(fields []string) {
 	for _, id := range rc.ids {
 		for _, fieldName := range fields {
 			fi := rc.model.getRelatedFieldInfo(fieldName)
+			if rc.env.cache.hasBatchedUpdate(rc.model, id, fi.json) {
+				continue
+			}
 			switch fi.fieldType {
 			case fieldtype.One2Many:
 				relRC := rc.env.Pool(fi.relatedModelName).Search(rc.Model().Field(fi.reverseFK).Equals(id)).Fetch()
@@ -569,6 +1214,8 @@ func (rc *RecordCollection) Get(fieldName string) interface{} {
 		res = fMap[fi.json]
 	case fi.isRelatedField() && !fi.isStored():
 		res, _ = rc.get(fi.relatedPath, false)
+	case fi.sqlGenerated:
+		res = rc.getSQLGenerated(fi)
 	default:
 		// If value is not in cache we fetch the whole model to speed up later calls to Get,
 		// except for the case of non stored relation fields, where we only load the requested field.
@@ -590,7 +1237,10 @@ func (rc *RecordCollection) Get(fieldName string) interface{} {
 		case int64:
 			res = newRecordCollection(rc.Env(), fi.relatedModel.name)
 			if r != 0 {
-				res = res.(RecordSet).Collection().withIds([]int64{r})
+				relRC := res.(RecordSet).Collection().withIds([]int64{r})
+				// Related records of the same group are loaded together
+				relRC.prefetch = rc.relatedPrefetchGroup(fi)
+				res = relRC
 			}
 		case []int64:
 			res = newRecordCollection(rc.Env(), fi.relatedModel.name).withIds(r)
@@ -599,6 +1249,73 @@ func (rc *RecordCollection) Get(fieldName string) interface{} {
 	return res
 }
 
+// ReadStrict returns a FieldMap for each record of this RecordCollection with
+// the id and the given fields, keyed as given, read from the cache only.
+// fields can be paths through relation fields, such as "Profile.Age".
+// Values are returned as they are in cache, so that relation fields are ids.
+//
+// Contrary to Get, ReadStrict never loads fields from the database. It
+// returns an error of kind ErrFieldNotLoaded if one of the fields is not in
+// cache for one of the records, so that code that expects the cache to be
+// prepared, for instance with WithPrefetchFields, can assert it is.
+func (rc *RecordCollection) ReadStrict(fields ...string) ([]FieldMap, error) {
+	rc.checkModelAccess(security.Read)
+	paths := make([]string, len(fields))
+	for i, field := range fields {
+		paths[i] = jsonizePath(rc.model, field)
+	}
+	res := make([]FieldMap, len(rc.Ids()))
+	for i, id := range rc.ids {
+		fData := FieldMap{"id": id}
+		for j, path := range paths {
+			if !rc.env.cache.checkIfInCache(rc.model, []int64{id}, []string{path}) {
+				return nil, &Error{
+					Kind:  ErrFieldNotLoaded,
+					Model: rc.model.name,
+					Cause: fmt.Errorf("field %s of %s record %d is not loaded", fields[j], rc.model.name, id),
+				}
+			}
+			fData[fields[j]] = rc.env.cache.get(rc.model, id, path)
+		}
+		res[i] = fData
+	}
+	return res, nil
+}
+
+// ReadValue returns the value of the given field of the single record of this
+// RecordCollection. field can be a path through relation fields, such as
+// "Profile.Age". The value of a relation field is returned as ids: an int64
+// for many2one and one2one fields (0 if null) and a []int64 otherwise.
+//
+// ReadValue panics like EnsureOne if this RecordCollection does not hold
+// exactly one record.
+func (rc *RecordCollection) ReadValue(field string) interface{} {
+	rc.Fetch()
+	rc.EnsureOne()
+	exprs := strings.Split(field, ExprSep)
+	rec := rc
+	for _, expr := range exprs[:len(exprs)-1] {
+		rs, ok := rec.Get(expr).(RecordSet)
+		if !ok {
+			log.Panic("Field in path is not a relation field", "model", rec.ModelName(), "field", expr, "path", field)
+		}
+		rec = rs.Collection()
+	}
+	fieldName := exprs[len(exprs)-1]
+	res := rec.Get(fieldName)
+	rs, ok := res.(RecordSet)
+	if !ok {
+		return res
+	}
+	if rec.model.fields.MustGet(fieldName).fieldType.Is2OneRelationType() {
+		if rs.IsEmpty() {
+			return int64(0)
+		}
+		return rs.Ids()[0]
+	}
+	return rs.Ids()
+}
+
 // get returns the value of field for this RecordSet.
 // It loads the cache if necessary before reading.
 // If all is true, all fields of the model are loaded, otherwise only field.
@@ -608,10 +1325,14 @@ func (rc *RecordCollection) get(field string, all bool) (interface{}, bool) {
 	rc.Fetch()
 	var dbCalled bool
 	if !rc.env.cache.checkIfInCache(rc.model, []int64{rc.ids[0]}, []string{field}) {
-		if !all {
-			rc.Load(field)
-		} else {
-			rc.Load()
+		loadSet := rc.prefetchSet()
+		switch {
+		case len(rc.prefetchFields) > 0:
+			loadSet.Load(rc.fieldsWithPrefetch(field)...)
+		case !all:
+			loadSet.Load(field)
+		default:
+			loadSet.Load()
 		}
 		dbCalled = true
 	}
@@ -621,6 +1342,146 @@ func (rc *RecordCollection) get(field string, all bool) (interface{}, bool) {
 	return rc.env.cache.get(rc.model, rc.ids[0], field), dbCalled
 }
 
+// WithPrefetchFields returns a copy of this RecordCollection that loads all
+// the given fields in a single query the first time a field that is not in
+// cache is read on one of its records. fields can be paths through relation
+// fields, such as "Profile.Age".
+//
+// This is a performance hint only: fields may still be loaded separately,
+// for instance after the cache has been invalidated. WithPrefetchFields
+// panics if one of the given fields does not exist.
+func (rc *RecordCollection) WithPrefetchFields(fields ...string) *RecordCollection {
+	for _, field := range fields {
+		rc.model.getRelatedFieldInfo(field)
+	}
+	rSet := *rc
+	rSet.prefetchFields = fields
+	return &rSet
+}
+
+// WithNullPolicy returns a copy of this RecordCollection that reads the null
+// values of scalar fields according to the given policy instead of
+// DefaultNullPolicy.
+func (rc *RecordCollection) WithNullPolicy(policy NullPolicy) *RecordCollection {
+	rSet := *rc
+	rSet.nullPolicy = policy
+	return &rSet
+}
+
+// readNullPolicy returns the NullPolicy with which this RecordCollection
+// reads null values.
+func (rc *RecordCollection) readNullPolicy() NullPolicy {
+	if rc.nullPolicy == 0 {
+		return DefaultNullPolicy
+	}
+	return rc.nullPolicy
+}
+
+// followPath returns the record reached from the first record of this
+// RecordCollection by following the relation fields of the given path,
+// such as "User.Profile.Age", and the name of the last field of the path.
+// The returned record is empty if a relation of the path is empty, so that
+// Get returns the zero value of the last field.
+func (rc *RecordCollection) followPath(path string) (*RecordCollection, string) {
+	exprs := strings.Split(path, ExprSep)
+	res := rc
+	for _, expr := range exprs[:len(exprs)-1] {
+		res = res.Get(expr).(RecordSet).Collection()
+		if len(res.ids) > 1 {
+			res = res.withIds(res.ids[:1])
+		}
+	}
+	return res, exprs[len(exprs)-1]
+}
+
+// IsNull returns true if the given field of the first record of this
+// RecordCollection is null in the database, or if this RecordCollection
+// is empty. Relation fields are null when they point to no record.
+//
+// Unlike Get, which returns the zero value of the field's type for null
+// values, IsNull distinguishes null values from actual zero values.
+// Non stored computed fields are never null.
+func (rc *RecordCollection) IsNull(fieldName string) bool {
+	rc.Fetch()
+	fi := rc.model.fields.MustGet(fieldName)
+	var res interface{}
+	switch {
+	case rc.IsEmpty():
+		return true
+	case fi.isComputedField() && !fi.isStored():
+		return false
+	case fi.isRelatedField() && !fi.isStored():
+		res, _ = rc.get(fi.relatedPath, false)
+	case fi.sqlGenerated:
+		res = rc.getSQLGenerated(fi)
+	default:
+		res, _ = rc.get(fieldName, !fi.fieldType.IsNonStoredRelationType())
+	}
+	switch r := res.(type) {
+	case nil, *interface{}:
+		return true
+	case int64:
+		return fi.isRelationField() && r == 0
+	case []int64:
+		return len(r) == 0
+	}
+	return false
+}
+
+// SelectRelated returns a copy of this RecordCollection that loads in a
+// single query the fields of its model and of the records at the end of each
+// of the given relation paths, such as "Profile" or "Profile.BestPost".
+//
+// Only the given relations are joined and only the records they point to are
+// populated in the cache, contrary to loading all the related fields. As for
+// WithPrefetchFields, the fields are loaded the first time a field that is not
+// in cache is read on one of the records.
+//
+// Each step of the paths must be a many2one or one2one field, otherwise
+// SelectRelated panics.
+func (rc *RecordCollection) SelectRelated(paths ...string) *RecordCollection {
+	fields := rc.model.fields.columnFieldNames()
+	for _, path := range paths {
+		relModel := rc.model.joinedModel(path)
+		for _, field := range relModel.fields.columnFieldNames() {
+			fields = append(fields, path+ExprSep+field)
+		}
+	}
+	return rc.WithPrefetchFields(fields...)
+}
+
+// joinedModel returns the model at the end of the given relation path of this
+// model. It panics if one of the steps of the path is not a many2one or one2one
+// field, that is a relation that can be joined.
+func (m *Model) joinedModel(path string) *Model {
+	curModel := m
+	for _, step := range strings.Split(path, ExprSep) {
+		fi, ok := curModel.fields.Get(step)
+		if !ok {
+			log.PanicWithError(&Error{Kind: ErrUnknownField, Model: curModel.name}, "Unknown field in relation path",
+				"model", m.name, "path", path, "field", step)
+		}
+		if !fi.fieldType.IsFKRelationType() {
+			log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: curModel.name}, "Relation path step is not a many2one or one2one field",
+				"model", m.name, "path", path, "field", step)
+		}
+		curModel = fi.relatedModel
+	}
+	return curModel
+}
+
+// fieldsWithPrefetch returns the prefetch fields of this
+// RecordCollection with the given field added if necessary
+func (rc *RecordCollection) fieldsWithPrefetch(field string) []string {
+	path := jsonizePath(rc.model, field)
+	for _, f := range rc.prefetchFields {
+		if jsonizePath(rc.model, f) == path {
+			return rc.prefetchFields
+		}
+	}
+	return append([]string{field}, rc.prefetchFields...)
+}
+
 // Set sets field given by fieldName to the given value. If the RecordSet has several
 // Records, all of them will be updated. Each call to Set makes an update query in the
 // database. It panics if it is called on an empty RecordSet.
@@ -631,7 +1492,20 @@ func (rc *RecordCollection) Set(fieldName string, value interface{}) {
 }
 
 // InvalidateCache clears the cache for this RecordSet data, and immediately reloads the data from the DB.
-func (rc *RecordCollection) InvalidateCache() {
+//
+// If fields are given, only these fields are removed from the cache, after the pending
+// changes of the records have been flushed. They are reloaded from the DB the next time
+// they are accessed, while the other fields stay in cache.
+func (rc *RecordCollection) InvalidateCache(fields ...string) {
+	if len(fields) > 0 {
+		rc.Flush()
+		for _, id := range rc.Ids() {
+			for _, field := range fields {
+				rc.env.cache.removeEntry(rc.model, id, rc.model.fields.MustGet(field).json)
+			}
+		}
+		return
+	}
 	for _, rec := range rc.Records() {
 		rc.env.cache.invalidateRecord(rc.model, rec.ids[0])
 	}
@@ -643,7 +1517,8 @@ func (rc *RecordCollection) InvalidateCache() {
 func (rc *RecordCollection) First(structPtr interface{}) {
 	rc.Fetch()
 	if err := checkStructPtr(structPtr); err != nil {
-		log.Panic("Invalid structPtr given", "error", err, "model", rc.ModelName(), "received", structPtr)
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName(), Cause: err},
+			"Invalid structPtr given", "error", err, "model", rc.ModelName(), "received", structPtr)
 	}
 	if rc.IsEmpty() {
 		return
@@ -658,11 +1533,58 @@ func (rc *RecordCollection) First(structPtr interface{}) {
 	MapToStruct(rc, structPtr, fMap)
 }
 
+// ReadOne populates structPtr with a copy of the single Record of this RecordCollection.
+// If cols are given, only these fields are loaded from the database, otherwise
+// all the fields of the struct are loaded. structPtr must a pointer to a struct.
+//
+// ReadOne panics if this RecordCollection does not hold exactly one record.
+// Use ReadOneErr to get an error instead.
+func (rc *RecordCollection) ReadOne(structPtr interface{}, cols ...string) {
+	if err := rc.ReadOneErr(structPtr, cols...); err != nil {
+		log.PanicWithError(err, "Unable to read record", "model", rc.ModelName(), "error", err)
+	}
+}
+
+// ReadOneErr populates structPtr like ReadOne, but returns an *Error of kind
+// ErrRecordNotFound if this RecordCollection is empty or of kind ErrMultipleRecords
+// if it holds more than one record instead of panicking.
+func (rc *RecordCollection) ReadOneErr(structPtr interface{}, cols ...string) error {
+	if err := checkStructPtr(structPtr); err != nil {
+		return &Error{Kind: ErrTypeMismatch, Model: rc.ModelName(), Cause: err}
+	}
+	rc.Fetch()
+	switch rc.Len() {
+	case 1:
+	case 0:
+		return &Error{Kind: ErrRecordNotFound, Model: rc.ModelName()}
+	default:
+		return &Error{Kind: ErrMultipleRecords, Model: rc.ModelName()}
+	}
+	fields := cols
+	if len(fields) == 0 {
+		typ := reflect.TypeOf(structPtr).Elem()
+		fields = make([]string, typ.NumField())
+		for i := 0; i < typ.NumField(); i++ {
+			fields[i] = typ.Field(i).Name
+		}
+	}
+	rc.Load(fields...)
+	fMap := rc.env.cache.getRecord(rc.Model(), rc.ids[0])
+	MapToStruct(rc, structPtr, fMap)
+	return nil
+}
+
 // All fetches a copy of all records of the RecordCollection and populates structSlicePtr.
+//
+// Relation fields of the struct that are pointers to structs, or slices of
+// pointers to structs, are hydrated with the related records as described in
+// MapToStruct. Records related through many2one and one2one fields are loaded
+// with one query per field and per level of nesting for all the records at once.
 func (rc *RecordCollection) All(structSlicePtr interface{}) {
 	rc.Fetch()
 	if err := checkStructSlicePtr(structSlicePtr); err != nil {
-		log.Panic("Invalid structPtr given", "error", err, "model", rc.ModelName(), "received", structSlicePtr)
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName(), Cause: err},
+			"Invalid structPtr given", "error", err, "model", rc.ModelName(), "received", structSlicePtr)
 	}
 	val := reflect.ValueOf(structSlicePtr)
 	// sspType is []*struct
@@ -671,6 +1593,7 @@ func (rc *RecordCollection) All(structSlicePtr interface{}) {
 	structType := sspType.Elem().Elem()
 	val.Elem().Set(reflect.MakeSlice(sspType, rc.Len(), rc.Len()))
 	recs := rc.Records()
+	rc.prefetchStructRelations(structType, make(map[cacheRef]bool))
 	for i := 0; i < rc.Len(); i++ {
 		fMap := rc.env.cache.getRecord(rc.Model(), recs[i].ids[0])
 		newStructPtr := reflect.New(structType).Interface()
@@ -679,11 +1602,49 @@ func (rc *RecordCollection) All(structSlicePtr interface{}) {
 	}
 }
 
+// prefetchStructRelations loads into the cache the records related to the
+// records of this RecordCollection through the relation fields of structType
+// that are hydrated into nested structs, recursively. seen holds the records
+// that have already been loaded, so that circular relations end.
+func (rc *RecordCollection) prefetchStructRelations(structType reflect.Type, seen map[cacheRef]bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		sf := structType.Field(i)
+		fi, ok := rc.model.fields.Get(sf.Name)
+		if !ok || !fi.isRelationField() {
+			continue
+		}
+		nestedType := hydratedStructType(sf.Type)
+		if nestedType == nil {
+			continue
+		}
+		if !rc.env.cache.checkIfInCache(rc.model, rc.ids, []string{fi.json}) {
+			rc.env.Pool(rc.ModelName()).Browse(rc.ids...).Load(fi.name)
+		}
+		var ids []int64
+		for _, id := range rc.ids {
+			for _, relID := range relationIds(rc.env.cache.get(rc.model, id, fi.json)) {
+				ref := fi.relatedModel.toRef(relID)
+				if !seen[ref] {
+					seen[ref] = true
+					ids = append(ids, relID)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		relRC := rc.env.Pool(fi.relatedModelName).Browse(ids...)
+		relRC.Load(modelStructFieldNames(relRC.model, nestedType)...)
+		relRC.prefetchStructRelations(nestedType, seen)
+	}
+}
+
 // Aggregates returns the result of this RecordCollection query, which must by a grouped query.
 func (rc *RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregateRow {
 	if len(rc.query.groups) == 0 {
 		log.Panic("Trying to get aggregates of a non-grouped query", "model", rc.model)
 	}
+	rc.checkModelAccess(security.Read)
 	rSet := rc.addRecordRuleConditions(rc.env.uid, security.Read)
 	fields := filterOnAuthorizedFields(rSet.model, rSet.env.uid, convertToStringSlice(fieldNames), security.Read)
 	subFields, rSet := rSet.substituteRelatedFields(fields)
@@ -695,7 +1656,7 @@ func (rc *RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregat
 	fieldsOperatorMap := rSet.fieldsGroupOperators(dbFields)
 	sql, args := rSet.query.selectGroupQuery(fieldsOperatorMap)
 	var res []GroupAggregateRow
-	rows := dbQuery(rSet.env.cr.tx, sql, args...)
+	rows := rSet.env.cr.query(sql, args...)
 	defer rows.Close()
 
 	for rows.Next() {
@@ -704,12 +1665,13 @@ func (rc *RecordCollection) Aggregates(fieldNames ...FieldNamer) []GroupAggregat
 		if err != nil {
 			log.Panic(err.Error(), "model", rSet.ModelName(), "fields", fields)
 		}
-		cnt := vals["__count"].(int64)
-		delete(vals, "__count")
+		cnt := vals[GroupCount].(int64)
+		delete(vals, GroupCount)
 		line := GroupAggregateRow{
 			Values:    vals,
 			Count:     int(cnt),
-			Condition: getGroupCondition(rc.query.groups, vals, rc.query.cond),
+			Condition: getGroupCondition(rc.model, rc.query.groups, vals, rc.query.cond),
+			pool:      rc.env.Pool(rc.ModelName()),
 		}
 		res = append(res, line)
 	}
@@ -744,28 +1706,159 @@ func (rc *RecordCollection) Condition() *Condition {
 	return rc.query.cond
 }
 
+// ToDomain returns the query condition associated with this RecordSet as a
+// domain, which can be stored and applied again later with SearchDomain.
+func (rc *RecordCollection) ToDomain() []interface{} {
+	return rc.query.cond.Serialize()
+}
+
 // Records returns the slice of RecordCollection singletons that constitute this
 // RecordCollection.
+//
+// The records pointed at by a many2one or one2one field of the returned
+// singletons are loaded together the first time one of them is read, so that
+// traversing such a field on each record issues a single query.
 func (rc *RecordCollection) Records() []*RecordCollection {
 	if !rc.env.cache.checkIfInCache(rc.model, rc.Ids(), rc.model.fields.storedFieldNames()) {
 		rc.Load()
 	}
+	if len(rc.prefetchFields) > 0 && !rc.env.cache.checkIfInCache(rc.model, rc.Ids(), rc.prefetchFields) {
+		rc.Load(rc.prefetchFields...)
+	}
 	res := make([]*RecordCollection, rc.Len())
+	group := &prefetchGroup{ids: rc.Ids()}
 	for i, id := range rc.Ids() {
 		newRC := newRecordCollection(rc.Env(), rc.ModelName())
 		res[i] = newRC.withIds([]int64{id})
+		res[i].prefetchFields = rc.prefetchFields
+		res[i].prefetch = group
 	}
 	return res
 }
 
+// RelatedRecords returns a RecordSet of the related model with the records
+// pointed at by the given relation field on all the records of this RecordSet,
+// without duplicates. field can be a field name or its JSON name, such as
+// "Tags" or "tag_ids".
+//
+// The field is loaded for all the records at once if it is not in cache yet.
+// The returned RecordSet can then be searched or filtered like any other.
+// It panics if field is not a relation field.
+func (rc *RecordCollection) RelatedRecords(field string) *RecordCollection {
+	fi := rc.model.fields.MustGet(field)
+	if !fi.fieldType.IsRelationType() {
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName()},
+			"RelatedRecords called on a non relation field", "model", rc.ModelName(), "field", field)
+	}
+	related := rc.env.Pool(fi.relatedModelName)
+	if rc.IsEmpty() {
+		return related
+	}
+	if !rc.env.cache.checkIfInCache(rc.model, rc.Ids(), []string{fi.json}) {
+		rc.Load(fi.json)
+	}
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, id := range rc.Ids() {
+		var relIds []int64
+		switch value := rc.env.cache.get(rc.model, id, fi.json).(type) {
+		case []int64:
+			relIds = value
+		case int64:
+			relIds = []int64{value}
+		}
+		for _, relID := range relIds {
+			if relID == 0 || seen[relID] {
+				continue
+			}
+			seen[relID] = true
+			ids = append(ids, relID)
+		}
+	}
+	return related.Browse(ids...)
+}
+
 // EnsureOne panics if rc is not a singleton
 func (rc *RecordCollection) EnsureOne() {
-	if rc.Len() != 1 {
-		log.Panic("Expected singleton", "model", rc.ModelName(), "received", rc)
+	switch rc.Len() {
+	case 1:
+	case 0:
+		log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: rc.ModelName()},
+			"Expected singleton", "model", rc.ModelName(), "received", rc)
+	default:
+		log.PanicWithError(&Error{Kind: ErrMultipleRecords, Model: rc.ModelName()},
+			"Expected singleton", "model", rc.ModelName(), "received", rc)
+	}
+}
+
+// diffIgnoredFields are the fields that are not compared by Diff
+// when no field is given, since they differ for nearly all records.
+var diffIgnoredFields = map[string]bool{
+	"ID":         true,
+	"CreateDate": true,
+	"CreateUID":  true,
+	"WriteDate":  true,
+	"WriteUID":   true,
+}
+
+// Diff compares the given fields of the single record of this RecordCollection
+// with those of the single record of other, and returns the fields whose values
+// differ, keyed by field name, with the value of this record first and the value
+// of other second. If no fields are given, all stored fields are compared except
+// the ID and the create and write date and user fields.
+//
+// Relation fields are compared by ids: many2one and one2one values are returned
+// as the id of the related record (0 if none), and other relation values as the
+// sorted slice of the related ids.
+//
+// It panics if one of the RecordSets does not contain exactly one record, or if
+// they are not of the same model.
+func (rc *RecordCollection) Diff(other RecordSet, fields ...string) map[string][2]interface{} {
+	rc.EnsureOne()
+	otherRC := other.Collection()
+	otherRC.EnsureOne()
+	if otherRC.model != rc.model {
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName()},
+			"Trying to compare records of different models", "model", rc.ModelName(), "other", otherRC.ModelName())
+	}
+	if len(fields) == 0 {
+		for _, f := range rc.model.fields.storedFieldNames() {
+			if !diffIgnoredFields[f] {
+				fields = append(fields, f)
+			}
+		}
+	}
+	res := make(map[string][2]interface{})
+	for _, f := range fields {
+		fi := rc.model.fields.MustGet(f)
+		val, otherVal := rc.diffValue(fi), otherRC.diffValue(fi)
+		if !reflect.DeepEqual(val, otherVal) {
+			res[fi.name] = [2]interface{}{val, otherVal}
+		}
+	}
+	return res
+}
+
+// diffValue returns the value of the given field of the single record of this
+// RecordCollection as compared by Diff.
+func (rc *RecordCollection) diffValue(fi *Field) interface{} {
+	val := rc.Get(fi.name)
+	if !fi.isRelationField() {
+		return val
+	}
+	ids := append([]int64{}, val.(RecordSet).Ids()...)
+	if fi.fieldType.IsFKRelationType() {
+		if len(ids) == 0 {
+			return int64(0)
+		}
+		return ids[0]
 	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
 }
 
-// IsEmpty returns true if rc is an empty RecordCollection
+// IsEmpty returns true if rc is an empty RecordCollection.
+// Like Len, it executes the search of rc if it has not been fetched yet.
 func (rc *RecordCollection) IsEmpty() bool {
 	return !rc.IsValid() || rc.Len() == 0
 }
@@ -787,7 +1880,9 @@ func (rc *RecordCollection) IsValid() bool {
 	return true
 }
 
-// Len returns the number of records in this RecordCollection
+// Len returns the number of records in this RecordCollection.
+// If rc has not been fetched yet, its search is executed first so that
+// the result does not depend on whether the ids have been resolved.
 func (rc *RecordCollection) Len() int {
 	rc.Fetch()
 	return len(rc.ids)
@@ -803,7 +1898,8 @@ func (rc *RecordCollection) Model() *Model {
 // set of unique records.
 func (rc *RecordCollection) Union(other RecordSet) *RecordCollection {
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to union RecordCollections of different models", "this", rc.ModelName(),
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName()},
+			"Unable to union RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -828,7 +1924,8 @@ func (rc *RecordCollection) Union(other RecordSet) *RecordCollection {
 // The result is guaranteed to be a set of unique records.
 func (rc *RecordCollection) Subtract(other RecordSet) *RecordCollection {
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to subtract RecordCollections of different models", "this", rc.ModelName(),
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName()},
+			"Unable to subtract RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -848,11 +1945,48 @@ func (rc *RecordCollection) Subtract(other RecordSet) *RecordCollection {
 	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
 }
 
+// AddIds returns a new RecordCollection with the records of this one and
+// the records of the same model with the given ids. Ids that are already
+// in this RecordCollection are not added twice.
+func (rc *RecordCollection) AddIds(ids ...int64) *RecordCollection {
+	rc.Fetch()
+	idMap := make(map[int64]bool)
+	var newIds []int64
+	for _, id := range append(rc.ids, ids...) {
+		if idMap[id] {
+			continue
+		}
+		idMap[id] = true
+		newIds = append(newIds, id)
+	}
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(newIds)
+}
+
+// SubtractIds returns a new RecordCollection with the records of this one
+// except those with the given ids. Ids that are not in this RecordCollection
+// are ignored.
+func (rc *RecordCollection) SubtractIds(ids ...int64) *RecordCollection {
+	rc.Fetch()
+	idMap := make(map[int64]bool)
+	for _, id := range ids {
+		idMap[id] = true
+	}
+	var newIds []int64
+	for _, id := range rc.ids {
+		if idMap[id] {
+			continue
+		}
+		newIds = append(newIds, id)
+	}
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(newIds)
+}
+
 // Intersect returns a new RecordCollection with only the records that are both
 // in this RecordCollection and in the other RecordSet.
 func (rc *RecordCollection) Intersect(other RecordSet) *RecordCollection {
 	if rc.ModelName() != other.ModelName() {
-		log.Panic("Unable to intersect RecordCollections of different models", "this", rc.ModelName(),
+		log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: rc.ModelName()},
+			"Unable to intersect RecordCollections of different models", "this", rc.ModelName(),
 			"other", other.ModelName())
 	}
 	rc.Fetch()
@@ -887,28 +2021,44 @@ func (rc *RecordCollection) CartesianProduct(records ...RecordSet) []*RecordColl
 }
 
 // Equals returns true if this RecordCollection is the same as other
-// i.e. they are of the same model and have the same ids
+// i.e. they are of the same model and have the same ids, regardless of
+// their order.
 func (rc *RecordCollection) Equals(other RecordSet) bool {
 	if rc.ModelName() != other.ModelName() {
 		return false
 	}
-	if rc.Len() != other.Len() {
-		return false
-	}
 	theseIds := make(map[int64]bool)
 	for _, id := range rc.Ids() {
 		theseIds[id] = true
 	}
+	otherIds := make(map[int64]bool)
 	for _, id := range other.Ids() {
 		if !theseIds[id] {
 			return false
 		}
-		delete(theseIds, id)
+		otherIds[id] = true
 	}
-	if len(theseIds) != 0 {
-		return false
+	return len(theseIds) == len(otherIds)
+}
+
+// Hash returns a stable hash of this RecordCollection computed from its
+// model name and its sorted ids. Two RecordSets that are Equals have the
+// same hash, so that it can be used as a cache key.
+func (rc *RecordCollection) Hash() string {
+	idMap := make(map[int64]bool)
+	for _, id := range rc.Ids() {
+		idMap[id] = true
 	}
-	return true
+	ids := make([]int64, 0, len(idMap))
+	for id := range idMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	h := sha256.New()
+	fmt.Fprintf(h, "%s%v", rc.ModelName(), ids)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // withIdMap adds the given ids to this RecordCollection and returns it too.
@@ -931,12 +2081,22 @@ func (rc *RecordCollection) withIds(ids []int64) *RecordCollection {
 		rc.query.cond = rc.Model().Field("ID").In(newIds)
 		rc.query.fetchAll = false
 		rc.query.limit = 0
+		rc.query.hasLimit = false
 		rc.query.offset = 0
 		rc.query.noDistinct = true
 	}
 	return rc
 }
 
+// Browse returns a new RecordCollection of the same model and in the same
+// Environment as this one, holding the records with the given ids.
+//
+// The database is not queried and the ids are not checked: trying
+// to read a record that does not exist will fail later.
+func (rc *RecordCollection) Browse(ids ...int64) *RecordCollection {
+	return newRecordCollection(rc.Env(), rc.ModelName()).withIds(ids)
+}
+
 // T translates the given string to the language specified by
 // the 'lang' key of rc.Env().Context(). If for any reason the
 // string cannot be translated, then src is returned.
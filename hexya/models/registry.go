@@ -114,9 +114,29 @@ type Model struct {
 	methods        *MethodsCollection
 	mixins         []*Model
 	sqlConstraints map[string]sqlConstraint
+	uniqueIndexes  map[string]uniqueIndex
 	sqlErrors      map[string]string
 	defaultOrder   []string
-}
+	deletionPolicy DeletionPolicy
+	logDeletions   bool
+	viewQuery      string
+	fieldSets      map[string][]string
+	// inboundRefs is true if a stored relation field of any model
+	// points to this model. It is computed at bootstrap.
+	inboundRefs bool
+}
+
+// A DeletionPolicy defines what Unlink does on the records of a model.
+type DeletionPolicy uint8
+
+const (
+	// HardDelete policy deletes records from the database. This is the default.
+	HardDelete DeletionPolicy = iota
+	// ArchiveOnUnlink policy sets the Active field of records to false instead
+	// of deleting them. Members of the admin group can still delete them by
+	// setting the "hexya_hard_delete" context key.
+	ArchiveOnUnlink
+)
 
 // An sqlConstraint holds the data needed to create a table constraint in the database
 type sqlConstraint struct {
@@ -125,6 +145,14 @@ type sqlConstraint struct {
 	errorString string
 }
 
+// A uniqueIndex holds the data needed to create a partial unique index in the database
+type uniqueIndex struct {
+	name        string
+	fields      []string
+	where       string
+	errorString string
+}
+
 // getRelatedModelInfo returns the Model of the related model when
 // following path.
 // - If skipLast is true, getRelatedModelInfo does not follow the last part of the path
@@ -237,7 +265,9 @@ func (m *Model) convertValuesToFieldType(fMap *FieldMap) {
 			inArgs := []reflect.Value{reflect.ValueOf(fMapValue)}
 			res := scanFunc.Call(inArgs)
 			if res[0].Interface() != nil {
-				log.Panic("Unable to scan into target Type", "error", res[0].Interface())
+				scanErr, _ := res[0].Interface().(error)
+				log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: m.name, Cause: scanErr},
+					"Unable to scan into target Type", "error", res[0].Interface())
 			}
 			val = valPtr.Elem()
 		default:
@@ -248,7 +278,8 @@ func (m *Model) convertValuesToFieldType(fMap *FieldMap) {
 				val, err = getSimpleTypeValue(fMapValue, fType)
 			}
 			if err != nil {
-				log.Panic(err.Error(), "model", m.name, "field", colName, "type", fType, "value", fMapValue)
+				log.PanicWithError(&Error{Kind: ErrTypeMismatch, Model: m.name, Cause: err},
+					err.Error(), "model", m.name, "field", colName, "type", fType, "value", fMapValue)
 			}
 		}
 		destVals.SetMapIndex(reflect.ValueOf(colName), val)
@@ -347,6 +378,24 @@ func (m *Model) isSystem() bool {
 	return false
 }
 
+// isSQLView returns true if this is a model backed by an SQL view.
+func (m *Model) isSQLView() bool {
+	if m.options&SQLViewModel > 0 {
+		return true
+	}
+	return false
+}
+
+// checkWritable panics with ErrReadOnlyModel if the records
+// of this model cannot be created, modified or deleted.
+func (m *Model) checkWritable() {
+	if !m.isSQLView() {
+		return
+	}
+	log.PanicWithError(&Error{Kind: ErrReadOnlyModel, Model: m.name},
+		"Write operation attempted on an SQL view model", "model", m.name)
+}
+
 // isSystem returns true if this is a n M2M Link model.
 func (m *Model) isM2MLink() bool {
 	if m.options&Many2ManyLinkModel > 0 {
@@ -361,6 +410,24 @@ func (m *Model) hasParentField() bool {
 	return parentExists
 }
 
+// hasInboundReferences returns true if a stored relation field of any model
+// (including M2M link models) points to this model, so that deleting records
+// of this model may cascade to other tables.
+func (m *Model) hasInboundReferences() bool {
+	return m.inboundRefs
+}
+
+// hasCascadeReferences returns true if this model has a relation field whose
+// records are deleted by the database when the related record is deleted.
+func (m *Model) hasCascadeReferences() bool {
+	for _, fi := range m.fields.registryByJSON {
+		if fi.fieldType.IsFKRelationType() && fi.isStored() && fi.onDelete == Cascade {
+			return true
+		}
+	}
+	return false
+}
+
 // Fields returns the fields collection of this model
 func (m *Model) Fields() *FieldsCollection {
 	return m.fields
@@ -371,14 +438,71 @@ func (m *Model) Methods() *MethodsCollection {
 	return m.methods
 }
 
+// methodFallbackName is the name of the method that holds the
+// fallback of a model set with SetMethodFallback.
+const methodFallbackName = "MethodFallback"
+
+// A MethodFallback is a function called when a method that does not exist
+// in a model is called on a RecordCollection. It receives the method name
+// and the call arguments and must return the method results.
+type MethodFallback func(rc *RecordCollection, method string, args []interface{}) []interface{}
+
+// SetMethodFallback sets the function called when an unknown method is
+// called on this model. This allows models to dispatch methods dynamically,
+// for instance to implement computed getters. Without a fallback, calling an
+// unknown method panics.
+//
+// The fallback is added to the model as the "MethodFallback" method, which
+// is returned so that execution permissions can be granted on it. Calling
+// an unknown method requires the permission to execute this method.
+//
+// It panics if called after bootstrap.
+func (m *Model) SetMethodFallback(fallback MethodFallback) *Method {
+	if Registry.bootstrapped {
+		log.Panic("Method fallbacks must be set before bootstrap", "model", m.name)
+	}
+	return m.AddMethod(methodFallbackName,
+		`MethodFallback is called with the name and the arguments of unknown methods`, fallback)
+}
+
+// SetSQLView turns this manual model into a read only model backed by an SQL
+// view with the given SELECT query. The view is created, or replaced, when
+// the database is synchronized. The query must return an "id" column and a
+// column for each stored field of the model.
+//
+// Records of this model can be searched, read and aggregated as usual, but
+// Create, Write and Unlink operations panic with ErrReadOnlyModel.
+//
+// It panics if this model has not been created with NewManualModel.
+func (m *Model) SetSQLView(query string) *Model {
+	if !m.isManual() {
+		log.Panic("Only manual models can be backed by an SQL view", "model", m.name)
+	}
+	m.options |= SQLViewModel
+	m.viewQuery = query
+	return m
+}
+
 // SetDefaultOrder sets the default order used by this model
 // when no OrderBy() is specified in a query. When unspecified,
-// default order is 'id asc'.
+// default order is 'id asc'. An explicit OrderBy() replaces the
+// default order entirely.
 //
 // Give the order fields in separate strings, such as
 // model.SetDefaultOrder("Name desc", "date asc", "id")
+//
+// It panics if an order expression is not valid.
 func (m *Model) SetDefaultOrder(orders ...string) {
-	m.defaultOrder = orders
+	for _, order := range orders {
+		parseOrderExpr(order)
+	}
+	m.defaultOrder = append([]string(nil), orders...)
+}
+
+// SetDeletionPolicy sets what Unlink does on the records of this model.
+// The ArchiveOnUnlink policy requires the model to have an Active field.
+func (m *Model) SetDeletionPolicy(policy DeletionPolicy) {
+	m.deletionPolicy = policy
 }
 
 // JSONizeFieldName returns the json name of the given fieldName
@@ -446,6 +570,32 @@ func (m *Model) RemoveSQLConstraint(name string) {
 	delete(m.sqlConstraints, fmt.Sprintf("%s_mancon", name))
 }
 
+// AddPartialUniqueConstraint makes the given fields unique among the records
+// that match the where SQL condition, such as "active" to ignore archived
+// records. It is created as a partial unique index in the database.
+//    - name is an arbitrary name to reference this constraint. It will be appended by
+//      the table name in the database, so there is only need to ensure that it is unique
+//      in this model.
+//    - fields are the fields whose values must be unique together.
+//    - where is the SQL condition selecting the records on which the constraint applies.
+//    - errorString is the text to display to the user when the constraint is violated
+//
+// Partial unique constraints are not created, with a warning, if the database
+// does not support partial indexes.
+func (m *Model) AddPartialUniqueConstraint(name string, fields []FieldNamer, where, errorString string) {
+	indexName := fmt.Sprintf("%s_%s_manidx", name, m.tableName)
+	fNames := make([]string, len(fields))
+	for i, f := range fields {
+		fNames[i] = f.String()
+	}
+	m.uniqueIndexes[indexName] = uniqueIndex{
+		name:        indexName,
+		fields:      fNames,
+		where:       where,
+		errorString: errorString,
+	}
+}
+
 // Underlying returns the underlying Model data object, i.e. itself
 func (m *Model) Underlying() *Model {
 	return m
@@ -503,8 +653,10 @@ func createModel(name string, options Option) *Model {
 		fields:         newFieldsCollection(),
 		methods:        newMethodsCollection(),
 		sqlConstraints: make(map[string]sqlConstraint),
+		uniqueIndexes:  make(map[string]uniqueIndex),
 		sqlErrors:      make(map[string]string),
 		defaultOrder:   []string{"id"},
+		fieldSets:      make(map[string][]string),
 	}
 	pk := &Field{
 		name:      "ID",
@@ -520,6 +672,7 @@ func createModel(name string, options Option) *Model {
 			}{},
 		).Field(0),
 	}
+	mi.acl.AddPermission(security.GroupEveryone, security.Create)
 	mi.fields.add(pk)
 	Registry.add(mi)
 	return mi
@@ -0,0 +1,140 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// A RelativeDate is a date relative to the current time, that can be used as
+// the argument of a condition on a date or datetime field. It is resolved to
+// an absolute date each time the query is executed, in the timezone given by
+// the "tz" key of the context (UTC if not set).
+//
+// A RelativeDate is made of an optional keyword among "now", "today",
+// "this_week", "this_month" and "this_year", which default to "now", followed
+// by an optional offset made of a sign, a number and a unit among "h" (hours),
+// "d" (days), "w" (weeks), "m" (months) and "y" (years). For instance, "-7d"
+// is seven days ago, "today" is midnight today and "this_month-1m" is the
+// first day of the previous month.
+//
+// Strings with this syntax given as argument of a condition on a date or
+// datetime field, for instance in a domain, are resolved the same way.
+type RelativeDate string
+
+// relativeDateRegex matches the RelativeDate syntax
+var relativeDateRegex = regexp.MustCompile(`^(now|today|this_week|this_month|this_year)?(?:([+-]\d+)([hdwmy]))?$`)
+
+// Resolve returns the absolute time of this RelativeDate relative to now,
+// in the given location. It returns an error if this RelativeDate is not
+// valid.
+func (rd RelativeDate) Resolve(now time.Time, loc *time.Location) (time.Time, error) {
+	matches := relativeDateRegex.FindStringSubmatch(string(rd))
+	if rd == "" || matches == nil {
+		return time.Time{}, fmt.Errorf("invalid relative date %q", string(rd))
+	}
+	t := now.In(loc)
+	year, month, day := t.Date()
+	switch matches[1] {
+	case "today":
+		t = time.Date(year, month, day, 0, 0, 0, 0, loc)
+	case "this_week":
+		// Weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		t = time.Date(year, month, day-offset, 0, 0, 0, 0, loc)
+	case "this_month":
+		t = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	case "this_year":
+		t = time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	if matches[2] == "" {
+		return t, nil
+	}
+	n, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid relative date %q: %s", string(rd), err)
+	}
+	switch matches[3] {
+	case "h":
+		t = t.Add(time.Duration(n) * time.Hour)
+	case "d":
+		t = t.AddDate(0, 0, n)
+	case "w":
+		t = t.AddDate(0, 0, 7*n)
+	case "m":
+		t = t.AddDate(0, n, 0)
+	case "y":
+		t = t.AddDate(n, 0, 0)
+	}
+	return t, nil
+}
+
+// isRelativeDate returns true if the given string has the RelativeDate syntax
+func isRelativeDate(s string) bool {
+	return s != "" && relativeDateRegex.MatchString(s)
+}
+
+// resolveRelativeDateArg returns the given condition argument for the field fi
+// with RelativeDate values, or strings with the RelativeDate syntax, replaced
+// by the absolute date or datetime they resolve to now in the timezone of the
+// given Environment. Other arguments are returned unchanged.
+func resolveRelativeDateArg(env *Environment, fi *Field, arg interface{}) interface{} {
+	if fi.fieldType != fieldtype.Date && fi.fieldType != fieldtype.DateTime {
+		return arg
+	}
+	var rd RelativeDate
+	switch a := arg.(type) {
+	case RelativeDate:
+		rd = a
+	case string:
+		if !isRelativeDate(a) {
+			return arg
+		}
+		rd = RelativeDate(a)
+	default:
+		return arg
+	}
+	t, err := rd.Resolve(time.Now(), env.location())
+	if err != nil {
+		log.Panic("Unable to resolve relative date", "field", fi.name, "error", err)
+	}
+	if fi.fieldType == fieldtype.Date {
+		year, month, day := t.Date()
+		return dates.Date{Time: time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+	}
+	// DateTime values are stored in the server's local time, as with dates.Now()
+	return dates.DateTime{Time: t.In(time.Local)}
+}
+
+// location returns the time location given by the "tz" key of the
+// context of this Environment, or UTC if it is not set or invalid.
+func (env Environment) location() *time.Location {
+	tz := env.context.GetString("tz")
+	if tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Warn("Invalid timezone in context, using UTC", "tz", tz, "error", err)
+		return time.UTC
+	}
+	return loc
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// A RetryPolicy defines how a transaction that failed with a
+// serialization error or because of a deadlock is retried.
+//
+// The delay before the nth retry is chosen randomly between half and
+// all of BaseDelay * 2^(n-1), and is capped to MaxDelay if it is set.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a transaction is
+	// retried after serialization errors.
+	MaxRetries uint8
+	// MaxDeadlockRetries is the maximum number of times a transaction
+	// is retried after deadlocks.
+	MaxDeadlockRetries uint8
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// MaxDelay is the maximum delay between two retries. 0 means no maximum.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used by ExecuteInNewEnvironment
+// and ExecuteInNewEnvironmentCtx.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:         DBSerializationMaxRetries,
+	MaxDeadlockRetries: DBDeadlockMaxRetries,
+	BaseDelay:          10 * time.Millisecond,
+	MaxDelay:           time.Second,
+}
+
+// A retryReason tells why a failed transaction can be retried
+type retryReason uint8
+
+const (
+	noRetry retryReason = iota
+	serializationRetry
+	deadlockRetry
+)
+
+// delay returns the time to wait before the given retry (starting at 1)
+// of the same reason
+func (rp RetryPolicy) delay(retry uint8) time.Duration {
+	if rp.BaseDelay <= 0 {
+		return 0
+	}
+	d := rp.BaseDelay << (retry - 1)
+	if d <= 0 || (rp.MaxDelay > 0 && d > rp.MaxDelay) {
+		// d <= 0 if the shift overflowed
+		d = rp.MaxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// wait blocks until the delay before the given retry has elapsed or until
+// ctx is done, in which case it returns ctx.Err().
+func (rp RetryPolicy) wait(ctx context.Context, retry uint8) error {
+	timer := time.NewTimer(rp.delay(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/tools/exceptions"
+)
+
+// JSON-RPC error codes returned by Dispatch
+const (
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCServerError    = -32000
+)
+
+// RPCDebug enables sending the debug information of errors to RPC clients.
+// It should only be set in development.
+var RPCDebug = false
+
+// reservedContextPrefix is the prefix of the context keys that are used
+// internally by the ORM and that cannot be set by RPC clients.
+const reservedContextPrefix = "hexya_"
+
+// An RPCRequest is a request to call a method of a model remotely.
+//
+// The method is called on the records of Model with the given IDs,
+// or on an empty RecordSet if IDs is empty. Args are the JSON encoded
+// arguments of the method, without the RecordSet receiver.
+type RPCRequest struct {
+	Model   string            `json:"model"`
+	Method  string            `json:"method"`
+	IDs     []int64           `json:"ids"`
+	Args    []json.RawMessage `json:"args"`
+	Context *types.Context    `json:"context"`
+}
+
+// An RPCResponse is the response to an RPCRequest.
+//
+// Result is the JSON encoded result of the method if it succeeded,
+// Error is set otherwise.
+type RPCResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// An RPCError is a JSON-RPC error object.
+type RPCError struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Data    RPCErrorData `json:"data"`
+}
+
+// RPCErrorData holds the details of an RPCError.
+//
+// Kind is the message of the kind of the ORM error (e.g. "access denied")
+// and Model the model on which it occurred, if any.
+type RPCErrorData struct {
+	Kind  string `json:"kind,omitempty"`
+	Model string `json:"model,omitempty"`
+	Debug string `json:"debug,omitempty"`
+}
+
+// Dispatch executes the given RPCRequest in a new Environment for the given
+// user and returns the RPCResponse to send back to the client.
+//
+// The arguments of the request are decoded against the parameter types of
+// the target method with CallJSON. Execution permissions are checked as for
+// any other method call. Query limits are capped at MaxLimit.
+func Dispatch(uid int64, req RPCRequest) RPCResponse {
+	model, ok := Registry.Get(req.Model)
+	if !ok || model.isMixin() {
+		return newRPCErrorResponse(RPCMethodNotFound, fmt.Sprintf("Unknown model %s", req.Model), nil)
+	}
+	if _, ok := model.methods.get(req.Method); !ok {
+		return newRPCErrorResponse(RPCMethodNotFound, fmt.Sprintf("Unknown method %s on model %s", req.Method, req.Model), nil)
+	}
+	var (
+		result    []byte
+		decodeErr error
+	)
+	err := ExecuteInNewEnvironment(uid, func(env Environment) {
+		env.maxLimit = MaxLimit
+		rs := env.Pool(req.Model)
+		if req.Context != nil {
+			rs = rs.WithNewContext(sanitizeRPCContext(req.Context))
+		}
+		if len(req.IDs) > 0 {
+			rs = rs.Browse(req.IDs...)
+		}
+		var res []interface{}
+		res, decodeErr = rs.callMultiJSON(req.Method, req.Args)
+		if decodeErr != nil {
+			return
+		}
+		for i, r := range res {
+			if rSet, ok := r.(RecordSet); ok {
+				res[i] = rSet.Ids()
+			}
+		}
+		var toEncode interface{}
+		switch len(res) {
+		case 0:
+		case 1:
+			toEncode = res[0]
+		default:
+			toEncode = res
+		}
+		var mErr error
+		result, mErr = json.Marshal(toEncode)
+		if mErr != nil {
+			log.Panic("Unable to encode method result", "model", req.Model, "method", req.Method, "error", mErr)
+		}
+	})
+	if decodeErr != nil {
+		return newRPCErrorResponse(RPCInvalidParams, decodeErr.Error(), decodeErr)
+	}
+	if err != nil {
+		return newRPCErrorResponse(RPCServerError, "Hexya Server Error", err)
+	}
+	return RPCResponse{Result: result}
+}
+
+// sanitizeRPCContext returns a copy of the given client context without
+// the keys that are reserved for internal use of the ORM.
+func sanitizeRPCContext(ctx *types.Context) *types.Context {
+	values := make(map[string]interface{})
+	for k, v := range ctx.ToMap() {
+		if strings.HasPrefix(k, reservedContextPrefix) {
+			continue
+		}
+		values[k] = v
+	}
+	return types.NewContext(values)
+}
+
+// newRPCErrorResponse returns an RPCResponse with an RPCError of the given
+// code and message. If err is not nil, the details of the RPCError are
+// extracted from it.
+func newRPCErrorResponse(code int, message string, err error) RPCResponse {
+	rpcErr := RPCError{
+		Code:    code,
+		Message: message,
+	}
+	var ormErr *Error
+	if errors.As(err, &ormErr) {
+		rpcErr.Data.Kind = ormErr.Kind.Error()
+		rpcErr.Data.Model = ormErr.Model
+	}
+	var userErr exceptions.UserError
+	if RPCDebug && errors.As(err, &userErr) {
+		rpcErr.Data.Debug = userErr.Debug
+	}
+	return RPCResponse{Error: &rpcErr}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// declareSavedSearchModel creates the SavedSearch model which stores the
+// named domains saved by the users for each model.
+func declareSavedSearchModel() {
+	savedSearch := createModel("SavedSearch", SystemModel)
+	savedSearch.InheritModel(Registry.MustGet("CommonMixin"))
+	savedSearch.AddFields(map[string]FieldDefinition{
+		"Name":     CharField{Required: true},
+		"ResModel": CharField{Required: true, Index: true},
+		"UserID":   IntegerField{Index: true},
+		"Shared":   BooleanField{},
+		"Domain":   TextField{},
+	})
+	savedSearch.SetDefaultOrder("Name", "id")
+}
+
+// savedSearches returns the saved searches of the model of this RecordCollection
+// that are visible by the current user, i.e. their own and the shared ones.
+// If name is not empty, only the saved searches with this name are returned.
+func (rc *RecordCollection) savedSearches(name string) *RecordCollection {
+	savedSearches := rc.env.Pool("SavedSearch").Sudo()
+	ssModel := savedSearches.model
+	cond := ssModel.Field("ResModel").Equals(rc.ModelName()).
+		AndCond(ssModel.Field("UserID").Equals(rc.env.uid).Or().Field("Shared").Equals(true))
+	if name != "" {
+		cond = cond.And().Field("Name").Equals(name)
+	}
+	return savedSearches.Search(cond)
+}
+
+// SaveSearch stores the condition of this RecordCollection as a domain under
+// the given name for the current user, so that it can be applied again later
+// with ApplySavedSearch. If shared is true, the saved search is available to
+// all users.
+//
+// An existing saved search of the current user with the same name is replaced.
+func (rc *RecordCollection) SaveSearch(name string, shared bool) {
+	domain, err := json.Marshal(rc.ToDomain())
+	if err != nil {
+		log.Panic("Unable to serialize search domain", "model", rc.ModelName(), "name", name, "error", err)
+	}
+	data := FieldMap{
+		"Name":     name,
+		"ResModel": rc.ModelName(),
+		"UserID":   rc.env.uid,
+		"Shared":   shared,
+		"Domain":   string(domain),
+	}
+	savedSearches := rc.env.Pool("SavedSearch").Sudo()
+	ssModel := savedSearches.model
+	existing := savedSearches.Search(ssModel.Field("ResModel").Equals(rc.ModelName()).
+		And().Field("UserID").Equals(rc.env.uid).
+		And().Field("Name").Equals(name))
+	if !existing.IsEmpty() {
+		existing.Call("Write", data)
+		return
+	}
+	savedSearches.Call("Create", data)
+}
+
+// SavedSearches returns the sorted names of the saved searches of this
+// RecordCollection's model that the current user can apply.
+func (rc *RecordCollection) SavedSearches() []string {
+	names := make(map[string]bool)
+	for _, ss := range rc.savedSearches("").Records() {
+		names[ss.Get("Name").(string)] = true
+	}
+	res := make([]string, 0, len(names))
+	for name := range names {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ApplySavedSearch returns a new lazy RecordSet filtering on this one with the
+// domain of the saved search with the given name. The current user's own
+// saved searches take precedence over the ones shared by other users.
+//
+// It panics with an ErrRecordNotFound error if no such saved search exists.
+func (rc *RecordCollection) ApplySavedSearch(name string) *RecordCollection {
+	var savedSearch *RecordCollection
+	for _, ss := range rc.savedSearches(name).Records() {
+		if savedSearch == nil || ss.Get("UserID").(int64) == rc.env.uid {
+			savedSearch = ss
+		}
+	}
+	if savedSearch == nil {
+		log.PanicWithError(&Error{Kind: ErrRecordNotFound, Model: "SavedSearch"}, "Unknown saved search",
+			"model", rc.ModelName(), "name", name, "uid", rc.env.uid)
+	}
+	var domain []interface{}
+	if err := json.Unmarshal([]byte(savedSearch.Get("Domain").(string)), &domain); err != nil {
+		log.Panic("Unable to parse saved search domain", "model", rc.ModelName(), "name", name, "error", err)
+	}
+	return rc.SearchDomain(domain)
+}
@@ -63,6 +63,27 @@ func (g Group) String() string {
 	return fmt.Sprintf("Group(%s)", g.ID)
 }
 
+// Implies returns true if members of this group are also members of the
+// other group through inheritance, directly or transitively.
+func (g *Group) Implies(other *Group) bool {
+	return g.implies(other, make(map[*Group]bool))
+}
+
+// implies returns true if this group implies the other group.
+// visited holds the groups already walked through.
+func (g *Group) implies(other *Group, visited map[*Group]bool) bool {
+	if visited[g] {
+		return false
+	}
+	visited[g] = true
+	for _, parent := range g.Inherits {
+		if parent == other || parent.implies(other, visited) {
+			return true
+		}
+	}
+	return false
+}
+
 // A GroupCollection keeps a list of groups
 type GroupCollection struct {
 	sync.RWMutex
@@ -84,13 +105,17 @@ func (gc *GroupCollection) NewGroup(ID, name string, inherits ...*Group) *Group
 }
 
 // RegisterGroup adds the given group to this GroupCollection
-// If group with the same ID exists, this methods panics.
+// If group with the same ID exists or if the group implies itself
+// through inheritance, this methods panics.
 func (gc *GroupCollection) RegisterGroup(group *Group) {
 	gc.Lock()
 	defer gc.Unlock()
 	if _, exists := gc.groups[group.ID]; exists {
 		log.Panic("Trying register a new group with an existing ID", "ID", group.ID)
 	}
+	if group.Implies(group) {
+		log.Panic("Trying to register a group with an inheritance cycle", "ID", group.ID)
+	}
 	gc.groups[group.ID] = group
 }
 
@@ -127,6 +152,39 @@ func (gc *GroupCollection) UnregisterGroup(group *Group) {
 	delete(gc.groups, group.ID)
 }
 
+// AddImpliedGroups makes the given group inherit the implied groups, so that
+// the members of group become members of the implied groups and of the groups
+// they inherit. Current members of group are updated accordingly.
+//
+// This method panics if an implied group is group itself or inherits group,
+// since this would create an inheritance cycle.
+func (gc *GroupCollection) AddImpliedGroups(group *Group, implied ...*Group) {
+	for _, imp := range implied {
+		if imp == group || imp.Implies(group) {
+			log.Panic("Adding implied group would create an inheritance cycle", "ID", group.ID, "implied", imp.ID)
+		}
+	}
+	gc.Lock()
+	group.Inherits = append(group.Inherits, implied...)
+	missing := make(map[int64][]*Group)
+	for uid, groups := range gc.memberships {
+		if _, ok := groups[group]; !ok {
+			continue
+		}
+		for _, imp := range implied {
+			if _, ok := groups[imp]; !ok {
+				missing[uid] = append(missing[uid], imp)
+			}
+		}
+	}
+	gc.Unlock()
+	for uid, imps := range missing {
+		for _, imp := range imps {
+			gc.AddMembership(uid, imp, true)
+		}
+	}
+}
+
 // GetGroup returns the group with the given groupID or nil if not found
 func (gc *GroupCollection) GetGroup(groupID string) *Group {
 	return gc.groups[groupID]
@@ -24,3 +24,7 @@ const (
 	Unlink
 	All = Read | Write | Unlink
 )
+
+// Create is the permission to create records. It only applies to
+// models access control lists and is therefore not part of All.
+const Create Permission = 1 << 3
@@ -177,3 +177,38 @@ func TestGroupRegistry(t *testing.T) {
 		})
 	})
 }
+
+func TestImpliedGroups(t *testing.T) {
+	Convey("Testing implied groups", t, func() {
+		gr := NewGroupCollection()
+		portal := gr.NewGroup("portal_test", "Portal")
+		user := gr.NewGroup("user_test", "User", portal)
+		manager := gr.NewGroup("manager_test", "Manager", user)
+		Convey("Groups should imply their ancestors transitively", func() {
+			So(manager.Implies(user), ShouldBeTrue)
+			So(manager.Implies(portal), ShouldBeTrue)
+			So(user.Implies(manager), ShouldBeFalse)
+			gr.AddMembership(2, manager)
+			So(gr.UserGroups(2), ShouldHaveLength, 4)
+			So(gr.UserGroups(2), ShouldContainKey, user)
+			So(gr.UserGroups(2), ShouldContainKey, portal)
+			So(gr.HasMembership(2, portal), ShouldBeTrue)
+		})
+		Convey("Adding implied groups should update memberships", func() {
+			gr.AddMembership(2, manager)
+			base := gr.NewGroup("base_test", "Base")
+			gr.AddImpliedGroups(portal, base)
+			So(manager.Implies(base), ShouldBeTrue)
+			So(gr.UserGroups(2), ShouldContainKey, base)
+			So(gr.UserGroups(2)[base], ShouldEqual, InheritedGroup)
+		})
+		Convey("Inheritance cycles should be rejected", func() {
+			So(func() { gr.AddImpliedGroups(portal, manager) }, ShouldPanic)
+			So(func() { gr.AddImpliedGroups(portal, portal) }, ShouldPanic)
+			So(portal.Inherits, ShouldBeEmpty)
+			cyclic := &Group{ID: "cyclic_test", Name: "Cyclic"}
+			cyclic.Inherits = []*Group{{ID: "cyclic_parent_test", Inherits: []*Group{cyclic}}}
+			So(func() { gr.RegisterGroup(cyclic) }, ShouldPanic)
+		})
+	})
+}
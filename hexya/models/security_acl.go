@@ -34,6 +34,52 @@ func (f *Field) RevokeAccess(group *security.Group, perm security.Permission) *F
 	return f
 }
 
+// GrantAccess grants the given perm to the given group on the records of this
+// model. perm can be any combination of security.Create, security.Read,
+// security.Write and security.Unlink.
+//
+// By default, all users have all permissions on all models. Revoke permissions
+// from security.GroupEveryone to restrict a model to some groups.
+func (m *Model) GrantAccess(group *security.Group, perm security.Permission) *Model {
+	m.acl.AddPermission(group, perm)
+	return m
+}
+
+// RevokeAccess denies the given perm to the given group on the records of this
+// model. perm can be any combination of security.Create, security.Read,
+// security.Write and security.Unlink.
+func (m *Model) RevokeAccess(group *security.Group, perm security.Permission) *Model {
+	m.acl.RemovePermission(group, perm)
+	return m
+}
+
+// checkModelPermission returns true if the given uid has the given perm on the
+// records of the given model. The superuser has all permissions.
+func checkModelPermission(m *Model, uid int64, perm security.Permission) bool {
+	if uid == security.SuperUserID || m.acl.CheckPermission(security.GroupEveryone, perm) {
+		// All users belong to GroupEveryone, so that we do not need to
+		// fetch the user's groups for models that are not restricted.
+		return true
+	}
+	userGroups := security.Registry.UserGroups(uid)
+	for group := range userGroups {
+		if m.acl.CheckPermission(group, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModelAccess panics with an ErrAccessDenied error if the current user
+// does not have the given perm on the records of this RecordCollection's model.
+func (rc *RecordCollection) checkModelAccess(perm security.Permission) {
+	if checkModelPermission(rc.model, rc.env.uid, perm) {
+		return
+	}
+	log.PanicWithError(&Error{Kind: ErrAccessDenied, Model: rc.model.name},
+		"You are not allowed to access records of this model", "model", rc.model.name, "uid", rc.env.uid, "permission", perm)
+}
+
 // checkFieldPermission checks if the given uid has the given perm on the given field info.
 func checkFieldPermission(f *Field, uid int64, perm security.Permission) bool {
 	userGroups := security.Registry.UserGroups(uid)
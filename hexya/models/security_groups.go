@@ -0,0 +1,54 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"sort"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+)
+
+// UserGroups returns the sorted IDs of the security groups the current user
+// belongs to, including the groups inherited through group inheritance and
+// the everyone group. The superuser belongs to all groups.
+//
+// The result is computed once per user and Environment, so that membership
+// changes made during the transaction are not taken into account.
+func (env Environment) UserGroups() []string {
+	if groups, ok := env.cache.userGroups[env.uid]; ok {
+		return groups
+	}
+	var groups []string
+	if env.uid == security.SuperUserID {
+		for _, group := range security.Registry.AllGroups() {
+			groups = append(groups, group.ID)
+		}
+	} else {
+		for group := range security.Registry.UserGroups(env.uid) {
+			groups = append(groups, group.ID)
+		}
+	}
+	sort.Strings(groups)
+	env.cache.userGroups[env.uid] = groups
+	return groups
+}
+
+// HasGroup returns true if the current user belongs to the security group
+// with the given ID, directly or through group inheritance.
+func (env Environment) HasGroup(groupID string) bool {
+	groups := env.UserGroups()
+	i := sort.SearchStrings(groups, groupID)
+	return i < len(groups) && groups[i] == groupID
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
+)
+
+// A RecordSnapshot is a portable copy of a record made with Snapshot, that
+// can be recreated later with Environment.Restore, for instance to be used as
+// a test fixture. It holds only plain values, so that it can be serialized.
+//
+// Records are identified by their external ID. Values holds the scalar fields
+// of the record by field name and Relations holds the snapshots of the records
+// pointed at by its many2one, one2one and many2many fields.
+type RecordSnapshot struct {
+	Model      string
+	ExternalID string
+	Values     map[string]interface{}
+	Relations  map[string][]RecordSnapshot
+}
+
+// Snapshot returns a RecordSnapshot of the single record of this
+// RecordCollection with the given fields, which must be writable.
+//
+// Fields can be paths through many2one, one2one and many2many fields, such as
+// "User.Name", in which case the related records are snapshotted with the
+// fields of the path. A relation field given alone only records the external
+// IDs of the related records, which must then exist when the snapshot is
+// restored.
+func (rc *RecordCollection) Snapshot(fields []string) (RecordSnapshot, error) {
+	switch rc.Len() {
+	case 0:
+		return RecordSnapshot{}, &Error{Kind: ErrRecordNotFound, Model: rc.model.name}
+	case 1:
+	default:
+		return RecordSnapshot{}, &Error{Kind: ErrMultipleRecords, Model: rc.model.name}
+	}
+	if _, ok := rc.model.fields.Get("HexyaExternalID"); !ok {
+		return RecordSnapshot{}, &Error{Kind: ErrUnknownField, Model: rc.model.name,
+			Cause: fmt.Errorf("model %s has no external ID", rc.model.name)}
+	}
+	var relFields []string
+	subPaths := make(map[string][]string)
+	res := RecordSnapshot{
+		Model:      rc.model.name,
+		ExternalID: rc.Get("HexyaExternalID").(string),
+		Values:     make(map[string]interface{}),
+		Relations:  make(map[string][]RecordSnapshot),
+	}
+	for _, path := range fields {
+		exprs := strings.SplitN(path, ExprSep, 2)
+		fi, ok := rc.model.fields.Get(exprs[0])
+		if !ok {
+			return RecordSnapshot{}, &Error{Kind: ErrUnknownField, Model: rc.model.name,
+				Cause: fmt.Errorf("unknown field %s in model %s", exprs[0], rc.model.name)}
+		}
+		switch {
+		case fi.fieldType.IsFKRelationType() || fi.fieldType == fieldtype.Many2Many:
+			if _, ok := subPaths[fi.name]; !ok {
+				relFields = append(relFields, fi.name)
+				subPaths[fi.name] = []string{}
+			}
+			if len(exprs) > 1 {
+				subPaths[fi.name] = append(subPaths[fi.name], exprs[1])
+			}
+		case fi.isRelationField():
+			return RecordSnapshot{}, &Error{Kind: ErrTypeMismatch, Model: rc.model.name,
+				Cause: fmt.Errorf("field %s of type %s cannot be snapshotted", fi.name, fi.fieldType)}
+		case len(exprs) > 1:
+			return RecordSnapshot{}, &Error{Kind: ErrTypeMismatch, Model: rc.model.name,
+				Cause: fmt.Errorf("field %s in path %s is not a relation field", fi.name, path)}
+		default:
+			res.Values[fi.name] = rc.Get(fi.name)
+		}
+	}
+	for _, field := range relFields {
+		related := rc.Get(field).(RecordSet).Collection()
+		snaps := make([]RecordSnapshot, 0, related.Len())
+		for _, rec := range related.Records() {
+			snap, err := rec.Snapshot(subPaths[field])
+			if err != nil {
+				return RecordSnapshot{}, err
+			}
+			snaps = append(snaps, snap)
+		}
+		res.Relations[field] = snaps
+	}
+	return res, nil
+}
+
+// Restore recreates the record of the given RecordSnapshot and returns it.
+//
+// Related records of the snapshot are restored first. If a record with the
+// external ID of a snapshot already exists, it is updated with the values of
+// the snapshot instead of being created again.
+func (env Environment) Restore(snap RecordSnapshot) *RecordCollection {
+	model := Registry.MustGet(snap.Model)
+	values := make(FieldMap)
+	for field, value := range snap.Values {
+		values[field] = value
+	}
+	for field, snaps := range snap.Relations {
+		fi := model.fields.MustGet(field)
+		ids := make([]int64, len(snaps))
+		for i, relSnap := range snaps {
+			ids[i] = env.Restore(relSnap).Ids()[0]
+		}
+		switch {
+		case fi.fieldType == fieldtype.Many2Many:
+			values[field] = ids
+		case len(ids) == 0:
+			values[field] = nil
+		default:
+			values[field] = ids[0]
+		}
+	}
+	existing := recordByExternalID(env, model, snap.ExternalID)
+	if !existing.IsEmpty() {
+		if len(values) > 0 {
+			existing.Call("Write", values)
+		}
+		return existing
+	}
+	values["HexyaExternalID"] = snap.ExternalID
+	return env.Pool(snap.Model).Call("Create", values).(RecordSet).Collection()
+}
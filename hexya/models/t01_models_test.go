@@ -16,7 +16,9 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types"
@@ -33,6 +35,11 @@ func TestModelDeclaration(t *testing.T) {
 		addressMI := NewMixinModel("AddressMixIn")
 		activeMI := NewMixinModel("ActiveMixIn")
 		viewModel := NewManualModel("UserView")
+		postCountView := NewManualModel("UserPostCount")
+		logEntry := NewModel("LogEntry")
+		place := NewModel("Place")
+		category := NewModel("Category")
+		contact := NewModel("Contact")
 
 		user.AddMethod("PrefixedUser", "",
 			func(rc *RecordCollection, prefix string) []string {
@@ -86,6 +93,13 @@ func TestModelDeclaration(t *testing.T) {
 				return res, []FieldNamer{}
 			})
 
+		user.AddMethod("ComputeMinor", "",
+			func(rc *RecordCollection) (FieldMap, []FieldNamer) {
+				res := make(FieldMap)
+				res["Minor"] = rc.Get("Age").(int16) < 18
+				return res, []FieldNamer{FieldName("Minor")}
+			})
+
 		user.AddMethod("InverseSetAge", "",
 			func(rc *RecordCollection, age int16) {
 				rc.Get("Profile").(*RecordCollection).Set("Age", age)
@@ -101,6 +115,21 @@ func TestModelDeclaration(t *testing.T) {
 				return FieldMap{}, []FieldNamer{}
 			})
 
+		user.AddMethod("DescribeWith", "",
+			func(rc *RecordCollection, prefix string, count int64, ratio float64, tags []string, data FieldMap) string {
+				return fmt.Sprintf("%s %s: %d %.1f %v %v", prefix, rc.Get("Name"), count, ratio, tags, data["Comment"])
+			})
+
+		user.AddMethod("RunCronTest", "",
+			func(rc *RecordCollection, delay int64, fail bool) {
+				cronTestRuns.start(rc.Env().Uid())
+				defer cronTestRuns.end()
+				time.Sleep(time.Duration(delay) * time.Millisecond)
+				if fail {
+					log.Panic("Cron test failure")
+				}
+			})
+
 		activeMI.AddMethod("IsActivated", "",
 			func(rc *RecordCollection) bool {
 				return rc.Get("Active").(bool)
@@ -129,6 +158,33 @@ func TestModelDeclaration(t *testing.T) {
 				return fmt.Sprintf("<%s>", res)
 			})
 
+		contact.Methods().MustGet("NameGet").Extend("",
+			func(rc *RecordCollection) string {
+				return fmt.Sprintf("%s (%s)", rc.Get("Name"), rc.Get("City"))
+			})
+
+		contact.SetMethodFallback(func(rc *RecordCollection, method string, args []interface{}) []interface{} {
+			fieldName := strings.TrimPrefix(method, "Get")
+			if _, ok := rc.model.fields.Get(fieldName); fieldName == method || !ok {
+				log.Panic("Unknown method in model", "method", method, "model", rc.ModelName())
+			}
+			return []interface{}{rc.Get(fieldName)}
+		})
+
+		profile.AddMethod("ComputeLocation", "",
+			func(rc *RecordCollection) (FieldMap, []FieldNamer) {
+				res := make(FieldMap)
+				res["Location"] = fmt.Sprintf("%s, %s", rc.Get("City"), rc.Get("Country"))
+				return res, []FieldNamer{}
+			})
+
+		place.AddMethod("ComputeLocation", "",
+			func(rc *RecordCollection) (FieldMap, []FieldNamer) {
+				res := make(FieldMap)
+				res["Location"] = fmt.Sprintf("%s, %s", rc.Get("City"), rc.Get("Country"))
+				return res, []FieldNamer{}
+			})
+
 		profile.Methods().MustGet("PrintAddress").Extend("",
 			func(rc *RecordCollection) string {
 				res := rc.Super().Call("PrintAddress").(string)
@@ -160,6 +216,12 @@ func TestModelDeclaration(t *testing.T) {
 				}
 			})
 
+		tag.AddMethod("ComputeWeightedRate",
+			`ComputeWeightedRate returns the rate of the tag multiplied by its sequence`,
+			func(rc *RecordCollection) (FieldMap, []FieldNamer) {
+				return FieldMap{"WeightedRate": float64(rc.Get("Rate").(float32)) * float64(rc.Get("Sequence").(int64))}, []FieldNamer{}
+			})
+
 		tag.AddMethod("CheckNameDescription",
 			`CheckNameDescription checks that the description of a tag is not equal to its name`,
 			func(rc *RecordCollection) {
@@ -187,6 +249,8 @@ func TestModelDeclaration(t *testing.T) {
 			"Age": IntegerField{Compute: user.Methods().MustGet("ComputeAge"),
 				Inverse: user.Methods().MustGet("InverseSetAge"),
 				Depends: []string{"Profile", "Profile.Age"}, Stored: true, GoType: new(int16)},
+			"Minor": BooleanField{Compute: user.Methods().MustGet("ComputeMinor"),
+				Depends: []string{"Age"}, Stored: true},
 			"Posts":     One2ManyField{RelationModel: Registry.MustGet("Post"), ReverseFK: "User"},
 			"PMoney":    FloatField{Related: "Profile.Money"},
 			"LastPost":  Many2OneField{RelationModel: Registry.MustGet("Post")},
@@ -198,20 +262,31 @@ func TestModelDeclaration(t *testing.T) {
 		})
 		user.AddSQLConstraint("nums_premium", "CHECK((is_premium = TRUE AND nums > 0) OR (IS_PREMIUM = false))",
 			"Premium users must have positive nums")
+		user.AddFieldSet("list", FieldName("Name"), FieldName("Email"))
+		user.AddFieldSet("list", FieldName("Email"), FieldName("Profile.City"), FieldName("Profile"))
 
 		profile.AddFields(map[string]FieldDefinition{
 			"Age":      IntegerField{GoType: new(int16)},
-			"Gender":   SelectionField{Selection: types.Selection{"male": "Male", "female": "Female"}},
+			"Gender":   SelectionField{Selection: types.Selection{"male": "Male", "female": "Female"}, Tracking: true},
 			"Money":    FloatField{},
 			"User":     Many2OneField{RelationModel: Registry.MustGet("User")},
 			"BestPost": One2OneField{RelationModel: Registry.MustGet("Post")},
 			"City":     CharField{},
 			"Country":  CharField{},
+			"Location": CharField{Compute: profile.Methods().MustGet("ComputeLocation"),
+				Depends: []string{"City", "Country"}},
+		})
+
+		place.AddFields(map[string]FieldDefinition{
+			"City":    CharField{},
+			"Country": CharField{},
+			"Location": CharField{Compute: place.Methods().MustGet("ComputeLocation"),
+				Depends: []string{"City", "Country"}},
 		})
 
 		post.AddFields(map[string]FieldDefinition{
-			"User":            Many2OneField{RelationModel: Registry.MustGet("User")},
-			"Title":           CharField{Required: true},
+			"User":            Many2OneField{RelationModel: Registry.MustGet("User"), Tracking: true},
+			"Title":           CharField{Required: true, Tracking: true},
 			"Content":         HTMLField{},
 			"Tags":            Many2ManyField{RelationModel: Registry.MustGet("Tag")},
 			"BestPostProfile": Rev2OneField{RelationModel: Registry.MustGet("Profile"), ReverseFK: "BestPost"},
@@ -227,6 +302,22 @@ func TestModelDeclaration(t *testing.T) {
 			"Parent":      Many2OneField{RelationModel: Registry.MustGet("Tag")},
 			"Description": CharField{Constraint: tag.Methods().MustGet("CheckNameDescription")},
 			"Rate":        FloatField{Constraint: tag.Methods().MustGet("CheckRate"), GoType: new(float32)},
+			"Sequence":    IntegerField{},
+			"WeightedRate": FloatField{ComputeSQL: "rate * sequence",
+				Compute: tag.Methods().MustGet("ComputeWeightedRate"), Depends: []string{"Rate", "Sequence"}},
+		})
+
+		contact.AddFields(map[string]FieldDefinition{
+			"Name": CharField{},
+			"City": CharField{},
+		})
+
+		category.AddFields(map[string]FieldDefinition{
+			"Name": CharField{},
+			"RelatedCategories": Many2ManyField{RelationModel: Registry.MustGet("Category"),
+				M2MOurField: "Category", M2MTheirField: "RelatedCategory"},
+			"RelatedByCategories": Many2ManyField{RelationModel: Registry.MustGet("Category"),
+				M2MOurField: "RelatedCategory", M2MTheirField: "Category"},
 		})
 
 		cv.AddFields(map[string]FieldDefinition{
@@ -249,10 +340,27 @@ func TestModelDeclaration(t *testing.T) {
 
 		Registry.MustGet("ModelMixin").InheritModel(activeMI)
 
+		logEntry.AddFields(map[string]FieldDefinition{
+			"Message": CharField{},
+			"Level":   IntegerField{},
+		})
+		logEntry.AddPartialUniqueConstraint("message_active", []FieldNamer{FieldName("Message")}, "active",
+			"Messages of active log entries must be unique")
+
 		viewModel.AddFields(map[string]FieldDefinition{
 			"Name": CharField{},
 			"City": CharField{},
 		})
+
+		postCountView.SetSQLView(`
+			SELECT u.id, u.name, COUNT(p.id) AS post_count
+			FROM "user" u
+				LEFT JOIN "post" p ON p.user_id = u.id
+			GROUP BY u.id, u.name`)
+		postCountView.AddFields(map[string]FieldDefinition{
+			"Name":      CharField{},
+			"PostCount": IntegerField{},
+		})
 	})
 }
 
@@ -298,5 +406,23 @@ func TestErroneousDeclarations(t *testing.T) {
 				})
 			}, ShouldPanic)
 		})
+		Convey("Ambiguous Ours and Theirs in M2M field def", func() {
+			tagModel := Registry.MustGet("Tag")
+			So(func() {
+				tagModel.AddFields(map[string]FieldDefinition{
+					"AmbiguousTags": Many2ManyField{RelationModel: tagModel,
+						M2MOurField: "OtherTag", M2MTheirField: "Other_Tag"},
+				})
+			}, ShouldPanic)
+		})
+		Convey("Unknown Ours in an existing M2M link model", func() {
+			categoryModel := Registry.MustGet("Category")
+			So(func() {
+				categoryModel.AddFields(map[string]FieldDefinition{
+					"WrongCategories": Many2ManyField{RelationModel: categoryModel, M2MLinkModelName: "CategoryRelatedCategoryRel",
+						M2MOurField: "SourceCategory", M2MTheirField: "RelatedCategory"},
+				})
+			}, ShouldPanic)
+		})
 	})
 }
@@ -92,6 +92,15 @@ func TestBootStrap(t *testing.T) {
 					)`)
 			}, ShouldNotPanic)
 		})
+		Convey("Columns used by SQL views should be updated by SyncDatabase", func() {
+			nameField := Registry.MustGet("User").Fields().MustGet("Name")
+			dbExecuteNoTx(`DROP VIEW IF EXISTS user_post_count`)
+			dbExecuteNoTx(`ALTER TABLE "user" ALTER COLUMN name SET DATA TYPE text`)
+			createDBViews()
+			So(SyncDatabase, ShouldNotPanic)
+			So(testAdapter.columns("user")["name"].DataType, ShouldEqual, testAdapter.typeSQL(nameField))
+			So(func() { dbExecuteNoTx(`SELECT name, post_count FROM user_post_count`) }, ShouldNotPanic)
+		})
 		Convey("All models should have a DB table", func() {
 			dbTables := testAdapter.tables()
 			for tableName, mi := range Registry.registryByTableName {
@@ -110,6 +119,58 @@ func TestBootStrap(t *testing.T) {
 			So(testAdapter.constraints("%_mancon"), ShouldHaveLength, 1)
 			So(testAdapter.constraints("%_mancon")[0], ShouldEqual, "nums_premium_user_mancon")
 		})
+		Convey("Partial unique indexes should have been created", func() {
+			So(testAdapter.indexes("log_entry", "%_manidx"), ShouldResemble, []string{"message_active_log_entry_manidx"})
+			So(testAdapter.partialIndexChanged("log_entry", "message_active_log_entry_manidx",
+				[]string{"message"}, "active"), ShouldBeFalse)
+			Convey("Changing the condition should recreate the index", func() {
+				logEntry := Registry.MustGet("LogEntry")
+				index := logEntry.uniqueIndexes["message_active_log_entry_manidx"]
+				index.where = "active AND message <> ''"
+				logEntry.uniqueIndexes["message_active_log_entry_manidx"] = index
+				So(testAdapter.partialIndexChanged("log_entry", "message_active_log_entry_manidx",
+					[]string{"message"}, index.where), ShouldBeTrue)
+				So(SyncDatabase, ShouldNotPanic)
+				So(testAdapter.partialIndexChanged("log_entry", "message_active_log_entry_manidx",
+					[]string{"message"}, index.where), ShouldBeFalse)
+				index.where = "active"
+				logEntry.uniqueIndexes["message_active_log_entry_manidx"] = index
+				So(SyncDatabase, ShouldNotPanic)
+				So(testAdapter.partialIndexChanged("log_entry", "message_active_log_entry_manidx",
+					[]string{"message"}, "active"), ShouldBeFalse)
+			})
+		})
+		Convey("Inbound references should have been computed", func() {
+			So(Registry.MustGet("User").hasInboundReferences(), ShouldBeTrue)
+			So(Registry.MustGet("Tag").hasInboundReferences(), ShouldBeTrue)
+			So(Registry.MustGet("Contact").hasInboundReferences(), ShouldBeFalse)
+		})
+		Convey("Fields with an SQL expression should be generated columns", func() {
+			weightedRate := Registry.MustGet("Tag").Fields().MustGet("WeightedRate")
+			if !testAdapter.supportsGeneratedColumns() {
+				So(weightedRate.sqlGenerated, ShouldBeFalse)
+				So(weightedRate.isComputedField(), ShouldBeTrue)
+				return
+			}
+			So(weightedRate.sqlGenerated, ShouldBeTrue)
+			So(weightedRate.isComputedField(), ShouldBeFalse)
+			So(weightedRate.isStored(), ShouldBeTrue)
+			So(testAdapter.columns("tag"), ShouldContainKey, "weighted_rate")
+			So(testAdapter.columns("tag")["weighted_rate"].IsGenerated, ShouldBeTrue)
+			So(testAdapter.generationExpressionChanged(weightedRate, "(rate * (sequence)::double precision)"), ShouldBeFalse)
+			So(testAdapter.generationExpressionChanged(weightedRate,
+				testAdapter.columns("tag")["weighted_rate"].GenerationExpression.String), ShouldBeFalse)
+			Convey("Changing the SQL expression should recreate the column", func() {
+				weightedRate.computeSQL = "rate + sequence"
+				So(SyncDatabase, ShouldNotPanic)
+				dbExpression := testAdapter.columns("tag")["weighted_rate"].GenerationExpression.String
+				So(testAdapter.generationExpressionChanged(weightedRate, dbExpression), ShouldBeFalse)
+				weightedRate.computeSQL = "rate * sequence"
+				So(SyncDatabase, ShouldNotPanic)
+				dbExpression = testAdapter.columns("tag")["weighted_rate"].GenerationExpression.String
+				So(testAdapter.generationExpressionChanged(weightedRate, dbExpression), ShouldBeFalse)
+			})
+		})
 	})
 	Convey("Making small changes to test DB sync", t, func() {
 		Convey("Modifying Required and Default values", func() {
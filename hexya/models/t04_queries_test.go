@@ -15,10 +15,14 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/hexya-erp/hexya/hexya/models/operator"
 	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -107,12 +111,63 @@ func TestConditions(t *testing.T) {
 					sql, _ := rs.query.selectQuery(fields)
 					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name, "user".id AS id FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".id  LIMIT 1 OFFSET 2`)
 				})
+				Convey("Testing validation of LIMIT and OFFSET", func() {
+					rs = env.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com"))
+					So(rs.Offset(-5).query.sqlLimitOffsetClause(), ShouldEqual, "")
+					So(func() { rs.Limit(-1) }, ShouldPanic)
+					So(rs.Limit(MaxLimit+1).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit+1))
+					So(rs.Limit(0).query.sqlLimitOffsetClause(), ShouldEqual, "")
+					So(rs.Limit(MaxLimit*3).WithMaxLimit(MaxLimit).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit))
+					rpcEnv := env
+					rpcEnv.maxLimit = MaxLimit
+					rpcRs := rpcEnv.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com"))
+					So(rpcRs.Limit(MaxLimit+1).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit))
+					So(rpcRs.Limit(MaxLimit+1).WithMaxLimit(MaxLimit*2).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit+1))
+					So(rpcRs.WithMaxLimit(0).Limit(MaxLimit*3).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit*3))
+					So(rpcRs.Limit(0).query.sqlLimitOffsetClause(), ShouldEqual, fmt.Sprintf("LIMIT %d ", MaxLimit))
+					So(rpcRs.Limit(0).WithMaxLimit(0).query.sqlLimitOffsetClause(), ShouldEqual, "")
+					So(rpcRs.query.sqlLimitOffsetClause(), ShouldEqual, "")
+					So(rs.query.sqlLimitOffsetClause(), ShouldEqual, "")
+					So(rs.Call("Limit", int64(3)).(RecordSet).Collection().Call("Offset", float64(2)).(RecordSet).Collection().query.sqlLimitOffsetClause(),
+						ShouldEqual, "LIMIT 3 OFFSET 2")
+					err := TryCall(func() { rs.Call("Limit", "10") })
+					So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+					So(err.Error(), ShouldContainSubstring, "Expected an integer argument of type int, got string (10)")
+					So(errors.Is(TryCall(func() { rs.Call("Offset", 2.5) }), ErrTypeMismatch), ShouldBeTrue)
+					So(errors.Is(TryCall(func() { rs.Call("Limit", float64(1<<63)) }), ErrTypeMismatch), ShouldBeTrue)
+					So(errors.Is(TryCall(func() { rs.Call("Limit", uint64(1<<63)) }), ErrTypeMismatch), ShouldBeTrue)
+				})
+				Convey("Testing query with ORDER BY on related fields and NULLS modifiers", func() {
+					rs = env.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com")).OrderBy("Profile.Age desc nulls last", "ID")
+					So(rs.query.sqlOrderByClause(), ShouldEqual, `ORDER BY "user__profile".age DESC NULLS LAST, "user".id `)
+					sql, _ := rs.query.selectQuery([]string{"name"})
+					So(sql, ShouldContainSubstring, `LEFT JOIN "profile" "T1" ON "user".profile_id="T1".id`)
+					So(sql, ShouldContainSubstring, `ORDER BY "T1".age DESC NULLS LAST, "user".id `)
+					So(func() { rs.OrderBy("Name; DROP TABLE user") }, ShouldPanic)
+					So(func() { rs.OrderBy("Name DESC NULLS") }, ShouldPanic)
+				})
 				Convey("Testing query with ORDER BY clauses", func() {
 					rs = env.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com")).Call("OrderBy", []string{"Email", "ID"}).(RecordSet).Collection().Load()
 					fields := []string{"name"}
 					sql, _ := rs.query.selectQuery(fields)
 					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name, "user".email AS email, "user".id AS id FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".email , "user".id  `)
 				})
+				Convey("Testing id tie-breaker in ORDER BY clauses", func() {
+					rs = env.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com"))
+					So(rs.OrderBy("Email").query.sqlOrderByClause(), ShouldEqual, `ORDER BY "user".email , "user".id `)
+					So(rs.OrderBy("ID desc", "Email").query.sqlOrderByClause(), ShouldEqual, `ORDER BY "user".id DESC, "user".email `)
+					So(rs.query.sqlOrderByClause(), ShouldEqual, "")
+					sql, _ := rs.OrderBy("Email").query.selectQuery([]string{"name"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name, "user".email AS email, "user".id AS id FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".email , "user".id  `)
+				})
+				Convey("Testing query with ORDER BY with a collation", func() {
+					rs = env.Pool("User").Search(rs.Model().Field("email").IContains("jane.smith@example.com")).OrderBy("Name", "ID").Collate("fr_FR")
+					sql, _ := rs.query.selectQuery([]string{"email"})
+					So(sql, ShouldEqual, `SELECT DISTINCT "user".email COLLATE "fr-FR-x-icu" AS email, "user".name COLLATE "fr-FR-x-icu" AS name, "user".id AS id FROM "user" "user"  WHERE ("user".email ILIKE ? )  ORDER BY "user".name COLLATE "fr-FR-x-icu" , "user".id  `)
+					rs = rs.WithContext("lang", "de_DE").Collate("")
+					So(rs.query.sqlOrderByClause(), ShouldEqual, `ORDER BY "user".name COLLATE "de-DE-x-icu" , "user".id `)
+					So(func() { rs.Collate(`fr"; DROP TABLE user`) }, ShouldPanic)
+				})
 				Convey("Testing complex conditions", func() {
 					rs = env.Pool("User").Search(rs.Model().Field("Profile.Age").GreaterOrEqual(12).
 						AndNot().Field("Name").IContains("Jane").
@@ -225,12 +280,112 @@ func TestConditions(t *testing.T) {
 					So(sql, ShouldEqual, `WHERE ("user".id NOT IN (?) ) `)
 					So(args, ShouldContain, []int64{23, 31})
 				})
+				Convey("In with a lazy RecordSet", func() {
+					profiles := env.Pool("Profile")
+					profiles = profiles.Search(profiles.Model().Field("Age").Greater(12))
+					rs = rs.Search(rs.Model().Field("Profile").In(profiles))
+					sql, args := rs.query.sqlWhereClause()
+					So(sql, ShouldStartWith, `WHERE ("user".profile_id IN (SELECT DISTINCT "profile".id AS id FROM "profile" "profile"`)
+					So(sql, ShouldContainSubstring, `WHERE ("profile".age > ? )`)
+					So(args, ShouldContain, 12)
+				})
+				Convey("In with a fetched RecordSet", func() {
+					profiles := env.Pool("Profile").SearchAll().Fetch()
+					rs = rs.Search(rs.Model().Field("Profile").NotIn(profiles))
+					sql, _ := rs.query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".profile_id NOT IN (?) ) `)
+				})
 				Convey("Child Of without parent field", func() {
 					rs = rs.Search(rs.Model().Field("ID").ChildOf(101))
 					sql, args := rs.query.selectQuery([]string{"Name"})
 					So(sql, ShouldEqual, `SELECT DISTINCT "user".name AS name FROM "user" "user"  WHERE ("user".id = ? )   `)
 					So(args, ShouldContain, 101)
 				})
+				Convey("Boolean and null filters", func() {
+					sql, args := rs.FilterNull("Profile").query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".profile_id IS NULL ) `)
+					So(args, ShouldBeEmpty)
+					sql, args = rs.FilterNotNull("Email").query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".email IS NOT NULL ) `)
+					So(args, ShouldBeEmpty)
+					sql, args = rs.FilterTrue("IsStaff").query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".is_staff = ? ) `)
+					So(args, ShouldContain, true)
+					sql, args = rs.FilterFalse("IsStaff").query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".is_staff = ? OR "user".is_staff IS NULL ) `)
+					So(args, ShouldContain, false)
+					So(func() { rs.FilterTrue("Name") }, ShouldPanic)
+				})
+				Convey("Nil values", func() {
+					sql, args := rs.Search(rs.Model().Field("Profile").Equals(nil)).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".profile_id IS NULL ) `)
+					So(args, ShouldBeEmpty)
+					sql, args = rs.Search(rs.Model().Field("Nums").Equals((*int64)(nil))).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".nums IS NULL ) `)
+					So(args, ShouldBeEmpty)
+					sql, args = rs.Search(rs.Model().Field("Name").NotEquals((*string)(nil))).query.sqlWhereClause()
+					So(sql, ShouldEqual, `WHERE ("user".name IS NOT NULL ) `)
+					So(args, ShouldBeEmpty)
+				})
+			})
+		}
+	})
+}
+
+func TestInsertUpdateQueries(t *testing.T) {
+	Convey("Testing SQL building for inserts and updates", t, func() {
+		if dbArgs.Driver == "postgres" {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				rs := env.Pool("User")
+				data := FieldMap{
+					"Name":    "John Smith",
+					"email":   "jsmith@example.com",
+					"Nums":    3,
+					"IsStaff": true,
+				}
+				Convey("Insert queries should have columns sorted by JSON name", func() {
+					sql, args := rs.query.insertQuery(data)
+					So(sql, ShouldEqual, `INSERT INTO "user" (email, is_staff, name, nums) VALUES (?, ?, ?, ?) RETURNING id`)
+					So(args, ShouldHaveLength, 4)
+					So(args[0], ShouldEqual, "jsmith@example.com")
+					So(args[1], ShouldEqual, true)
+					So(args[2], ShouldEqual, "John Smith")
+					So(args[3], ShouldEqual, 3)
+				})
+				Convey("Multi-row insert queries should insert all rows at once", func() {
+					data2 := FieldMap{
+						"Name":    "Jane Doe",
+						"email":   "jdoe@example.com",
+						"Nums":    5,
+						"IsStaff": false,
+					}
+					sql, args := rs.query.insertRowsQuery([]FieldMap{data, data2})
+					So(sql, ShouldEqual, `INSERT INTO "user" (email, is_staff, name, nums) VALUES (?, ?, ?, ?), (?, ?, ?, ?)`)
+					So(args, ShouldHaveLength, 8)
+					So(args[2], ShouldEqual, "John Smith")
+					So(args[6], ShouldEqual, "Jane Doe")
+				})
+				Convey("Equivalent writes should generate identical SQL", func() {
+					rs = rs.Search(rs.Model().Field("ID").Equals(1))
+					insertSQL, _ := rs.query.insertQuery(data)
+					updateSQL, updateArgs := rs.query.updateQuery(data)
+					So(updateSQL, ShouldEqual, `UPDATE "user" SET email = ?, is_staff = ?, name = ?, nums = ? WHERE ("user".id = ? ) `)
+					So(updateArgs, ShouldHaveLength, 5)
+					So(updateArgs[2], ShouldEqual, "John Smith")
+					So(updateArgs[4], ShouldEqual, 1)
+					for i := 0; i < 20; i++ {
+						data2 := FieldMap{
+							"IsStaff": true,
+							"Nums":    3,
+							"email":   "jsmith@example.com",
+							"Name":    "John Smith",
+						}
+						sql, _ := rs.query.insertQuery(data2)
+						So(sql, ShouldEqual, insertSQL)
+						sql, _ = rs.query.updateQuery(data2)
+						So(sql, ShouldEqual, updateSQL)
+					}
+				})
 			})
 		}
 	})
@@ -262,3 +417,106 @@ func TestConditionSerialization(t *testing.T) {
 		})
 	})
 }
+
+func TestDomainParsing(t *testing.T) {
+	Convey("Testing domain parsing", t, func() {
+		Convey("Testing implicit AND of terms", func() {
+			dom := []interface{}{
+				[]interface{}{"Name", "ilike", "John"},
+				[]interface{}{"Age", ">", 18},
+			}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, "[& [Name ilike John] [Age > 18]]")
+		})
+		Convey("Testing operators", func() {
+			for _, op := range []string{"=", "!=", ">", ">=", "<", "<=", "=like", "like", "not like", "ilike", "not ilike", "=ilike"} {
+				dom := []interface{}{[]interface{}{"Name", op, "John"}}
+				So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, fmt.Sprintf("[[Name %s John]]", op))
+			}
+			dom := []interface{}{[]interface{}{"Nums", "in", []int64{1, 2}}}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, "[[Nums in [1 2]]]")
+			dom = []interface{}{[]interface{}{"Nums", operator.NotIn, []int64{1, 2}}}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, "[[Nums not in [1 2]]]")
+		})
+		Convey("Testing OR and NOT", func() {
+			dom := []interface{}{"|", []interface{}{"Name", "=", "John"}, []interface{}{"Age", "<", 18}}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, "[| [Name = John] [Age < 18]]")
+			dom = []interface{}{"!", []interface{}{"Name", "=", "John"}}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual, "[! [Name = John]]")
+		})
+		Convey("Testing nested OR and NOT", func() {
+			dom := []interface{}{"&", "|", []interface{}{"Name", "=", "John"}, "!", []interface{}{"Age", ">", 18},
+				"!", "|", []interface{}{"IsStaff", "=", true}, []interface{}{"Nums", "=", 3}}
+			So(fmt.Sprint(ParseDomain(dom).Serialize()), ShouldEqual,
+				"[& | [Name = John] ! [Age > 18] ! | [IsStaff = true] [Nums = 3]]")
+		})
+		Convey("Testing serialization of NOT conditions", func() {
+			cond := newCondition().And().Field("Name").Equals("John").AndNot().Field("Age").Greater(18)
+			So(fmt.Sprint(cond.Serialize()), ShouldEqual, "[& [Name = John] ! [Age > 18]]")
+		})
+		Convey("Testing malformed domains", func() {
+			So(func() { ParseDomain([]interface{}{"|", []interface{}{"Name", "=", "John"}}) }, ShouldPanic)
+			So(func() { ParseDomain([]interface{}{[]interface{}{"Name", "=="}}) }, ShouldPanic)
+			So(func() { ParseDomain([]interface{}{[]interface{}{"Name", "==", "John"}}) }, ShouldPanic)
+			So(func() { ParseDomain([]interface{}{42}) }, ShouldPanic)
+		})
+	})
+}
+
+func TestRelativeDates(t *testing.T) {
+	Convey("Testing relative dates", t, func() {
+		tokyo, err := time.LoadLocation("Asia/Tokyo")
+		So(err, ShouldBeNil)
+		// Saturday 2017-09-30 22:30 in UTC is Sunday 2017-10-01 07:30 in Tokyo
+		now := time.Date(2017, 9, 30, 22, 30, 0, 0, time.UTC)
+		resolve := func(rd string) time.Time {
+			t, err := RelativeDate(rd).Resolve(now, tokyo)
+			So(err, ShouldBeNil)
+			return t
+		}
+		Convey("Offsets should be relative to now in the given location", func() {
+			So(resolve("-7d").Equal(time.Date(2017, 9, 24, 7, 30, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("-7d").Location(), ShouldEqual, tokyo)
+			So(resolve("+2w").Equal(now.AddDate(0, 0, 14)), ShouldBeTrue)
+			So(resolve("-1m").Equal(time.Date(2017, 9, 1, 7, 30, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("-1y").Equal(now.AddDate(-1, 0, 0)), ShouldBeTrue)
+			So(resolve("-3h").Equal(now.Add(-3*time.Hour)), ShouldBeTrue)
+		})
+		Convey("Keywords should be resolved in the given location", func() {
+			So(resolve("now").Equal(now), ShouldBeTrue)
+			So(resolve("today").Equal(time.Date(2017, 10, 1, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("today-1d").Equal(time.Date(2017, 9, 30, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("this_week").Equal(time.Date(2017, 9, 25, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("this_month").Equal(time.Date(2017, 10, 1, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("this_month-1m").Equal(time.Date(2017, 9, 1, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+			So(resolve("this_year").Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, tokyo)), ShouldBeTrue)
+		})
+		Convey("Invalid relative dates should return an error", func() {
+			for _, rd := range []string{"", "7d", "-7", "-7s", "yesterday", "2017-10-01"} {
+				_, err := RelativeDate(rd).Resolve(now, tokyo)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("Relative dates in conditions should be resolved at query time in the context timezone", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User").WithContext("tz", "Asia/Tokyo")
+				rs := users.Search(users.Model().Field("CreateDate").GreaterOrEqual(RelativeDate("-7d")))
+				_, args := rs.query.sqlWhereClause()
+				So(args, ShouldHaveLength, 1)
+				arg := args[0].(dates.DateTime)
+				So(arg.Sub(time.Now().AddDate(0, 0, -7)), ShouldBeBetween, -time.Minute, time.Minute)
+				So(users.SearchDomain([]interface{}{[]interface{}{"CreateDate", ">=", "-7d"}}).SearchCount(),
+					ShouldEqual, users.SearchAll().SearchCount())
+				So(users.SearchDomain([]interface{}{[]interface{}{"CreateDate", ">=", "+1d"}}).SearchCount(), ShouldEqual, 0)
+
+				posts := env.Pool("Post").WithContext("tz", "Asia/Tokyo")
+				rs = posts.Search(posts.Model().Field("LastRead").Equals("today"))
+				_, args = rs.query.sqlWhereClause()
+				So(args[0].(dates.Date).Format(dates.DefaultServerDateFormat), ShouldEqual,
+					time.Now().In(tokyo).Format(dates.DefaultServerDateFormat))
+				rs = posts.Search(posts.Model().Field("Title").Equals("today"))
+				_, args = rs.query.sqlWhereClause()
+				So(args, ShouldResemble, SQLParams{"today"})
+			})
+		})
+	})
+}
@@ -15,11 +15,15 @@
 package models
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"fmt"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -294,6 +298,39 @@ func TestSearchRecordSet(t *testing.T) {
 				So(recs[1].Get("City"), ShouldEqual, "")
 				So(recs[2].Get("City"), ShouldEqual, "")
 			})
+
+			Convey("Testing SQL view model", func() {
+				postCounts := env.Pool("UserPostCount")
+				So(postCounts.SearchAll().SearchCount(), ShouldEqual, env.Pool("User").SearchAll().SearchCount())
+				for _, rec := range postCounts.SearchAll().Records() {
+					posts := env.Pool("Post").Search(Registry.MustGet("Post").Field("User").Equals(rec.Ids()[0]))
+					So(rec.Get("PostCount"), ShouldEqual, posts.SearchCount())
+				}
+				janePosts := postCounts.Search(postCounts.Model().Field("Name").Equals("Jane Smith"))
+				So(janePosts.Len(), ShouldEqual, 1)
+				var total int64
+				for _, row := range postCounts.SearchAll().GroupBy(FieldName("Name")).Aggregates(FieldName("Name"), FieldName("PostCount")) {
+					So(row.Count, ShouldEqual, 1)
+					total += row.Values["post_count"].(int64)
+				}
+				So(total, ShouldEqual, env.Pool("Post").Search(Registry.MustGet("Post").Field("User").IsNotNull()).SearchCount())
+				Convey("Writes on SQL view models should be rejected", func() {
+					err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+						env.Pool("UserPostCount").Call("Create", FieldMap{"Name": "View User"})
+					})
+					So(errors.Is(err, ErrReadOnlyModel), ShouldBeTrue)
+					err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+						postCounts := env.Pool("UserPostCount")
+						postCounts.Search(postCounts.Model().Field("Name").Equals("Jane Smith")).Set("PostCount", 12)
+					})
+					So(errors.Is(err, ErrReadOnlyModel), ShouldBeTrue)
+					err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+						postCounts := env.Pool("UserPostCount")
+						postCounts.Search(postCounts.Model().Field("Name").Equals("Jane Smith")).Call("Unlink")
+					})
+					So(errors.Is(err, ErrReadOnlyModel), ShouldBeTrue)
+				})
+			})
 		})
 	})
 	group1 := security.Registry.NewGroup("group1", "Group 1")
@@ -362,9 +399,129 @@ func TestSearchRecordSet(t *testing.T) {
 				users = env.Pool("User").SearchAll()
 				So(users.Len(), ShouldEqual, 2)
 				So(users.Records()[0].Get("Name"), ShouldBeIn, []string{"Jane Smith", "John Smith"})
+				_, total := env.Pool("User").SearchRead(nil, []string{"Name"}, 0, 0, "")
+				So(total, ShouldEqual, 2)
+				userModel.RemoveRecordRule("jOnly")
+				userModel.RemoveRecordRule("writeRule")
+			})
+			Convey("Checking access rights and rules beforehand", func() {
+				userModel.methods.MustGet("Load").AllowGroup(group1)
+				users := env.Pool("User")
+				So(users.CheckAccessRights("read"), ShouldBeTrue)
+				So(users.CheckAccessRights("write"), ShouldBeFalse)
+				So(users.CheckAccessRights("create"), ShouldBeFalse)
+				So(func() { users.CheckAccessRights("print") }, ShouldPanic)
+
+				userModel.AddRecordRule(&RecordRule{
+					Name:      "jOnly",
+					Group:     group1,
+					Condition: users.Model().Field("Name").IContains("j"),
+					Perms:     security.Read,
+				})
+				userModel.AddRecordRule(&RecordRule{
+					Name:      "writeRule",
+					Group:     group1,
+					Condition: users.Model().Field("Name").Equals("Nobody"),
+					Perms:     security.Write,
+				})
+				allUsers := users.Browse(users.Sudo().SearchAll().Ids()...)
+				jUsers := users.Browse(users.Sudo().Search(users.Model().Field("Name").IContains("j")).Ids()...)
+				So(allUsers.Len(), ShouldEqual, 3)
+				So(jUsers.Len(), ShouldEqual, 2)
+				So(jUsers.CheckAccessRule("read"), ShouldBeNil)
+				So(errors.Is(allUsers.CheckAccessRule("read"), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(jUsers.CheckAccessRule("write"), ErrAccessDenied), ShouldBeTrue)
+				So(jUsers.CheckAccessRule("create"), ShouldBeNil)
+				So(users.CheckAccessRule("write"), ShouldBeNil)
 				userModel.RemoveRecordRule("jOnly")
 				userModel.RemoveRecordRule("writeRule")
 			})
+			Convey("Checking access rights and rules with Values", func() {
+				userModel.methods.MustGet("Load").AllowGroup(group1)
+				users := env.Pool("User")
+				allUsers := users.Browse(users.Sudo().SearchAll().Ids()...)
+				userJane := users.Search(users.Model().Field("Name").Equals("Jane Smith"))
+				So(errors.Is(TryCall(func() { userJane.Values([]string{"Profile.Money"}) }), ErrAccessDenied), ShouldBeTrue)
+
+				userModel.fields.MustGet("Email").RevokeAccess(security.GroupEveryone, security.Read)
+				So(errors.Is(TryCall(func() { userJane.Values([]string{"LOWER(Email) AS email"}) }), ErrAccessDenied), ShouldBeTrue)
+				userModel.fields.MustGet("Email").GrantAccess(security.GroupEveryone, security.Read)
+
+				profileModel := Registry.MustGet("Profile")
+				profileModel.methods.MustGet("Load").AllowGroup(group1)
+				So(userJane.Values([]string{"Profile.Age"})[0]["Profile.Age"], ShouldEqual, 23)
+				profileModel.AddRecordRule(&RecordRule{
+					Name:      "oldOnly",
+					Group:     group1,
+					Condition: profileModel.Field("Age").Greater(100),
+					Perms:     security.Read,
+				})
+				So(errors.Is(TryCall(func() { userJane.Values([]string{"Profile.Age"}) }), ErrAccessDenied), ShouldBeTrue)
+				profileModel.RemoveRecordRule("oldOnly")
+				profileModel.methods.MustGet("Load").RevokeGroup(group1)
+
+				userModel.AddRecordRule(&RecordRule{
+					Name:      "jOnly",
+					Group:     group1,
+					Condition: users.Model().Field("Name").IContains("j"),
+					Perms:     security.Read,
+				})
+				res := allUsers.Values([]string{"Name"})
+				So(res, ShouldHaveLength, 3)
+				var visible int
+				for _, vals := range res {
+					if vals != nil {
+						So(vals["Name"], ShouldBeIn, []string{"Jane Smith", "John Smith"})
+						visible++
+					}
+				}
+				So(visible, ShouldEqual, 2)
+				userModel.RemoveRecordRule("jOnly")
+			})
+		})
+	})
+	Convey("Testing model access control lists", t, func() {
+		tagModel := Registry.MustGet("Tag")
+		tagModel.RevokeAccess(security.GroupEveryone, security.All|security.Create)
+		SimulateInNewEnvironment(2, func(env Environment) {
+			tagData := FieldMap{"Name": "ACL Tag", "Description": "Tag for ACL tests"}
+			Convey("Operations should be denied without model permission", func() {
+				So(errors.Is(TryCall(func() { env.Pool("Tag").Call("Create", tagData) }), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { env.Pool("Tag").SearchAll().Load() }), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { env.Pool("Tag").SearchAll().Fetch() }), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { env.Pool("Tag").Browse(1).Ids() }), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(TryCall(func() {
+					env.Pool("Tag").SearchAll().GroupBy(FieldName("Name")).Aggregates(FieldName("Name"), FieldName("Rate"))
+				}), ErrAccessDenied), ShouldBeTrue)
+				tagID := env.Pool("Tag").Sudo().Call("Create", tagData).(RecordSet).Collection().Ids()[0]
+				So(errors.Is(TryCall(func() { env.Pool("Tag").Browse(tagID).GetMetadata() }), ErrAccessDenied), ShouldBeTrue)
+				So(env.Pool("Tag").CheckAccessRights("create"), ShouldBeFalse)
+				So(env.Pool("Tag").CheckAccessRights("read"), ShouldBeFalse)
+			})
+			Convey("The superuser should bypass model access control lists", func() {
+				tag := env.Pool("Tag").Sudo().Call("Create", tagData).(RecordSet).Collection()
+				So(tag.Get("Name"), ShouldEqual, "ACL Tag")
+				So(func() { tag.Call("Write", FieldMap{"Rate": 2}) }, ShouldNotPanic)
+				So(func() { tag.Call("Unlink") }, ShouldNotPanic)
+			})
+			Convey("Operations should be allowed according to group permissions", func() {
+				tagModel.GrantAccess(group1, security.Create|security.Read)
+				tag := env.Pool("Tag").Call("Create", tagData).(RecordSet).Collection()
+				So(tag.Get("Name"), ShouldEqual, "ACL Tag")
+				So(env.Pool("Tag").CheckAccessRights("read"), ShouldBeTrue)
+				So(env.Pool("Tag").CheckAccessRights("write"), ShouldBeFalse)
+				So(errors.Is(TryCall(func() { tag.Call("Write", FieldMap{"Rate": 2}) }), ErrAccessDenied), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { tag.Call("Unlink") }), ErrAccessDenied), ShouldBeTrue)
+
+				tagModel.GrantAccess(group1, security.Write|security.Unlink)
+				So(func() { tag.Call("Write", FieldMap{"Rate": 2}) }, ShouldNotPanic)
+				So(tag.Get("Rate"), ShouldEqual, 2)
+				So(tag.Call("Unlink"), ShouldEqual, 1)
+			})
+		})
+		Reset(func() {
+			tagModel.RevokeAccess(group1, security.All|security.Create)
+			tagModel.GrantAccess(security.GroupEveryone, security.All|security.Create)
 		})
 	})
 	security.Registry.UnregisterGroup(group1)
@@ -521,6 +678,64 @@ func TestGroupedQueries(t *testing.T) {
 				So(groupedUsers[1].Values["nums"], ShouldEqual, 4)
 				So(groupedUsers[1].Count, ShouldEqual, 2)
 			})
+			Convey("Grouped query filtered on aggregates", func() {
+				users := env.Pool("User")
+				grouped := users.GroupBy(FieldName("IsStaff"))
+				rows := grouped.Having(users.Model().Field("Nums").Greater(3)).Aggregates(FieldName("IsStaff"), FieldName("Nums"))
+				So(rows, ShouldHaveLength, 1)
+				So(rows[0].Values["is_staff"], ShouldBeTrue)
+				So(rows[0].Values["nums"], ShouldEqual, 4)
+				rows = grouped.Having(users.Model().Field(GroupCount).Equals(1)).Aggregates(FieldName("IsStaff"), FieldName("Nums"))
+				So(rows, ShouldHaveLength, 1)
+				So(rows[0].Values["is_staff"], ShouldBeFalse)
+				rows = grouped.Having(users.Model().Field("Nums").Greater(3)).
+					Having(users.Model().Field("IsStaff").Equals(false)).Aggregates(FieldName("IsStaff"), FieldName("Nums"))
+				So(rows, ShouldBeEmpty)
+				So(func() { grouped.Having(users.Model().Field("Name").Equals("x")).Aggregates(FieldName("IsStaff")) }, ShouldPanic)
+			})
+			Convey("Records of groups should only be loaded on demand", func() {
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				rows := env.Pool("User").GroupBy(FieldName("IsStaff")).Aggregates(FieldName("IsStaff"), FieldName("Nums"))
+				queries := collector.started
+				groups := make([]*RecordCollection, len(rows))
+				for i, row := range rows {
+					groups[i] = row.Records()
+				}
+				So(collector.started, ShouldEqual, queries)
+				So(groups[0].Len(), ShouldEqual, rows[0].Count)
+				SetMetricsCollector(nil)
+				So(collector.started, ShouldBeGreaterThan, queries)
+				for i, row := range rows {
+					So(groups[i].Len(), ShouldEqual, row.Count)
+					for _, rec := range groups[i].Records() {
+						So(rec.Get("IsStaff"), ShouldEqual, row.Values["is_staff"])
+					}
+				}
+				So(func() { GroupAggregateRow{}.Records() }, ShouldPanic)
+			})
+			Convey("Ordering groups by a computed sum and limiting to the top three", func() {
+				users := env.Pool("User")
+				for i, nums := range []int{7, 12, 5, 9} {
+					users.Call("Create", FieldMap{
+						"Name":  "Group User",
+						"Email": fmt.Sprintf("group%d@example.com", i),
+						"Nums":  nums,
+					})
+				}
+				rows := users.GroupBy(FieldName("Name")).OrderBy("Nums DESC").Limit(3).Aggregates(FieldName("Name"), FieldName("Nums"))
+				So(rows, ShouldHaveLength, 3)
+				So(rows[0].Values["name"], ShouldEqual, "Group User")
+				So(rows[0].Values["nums"], ShouldEqual, 33)
+				So(rows[0].Count, ShouldEqual, 4)
+				So(rows[1].Values["nums"], ShouldBeGreaterThanOrEqualTo, rows[2].Values["nums"])
+				So(rows[0].Values["nums"], ShouldBeGreaterThanOrEqualTo, rows[1].Values["nums"])
+				rows = users.GroupBy(FieldName("Name")).OrderBy(GroupCount + " desc").Limit(1).Aggregates(FieldName("Name"))
+				So(rows, ShouldHaveLength, 1)
+				So(rows[0].Values["name"], ShouldEqual, "Group User")
+				So(rows[0].Count, ShouldEqual, 4)
+				So(func() { users.GroupBy(FieldName("Name")).OrderBy("Email").Aggregates(FieldName("Name")) }, ShouldPanic)
+			})
 		})
 	})
 }
@@ -639,6 +854,64 @@ func TestUpdateRecordSet(t *testing.T) {
 			userWill.Call("Write", FieldMap{"Nums": 0, "IsPremium": true})
 		}).Error(), ShouldStartWith, "pq: Premium users must have positive nums")
 	})
+	Convey("Testing updates with WriteIfChanged", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userJane := env.Pool("User").Search(env.Pool("User").Model().Field("Email").Equals("jane.smith@example.com"))
+			profile := userJane.Get("Profile").(RecordSet).Collection()
+			writeDate := userJane.Get("WriteDate").(dates.DateTime)
+			Convey("Writing unchanged values should not update the record", func() {
+				So(userJane.Get("Email"), ShouldEqual, "jane.smith@example.com")
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				res := userJane.Call("WriteIfChanged", FieldMap{
+					"Email":   "jane.smith@example.com",
+					"Profile": profile.Get("ID"),
+				})
+				env.Flush()
+				So(collector.started, ShouldEqual, 0)
+				So(res, ShouldEqual, 0)
+				So(userJane.Get("WriteDate").(dates.DateTime).Equal(writeDate), ShouldBeTrue)
+			})
+			Convey("Writing an unchanged relation as a RecordSet should not update the record", func() {
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				res := userJane.Call("WriteIfChanged", FieldMap{"Profile": profile})
+				env.Flush()
+				So(collector.started, ShouldEqual, 0)
+				So(res, ShouldEqual, 0)
+				So(userJane.Get("WriteDate").(dates.DateTime).Equal(writeDate), ShouldBeTrue)
+			})
+			Convey("Writing changed values should only update changed records", func() {
+				users := env.Pool("User").Search(env.Pool("User").Model().Field("Email").Equals("jane.smith@example.com").
+					Or().Field("Email").Equals("will.smith@example.com"))
+				So(users.Len(), ShouldEqual, 2)
+				res := users.Call("WriteIfChanged", FieldMap{"Email": "jane.smith@example.com"})
+				So(res, ShouldEqual, 1)
+				So(userJane.Get("WriteDate").(dates.DateTime).Equal(writeDate), ShouldBeTrue)
+				So(users.Subtract(userJane).Get("Email"), ShouldEqual, "jane.smith@example.com")
+			})
+			Convey("Records with the same changes should be updated with a single query", func() {
+				users := env.Pool("User").Search(env.Pool("User").Model().Field("Email").Equals("jane.smith@example.com").
+					Or().Field("Email").Equals("will.smith@example.com"))
+				users.Load()
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				res := users.Call("WriteIfChanged", FieldMap{"Nums": 42})
+				env.Flush()
+				So(res, ShouldEqual, 2)
+				var updates int
+				for _, query := range collector.queries {
+					if strings.HasPrefix(query, "UPDATE") {
+						updates++
+					}
+				}
+				So(updates, ShouldEqual, 1)
+			})
+		})
+	})
 
 	group1 := security.Registry.NewGroup("group1", "Group 1")
 	security.Registry.AddMembership(2, group1)
@@ -738,62 +1011,2218 @@ func TestUpdateRecordSet(t *testing.T) {
 	security.Registry.UnregisterGroup(group1)
 }
 
-func TestDeleteRecordSet(t *testing.T) {
-	Convey("Delete user John Smith", t, func() {
+func TestTypedErrors(t *testing.T) {
+	Convey("Testing typed errors on CRUD operations", t, func() {
+		Convey("Updating a non existent record should raise ErrRecordNotFound", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").withIds([]int64{999999}).Call("Write", FieldMap{"Name": "Nobody"})
+			})
+			So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+			var ormErr *Error
+			So(errors.As(err, &ormErr), ShouldBeTrue)
+			So(ormErr.Model, ShouldEqual, "User")
+		})
+		Convey("EnsureOne on an empty RecordSet should raise ErrRecordNotFound", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("Nobody")).EnsureOne()
+			})
+			So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+		})
+		Convey("Creating a record with a wrong relation value should raise ErrTypeMismatch", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Post").Call("Create", FieldMap{"Title": "Wrong Post", "User": "not an id"})
+			})
+			So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+		})
+		Convey("Union of RecordSets of different models should raise ErrTypeMismatch", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").Union(env.Pool("Post"))
+			})
+			So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+		})
+		Convey("Calling a forbidden method should raise ErrAccessDenied", func() {
+			err := SimulateInNewEnvironment(3, func(env Environment) {
+				env.Pool("User").Call("Create", FieldMap{"Name": "Forbidden User"})
+			})
+			So(errors.Is(err, ErrAccessDenied), ShouldBeTrue)
+			So(errors.Is(err, ErrRecordNotFound), ShouldBeFalse)
+		})
+		Convey("Saving a record without a required field should raise ErrRequiredFieldMissing", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Post").Call("Create", FieldMap{"Content": "Post without title"})
+				env.Flush()
+			})
+			So(errors.Is(err, ErrRequiredFieldMissing), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "Missing value for required field")
+			So(err.Error(), ShouldContainSubstring, "Title")
+		})
+		Convey("Violating an SQL constraint should raise ErrDatabase", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				profile := env.Pool("Profile").Call("Create", FieldMap{"Age": 30})
+				env.Pool("User").Call("Create", FieldMap{"Name": "Rob Smith", "IsPremium": true, "Profile": profile})
+				env.Flush()
+			})
+			So(errors.Is(err, ErrDatabase), ShouldBeTrue)
+		})
+		Convey("Writing an unknown field should raise ErrUnknownField", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).
+					Call("Write", FieldMap{"Nmae": "Jane"})
+			})
+			So(errors.Is(err, ErrUnknownField), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "Unknown field Nmae on model User")
+		})
+		Convey("Creating a record with an unknown field should raise ErrUnknownField", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Tag").Call("Create", FieldMap{"Name": "Tag", "Colour": "red"})
+			})
+			So(errors.Is(err, ErrUnknownField), ShouldBeTrue)
+		})
+		Convey("Searching on an unknown field should raise ErrUnknownField", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Emial").Equals("jane.smith@example.com")).Fetch()
+			})
+			So(errors.Is(err, ErrUnknownField), ShouldBeTrue)
+		})
+		Convey("Writing a computed field without inverse should raise ErrReadOnlyField", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).
+					Call("Write", FieldMap{"DecoratedName": "Jane"})
+			})
+			So(errors.Is(err, ErrReadOnlyField), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "DecoratedName")
+			err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).
+					Call("Write", FieldMap{"DecoratedName": ""})
+			})
+			So(err, ShouldBeNil)
+			err = SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).
+					WithContext("hexya_force_compute_write", false).Call("Write", FieldMap{"DecoratedName": "Jane"})
+			})
+			So(errors.Is(err, ErrReadOnlyField), ShouldBeTrue)
+		})
+		Convey("Writing a ReadOnly field should raise ErrReadOnlyField", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).
+					Call("Write", FieldMap{"CreateUID": int64(5)})
+			})
+			So(errors.Is(err, ErrReadOnlyField), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "CreateUID")
+		})
+		Convey("ReadOnly field values should be dropped with DropReadOnlyFieldValues", func() {
+			DropReadOnlyFieldValues = true
+			defer func() { DropReadOnlyFieldValues = false }()
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				createUID := userJane.Get("CreateUID")
+				userJane.Call("Write", FieldMap{"CreateUID": int64(5), "Nums": 3})
+				So(userJane.Get("CreateUID"), ShouldEqual, createUID)
+				So(userJane.Get("Nums"), ShouldEqual, 3)
+			})
+			So(err, ShouldBeNil)
+		})
+		Convey("Server side code should be able to write ReadOnly fields", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				So(func() {
+					userJane.WithContext("hexya_allow_readonly_write", true).Call("Write", FieldMap{"CreateUID": int64(5)})
+				}, ShouldPanic)
+				So(func() {
+					userJane.WithContext("hexya_force_compute_write", true).Call("Write", FieldMap{"CreateUID": int64(5)})
+				}, ShouldPanic)
+				userJane.WithReadOnlyWrite().Call("Write", FieldMap{"CreateUID": int64(5)})
+				So(userJane.Get("CreateUID"), ShouldEqual, 5)
+			})
+			So(err, ShouldBeNil)
+		})
+	})
+	Convey("Testing TryCall", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
-			users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
-			num := users.Call("Unlink")
-			Convey("Number of deleted record should be 1", func() {
-				So(num, ShouldEqual, 1)
+			Convey("ORM errors should be returned", func() {
+				err := TryCall(func() {
+					env.Pool("User").Union(env.Pool("Post"))
+				})
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+			})
+			Convey("No error should be returned if nothing panicked", func() {
+				err := TryCall(func() {
+					env.Pool("User").SearchAll().Len()
+				})
+				So(err, ShouldBeNil)
+			})
+			Convey("Runtime errors should still panic", func() {
+				So(func() {
+					TryCall(func() {
+						var rc *RecordCollection
+						rc.Len()
+					})
+				}, ShouldPanic)
 			})
 		})
 	})
-	group1 := security.Registry.NewGroup("group1", "Group 1")
-	security.Registry.AddMembership(2, group1)
-	Convey("Checking unlink access permissions", t, func() {
-		SimulateInNewEnvironment(2, func(env Environment) {
-			userModel := Registry.MustGet("User")
+}
 
-			Convey("Checking that user 2 cannot unlink records", func() {
-				userModel.methods.MustGet("Load").AllowGroup(group1)
-				users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
-				So(func() { users.Call("Unlink") }, ShouldPanic)
+func TestReadOne(t *testing.T) {
+	Convey("Testing ReadOne and ReadOneErr", t, func() {
+		type UserStruct struct {
+			ID    int64
+			Name  string
+			Email string
+		}
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			Convey("Reading a single record should populate the struct", func() {
+				var userJaneStruct UserStruct
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				So(userJane.ReadOneErr(&userJaneStruct, "Name", "Email"), ShouldBeNil)
+				So(userJaneStruct.Email, ShouldEqual, "jane.smith@example.com")
+				So(userJaneStruct.ID, ShouldEqual, userJane.ids[0])
 			})
-			Convey("Adding unlink permission to user2", func() {
-				userModel.methods.MustGet("Unlink").AllowGroup(group1)
-				users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
-				num := users.Call("Unlink")
-				So(num, ShouldEqual, 1)
+			Convey("Reading an empty RecordSet should return ErrRecordNotFound", func() {
+				var userStruct UserStruct
+				err := users.Search(users.Model().Field("Email").Equals("nobody@example.com")).ReadOneErr(&userStruct)
+				So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+				So(errors.Is(err, ErrMultipleRecords), ShouldBeFalse)
 			})
-			Convey("Checking record rules", func() {
+			Convey("Reading several records should return ErrMultipleRecords", func() {
+				var userStruct UserStruct
+				err := users.SearchAll().ReadOneErr(&userStruct)
+				So(errors.Is(err, ErrMultipleRecords), ShouldBeTrue)
+				So(errors.Is(err, ErrRecordNotFound), ShouldBeFalse)
+			})
+			Convey("ReadOne should panic with the same errors", func() {
+				var userStruct UserStruct
+				So(func() { users.SearchAll().ReadOne(&userStruct) }, ShouldPanic)
+				err := TryCall(func() {
+					users.Search(users.Model().Field("Email").Equals("nobody@example.com")).ReadOne(&userStruct)
+				})
+				So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+			})
+		})
+	})
+}
 
-				rule := RecordRule{
-					Name:      "jOnly",
-					Group:     group1,
-					Condition: env.Pool("User").Model().Field("Name").IContains("j"),
-					Perms:     security.Unlink,
-				}
-				userModel.AddRecordRule(&rule)
+func TestReadValue(t *testing.T) {
+	Convey("Testing ReadValue", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			profile := userJane.Get("Profile").(RecordSet).Collection()
+			Convey("Reading a scalar field", func() {
+				So(userJane.ReadValue("Email"), ShouldEqual, "jane.smith@example.com")
+			})
+			Convey("Reading a many2one field should return its id", func() {
+				So(userJane.ReadValue("Profile"), ShouldEqual, profile.ids[0])
+			})
+			Convey("Reading a one2many field should return its ids", func() {
+				So(userJane.ReadValue("Posts"), ShouldResemble, userJane.Get("Posts").(RecordSet).Ids())
+			})
+			Convey("Reading a field through a relation path", func() {
+				So(userJane.ReadValue("Profile.Age"), ShouldEqual, profile.Get("Age"))
+			})
+			Convey("Reading a value of an empty or multiple RecordSet should panic", func() {
+				err := TryCall(func() {
+					users.Search(users.Model().Field("Email").Equals("nobody@example.com")).ReadValue("Email")
+				})
+				So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+				err = TryCall(func() {
+					users.SearchAll().ReadValue("Email")
+				})
+				So(errors.Is(err, ErrMultipleRecords), ShouldBeTrue)
+			})
+		})
+	})
+}
 
-				notUsedRule := RecordRule{
-					Name:      "writeRule",
-					Group:     group1,
-					Condition: env.Pool("User").Model().Field("Name").Equals("Nobody"),
-					Perms:     security.Write,
+func TestLazySearch(t *testing.T) {
+	Convey("Testing lazy id resolution of searched RecordSets", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			janeCond := users.Model().Field("Email").Equals("jane.smith@example.com")
+			Convey("Reading a searched RecordSet should resolve its ids", func() {
+				userJane := users.Search(janeCond)
+				So(userJane.fetched, ShouldBeFalse)
+				So(userJane.Get("Email"), ShouldEqual, "jane.smith@example.com")
+				So(userJane.Ids(), ShouldHaveLength, 1)
+			})
+			Convey("Searching in a fetched RecordSet should resolve the new ids", func() {
+				allUsers := users.SearchAll().Fetch()
+				So(allUsers.Len(), ShouldBeGreaterThan, 1)
+				userJane := allUsers.Search(janeCond)
+				So(userJane.fetched, ShouldBeFalse)
+				So(userJane.Len(), ShouldEqual, 1)
+				So(userJane.Records(), ShouldHaveLength, 1)
+				So(userJane.Records()[0].Get("Email"), ShouldEqual, "jane.smith@example.com")
+				So(allUsers.Limit(1).Len(), ShouldEqual, 1)
+			})
+			Convey("Searching in an explicitly empty RecordSet should stay empty", func() {
+				noUsers := users.Browse()
+				So(noUsers.Search(janeCond).Len(), ShouldEqual, 0)
+				So(noUsers.Search(janeCond).IsEmpty(), ShouldBeTrue)
+				So(users.Len(), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestPrefetchFields(t *testing.T) {
+	Convey("Testing WithPrefetchFields", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			ids := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Ids()
+			Convey("The first read should load all declared fields in one query", func() {
+				userJane := users.Browse(ids...).WithPrefetchFields("Email", "Nums", "Profile.Age")
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				email := userJane.Get("Email")
+				nums := userJane.Get("Nums")
+				SetMetricsCollector(nil)
+				So(email, ShouldEqual, "jane.smith@example.com")
+				So(nums, ShouldNotBeNil)
+				So(collector.started, ShouldEqual, 1)
+				So(collector.queries[0], ShouldContainSubstring, "email")
+				So(collector.queries[0], ShouldContainSubstring, "nums")
+				So(collector.queries[0], ShouldContainSubstring, "age")
+			})
+			Convey("Records should inherit the prefetch fields", func() {
+				recs := users.Browse(ids...).WithPrefetchFields("Email", "Nums").Records()
+				So(recs[0].prefetchFields, ShouldResemble, []string{"Email", "Nums"})
+			})
+			Convey("Unknown fields should panic", func() {
+				So(func() { users.WithPrefetchFields("Email", "UnknownField") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestReadDisplay(t *testing.T) {
+	Convey("Testing reading relation fields with display names", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			tags := env.Pool("Tag")
+			posts := env.Pool("Post")
+			for i := 0; i < 5; i++ {
+				user := users.Call("Create", FieldMap{"Name": fmt.Sprintf("Reader %d", i), "Email": fmt.Sprintf("reader%d@example.com", i)}).(RecordSet).Collection()
+				tag1 := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Read Tag %dA", i)}).(RecordSet).Collection()
+				tag2 := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Read Tag %dB", i)}).(RecordSet).Collection()
+				posts.Call("Create", FieldMap{"Title": fmt.Sprintf("Read Post %d", i), "User": user, "Tags": tag1.Union(tag2)})
+			}
+			posts.Call("Create", FieldMap{"Title": "Read Post without user"})
+			env.Flush()
+			cond := posts.Model().Field("Title").Contains("Read Post")
+			fields := []string{"Title", "User", "Tags"}
+			countQueries := func(fnct func()) int {
+				*env.cache = *newCache()
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				fnct()
+				return collector.started
+			}
+			Convey("Relation fields should be returned with their names", func() {
+				res := posts.Search(cond).OrderBy("Title").ReadDisplay(fields)
+				So(res, ShouldHaveLength, 6)
+				So(res[0]["Title"], ShouldEqual, "Read Post 0")
+				So(res[0]["User"].(FieldMap)["name"], ShouldEqual, "Reader 0")
+				So(res[0]["User"].(FieldMap)["id"], ShouldBeGreaterThan, 0)
+				So(res[0]["Tags"], ShouldHaveLength, 2)
+				So([]string{res[0]["Tags"].([]FieldMap)[0]["name"].(string), res[0]["Tags"].([]FieldMap)[1]["name"].(string)},
+					ShouldContain, "Read Tag 0B")
+				So(res[5]["Title"], ShouldEqual, "Read Post without user")
+				So(res[5]["User"], ShouldBeNil)
+				So(res[5]["Tags"], ShouldBeEmpty)
+			})
+			Convey("Names should be resolved with one query per related model", func() {
+				readQueries := countQueries(func() {
+					posts.Search(cond).Call("Read", fields)
+				})
+				perRecordQueries := countQueries(func() {
+					for _, line := range posts.Search(cond).Call("Read", fields).([]FieldMap) {
+						for _, rec := range line["User"].(RecordSet).Collection().Records() {
+							rec.Call("NameGet")
+						}
+						for _, rec := range line["Tags"].(RecordSet).Collection().Records() {
+							rec.Call("NameGet")
+						}
+					}
+				})
+				batchedQueries := countQueries(func() {
+					posts.Search(cond).ReadDisplay(fields)
+				})
+				So(batchedQueries, ShouldEqual, readQueries+2)
+				So(batchedQueries, ShouldBeLessThan, perRecordQueries)
+			})
+		})
+	})
+}
+
+// createBenchPosts creates nbUsers users with postsPerUser posts each for
+// benchmarks. If withTags is true, the posts of each user are tagged with a
+// tag of their own. It returns the condition matching the created posts.
+func createBenchPosts(env Environment, prefix string, nbUsers, postsPerUser int, withTags bool) *Condition {
+	users := env.Pool("User")
+	tags := env.Pool("Tag")
+	posts := env.Pool("Post")
+	for i := 0; i < nbUsers; i++ {
+		user := users.Call("Create", FieldMap{
+			"Name":  fmt.Sprintf("%s Author %d", prefix, i),
+			"Email": fmt.Sprintf("%s.author%d@example.com", strings.ToLower(prefix), i),
+		}).(RecordSet).Collection()
+		var tag *RecordCollection
+		if withTags {
+			tag = tags.Call("Create", FieldMap{"Name": fmt.Sprintf("%s Tag %d", prefix, i)}).(RecordSet).Collection()
+		}
+		for j := 0; j < postsPerUser; j++ {
+			data := FieldMap{"Title": fmt.Sprintf("%s Post %d-%d", prefix, i, j), "User": user}
+			if tag != nil {
+				data["Tags"] = tag
+			}
+			posts.Call("Create", data)
+		}
+	}
+	env.Flush()
+	return posts.Model().Field("Title").Like(prefix + " Post %")
+}
+
+func BenchmarkReadDisplay(b *testing.B) {
+	SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+		posts := env.Pool("Post")
+		cond := createBenchPosts(env, "Display", 50, 1, true)
+		fields := []string{"Title", "User", "Tags"}
+		b.Run("PerRecord", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				*env.cache = *newCache()
+				for _, line := range posts.Search(cond).Call("Read", fields).([]FieldMap) {
+					line["User"].(RecordSet).Collection().Call("NameGet")
+					for _, rec := range line["Tags"].(RecordSet).Collection().Records() {
+						rec.Call("NameGet")
+					}
 				}
-				userModel.AddRecordRule(&notUsedRule)
+			}
+		})
+		b.Run("Batched", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				*env.cache = *newCache()
+				posts.Search(cond).ReadDisplay(fields)
+			}
+		})
+	})
+}
 
-				userJane := env.Pool("User").Search(env.Pool("User").Model().Field("Email").Equals("jane.smith@example.com"))
-				So(userJane.Len(), ShouldEqual, 1)
-				So(userJane.Call("Unlink"), ShouldEqual, 1)
+func TestSelectRelated(t *testing.T) {
+	Convey("Testing SelectRelated", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			ids := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Ids()
+			profileModel := Registry.MustGet("Profile")
+			postModel := Registry.MustGet("Post")
+			Convey("Only the given relations should be joined and cached", func() {
+				userJane := users.Browse(ids...).SelectRelated("Profile")
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				email := userJane.Get("Email")
+				SetMetricsCollector(nil)
+				So(email, ShouldEqual, "jane.smith@example.com")
+				So(collector.started, ShouldEqual, 1)
+				So(collector.queries[0], ShouldContainSubstring, `LEFT JOIN "profile"`)
+				So(collector.queries[0], ShouldNotContainSubstring, `"post"`)
+				So(collector.queries[0], ShouldNotContainSubstring, `"resume"`)
+				profile := userJane.Get("Profile").(RecordSet).Collection()
+				So(env.cache.checkIfInCache(profileModel, profile.Ids(), []string{"age", "best_post_id"}), ShouldBeTrue)
+				bestPost := profile.Get("BestPost").(RecordSet).Collection()
+				So(bestPost.IsEmpty(), ShouldBeFalse)
+				So(env.cache.checkIfInCache(postModel, bestPost.Ids(), []string{"title"}), ShouldBeFalse)
+			})
+			Convey("Nested relation paths should be joined", func() {
+				userJane := users.Browse(ids...).SelectRelated("Profile.BestPost")
+				userJane.Get("Email")
+				profile := userJane.Get("Profile").(RecordSet).Collection()
+				bestPost := profile.Get("BestPost").(RecordSet).Collection()
+				So(env.cache.checkIfInCache(postModel, bestPost.Ids(), []string{"title"}), ShouldBeTrue)
+			})
+			Convey("Invalid relation paths should panic", func() {
+				So(errors.Is(TryCall(func() { users.SelectRelated("Unknown") }), ErrUnknownField), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { users.SelectRelated("Posts") }), ErrTypeMismatch), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { users.SelectRelated("Profile.Unknown") }), ErrUnknownField), ShouldBeTrue)
+				So(errors.Is(TryCall(func() { users.SelectRelated("Profile.Age") }), ErrTypeMismatch), ShouldBeTrue)
+			})
+		})
+	})
+}
 
-				userWill := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("Will Smith"))
-				So(userWill.Call("Unlink"), ShouldEqual, 0)
+func TestValues(t *testing.T) {
+	Convey("Testing Values with expressions", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			profile := userJane.Get("Profile").(RecordSet).Collection()
+			Convey("Aliased expressions and relation paths should be returned together", func() {
+				res := userJane.Values([]string{"Nums * ? + Profile.Age AS total", "Profile.Money", "UPPER(Name) AS upper_name"}, 10)
+				So(res, ShouldHaveLength, 1)
+				So(res[0], ShouldHaveLength, 3)
+				total := int64(userJane.Get("Nums").(int))*10 + int64(profile.Get("Age").(int16))
+				So(res[0]["total"], ShouldEqual, total)
+				So(res[0]["Profile.Money"], ShouldEqual, profile.Get("Money"))
+				So(res[0]["upper_name"], ShouldEqual, strings.ToUpper(userJane.Get("Name").(string)))
+			})
+			Convey("Window functions should rank records per partition", func() {
+				ranked := users.Call("Create", FieldMap{"Name": "Window A", "Email": "wa@example.com", "IsStaff": true, "Nums": 5}).(RecordSet).Collection()
+				ranked = ranked.Union(users.Call("Create", FieldMap{"Name": "Window B", "Email": "wb@example.com", "IsStaff": true, "Nums": 7}).(RecordSet).Collection())
+				ranked = ranked.Union(users.Call("Create", FieldMap{"Name": "Window C", "Email": "wc@example.com", "IsStaff": false, "Nums": 2}).(RecordSet).Collection())
+				res := ranked.Values([]string{"Name", "ROW_NUMBER() OVER (PARTITION BY IsStaff ORDER BY Nums DESC) AS rank",
+					"SUM(Nums) OVER (PARTITION BY IsStaff) AS total"})
+				So(res, ShouldHaveLength, 3)
+				So(res[0]["Name"], ShouldEqual, "Window A")
+				So(res[0]["rank"], ShouldEqual, 2)
+				So(res[0]["total"], ShouldEqual, 12)
+				So(res[1]["Name"], ShouldEqual, "Window B")
+				So(res[1]["rank"], ShouldEqual, 1)
+				So(res[2]["Name"], ShouldEqual, "Window C")
+				So(res[2]["rank"], ShouldEqual, 1)
+				So(res[2]["total"], ShouldEqual, 2)
+				So(func() { ranked.Values([]string{"RANK() AS rank"}) }, ShouldPanic)
+				So(func() { ranked.Values([]string{"SUM(Nums) AS total"}) }, ShouldPanic)
+			})
+			Convey("Invalid specifications should panic", func() {
+				So(func() { userJane.Values([]string{"Nums; DROP TABLE user AS x"}) }, ShouldPanic)
+				So(func() { userJane.Values([]string{"Nums * 2"}) }, ShouldPanic)
+				So(func() { userJane.Values([]string{"pg_sleep(1) AS x"}) }, ShouldPanic)
+				So(func() { userJane.Values([]string{"Nums AS \"x\""}) }, ShouldPanic)
+				So(func() { userJane.Values([]string{"Nums * ? AS x"}) }, ShouldPanic)
+				So(errors.Is(TryCall(func() { userJane.Values([]string{"Posts AS p"}) }), ErrUnknownField), ShouldBeTrue)
+			})
+		})
+	})
+}
 
-				userModel.RemoveRecordRule("jOnly")
-				userModel.RemoveRecordRule("writeRule")
+func TestRecompute(t *testing.T) {
+	Convey("Testing Recompute", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Age": int16(30)}).(RecordSet).Collection()
+			userKid := users.Call("Create", FieldMap{
+				"Name":    "Recompute Kid",
+				"Email":   "kid@example.com",
+				"Profile": profile,
+			}).(RecordSet).Collection()
+			So(userKid.Get("Age"), ShouldEqual, 30)
+			So(userKid.Get("Minor"), ShouldBeFalse)
+			profile.WithContext("hexya_no_recompute_stored_fields", true).Set("Age", int16(12))
+			So(userKid.Get("Age"), ShouldEqual, 30)
+			recs := userJane.Union(userKid)
+			Convey("Recompute should only update changed records", func() {
+				So(recs.Recompute(), ShouldEqual, 1)
+				So(userKid.Get("Age"), ShouldEqual, 12)
+				So(userKid.Get("Minor"), ShouldBeTrue)
+				So(userJane.Get("Age"), ShouldEqual, 23)
+				So(recs.Recompute(), ShouldEqual, 0)
+			})
+			Convey("Recompute should compute dependencies first", func() {
+				So(recs.Recompute("Minor", "Age"), ShouldEqual, 1)
+				So(userKid.Get("Age"), ShouldEqual, 12)
+				So(userKid.Get("Minor"), ShouldBeTrue)
+				ordered := sortByDependencies([]*Field{
+					users.model.fields.MustGet("Minor"),
+					users.model.fields.MustGet("Age"),
+				})
+				So(ordered[0].name, ShouldEqual, "Age")
+				So(ordered[1].name, ShouldEqual, "Minor")
+			})
+			Convey("Recompute should not update records for other fields", func() {
+				So(recs.Recompute("Minor"), ShouldEqual, 0)
+				So(userKid.Get("Age"), ShouldEqual, 30)
+			})
+			Convey("Recompute should panic on non stored computed fields", func() {
+				So(func() { recs.Recompute("DecoratedName") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestFieldTracking(t *testing.T) {
+	Convey("Testing field tracking", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			userWill := users.Search(users.Model().Field("Name").Equals("Will Smith"))
+			trackingValues := func(model string, id int64) *RecordCollection {
+				tvModel := Registry.MustGet("TrackingValue")
+				return env.Pool("TrackingValue").Search(tvModel.Field("ResModel").Equals(model).
+					And().Field("ResID").Equals(id))
+			}
+			Convey("Changing tracked fields should write history rows", func() {
+				post := env.Pool("Post").Call("Create", FieldMap{
+					"Title":   "Tracked Post",
+					"User":    userJane,
+					"Content": "Content",
+				}).(RecordSet).Collection()
+				env.Flush()
+				postID := post.persistedIds()[0]
+				env.Pool("Post").Browse(postID).Call("Write", FieldMap{
+					"Title":   "Tracked Post (modified)",
+					"User":    userWill,
+					"Content": "Modified content",
+				})
+				env.Flush()
+				tvs := trackingValues("Post", postID)
+				So(tvs.Len(), ShouldEqual, 2)
+				for _, tv := range tvs.Records() {
+					So(tv.Get("UID"), ShouldEqual, security.SuperUserID)
+					switch tv.Get("Field") {
+					case "Title":
+						So(tv.Get("OldValue"), ShouldEqual, "Tracked Post")
+						So(tv.Get("NewValue"), ShouldEqual, "Tracked Post (modified)")
+					case "User":
+						So(tv.Get("OldValue"), ShouldEqual, userJane.Get("Name"))
+						So(tv.Get("NewValue"), ShouldEqual, userWill.Get("Name"))
+					default:
+						So(tv.Get("Field"), ShouldBeIn, []string{"Title", "User"})
+					}
+				}
+			})
+			Convey("Writing several records at once should log each of them", func() {
+				post1 := env.Pool("Post").Call("Create", FieldMap{
+					"Title": "Tracked Post 1",
+					"User":  userJane,
+				}).(RecordSet).Collection()
+				post2 := env.Pool("Post").Call("Create", FieldMap{
+					"Title": "Tracked Post 2",
+					"User":  userJane,
+				}).(RecordSet).Collection()
+				env.Flush()
+				postIds := append(post1.persistedIds(), post2.persistedIds()...)
+				env.Pool("Post").Browse(postIds...).Call("Write", FieldMap{"User": userWill})
+				env.Flush()
+				for _, postID := range postIds {
+					tvs := trackingValues("Post", postID)
+					So(tvs.Len(), ShouldEqual, 1)
+					So(tvs.Get("Field"), ShouldEqual, "User")
+					So(tvs.Get("OldValue"), ShouldEqual, userJane.Get("Name"))
+					So(tvs.Get("NewValue"), ShouldEqual, userWill.Get("Name"))
+				}
+			})
+			Convey("Selection fields should log their labels", func() {
+				profile := env.Pool("Profile").Call("Create", FieldMap{"Gender": "male"}).(RecordSet).Collection()
+				env.Flush()
+				profileID := profile.persistedIds()[0]
+				env.Pool("Profile").Browse(profileID).Call("Write", FieldMap{"Gender": "female", "City": "Paris"})
+				env.Flush()
+				tvs := trackingValues("Profile", profileID)
+				So(tvs.Len(), ShouldEqual, 1)
+				So(tvs.Get("Field"), ShouldEqual, "Gender")
+				So(tvs.Get("OldValue"), ShouldEqual, "Male")
+				So(tvs.Get("NewValue"), ShouldEqual, "Female")
+			})
+			Convey("Writing untracked fields should not write history rows", func() {
+				userJane.Call("Write", FieldMap{"Nums": 4})
+				env.Flush()
+				So(trackingValues("User", userJane.Ids()[0]).Len(), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestGetMetadata(t *testing.T) {
+	Convey("Testing record metadata", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Convey("Metadata should be returned after create and write", func() {
+				post := env.Pool("Post").Call("Create", FieldMap{
+					"Title":   "Metadata Post",
+					"Content": "Content",
+				}).(RecordSet).Collection()
+				post.Call("Write", FieldMap{"Title": "Metadata Post (modified)"})
+				metadata := post.GetMetadata()
+				So(metadata, ShouldHaveLength, 1)
+				meta, ok := metadata[post.Ids()[0]]
+				So(ok, ShouldBeTrue)
+				So(meta.ID, ShouldEqual, post.Ids()[0])
+				So(meta.CreateUID, ShouldEqual, security.SuperUserID)
+				So(meta.WriteUID, ShouldEqual, security.SuperUserID)
+				So(meta.CreateDate.IsZero(), ShouldBeFalse)
+				So(meta.WriteDate.IsZero(), ShouldBeFalse)
+				So(meta.WriteDate.GreaterEqual(meta.CreateDate), ShouldBeTrue)
+				So(meta.ExternalID, ShouldEqual, post.Get("HexyaExternalID"))
+			})
+			Convey("Models without audit fields should return what is available", func() {
+				tvModel := Registry.MustGet("TrackingValue")
+				tv := env.Pool("TrackingValue").Call("Create", FieldMap{
+					"ResModel": "Post",
+					"ResID":    int64(1),
+					"Field":    "Title",
+				}).(RecordSet).Collection()
+				_, hasCreateUID := tvModel.fields.Get("CreateUID")
+				So(hasCreateUID, ShouldBeFalse)
+				metadata := tv.GetMetadata()
+				So(metadata, ShouldHaveLength, 1)
+				meta := metadata[tv.Ids()[0]]
+				So(meta.ID, ShouldEqual, tv.Ids()[0])
+				So(meta.CreateUID, ShouldEqual, 0)
+				So(meta.CreateDate.IsZero(), ShouldBeTrue)
+				So(meta.ExternalID, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestSearchDomain(t *testing.T) {
+	Convey("Testing search with domains", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			dom := []interface{}{"|", []interface{}{"Name", "=", "John Smith"},
+				"!", []interface{}{"Nums", "in", []int64{1, 2}}}
+			Convey("Round-tripping a domain should give back the same domain", func() {
+				So(fmt.Sprint(users.SearchDomain(dom).ToDomain()), ShouldEqual, fmt.Sprint(dom))
+			})
+			Convey("Searching by domain should give the same result as searching by condition", func() {
+				cond := users.Model().Field("Name").Equals("John Smith").
+					OrNot().Field("Nums").In([]int64{1, 2})
+				So(users.SearchDomain(dom).Equals(users.Search(cond)), ShouldBeTrue)
+				reapplied := users.SearchDomain(users.SearchDomain(dom).ToDomain())
+				So(reapplied.Equals(users.Search(cond)), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestSearchWithRecordSetArg(t *testing.T) {
+	Convey("Testing search with RecordSet arguments", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			posts := env.Pool("Post")
+			user := users.Call("Create", FieldMap{"Name": "RecordSet Arg User", "Email": "rsarg@example.com"}).(RecordSet).Collection()
+			post := posts.Call("Create", FieldMap{"Title": "RecordSet Arg Post", "Content": "Content", "User": user}).(RecordSet).Collection()
+			env.Flush()
+			Convey("A RecordSet value should be expanded to its ids", func() {
+				res := posts.Search(posts.Model().Field("User").In(user))
+				So(res.Equals(post), ShouldBeTrue)
+				res = posts.Search(posts.Model().Field("ID").In(post))
+				So(res.Equals(post), ShouldBeTrue)
+				res = posts.SearchDomain([]interface{}{[]interface{}{"User", "in", user}})
+				So(res.Equals(post), ShouldBeTrue)
+			})
+			Convey("A lazy RecordSet value should be searched in a subquery", func() {
+				lazyUsers := users.Search(users.Model().Field("Email").Equals("rsarg@example.com"))
+				res := posts.Search(posts.Model().Field("User").In(lazyUsers))
+				So(res.Equals(post), ShouldBeTrue)
+				So(lazyUsers.fetched, ShouldBeFalse)
+				res = posts.Search(posts.Model().Field("User").NotIn(lazyUsers))
+				So(res.Intersect(post).IsEmpty(), ShouldBeTrue)
+				emptyUsers := users.Search(users.Model().Field("Email").Equals("nobody@example.com"))
+				So(posts.Search(posts.Model().Field("User").In(emptyUsers)).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("A RecordSet of another model should fail", func() {
+				tags := env.Pool("Tag").SearchAll()
+				err := TryCall(func() { posts.Search(posts.Model().Field("User").In(tags)).SearchCount() })
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+				err = TryCall(func() { posts.Search(posts.Model().Field("ID").NotIn(user)).SearchCount() })
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestSavedSearches(t *testing.T) {
+	Convey("Testing saved searches", t, func() {
+		SimulateInNewEnvironment(2, func(env Environment) {
+			users := env.Pool("User")
+			staff := users.Search(users.Model().Field("IsStaff").Equals(true))
+			johns := users.Search(users.Model().Field("Name").IContains("John").
+				OrNot().Field("Nums").In([]int64{1, 2}))
+			Convey("Saving searches should store their domain", func() {
+				staff.SaveSearch("Staff", false)
+				johns.SaveSearch("Johns", true)
+				ss := env.Pool("SavedSearch").Sudo()
+				saved := ss.Search(ss.Model().Field("Name").Equals("Johns"))
+				So(saved.Len(), ShouldEqual, 1)
+				So(saved.Get("UserID"), ShouldEqual, 2)
+				So(saved.Get("ResModel"), ShouldEqual, "User")
+				So(saved.Get("Shared"), ShouldBeTrue)
+				Convey("Saved searches should be listed", func() {
+					So(users.SavedSearches(), ShouldResemble, []string{"Johns", "Staff"})
+					So(env.Pool("Post").SavedSearches(), ShouldBeEmpty)
+				})
+				Convey("Applying a saved search should filter with its domain", func() {
+					So(fmt.Sprint(users.ApplySavedSearch("Staff").ToDomain()), ShouldEqual, fmt.Sprint(staff.ToDomain()))
+					So(fmt.Sprint(users.ApplySavedSearch("Johns").ToDomain()), ShouldEqual, fmt.Sprint(johns.ToDomain()))
+				})
+				Convey("Saving again with the same name should replace the saved search", func() {
+					johns.SaveSearch("Staff", false)
+					So(users.SavedSearches(), ShouldResemble, []string{"Johns", "Staff"})
+					So(fmt.Sprint(users.ApplySavedSearch("Staff").ToDomain()), ShouldEqual, fmt.Sprint(johns.ToDomain()))
+				})
+				Convey("Only shared searches should be available to other users", func() {
+					suUsers := users.Sudo()
+					So(suUsers.SavedSearches(), ShouldResemble, []string{"Johns"})
+					So(fmt.Sprint(suUsers.ApplySavedSearch("Johns").ToDomain()), ShouldEqual, fmt.Sprint(johns.ToDomain()))
+					So(func() { suUsers.ApplySavedSearch("Staff") }, ShouldPanic)
+				})
+			})
+			Convey("Applying an unknown saved search should fail", func() {
+				So(func() { users.ApplySavedSearch("Unknown") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestSearchRead(t *testing.T) {
+	Convey("Testing SearchRead", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			allNames := make([]string, 0)
+			for _, user := range users.SearchAll().OrderBy("Name").Records() {
+				allNames = append(allNames, user.Get("Name").(string))
+			}
+			So(len(allNames), ShouldBeGreaterThanOrEqualTo, 3)
+			readNames := func(records []FieldMap) []string {
+				res := make([]string, len(records))
+				for i, rec := range records {
+					res[i] = rec["Name"].(string)
+				}
+				return res
+			}
+			Convey("Records should be paged and the total should ignore the limit", func() {
+				records, total := users.SearchRead(nil, []string{"Name", "Email"}, 0, 2, "Name")
+				So(total, ShouldEqual, len(allNames))
+				So(records, ShouldHaveLength, 2)
+				So(readNames(records), ShouldResemble, allNames[:2])
+				So(records[0], ShouldContainKey, "Email")
+				So(records[0], ShouldContainKey, "id")
+				end := 4
+				if end > len(allNames) {
+					end = len(allNames)
+				}
+				records, total = users.SearchRead(nil, []string{"Name"}, 2, 2, "Name")
+				So(total, ShouldEqual, len(allNames))
+				So(readNames(records), ShouldResemble, allNames[2:end])
+			})
+			Convey("Records should be sorted by the given order", func() {
+				records, _ := users.SearchRead(nil, []string{"Name"}, 0, -1, "Name desc, id")
+				So(records, ShouldHaveLength, len(allNames))
+				So(records[0]["Name"], ShouldEqual, allNames[len(allNames)-1])
+				So(records[len(records)-1]["Name"], ShouldEqual, allNames[0])
+			})
+			Convey("Records should be filtered by the domain", func() {
+				dom := []interface{}{[]interface{}{"Name", "ilike", "Smith"}}
+				records, total := users.SearchRead(dom, []string{"Name"}, 0, 1, "Name")
+				So(total, ShouldEqual, users.Search(users.Model().Field("Name").IContains("Smith")).SearchCount())
+				So(total, ShouldBeGreaterThan, 1)
+				So(records, ShouldHaveLength, 1)
+				So(records[0]["Name"], ShouldContainSubstring, "Smith")
+			})
+			Convey("A zero limit should only count the records in one query", func() {
+				dom := []interface{}{[]interface{}{"Name", "ilike", "Smith"}}
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				records, total := users.SearchRead(dom, []string{"Name", "Email"}, 0, 0, "Name")
+				So(collector.started, ShouldEqual, 1)
+				So(total, ShouldEqual, users.Search(users.Model().Field("Name").IContains("Smith")).SearchCount())
+				So(total, ShouldBeGreaterThan, 1)
+				So(records, ShouldNotBeNil)
+				So(records, ShouldBeEmpty)
+			})
+			Convey("SearchAndCount should return the records and the total", func() {
+				smiths := users.Search(users.Model().Field("Name").IContains("Smith"))
+				recs, total := smiths.OrderBy("Name").Limit(1).SearchAndCount()
+				So(total, ShouldEqual, smiths.SearchCount())
+				So(total, ShouldBeGreaterThan, 1)
+				So(recs.Len(), ShouldEqual, 1)
+				So(recs.Get("Name"), ShouldContainSubstring, "Smith")
+			})
+			Convey("SearchAndCount with a zero limit should only count in one query", func() {
+				smiths := users.Search(users.Model().Field("Name").IContains("Smith"))
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				recs, total := smiths.Limit(0).SearchAndCount()
+				SetMetricsCollector(nil)
+				So(collector.started, ShouldEqual, 1)
+				So(recs.IsEmpty(), ShouldBeTrue)
+				So(total, ShouldEqual, smiths.SearchCount())
+				So(total, ShouldBeGreaterThan, 1)
+				So(smiths.Limit(0).Len(), ShouldEqual, total)
+			})
+			Convey("A zero limit should not mean no limit anymore", func() {
+				records, total := users.SearchRead(nil, []string{"Name"}, 0, 0, "Name")
+				So(total, ShouldEqual, len(allNames))
+				So(records, ShouldBeEmpty)
+				records, _ = users.SearchRead(nil, []string{"Name"}, 0, -1, "Name")
+				So(readNames(records), ShouldResemble, allNames)
+			})
+		})
+	})
+}
+
+func TestDeleteRecordSet(t *testing.T) {
+	Convey("Delete user John Smith", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
+			num := users.Call("Unlink")
+			Convey("Number of deleted record should be 1", func() {
+				So(num, ShouldEqual, 1)
+			})
+		})
+	})
+	Convey("Deleting records should drop their pending updates", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith")).Load()
+			users.Set("Nums", 13)
+			So(env.cache.scheduledUpdate, ShouldContainKey, users.getFirstCacheRef())
+			Convey("When the records are deleted directly", func() {
+				users.Call("Unlink")
+				So(env.cache.scheduledUpdate, ShouldNotContainKey, users.getFirstCacheRef())
+				So(env.Flush, ShouldNotPanic)
+			})
+			Convey("When the records are deleted by cascade", func() {
+				users.Get("Resume").(RecordSet).Collection().Call("Unlink")
+				So(env.cache.scheduledUpdate, ShouldNotContainKey, users.getFirstCacheRef())
+				So(env.Flush, ShouldNotPanic)
+			})
+		})
+	})
+	Convey("Delete leaf records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Cr().Execute("INSERT INTO log_entry (message, level) SELECT 'Message ' || g, g FROM generate_series(1, 20) g")
+			logs := env.Pool("LogEntry").SearchAll().Load()
+			ids := logs.Ids()
+			So(ids, ShouldHaveLength, 20)
+			So(env.cache.checkIfInCache(logs.model, ids, []string{"message"}), ShouldBeTrue)
+			collector := new(testMetricsCollector)
+			SetMetricsCollector(collector)
+			num := env.Pool("LogEntry").SearchAll().Call("Unlink")
+			SetMetricsCollector(nil)
+			So(num, ShouldEqual, 20)
+			So(collector.started, ShouldEqual, 1)
+			So(collector.queries[0], ShouldStartWith, "DELETE")
+			for _, id := range ids {
+				So(env.cache.checkIfInCache(logs.model, []int64{id}, []string{"message"}), ShouldBeFalse)
+			}
+			So(env.Pool("LogEntry").SearchAll().SearchCount(), ShouldEqual, 0)
+		})
+	})
+	Convey("Deletion policies", t, func() {
+		logModel := Registry.MustGet("LogEntry")
+		logModel.SetDeletionPolicy(ArchiveOnUnlink)
+		Reset(func() {
+			logModel.SetDeletionPolicy(HardDelete)
+		})
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			env.Cr().Execute("INSERT INTO log_entry (message, level, active) SELECT 'Message ' || g, g, TRUE FROM generate_series(1, 3) g")
+			Convey("Unlink should archive records by default", func() {
+				So(env.Pool("LogEntry").SearchAll().Call("Unlink"), ShouldEqual, 3)
+				logs := env.Pool("LogEntry").SearchAll()
+				So(logs.SearchCount(), ShouldEqual, 3)
+				for _, rec := range logs.Records() {
+					So(rec.Get("Active"), ShouldBeFalse)
+				}
+			})
+			Convey("Admins should be able to hard delete records", func() {
+				logs := env.Pool("LogEntry").SearchAll().WithContext("hexya_hard_delete", true)
+				So(logs.Call("Unlink"), ShouldEqual, 3)
+				So(env.Pool("LogEntry").SearchAll().SearchCount(), ShouldEqual, 0)
+			})
+			Convey("HardDelete policy should delete records", func() {
+				logModel.SetDeletionPolicy(HardDelete)
+				So(env.Pool("LogEntry").SearchAll().Call("Unlink"), ShouldEqual, 3)
+				So(env.Pool("LogEntry").SearchAll().SearchCount(), ShouldEqual, 0)
+			})
+		})
+		SimulateInNewEnvironment(2, func(env Environment) {
+			logModel.methods.MustGet("Unlink").AllowGroup(security.GroupEveryone)
+			Reset(func() {
+				logModel.methods.MustGet("Unlink").RevokeGroup(security.GroupEveryone)
+			})
+			Convey("Non admins should not be able to hard delete records", func() {
+				logs := env.Pool("LogEntry").SearchAll().WithContext("hexya_hard_delete", true)
+				So(func() { logs.Call("Unlink") }, ShouldPanic)
+			})
+		})
+	})
+	group1 := security.Registry.NewGroup("group1", "Group 1")
+	security.Registry.AddMembership(2, group1)
+	Convey("Checking unlink access permissions", t, func() {
+		SimulateInNewEnvironment(2, func(env Environment) {
+			userModel := Registry.MustGet("User")
+
+			Convey("Checking that user 2 cannot unlink records", func() {
+				userModel.methods.MustGet("Load").AllowGroup(group1)
+				users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
+				So(func() { users.Call("Unlink") }, ShouldPanic)
+			})
+			Convey("Adding unlink permission to user2", func() {
+				userModel.methods.MustGet("Unlink").AllowGroup(group1)
+				users := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("John Smith"))
+				num := users.Call("Unlink")
+				So(num, ShouldEqual, 1)
+			})
+			Convey("Checking record rules", func() {
+
+				rule := RecordRule{
+					Name:      "jOnly",
+					Group:     group1,
+					Condition: env.Pool("User").Model().Field("Name").IContains("j"),
+					Perms:     security.Unlink,
+				}
+				userModel.AddRecordRule(&rule)
+
+				notUsedRule := RecordRule{
+					Name:      "writeRule",
+					Group:     group1,
+					Condition: env.Pool("User").Model().Field("Name").Equals("Nobody"),
+					Perms:     security.Write,
+				}
+				userModel.AddRecordRule(&notUsedRule)
+
+				userJane := env.Pool("User").Search(env.Pool("User").Model().Field("Email").Equals("jane.smith@example.com"))
+				So(userJane.Len(), ShouldEqual, 1)
+				So(userJane.Call("Unlink"), ShouldEqual, 1)
+
+				userWill := env.Pool("User").Search(env.Pool("User").Model().Field("Name").Equals("Will Smith"))
+				So(userWill.Call("Unlink"), ShouldEqual, 0)
+
+				userModel.RemoveRecordRule("jOnly")
+				userModel.RemoveRecordRule("writeRule")
+			})
+		})
+	})
+	security.Registry.UnregisterGroup(group1)
+}
+
+func BenchmarkUnlinkLeafRecords(b *testing.B) {
+	SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			env.Cr().Execute("INSERT INTO log_entry (message, level) SELECT 'Message ' || g, g FROM generate_series(1, 10000) g")
+			logs := env.Pool("LogEntry").SearchAll().Load()
+			b.StartTimer()
+			logs.Call("Unlink")
+		}
+	})
+}
+
+func TestModifiedSince(t *testing.T) {
+	Convey("Testing modified records retrieval", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("Post")
+			oldPost := posts.Call("Create", FieldMap{"Title": "Old Post", "Content": "Content"}).(RecordSet).Collection()
+			writtenPost := posts.Call("Create", FieldMap{"Title": "Written Post", "Content": "Content"}).(RecordSet).Collection()
+			oldPost.Union(writtenPost).Flush()
+			time.Sleep(10 * time.Millisecond)
+			since := time.Now()
+			time.Sleep(10 * time.Millisecond)
+			writtenPost.Call("Write", FieldMap{"Title": "Written Post (modified)"})
+			newPost := posts.Call("Create", FieldMap{"Title": "New Post", "Content": "Content"}).(RecordSet).Collection()
+			Convey("Only records written or created after the given time should be returned", func() {
+				all := oldPost.Union(writtenPost).Union(newPost)
+				modified := all.ModifiedSince(since)
+				So(modified.Len(), ShouldEqual, 2)
+				So(modified.Equals(writtenPost.Union(newPost)), ShouldBeTrue)
+				So(oldPost.ModifiedSince(since).IsEmpty(), ShouldBeTrue)
+				So(all.ModifiedSince(time.Now().Add(time.Hour)).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Models without audit fields should panic", func() {
+				So(func() { env.Pool("TrackingValue").ModifiedSince(since) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestChangesSince(t *testing.T) {
+	Convey("Testing changes feed", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("Post")
+			var ids []int64
+			for i := 0; i < 6; i++ {
+				post := posts.Call("Create", FieldMap{"Title": fmt.Sprintf("Feed Post %d", i), "Content": "Content"}).(RecordSet).Collection()
+				post.Flush()
+				ids = append(ids, post.persistedIds()[0])
+			}
+			ts1 := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+			ts2 := ts1.Add(24 * time.Hour)
+			env.Cr().Execute("UPDATE post SET write_date = ? WHERE id IN (?)", ts1, ids[:3])
+			env.Cr().Execute("UPDATE post SET write_date = ? WHERE id IN (?)", ts2, ids[3:])
+			env.InvalidateModel("Post")
+			getIds := func(res []FieldMap) []int64 {
+				var resIds []int64
+				for _, fm := range res {
+					resIds = append(resIds, fm["id"].(int64))
+				}
+				return resIds
+			}
+			Convey("Resuming across pages should not skip records with identical timestamps", func() {
+				page, mark := posts.ChangesSince(ts1.Add(-24*time.Hour), 2)
+				So(getIds(page), ShouldResemble, ids[:3])
+				So(mark.Equal(ts1), ShouldBeTrue)
+				So(page[0], ShouldContainKey, "Title")
+				page, mark = posts.ChangesSince(mark, 2)
+				So(getIds(page), ShouldResemble, ids[3:])
+				So(mark.Equal(ts2), ShouldBeTrue)
+				page, mark = posts.ChangesSince(mark, 2)
+				So(page, ShouldBeEmpty)
+				So(mark.Equal(ts2), ShouldBeTrue)
+			})
+			Convey("Without limit, all changes should be returned at once", func() {
+				page, mark := posts.ChangesSince(ts1.Add(-24*time.Hour), 0)
+				So(getIds(page), ShouldResemble, ids)
+				So(mark.Equal(ts2), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestDeletionsSince(t *testing.T) {
+	Convey("Testing deletions feed", t, func() {
+		tagModel := Registry.MustGet("Tag")
+		tagModel.LogDeletions()
+		Reset(func() {
+			tagModel.logDeletions = false
+		})
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			since := time.Now().Add(-time.Second)
+			tag := env.Pool("Tag").Call("Create", FieldMap{"Name": "Deleted Tag"}).(RecordSet).Collection()
+			tag.Flush()
+			tagID := tag.persistedIds()[0]
+			Convey("Unlinking a record should produce a tombstone", func() {
+				So(tag.Call("Unlink"), ShouldEqual, 1)
+				deletions := env.Pool("Tag").DeletionsSince(since)
+				So(deletions, ShouldHaveLength, 1)
+				So(deletions[0].Model, ShouldEqual, "Tag")
+				So(deletions[0].ID, ShouldEqual, tagID)
+				So(deletions[0].UID, ShouldEqual, security.SuperUserID)
+				So(env.Pool("Post").DeletionsSince(since), ShouldBeEmpty)
+				So(env.Pool("Tag").DeletionsSince(time.Now().Add(time.Hour)), ShouldBeEmpty)
+			})
+			Convey("Tombstones should be prunable by age", func() {
+				tag.Call("Unlink")
+				So(env.PruneTombstones(time.Hour), ShouldEqual, 0)
+				So(env.Pool("Tag").DeletionsSince(since), ShouldHaveLength, 1)
+				So(env.PruneTombstones(-time.Hour), ShouldEqual, 1)
+				So(env.Pool("Tag").DeletionsSince(since), ShouldBeEmpty)
+			})
+			Convey("Models not declared with LogDeletions should not be logged", func() {
+				tagModel.logDeletions = false
+				tag.Call("Unlink")
+				So(env.Pool("Tag").DeletionsSince(since), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestOrderByRelatedFields(t *testing.T) {
+	Convey("Testing ordering by related fields with NULLS modifiers", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			profiles := env.Pool("Profile")
+			young := profiles.Call("Create", FieldMap{"Age": int16(20)}).(RecordSet).Collection()
+			old := profiles.Call("Create", FieldMap{"Age": int16(60)}).(RecordSet).Collection()
+			userYoung := users.Call("Create", FieldMap{"Name": "Order Young", "Email": "oy@example.com", "Profile": young}).(RecordSet).Collection()
+			userOld := users.Call("Create", FieldMap{"Name": "Order Old", "Email": "oo@example.com", "Profile": old}).(RecordSet).Collection()
+			userNone := users.Call("Create", FieldMap{"Name": "Order None", "Email": "on@example.com"}).(RecordSet).Collection()
+			cond := users.Model().Field("Email").In([]string{"oy@example.com", "oo@example.com", "on@example.com"})
+			Convey("Records should be ordered by a related field", func() {
+				res := users.Search(cond).OrderBy("Profile.Age").Ids()
+				So(res, ShouldHaveLength, 3)
+				So(res[0], ShouldEqual, userYoung.Ids()[0])
+				So(res[1], ShouldEqual, userOld.Ids()[0])
+			})
+			Convey("NULLS LAST should put records without value last", func() {
+				res := users.Search(cond).OrderBy("Profile.Age DESC NULLS LAST").Ids()
+				So(res, ShouldResemble, []int64{userOld.Ids()[0], userYoung.Ids()[0], userNone.Ids()[0]})
+				res = users.Search(cond).OrderBy("Profile.Age desc").Ids()
+				So(res, ShouldResemble, []int64{userNone.Ids()[0], userOld.Ids()[0], userYoung.Ids()[0]})
+				res = users.Search(cond).OrderBy("Profile.Age NULLS FIRST").Ids()
+				So(res, ShouldResemble, []int64{userNone.Ids()[0], userYoung.Ids()[0], userOld.Ids()[0]})
+			})
+			Convey("Invalid ORDER BY expressions should panic", func() {
+				So(func() { users.OrderBy("Name NULLS") }, ShouldPanic)
+				So(func() { users.OrderBy("Name DESC, Email") }, ShouldPanic)
+				So(func() { users.OrderBy("") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestCollate(t *testing.T) {
+	Convey("Testing ordering with a collation", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			var emails []string
+			for i, name := range []string{"zeta", "Émile", "beta", "Eric", "Alpha"} {
+				email := fmt.Sprintf("collate%d@example.com", i)
+				users.Call("Create", FieldMap{"Name": name, "Email": email})
+				emails = append(emails, email)
+			}
+			cond := users.Model().Field("Email").In(emails)
+			names := func(rs *RecordCollection) []string {
+				var res []string
+				for _, rec := range rs.Records() {
+					res = append(res, rec.Get("Name").(string))
+				}
+				return res
+			}
+			Convey("Missing collations should fall back to the default collation", func() {
+				adapter := adapters[db.DriverName()].(*postgresAdapter)
+				So(adapter.collationExists("xx-XX-x-icu"), ShouldBeFalse)
+				So(names(users.Search(cond).OrderBy("Name").Collate("xx_XX")),
+					ShouldResemble, names(users.Search(cond).OrderBy("Name")))
+			})
+			// ICU collations are not available on all databases
+			naturalConvey := Convey
+			if adapters[db.DriverName()].collation("fr_FR") == "" {
+				naturalConvey = SkipConvey
+			}
+			naturalConvey("Mixed-case and accented names should sort naturally", func() {
+				So(names(users.Search(cond).OrderBy("Name").Collate("fr_FR")),
+					ShouldResemble, []string{"Alpha", "beta", "Émile", "Eric", "zeta"})
+				So(names(users.Search(cond).OrderBy("Name desc").Collate("")),
+					ShouldResemble, []string{"zeta", "Eric", "Émile", "beta", "Alpha"})
+			})
+			Convey("Collations should be configurable per locale", func() {
+				Collations["xx_XX"] = "C"
+				defer delete(Collations, "xx_XX")
+				So(names(users.Search(cond).OrderBy("Name").WithContext("lang", "xx_XX").Collate("")),
+					ShouldResemble, []string{"Alpha", "Eric", "beta", "zeta", "Émile"})
+			})
+		})
+	})
+}
+
+func TestDefaultOrder(t *testing.T) {
+	Convey("Testing the default order of models", t, func() {
+		tagModel := Registry.MustGet("Tag")
+		tagModel.SetDefaultOrder("Name desc", "id")
+		Reset(func() {
+			tagModel.SetDefaultOrder("id")
+		})
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			for _, name := range []string{"Order B", "Order A", "Order C"} {
+				tags.Call("Create", FieldMap{"Name": name})
+			}
+			cond := tags.Model().Field("Name").In([]string{"Order A", "Order B", "Order C"})
+			names := func(rs *RecordCollection) []string {
+				var res []string
+				for _, rec := range rs.Records() {
+					res = append(res, rec.Get("Name").(string))
+				}
+				return res
+			}
+			Convey("Search should apply the default order", func() {
+				So(names(tags.Search(cond)), ShouldResemble, []string{"Order C", "Order B", "Order A"})
+			})
+			Convey("An explicit OrderBy should override the default order", func() {
+				So(names(tags.Search(cond).OrderBy("Name")), ShouldResemble, []string{"Order A", "Order B", "Order C"})
+				loaded := tags.Search(cond).Load()
+				So(names(loaded), ShouldResemble, []string{"Order C", "Order B", "Order A"})
+				So(names(loaded.OrderBy("Name")), ShouldResemble, []string{"Order A", "Order B", "Order C"})
+			})
+			Convey("Invalid default orders should panic", func() {
+				So(func() { tagModel.SetDefaultOrder("Name; DROP TABLE tag") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestNullPolicy(t *testing.T) {
+	Convey("Testing the reading of null values", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			profile := env.Pool("Profile").Call("Create", FieldMap{"Age": int16(30), "Money": 12.5}).(RecordSet).Collection()
+			user := env.Pool("User").Call("Create", FieldMap{"Name": "Null User", "Email": "null@example.com", "IsStaff": true}).(RecordSet).Collection()
+			post := env.Pool("Post").Call("Create", FieldMap{"Title": "Null Post", "Abstract": "Abstract", "LastRead": dates.Today()}).(RecordSet).Collection()
+			env.Flush()
+			for _, col := range []string{`profile.age`, `profile.money`, `"user".is_staff`, `post.abstract`, `post.last_read`} {
+				table, column := strings.Split(col, ".")[0], strings.Split(col, ".")[1]
+				env.Cr().Execute(fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL`, table, column))
+				env.Cr().Execute(fmt.Sprintf(`UPDATE %s SET %s = NULL`, table, column))
+			}
+			*env.cache = *newCache()
+			Convey("Null values should be read as zero values by default", func() {
+				pData := profile.Call("Read", []string{"Age", "Money"}).([]FieldMap)[0]
+				So(pData["Age"], ShouldEqual, int16(0))
+				So(pData["Money"], ShouldEqual, float64(0))
+				uData := user.Call("Read", []string{"IsStaff", "Profile"}).([]FieldMap)[0]
+				So(uData["IsStaff"], ShouldEqual, false)
+				So(uData["Profile"].(RecordSet).IsEmpty(), ShouldBeTrue)
+				postData := post.Call("Read", []string{"Title", "Abstract", "LastRead", "WriteDate"}).([]FieldMap)[0]
+				So(postData["Title"], ShouldEqual, "Null Post")
+				So(postData["Abstract"], ShouldEqual, "")
+				So(postData["LastRead"].(dates.Date).IsZero(), ShouldBeTrue)
+				So(postData["WriteDate"].(dates.DateTime).IsZero(), ShouldBeTrue)
+			})
+			Convey("IsNull should tell null values from zero values", func() {
+				So(profile.IsNull("Age"), ShouldBeTrue)
+				So(user.IsNull("IsStaff"), ShouldBeTrue)
+				So(user.IsNull("Profile"), ShouldBeTrue)
+				So(user.IsNull("Name"), ShouldBeFalse)
+				So(post.IsNull("LastRead"), ShouldBeTrue)
+				So(post.IsNull("Title"), ShouldBeFalse)
+				So(env.Pool("Post").IsNull("Title"), ShouldBeTrue)
+			})
+			Convey("NullAsNil policy should preserve nil values", func() {
+				pData := profile.WithNullPolicy(NullAsNil).Call("Read", []string{"Age", "Money"}).([]FieldMap)[0]
+				So(pData["Age"], ShouldBeNil)
+				So(pData["Money"], ShouldBeNil)
+				uData := user.WithNullPolicy(NullAsNil).Call("Read", []string{"IsStaff", "Name", "Profile"}).([]FieldMap)[0]
+				So(uData["IsStaff"], ShouldBeNil)
+				So(uData["Name"], ShouldEqual, "Null User")
+				So(uData["Profile"].(RecordSet).IsEmpty(), ShouldBeTrue)
+				postData := post.WithNullPolicy(NullAsNil).Call("Read", []string{"Abstract", "LastRead", "WriteDate"}).([]FieldMap)[0]
+				So(postData["Abstract"], ShouldBeNil)
+				So(postData["LastRead"], ShouldBeNil)
+				So(postData["WriteDate"], ShouldBeNil)
+			})
+			Convey("NullAsNil policy should follow field paths", func() {
+				user.Set("Profile", profile)
+				uData := user.WithNullPolicy(NullAsNil).Call("Read", []string{"Name", "Profile.Age", "Profile.Money"}).([]FieldMap)[0]
+				So(uData["Name"], ShouldEqual, "Null User")
+				So(uData["Profile.Age"], ShouldBeNil)
+				So(uData["Profile.Money"], ShouldBeNil)
+				uData = user.Call("Read", []string{"Profile.Age"}).([]FieldMap)[0]
+				So(uData["Profile.Age"], ShouldEqual, int16(0))
+			})
+			Convey("The default policy should be configurable", func() {
+				DefaultNullPolicy = NullAsNil
+				defer func() { DefaultNullPolicy = NullAsZero }()
+				So(profile.Call("Read", []string{"Age"}).([]FieldMap)[0]["Age"], ShouldBeNil)
+				So(profile.WithNullPolicy(NullAsZero).Call("Read", []string{"Age"}).([]FieldMap)[0]["Age"], ShouldEqual, int16(0))
+			})
+		})
+	})
+}
+
+func TestAllHydration(t *testing.T) {
+	Convey("Testing hydration of relation fields into nested structs", t, func() {
+		type ProfileStruct struct {
+			ID    int64
+			Age   int16
+			Money float64
+		}
+		type UserStruct struct {
+			ID      int64
+			Name    string
+			Profile *ProfileStruct
+		}
+		type TagStruct struct {
+			ID     int64
+			Name   string
+			Parent *TagStruct
+		}
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			profiles := env.Pool("Profile")
+			var emails []string
+			for i := 0; i < 3; i++ {
+				profile := profiles.Call("Create", FieldMap{"Age": int16(20 + i), "Money": float64(i)}).(RecordSet).Collection()
+				email := fmt.Sprintf("hydrated%d@example.com", i)
+				users.Call("Create", FieldMap{"Name": fmt.Sprintf("Hydrated %d", i), "Email": email, "Profile": profile})
+				emails = append(emails, email)
+			}
+			users.Call("Create", FieldMap{"Name": "Hydrated None", "Email": "hydrated-none@example.com"})
+			emails = append(emails, "hydrated-none@example.com")
+			env.Flush()
+			cond := users.Model().Field("Email").In(emails)
+			Convey("Many2One fields should be hydrated into nested structs", func() {
+				*env.cache = *newCache()
+				loadCollector := new(testMetricsCollector)
+				SetMetricsCollector(loadCollector)
+				users.Search(cond).OrderBy("Name").Records()
+				*env.cache = *newCache()
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				var userStructs []*UserStruct
+				users.Search(cond).OrderBy("Name").All(&userStructs)
+				SetMetricsCollector(nil)
+				So(collector.started, ShouldEqual, loadCollector.started+1)
+				So(userStructs, ShouldHaveLength, 4)
+				for i := 0; i < 3; i++ {
+					So(userStructs[i].Name, ShouldEqual, fmt.Sprintf("Hydrated %d", i))
+					So(userStructs[i].Profile, ShouldNotBeNil)
+					So(userStructs[i].Profile.ID, ShouldBeGreaterThan, 0)
+					So(userStructs[i].Profile.Age, ShouldEqual, 20+i)
+					So(userStructs[i].Profile.Money, ShouldEqual, float64(i))
+				}
+				So(userStructs[3].Name, ShouldEqual, "Hydrated None")
+				So(userStructs[3].Profile, ShouldBeNil)
+			})
+			Convey("Nested structs should also be hydrated by First", func() {
+				var userStruct UserStruct
+				users.Search(users.Model().Field("Email").Equals("hydrated1@example.com")).First(&userStruct)
+				So(userStruct.Profile, ShouldNotBeNil)
+				So(userStruct.Profile.Age, ShouldEqual, 21)
+			})
+			Convey("Only relation fields of nested structs should be hydrated", func() {
+				type PostStruct struct {
+					ID       int64
+					Title    string
+					LastRead dates.Date
+					Notes    struct{ Text string }
+				}
+				type BestPostProfileStruct struct {
+					ID       int64
+					Age      int16
+					BestPost *PostStruct
+					Extra    *ProfileStruct
+				}
+				type BestPostUserStruct struct {
+					ID      int64
+					Profile *BestPostProfileStruct
+				}
+				post := env.Pool("Post").Call("Create", FieldMap{"Title": "Hydrated Post", "LastRead": dates.Today()}).(RecordSet).Collection()
+				user := users.Search(users.Model().Field("Email").Equals("hydrated2@example.com"))
+				user.Get("Profile").(RecordSet).Collection().Set("BestPost", post)
+				var userStructs []*BestPostUserStruct
+				So(func() { user.All(&userStructs) }, ShouldNotPanic)
+				So(userStructs, ShouldHaveLength, 1)
+				So(userStructs[0].Profile.Age, ShouldEqual, 22)
+				So(userStructs[0].Profile.Extra, ShouldBeNil)
+				So(userStructs[0].Profile.BestPost, ShouldNotBeNil)
+				So(userStructs[0].Profile.BestPost.Title, ShouldEqual, "Hydrated Post")
+				So(userStructs[0].Profile.BestPost.LastRead.Equal(dates.Today()), ShouldBeTrue)
+				So(userStructs[0].Profile.BestPost.Notes.Text, ShouldBeEmpty)
+			})
+			Convey("Circular relations should be bounded", func() {
+				tags := env.Pool("Tag")
+				tagA := tags.Call("Create", FieldMap{"Name": "Circular A"}).(RecordSet).Collection()
+				tagB := tags.Call("Create", FieldMap{"Name": "Circular B", "Parent": tagA}).(RecordSet).Collection()
+				tagA.Set("Parent", tagB)
+				var tagStructs []*TagStruct
+				tagA.All(&tagStructs)
+				So(tagStructs, ShouldHaveLength, 1)
+				So(tagStructs[0].Name, ShouldEqual, "Circular A")
+				So(tagStructs[0].Parent, ShouldNotBeNil)
+				So(tagStructs[0].Parent.Name, ShouldEqual, "Circular B")
+				So(tagStructs[0].Parent.Parent, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestOrderTieBreaker(t *testing.T) {
+	Convey("Testing stable pagination with equal sort keys", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			var created []int64
+			for i := 0; i < 6; i++ {
+				tag := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Tied %d", i), "Description": "Tied"}).(RecordSet).Collection()
+				env.Flush()
+				created = append(created, tag.persistedIds()...)
+			}
+			cond := tags.Model().Field("Description").Equals("Tied")
+			Convey("Pages should neither overlap nor skip records", func() {
+				var paged []int64
+				for offset := 0; offset < 6; offset += 2 {
+					paged = append(paged, tags.Search(cond).OrderBy("Description").Limit(2).Offset(offset).Ids()...)
+				}
+				So(paged, ShouldResemble, created)
+			})
+			Convey("Records should come in the same order at each search", func() {
+				first := tags.Search(cond).OrderBy("Description desc").Ids()
+				So(first, ShouldResemble, created)
+				So(tags.Search(cond).OrderBy("Description desc").Ids(), ShouldResemble, first)
+			})
+			Convey("An explicit order by id should be kept", func() {
+				ids := tags.Search(cond).OrderBy("ID desc", "Description").Ids()
+				So(ids, ShouldHaveLength, 6)
+				So(ids[0], ShouldEqual, created[5])
+				So(ids[5], ShouldEqual, created[0])
+			})
+		})
+	})
+}
+
+func TestBatchIterate(t *testing.T) {
+	Convey("Testing iteration on records by batches", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			var created []int64
+			for i := 0; i < 7; i++ {
+				tag := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Batched %d", i), "Description": "Batched"}).(RecordSet).Collection()
+				env.Flush()
+				created = append(created, tag.persistedIds()...)
+			}
+			*env.cache = *newCache()
+			batched := tags.Search(tags.Model().Field("Description").Equals("Batched"))
+			Convey("Records should be split in batches of the given size", func() {
+				var sizes []int
+				var ids []int64
+				err := batched.OrderBy("Name desc").Limit(2).BatchIterate(3, func(rs RecordSet) error {
+					sizes = append(sizes, rs.Len())
+					ids = append(ids, rs.Ids()...)
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(sizes, ShouldResemble, []int{3, 3, 1})
+				So(ids, ShouldResemble, created)
+			})
+			Convey("The cache should be cleared between batches", func() {
+				var previous []int64
+				err := batched.BatchIterate(3, func(rs RecordSet) error {
+					if previous != nil {
+						So(env.cache.checkIfInCache(tags.model, previous, []string{"name"}), ShouldBeFalse)
+					}
+					for _, rec := range rs.Collection().Records() {
+						So(rec.Get("Name"), ShouldStartWith, "Batched")
+					}
+					So(env.cache.checkIfInCache(tags.model, rs.Ids(), []string{"name"}), ShouldBeTrue)
+					previous = rs.Ids()
+					return nil
+				})
+				So(err, ShouldBeNil)
+			})
+			Convey("Changes made in a batch should be flushed", func() {
+				err := batched.BatchIterate(4, func(rs RecordSet) error {
+					rs.Collection().Set("Rate", float32(5))
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(tags.Search(tags.Model().Field("Rate").Equals(5.0).And().Field("Description").Equals("Batched")).Len(), ShouldEqual, 7)
+			})
+			Convey("Errors should stop the iteration and report progress", func() {
+				errStop := errors.New("stop")
+				var calls int
+				err := batched.BatchIterate(3, func(rs RecordSet) error {
+					calls++
+					if calls == 2 {
+						return errStop
+					}
+					return nil
+				})
+				So(calls, ShouldEqual, 2)
+				So(errors.Is(err, errStop), ShouldBeTrue)
+				var batchErr *BatchError
+				So(errors.As(err, &batchErr), ShouldBeTrue)
+				So(batchErr.Processed, ShouldEqual, 3)
+				So(batchErr.LastID, ShouldEqual, created[2])
+			})
+			Convey("Empty RecordSets should not call fn", func() {
+				var calls int
+				err := tags.BatchIterate(3, func(rs RecordSet) error {
+					calls++
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(calls, ShouldEqual, 0)
+				So(func() { batched.BatchIterate(0, func(RecordSet) error { return nil }) }, ShouldPanic)
+			})
+			Convey("Committing batches should be refused with uncommitted changes", func() {
+				So(func() { batched.BatchIterateCommit(3, func(RecordSet) error { return nil }) }, ShouldPanic)
+			})
+		})
+	})
+	Convey("Testing iteration on records by committed batches", t, func() {
+		var created []int64
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			for i := 0; i < 5; i++ {
+				tag := env.Pool("Tag").Call("Create", FieldMap{"Name": fmt.Sprintf("Committed %d", i), "Description": "Committed batch"}).(RecordSet).Collection()
+				env.Flush()
+				created = append(created, tag.persistedIds()...)
+			}
+		}), ShouldBeNil)
+		Reset(func() {
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Tag").Browse(created...).Call("Unlink")
+			})
+		})
+		countRate := func(rate float32) int {
+			var count int
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				count = tags.Search(tags.Model().Field("Rate").Equals(rate).And().Field("ID").In(created)).SearchCount()
+			})
+			return count
+		}
+		Convey("Each batch should be committed", func() {
+			var sizes []int
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				err := tags.Search(tags.Model().Field("ID").In(created)).BatchIterateCommit(2, func(rs RecordSet) error {
+					sizes = append(sizes, rs.Len())
+					rs.Collection().Set("Rate", float32(3))
+					return nil
+				})
+				So(err, ShouldBeNil)
+			})
+			So(err, ShouldBeNil)
+			So(sizes, ShouldResemble, []int{2, 2, 1})
+			So(countRate(3), ShouldEqual, 5)
+		})
+		Convey("Errors should roll back their batch only", func() {
+			errStop := errors.New("stop")
+			var batchErr *BatchError
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				var calls int
+				err := tags.Search(tags.Model().Field("ID").In(created)).BatchIterateCommit(2, func(rs RecordSet) error {
+					calls++
+					rs.Collection().Set("Rate", float32(4))
+					if calls == 2 {
+						return errStop
+					}
+					return nil
+				})
+				So(errors.As(err, &batchErr), ShouldBeTrue)
+			})
+			So(errors.Is(batchErr, errStop), ShouldBeTrue)
+			So(batchErr.Processed, ShouldEqual, 2)
+			So(countRate(4), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestSelfReferentialMany2Many(t *testing.T) {
+	Convey("Testing self-referential many2many relations", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			categories := env.Pool("Category")
+			var created []*RecordCollection
+			for i := 0; i < 3; i++ {
+				category := categories.Call("Create", FieldMap{"Name": fmt.Sprintf("Self %d", i)}).(RecordSet).Collection()
+				env.Flush()
+				created = append(created, categories.Browse(category.persistedIds()...))
+			}
+			catA, catB, catC := created[0], created[1], created[2]
+			catA.Set("RelatedCategories", catB.Union(catC))
+			catB.Set("RelatedCategories", catA)
+			check := func() {
+				So(catA.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldHaveLength, 2)
+				So(catA.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldContain, catB.ids[0])
+				So(catA.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldContain, catC.ids[0])
+				So(catA.Get("RelatedByCategories").(RecordSet).Collection().Ids(), ShouldResemble, catB.Ids())
+				So(catB.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldResemble, catA.Ids())
+				So(catB.Get("RelatedByCategories").(RecordSet).Collection().Ids(), ShouldResemble, catA.Ids())
+				So(catC.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldBeEmpty)
+				So(catC.Get("RelatedByCategories").(RecordSet).Collection().Ids(), ShouldResemble, catA.Ids())
+			}
+			Convey("Links in both directions should be read from the cache", func() {
+				check()
+			})
+			Convey("Links in both directions should be read from the database", func() {
+				*env.cache = *newCache()
+				check()
+				var count int
+				env.cr.Get(&count, `SELECT COUNT(*) FROM category_related_category_rel WHERE category_id IN (?)`, []int64{catA.ids[0], catB.ids[0]})
+				So(count, ShouldEqual, 3)
+			})
+			Convey("Writing the reverse relation should update both sides", func() {
+				check()
+				catC.Set("RelatedByCategories", catB)
+				So(catB.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldHaveLength, 2)
+				So(catB.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldContain, catC.ids[0])
+				So(catA.Get("RelatedCategories").(RecordSet).Collection().Ids(), ShouldNotContain, catC.ids[0])
+				So(catC.Get("RelatedByCategories").(RecordSet).Collection().Ids(), ShouldResemble, catB.Ids())
+			})
+		})
+	})
+}
+
+func TestRelatedRecords(t *testing.T) {
+	Convey("Testing traversal of relation fields with RelatedRecords", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			posts := env.Pool("Post")
+			tags := env.Pool("Tag")
+			tag1 := tags.Call("Create", FieldMap{"Name": "Related 1"}).(RecordSet).Collection()
+			tag2 := tags.Call("Create", FieldMap{"Name": "Related 2"}).(RecordSet).Collection()
+			tag3 := tags.Call("Create", FieldMap{"Name": "Related 3"}).(RecordSet).Collection()
+			user1 := users.Call("Create", FieldMap{"Name": "Related User 1", "Email": "related1@example.com"}).(RecordSet).Collection()
+			user2 := users.Call("Create", FieldMap{"Name": "Related User 2", "Email": "related2@example.com"}).(RecordSet).Collection()
+			post1 := posts.Call("Create", FieldMap{"Title": "Related Post 1", "User": user1, "Tags": tag1.Union(tag2)}).(RecordSet).Collection()
+			post2 := posts.Call("Create", FieldMap{"Title": "Related Post 2", "User": user1, "Tags": tag2.Union(tag3)}).(RecordSet).Collection()
+			post3 := posts.Call("Create", FieldMap{"Title": "Related Post 3", "User": user2}).(RecordSet).Collection()
+			env.Flush()
+			postIds := post1.Union(post2).Union(post3).persistedIds()
+			allPosts := posts.Search(posts.Model().Field("ID").In(postIds))
+			Convey("Many2Many fields should return the union of the related records", func() {
+				related := allPosts.RelatedRecords("Tags")
+				So(related.ModelName(), ShouldEqual, "Tag")
+				So(related.Len(), ShouldEqual, 3)
+				So(post1.RelatedRecords("tag_ids").Len(), ShouldEqual, 2)
+				So(post3.RelatedRecords("Tags").IsEmpty(), ShouldBeTrue)
+				filtered := related.Search(tags.Model().Field("Name").Equals("Related 3"))
+				So(filtered.Len(), ShouldEqual, 1)
+				So(filtered.Get("Name"), ShouldEqual, "Related 3")
+			})
+			Convey("One2Many fields should return the union of the related records", func() {
+				*env.cache = *newCache()
+				bothUsers := users.Search(users.Model().Field("Email").In([]string{"related1@example.com", "related2@example.com"}))
+				related := bothUsers.RelatedRecords("Posts")
+				So(related.ModelName(), ShouldEqual, "Post")
+				So(related.Len(), ShouldEqual, 3)
+				for _, id := range postIds {
+					So(related.Ids(), ShouldContain, id)
+				}
+				So(related.RelatedRecords("Tags").Len(), ShouldEqual, 3)
+			})
+			Convey("Many2One fields should return the related records without duplicates", func() {
+				related := allPosts.RelatedRecords("User")
+				So(related.ModelName(), ShouldEqual, "User")
+				So(related.Len(), ShouldEqual, 2)
+			})
+			Convey("Non relation fields should panic", func() {
+				So(func() { allPosts.RelatedRecords("Title") }, ShouldPanic)
+				So(users.RelatedRecords("Posts").IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestComputeDisplayNames(t *testing.T) {
+	Convey("Testing cached display names", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User").SearchAll()
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+			displayNameField := users.model.fields.MustGet("DisplayName")
+			So(displayNameField.depends, ShouldResemble, []string{"Name"})
+			*env.cache = *newCache()
+			users.ComputeDisplayNames()
+			Convey("Display names should be computed for all records and cached", func() {
+				for _, id := range users.Ids() {
+					So(env.cache.checkIfInCache(users.model, []int64{id}, []string{"display_name"}), ShouldBeTrue)
+				}
+				So(env.cache.get(users.model, userJane.ids[0], "display_name"), ShouldEqual, "Jane A. Smith")
+				So(userJane.Get("DisplayName"), ShouldEqual, "Jane A. Smith")
+				So(env.cache.scheduledUpdate, ShouldNotContainKey, userJane.getFirstCacheRef())
+			})
+			Convey("DisplayName should not depend on Name with a custom NameGet", func() {
+				So(Registry.MustGet("Contact").fields.MustGet("DisplayName").depends, ShouldResemble, []string{""})
+				contact := env.Pool("Contact").Call("Create", FieldMap{"Name": "John", "City": "Lyon"}).(RecordSet).Collection()
+				So(contact.Get("DisplayName"), ShouldEqual, "John (Lyon)")
+			})
+			Convey("Cached display names should be updated when the name is written", func() {
+				userJane.Set("Name", "Jane B. Smith")
+				So(env.cache.checkIfInCache(users.model, userJane.ids, []string{"display_name"}), ShouldBeFalse)
+				So(userJane.Get("DisplayName"), ShouldEqual, "Jane B. Smith")
+				So(users.DisplayNames()[userJane.ids[0]], ShouldEqual, "Jane B. Smith")
+				env.Flush()
+			})
+		})
+	})
+}
+
+func TestIdsPage(t *testing.T) {
+	Convey("Testing paging through ids", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			for i := 0; i < 7; i++ {
+				tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Paged %d", i), "Description": "Paged"})
+			}
+			env.Flush()
+			paged := tags.Search(tags.Model().Field("Description").Equals("Paged")).OrderBy("Name desc")
+			allIds := tags.Search(tags.Model().Field("Description").Equals("Paged")).OrderBy("Name desc").Ids()
+			So(allIds, ShouldHaveLength, 7)
+			Convey("Consecutive pages should cover all ids exactly once in order", func() {
+				var ids []int64
+				for offset := 0; ; offset += 3 {
+					page := paged.IdsPage(offset, 3)
+					if len(page) == 0 {
+						break
+					}
+					So(len(page), ShouldBeLessThanOrEqualTo, 3)
+					ids = append(ids, page...)
+				}
+				So(ids, ShouldResemble, allIds)
+				So(paged.fetched, ShouldBeFalse)
+			})
+			Convey("Each page should be queried without loading the whole RecordSet", func() {
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				So(paged.IdsPage(5, 3), ShouldResemble, allIds[5:])
+				So(collector.started, ShouldEqual, 1)
+			})
+			Convey("Pages should stay within the limit of the RecordSet", func() {
+				limited := paged.Limit(5)
+				So(limited.IdsPage(0, 3), ShouldResemble, allIds[:3])
+				So(limited.IdsPage(3, 3), ShouldResemble, allIds[3:5])
+				So(limited.IdsPage(5, 3), ShouldBeEmpty)
+				So(paged.Offset(2).IdsPage(1, 2), ShouldResemble, allIds[3:5])
+			})
+			Convey("Pages of a fetched RecordSet should be taken from its ids", func() {
+				fetched := paged.Fetch()
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				defer SetMetricsCollector(nil)
+				So(fetched.IdsPage(4, 0), ShouldResemble, allIds[4:])
+				So(fetched.IdsPage(7, 3), ShouldBeEmpty)
+				So(collector.started, ShouldEqual, 0)
+				So(tags.IdsPage(0, 3), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestCreateMany(t *testing.T) {
+	Convey("Testing creating several records at once", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			posts := env.Pool("Post")
+			Convey("Returned ids should align with the input data", func() {
+				titles := []string{"Many 3", "Many 1", "Many 2", "Many 1"}
+				data := make([]FieldMapper, len(titles))
+				for i, title := range titles {
+					data[i] = FieldMap{"Title": title, "Content": fmt.Sprintf("Content %d", i)}
+				}
+				ids, err := posts.CreateMany(data)
+				So(err, ShouldBeNil)
+				So(ids, ShouldHaveLength, len(titles))
+				*env.cache = *newCache()
+				for i, id := range ids {
+					So(id, ShouldBeGreaterThan, 0)
+					post := posts.Browse(id)
+					So(post.Get("Title"), ShouldEqual, titles[i])
+					So(post.Get("Content"), ShouldEqual, fmt.Sprintf("Content %d", i))
+				}
+				So(posts.Search(posts.Model().Field("Title").Like("Many %")).SearchCount(), ShouldEqual, 4)
+			})
+			Convey("A failing record should cancel the creation of all records", func() {
+				ids, err := posts.CreateMany([]FieldMapper{
+					FieldMap{"Title": "Many OK"},
+					FieldMap{"Content": "Post without title"},
+				})
+				So(ids, ShouldBeNil)
+				So(errors.Is(err, ErrRequiredFieldMissing), ShouldBeTrue)
+				So(posts.Search(posts.Model().Field("Title").Equals("Many OK")).SearchCount(), ShouldEqual, 0)
+			})
+			Convey("Empty data should create no record", func() {
+				ids, err := posts.CreateMany(nil)
+				So(err, ShouldBeNil)
+				So(ids, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestWriteR(t *testing.T) {
+	Convey("Testing writes returning the updated records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			var expected []int64
+			for i := 0; i < 6; i++ {
+				tag := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("WriteR %d", i), "Description": "WriteR", "Rate": float32(i)}).(RecordSet).Collection()
+				env.Flush()
+				if i >= 3 {
+					expected = append(expected, tag.persistedIds()...)
+				}
+			}
+			*env.cache = *newCache()
+			Convey("The returned RecordSet should match the filtered rows that were updated", func() {
+				filtered := tags.Search(tags.Model().Field("Description").Equals("WriteR").And().Field("Rate").GreaterOrEqual(3))
+				updated := filtered.WriteR(FieldMap{"Description": "WriteR updated"})
+				So(updated.Ids(), ShouldHaveLength, 3)
+				So(updated.Ids(), ShouldContain, expected[0])
+				So(updated.Ids(), ShouldContain, expected[1])
+				So(updated.Ids(), ShouldContain, expected[2])
+				env.Flush()
+				*env.cache = *newCache()
+				changed := tags.Search(tags.Model().Field("Description").Equals("WriteR updated")).OrderBy("ID")
+				So(changed.Ids(), ShouldResemble, expected)
+				So(tags.Search(tags.Model().Field("Description").Equals("WriteR")).SearchCount(), ShouldEqual, 3)
+			})
+			Convey("Writing on a filter matching no record should return an empty RecordSet", func() {
+				updated := tags.Search(tags.Model().Field("Description").Equals("No such tag")).WriteR(FieldMap{"Rate": float32(1)})
+				So(updated.IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Writing on a fetched RecordSet should return its records", func() {
+				fetched := tags.Search(tags.Model().Field("Name").Equals("WriteR 1")).Fetch()
+				updated := fetched.WriteR(FieldMap{"Rate": float32(7)})
+				So(updated.Ids(), ShouldResemble, fetched.Ids())
+				So(updated.Get("Rate"), ShouldEqual, 7)
+			})
+		})
+	})
+}
+
+func TestFieldSets(t *testing.T) {
+	Convey("Testing field sets", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			Convey("Field sets should be extended without duplicates", func() {
+				So(users.model.FieldSet("list"), ShouldResemble, []FieldName{"Name", "Email", "Profile.City", "Profile"})
+				So(func() { users.model.FieldSet("form") }, ShouldPanic)
+			})
+			Convey("Reading a field set should return exactly the fields of the set", func() {
+				jane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				res := jane.ReadFieldSet("list")
+				So(res, ShouldHaveLength, 1)
+				So(res[0], ShouldHaveLength, 5)
+				So(res[0]["id"], ShouldEqual, jane.Ids()[0])
+				So(res[0]["Name"], ShouldEqual, jane.Get("Name"))
+				So(res[0]["Email"], ShouldEqual, "jane.smith@example.com")
+				So(res[0]["Profile.City"], ShouldEqual, "New York")
+				So(res[0]["Profile"].(RecordSet).Ids(), ShouldResemble, jane.Get("Profile").(RecordSet).Ids())
+				So(res[0], ShouldNotContainKey, "IsStaff")
+			})
+			Convey("Reading a field set should return a FieldMap per record", func() {
+				all := users.SearchAll().OrderBy("ID")
+				res := all.ReadFieldSet("list")
+				So(res, ShouldHaveLength, all.Len())
+				for i, rec := range all.Records() {
+					So(res[i]["id"], ShouldEqual, rec.Ids()[0])
+					So(res[i]["Profile.City"], ShouldEqual, rec.Get("Profile").(RecordSet).Collection().Get("City"))
+				}
+			})
+			Convey("Reading an unknown field set should panic", func() {
+				So(func() { users.SearchAll().ReadFieldSet("form") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestDiff(t *testing.T) {
+	Convey("Testing record diffs", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			parent := tags.Call("Create", FieldMap{"Name": "Diff Parent"}).(RecordSet).Collection()
+			tag1 := tags.Call("Create", FieldMap{"Name": "Diff 1", "Description": "Diff", "Rate": float32(3), "Parent": parent}).(RecordSet).Collection()
+			tag2 := tags.Call("Create", FieldMap{"Name": "Diff 2", "Description": "Diff", "Rate": float32(3), "Parent": parent}).(RecordSet).Collection()
+			Convey("Identical records should produce an empty diff", func() {
+				So(tag1.Diff(tag1), ShouldBeEmpty)
+				So(tag1.Diff(tag2, "Description", "Rate", "Parent"), ShouldBeEmpty)
+			})
+			Convey("Differing fields should be reported with both values", func() {
+				tag2.Call("Write", FieldMap{"Rate": float32(4), "Parent": tags.Browse()})
+				diff := tag1.Diff(tag2)
+				So(diff, ShouldContainKey, "Name")
+				So(diff["Name"], ShouldResemble, [2]interface{}{"Diff 1", "Diff 2"})
+				So(diff["Rate"], ShouldResemble, [2]interface{}{float32(3), float32(4)})
+				So(diff["Parent"], ShouldResemble, [2]interface{}{parent.Ids()[0], int64(0)})
+				So(diff, ShouldNotContainKey, "Description")
+				So(diff, ShouldNotContainKey, "ID")
+				So(diff, ShouldNotContainKey, "CreateDate")
+				So(tag1.Diff(tag2, "Description", "Rate"), ShouldHaveLength, 1)
+			})
+			Convey("Relation fields should be compared by ids", func() {
+				related := env.Pool("Post").Call("Create", FieldMap{"Title": "Diff Related"}).(RecordSet).Collection()
+				tag1.Set("Posts", related)
+				diff := tag1.Diff(tag2, "Posts")
+				So(diff["Posts"], ShouldResemble, [2]interface{}{related.Ids(), []int64{}})
+				tag2.Set("Posts", related)
+				So(tag1.Diff(tag2, "Posts"), ShouldBeEmpty)
+			})
+			Convey("Diff should require two single records of the same model", func() {
+				So(func() { tag1.Diff(tag1.Union(tag2)) }, ShouldPanic)
+				So(func() { tag1.Union(tag2).Diff(tag1) }, ShouldPanic)
+				So(func() { tag1.Diff(env.Pool("User").SearchAll().Limit(1)) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestPartialUniqueConstraints(t *testing.T) {
+	Convey("Testing partial unique constraints", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			logs := env.Pool("LogEntry")
+			archived := logs.Call("Create", FieldMap{"Message": "Unique message", "Active": true}).(RecordSet).Collection()
+			env.Flush()
+			Convey("An archived duplicate should not block creating an active record", func() {
+				archived.Set("Active", false)
+				env.Flush()
+				So(func() {
+					logs.Call("Create", FieldMap{"Message": "Unique message", "Active": true})
+					env.Flush()
+				}, ShouldNotPanic)
+				So(logs.Search(logs.Model().Field("Message").Equals("Unique message")).SearchCount(), ShouldEqual, 2)
+			})
+		})
+		Convey("Two active duplicates should be rejected", func() {
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				logs := env.Pool("LogEntry")
+				logs.Call("Create", FieldMap{"Message": "Unique message", "Active": true})
+				logs.Call("Create", FieldMap{"Message": "Unique message", "Active": true})
+				env.Flush()
+			})
+			So(errors.Is(err, ErrDatabase), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "Messages of active log entries must be unique")
+		})
+	})
+}
+
+func TestResequence(t *testing.T) {
+	Convey("Testing resequencing records", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			var ids []int64
+			for i, seq := range []int{10, 10, 35, 2} {
+				tag := tags.Call("Create", FieldMap{"Name": fmt.Sprintf("Ordered %d", i), "Sequence": seq}).(RecordSet).Collection()
+				ids = append(ids, tag.Ids()[0])
+			}
+			Convey("Resequencing should produce strictly increasing values in the requested order", func() {
+				order := []int64{ids[2], ids[0], ids[3], ids[1]}
+				So(tags.Resequence(order, "Sequence"), ShouldEqual, 4)
+				prev := 0
+				for _, id := range order {
+					seq := tags.Browse(id).Get("Sequence").(int64)
+					So(seq, ShouldBeGreaterThan, prev)
+					prev = int(seq)
+				}
+				So(prev, ShouldEqual, 4)
+				sorted := tags.Search(tags.Model().Field("Name").Like("Ordered %")).OrderBy("Sequence")
+				So(sorted.Ids(), ShouldResemble, order)
+			})
+			Convey("Unknown and duplicate ids should be ignored", func() {
+				So(tags.Resequence([]int64{ids[1], ids[1], 0, ids[0]}, "Sequence"), ShouldEqual, 2)
+				So(tags.Browse(ids[1]).Get("Sequence"), ShouldEqual, 1)
+				So(tags.Browse(ids[0]).Get("Sequence"), ShouldEqual, 2)
+				So(tags.Resequence(nil, "Sequence"), ShouldEqual, 0)
+			})
+			Convey("Records filtered out by record rules should not take a position", func() {
+				tags.Model().AddRecordRule(&RecordRule{
+					Name:      "notOrdered2",
+					Global:    true,
+					Condition: tags.Model().Field("Name").NotEquals("Ordered 2"),
+					Perms:     security.Write,
+				})
+				defer tags.Model().RemoveRecordRule("notOrdered2")
+				So(tags.Resequence([]int64{ids[2], ids[0], ids[3], ids[1]}, "Sequence"), ShouldEqual, 3)
+				So(tags.Browse(ids[2]).Get("Sequence"), ShouldEqual, 35)
+				So(tags.Browse(ids[0]).Get("Sequence"), ShouldEqual, 1)
+				So(tags.Browse(ids[3]).Get("Sequence"), ShouldEqual, 2)
+				So(tags.Browse(ids[1]).Get("Sequence"), ShouldEqual, 3)
+			})
+			Convey("Resequencing a non integer field should panic", func() {
+				So(func() { tags.Resequence(ids, "Name") }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestMany2OnePrefetch(t *testing.T) {
+	Convey("Testing batch loading of many2one targets", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			posts := env.Pool("Post")
+			for i := 0; i < 5; i++ {
+				user := users.Call("Create", FieldMap{"Name": fmt.Sprintf("Prefetch User %d", i), "Email": fmt.Sprintf("prefetch%d@example.com", i)}).(RecordSet).Collection()
+				for j := 0; j < 4; j++ {
+					posts.Call("Create", FieldMap{"Title": fmt.Sprintf("Prefetch Post %d-%d", i, j), "User": user})
+				}
+			}
+			env.Flush()
+			cond := posts.Model().Field("Title").Like("Prefetch Post %")
+			collector := new(testMetricsCollector)
+			SetMetricsCollector(collector)
+			defer SetMetricsCollector(nil)
+			Convey("Traversing a many2one on each record should load all targets at once", func() {
+				*env.cache = *newCache()
+				records := posts.Search(cond).Records()
+				So(records, ShouldHaveLength, 20)
+				queries := collector.started
+				userIds := make(map[int64]bool)
+				for _, post := range records {
+					user := post.Get("User").(RecordSet).Collection()
+					So(user.Get("Name"), ShouldStartWith, "Prefetch User")
+					userIds[user.Ids()[0]] = true
+				}
+				So(userIds, ShouldHaveLength, 5)
+				So(collector.started, ShouldEqual, queries+1)
+			})
+			Convey("Records taken separately should still be loaded one by one", func() {
+				*env.cache = *newCache()
+				ids := posts.Search(cond).Ids()
+				queries := collector.started
+				for _, id := range ids {
+					posts.Browse(id).Get("User").(RecordSet).Collection().Get("Name")
+				}
+				So(collector.started, ShouldBeGreaterThan, queries+5)
+			})
+			Convey("Values changed in cache should not be overwritten by prefetching", func() {
+				*env.cache = *newCache()
+				records := posts.Search(cond).OrderBy("Title").Records()
+				first := records[0].Get("User").(RecordSet).Collection()
+				first.Load()
+				env.cache.updateEntry(first.model, first.Ids()[0], "name", "Changed in cache")
+				for _, post := range records[4:] {
+					post.Get("User").(RecordSet).Collection().Get("Name")
+				}
+				So(first.Get("Name"), ShouldEqual, "Changed in cache")
+			})
+		})
+	})
+}
+
+func BenchmarkMany2OneTraversal(b *testing.B) {
+	SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+		posts := env.Pool("Post")
+		cond := createBenchPosts(env, "Traversal", 100, 10, false)
+		b.Run("PerRecord", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				*env.cache = *newCache()
+				for _, id := range posts.Search(cond).Ids() {
+					posts.Browse(id).Get("User").(RecordSet).Collection().Get("Name")
+				}
+			}
+		})
+		b.Run("Batched", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				*env.cache = *newCache()
+				for _, post := range posts.Search(cond).Records() {
+					post.Get("User").(RecordSet).Collection().Get("Name")
+				}
+			}
+		})
+	})
+}
+
+func TestReadStrict(t *testing.T) {
+	Convey("Testing strict reads from the cache", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			jane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			*env.cache = *newCache()
+			jane.Load("Name", "Profile")
+			Convey("Fields in cache should be returned", func() {
+				res, err := jane.ReadStrict("Name", "Profile")
+				So(err, ShouldBeNil)
+				So(res, ShouldHaveLength, 1)
+				So(res[0]["id"], ShouldEqual, jane.Ids()[0])
+				So(res[0]["Name"], ShouldContainSubstring, "Jane")
+				So(res[0]["Profile"], ShouldEqual, jane.Get("Profile").(RecordSet).Ids()[0])
+			})
+			Convey("A field missing from the cache should return an error", func() {
+				res, err := jane.ReadStrict("Name", "Email")
+				So(res, ShouldBeNil)
+				So(errors.Is(err, ErrFieldNotLoaded), ShouldBeTrue)
+				So(err.Error(), ShouldContainSubstring, "Email")
+				So(env.cache.checkIfInCache(jane.model, jane.Ids(), []string{"email"}), ShouldBeFalse)
+			})
+			Convey("Fields of related records should also be checked", func() {
+				_, err := jane.ReadStrict("Profile.Age")
+				So(errors.Is(err, ErrFieldNotLoaded), ShouldBeTrue)
+				jane.Get("Profile").(RecordSet).Collection().Load("Age")
+				res, err := jane.ReadStrict("Profile.Age")
+				So(err, ShouldBeNil)
+				So(res[0], ShouldContainKey, "Profile.Age")
+			})
+		})
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	Convey("Testing record snapshots", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			posts := env.Pool("Post")
+			author := users.Call("Create", FieldMap{"Name": "Snapshot Author", "Email": "snapshot@example.com"}).(RecordSet).Collection()
+			post := posts.Call("Create", FieldMap{"Title": "Snapshot Post", "Content": "Snapshot content", "User": author}).(RecordSet).Collection()
+			fields := []string{"Title", "Content", "User.Name", "User.Email"}
+			Convey("Snapshot then restore should reproduce the record and its many2one", func() {
+				snap, err := post.Snapshot(fields)
+				So(err, ShouldBeNil)
+				So(snap.Model, ShouldEqual, "Post")
+				So(snap.ExternalID, ShouldEqual, post.Get("HexyaExternalID"))
+				So(snap.Values["Title"], ShouldEqual, "Snapshot Post")
+				So(snap.Relations["User"], ShouldHaveLength, 1)
+				So(snap.Relations["User"][0].Values["Email"], ShouldEqual, "snapshot@example.com")
+				post.Call("Unlink")
+				author.Call("Unlink")
+				restored := env.Restore(snap)
+				So(restored.Len(), ShouldEqual, 1)
+				So(restored.Equals(post), ShouldBeFalse)
+				So(restored.Get("Title"), ShouldEqual, "Snapshot Post")
+				So(restored.Get("Content"), ShouldEqual, "Snapshot content")
+				So(restored.Get("HexyaExternalID"), ShouldEqual, snap.ExternalID)
+				restoredAuthor := restored.Get("User").(RecordSet).Collection()
+				So(restoredAuthor.Len(), ShouldEqual, 1)
+				So(restoredAuthor.Get("Name"), ShouldEqual, "Snapshot Author")
+				So(restoredAuthor.Get("Email"), ShouldEqual, "snapshot@example.com")
+				So(restoredAuthor.Get("HexyaExternalID"), ShouldEqual, snap.Relations["User"][0].ExternalID)
+			})
+			Convey("Existing related records should be resolved by external ID", func() {
+				snap, err := post.Snapshot([]string{"Title", "User"})
+				So(err, ShouldBeNil)
+				post.Call("Unlink")
+				restored := env.Restore(snap)
+				So(restored.Get("User").(RecordSet).Collection().Equals(author), ShouldBeTrue)
+				So(users.Search(users.Model().Field("Email").Equals("snapshot@example.com")).SearchCount(), ShouldEqual, 1)
+			})
+			Convey("Invalid snapshots should return an error", func() {
+				_, err := posts.Search(posts.Model().Field("Title").Equals("Snapshot Post")).Union(posts.SearchAll()).Snapshot(fields)
+				So(errors.Is(err, ErrMultipleRecords), ShouldBeTrue)
+				_, err = post.Snapshot([]string{"Title.Name"})
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+				_, err = post.Snapshot([]string{"Unknown"})
+				So(errors.Is(err, ErrUnknownField), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestSQLComputedFields(t *testing.T) {
+	Convey("Testing fields computed by the database", t, func() {
+		if !testAdapter.supportsGeneratedColumns() {
+			return
+		}
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			tags := env.Pool("Tag")
+			created := tags.Call("Create", FieldMap{"Name": "Weighted 1", "Rate": float32(2.5), "Sequence": 4}).(RecordSet).Collection()
+			tags.Call("Create", FieldMap{"Name": "Weighted 2", "Rate": float32(1), "Sequence": 3})
+			tags.Call("Create", FieldMap{"Name": "Weighted 3", "Rate": float32(5), "Sequence": 1})
+			Convey("Generated values should be read from the database after creation", func() {
+				So(created.Get("WeightedRate"), ShouldEqual, 10.0)
+			})
+			Convey("Generated values should be updated when the record is written", func() {
+				env.Flush()
+				tag := tags.Search(tags.Model().Field("Name").Equals("Weighted 1"))
+				So(tag.Get("WeightedRate"), ShouldEqual, 10.0)
+				tag.Set("Sequence", 2)
+				So(tag.Get("WeightedRate"), ShouldEqual, 5.0)
+			})
+			Convey("Generated fields should be filterable and sortable", func() {
+				env.Flush()
+				weighted := tags.Search(tags.Model().Field("Name").Like("Weighted %"))
+				res := weighted.Search(tags.Model().Field("WeightedRate").Greater(4)).OrderBy("WeightedRate desc")
+				So(res.Len(), ShouldEqual, 2)
+				So(res.Records()[0].Get("Name"), ShouldEqual, "Weighted 1")
+				So(res.Records()[1].Get("Name"), ShouldEqual, "Weighted 3")
+			})
+			Convey("Writing a generated field should panic", func() {
+				So(func() { created.Set("WeightedRate", 3.0) }, ShouldPanic)
+			})
+		})
+	})
+}
+
+func TestBooleanAndNullFilters(t *testing.T) {
+	Convey("Testing boolean and null filter shorthands", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			profile := env.Pool("Profile").Call("Create", FieldMap{"City": "Lille"}).(RecordSet).Collection()
+			withProfile := users.Call("Create", FieldMap{"Name": "Filter With Profile", "Email": "filter1@example.com",
+				"Profile": profile, "IsStaff": true}).(RecordSet).Collection()
+			withoutProfile := users.Call("Create", FieldMap{"Name": "Filter Without Profile", "Email": "filter2@example.com"}).(RecordSet).Collection()
+			env.Flush()
+			filtered := users.Search(users.Model().Field("Name").Like("Filter %")).OrderBy("Name")
+			Convey("FilterNull should match the records with a null value", func() {
+				res := filtered.FilterNull("Profile")
+				So(res.Len(), ShouldEqual, 1)
+				So(res.Get("Name"), ShouldEqual, "Filter Without Profile")
+				So(res.Ids(), ShouldResemble, withoutProfile.persistedIds())
+			})
+			Convey("FilterNotNull should match the records with a value", func() {
+				res := filtered.FilterNotNull("Profile")
+				So(res.Len(), ShouldEqual, 1)
+				So(res.Ids(), ShouldResemble, withProfile.persistedIds())
+			})
+			Convey("FilterTrue and FilterFalse should match boolean values", func() {
+				So(filtered.FilterTrue("IsStaff").Ids(), ShouldResemble, withProfile.persistedIds())
+				So(filtered.FilterFalse("IsStaff").Ids(), ShouldResemble, withoutProfile.persistedIds())
+			})
+			Convey("Conditions with a nil value should match null values", func() {
+				res := filtered.SearchDomain([]interface{}{[]interface{}{"profile_id", "=", nil}})
+				So(res.Ids(), ShouldResemble, withoutProfile.persistedIds())
+				res = filtered.Search(users.Model().Field("Profile").Equals((*interface{})(nil)))
+				So(res.Ids(), ShouldResemble, withoutProfile.persistedIds())
+				res = filtered.Search(users.Model().Field("Profile").NotEquals((*interface{})(nil)))
+				So(res.Ids(), ShouldResemble, withProfile.persistedIds())
 			})
 		})
 	})
-	security.Registry.UnregisterGroup(group1)
 }
@@ -15,9 +15,15 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/tools/exceptions"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -40,6 +46,70 @@ func TestMethods(t *testing.T) {
 	})
 }
 
+func TestMethodSignature(t *testing.T) {
+	Convey("Testing method signatures", t, func() {
+		Convey("Signature of a method with mixed parameters should be reported", func() {
+			params, returns, ok := Registry.MustGet("User").MethodSignature("DescribeWith")
+			So(ok, ShouldBeTrue)
+			So(params, ShouldResemble, []reflect.Type{
+				reflect.TypeOf(""),
+				reflect.TypeOf(int64(0)),
+				reflect.TypeOf(float64(0)),
+				reflect.TypeOf([]string{}),
+				reflect.TypeOf(FieldMap{}),
+			})
+			So(returns, ShouldResemble, []reflect.Type{reflect.TypeOf("")})
+		})
+		Convey("Signature of an extended method should be the one of its first layer", func() {
+			params, returns, ok := Registry.MustGet("Profile").MethodSignature("PrintAddress")
+			So(ok, ShouldBeTrue)
+			So(params, ShouldBeEmpty)
+			So(returns, ShouldResemble, []reflect.Type{reflect.TypeOf("")})
+		})
+		Convey("Unknown methods should not be found", func() {
+			_, _, ok := Registry.MustGet("User").MethodSignature("UnknownMethod")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestMethodFallback(t *testing.T) {
+	Convey("Testing method fallbacks", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Convey("Unknown methods should be handled by the model's fallback", func() {
+				contact := env.Pool("Contact").Call("Create", FieldMap{"Name": "John", "City": "Lyon"}).(RecordSet).Collection()
+				So(contact.Call("GetCity"), ShouldEqual, "Lyon")
+				So(contact.CallMulti("GetName"), ShouldResemble, []interface{}{"John"})
+				So(func() { contact.Call("UnknownMethod") }, ShouldPanic)
+			})
+			Convey("Fallbacks should require the execution permission", func() {
+				contact := env.Pool("Contact").Call("Create", FieldMap{"Name": "John", "City": "Lyon"}).(RecordSet).Collection()
+				err := TryCall(func() { contact.Sudo(2).Call("GetCity") })
+				So(errors.Is(err, ErrAccessDenied), ShouldBeTrue)
+				group1 := security.Registry.NewGroup("group1", "Group 1")
+				defer security.Registry.UnregisterGroup(group1)
+				security.Registry.AddMembership(2, group1)
+				contactModel := Registry.MustGet("Contact")
+				contactModel.methods.MustGet(methodFallbackName).AllowGroup(group1)
+				contactModel.methods.MustGet("Load").AllowGroup(group1)
+				defer contactModel.methods.MustGet(methodFallbackName).RevokeGroup(group1)
+				defer contactModel.methods.MustGet("Load").RevokeGroup(group1)
+				contactModel.GrantAccess(group1, security.Read)
+				defer contactModel.RevokeAccess(group1, security.Read)
+				So(contact.Sudo(2).Call("GetCity"), ShouldEqual, "Lyon")
+			})
+			Convey("Unknown methods should panic on Profile", func() {
+				profile := env.Pool("Profile").Call("Create", FieldMap{"City": "Lyon"}).(RecordSet).Collection()
+				So(func() { profile.Call("GetCity") }, ShouldPanic)
+			})
+			Convey("Unknown methods should panic on models without fallback", func() {
+				users := env.Pool("User")
+				So(func() { users.Call("GetName") }, ShouldPanic)
+			})
+		})
+	})
+}
+
 func TestComputedNonStoredFields(t *testing.T) {
 	Convey("Testing non stored computed fields", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -222,3 +292,171 @@ func TestMixedInModels(t *testing.T) {
 		})
 	})
 }
+
+func TestCallJSON(t *testing.T) {
+	Convey("Testing method calls with JSON arguments", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			userWill := users.Search(users.Model().Field("Name").Equals("Will Smith"))
+			Convey("Arguments should be decoded into int64, string and maps", func() {
+				res, err := userJane.CallJSON("DescribeWith", []json.RawMessage{
+					json.RawMessage(`"Hello"`), json.RawMessage(`42`), json.RawMessage(`1.5`),
+					json.RawMessage(`["a"]`), json.RawMessage(`{"Comment": "ok"}`)})
+				So(err, ShouldBeNil)
+				So(res, ShouldEqual, fmt.Sprintf("Hello %s: 42 1.5 [a] ok", userJane.Get("Name")))
+			})
+			Convey("Arguments should be decoded into structs", func() {
+				res, err := users.CallJSON("FieldsGet", []json.RawMessage{json.RawMessage(`{"allfields": ["Name", "Email"]}`)})
+				So(err, ShouldBeNil)
+				fInfos := res.(map[string]*FieldInfo)
+				So(fInfos, ShouldHaveLength, 2)
+				So(fInfos, ShouldContainKey, "name")
+				So(fInfos, ShouldContainKey, "email")
+			})
+			Convey("Arguments should be decoded into RecordSets", func() {
+				res, err := userWill.CallJSON("Union", []json.RawMessage{json.RawMessage(fmt.Sprintf("[%d]", userJane.Ids()[0]))})
+				So(err, ShouldBeNil)
+				So(res.(RecordSet).Len(), ShouldEqual, 2)
+				So(res.(RecordSet).Collection().Equals(userWill.Union(userJane)), ShouldBeTrue)
+				res, err = userWill.CallJSON("Subtract", []json.RawMessage{json.RawMessage(fmt.Sprintf("%d", userWill.Ids()[0]))})
+				So(err, ShouldBeNil)
+				So(res.(RecordSet).IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Conditions should be decoded from domains", func() {
+				res, err := users.CallJSON("Search", []json.RawMessage{json.RawMessage(`[["Email", "=", "jane.smith@example.com"]]`)})
+				So(err, ShouldBeNil)
+				So(res.(RecordSet).Ids(), ShouldResemble, userJane.Ids())
+			})
+			Convey("Arguments of the wrong type should return a type mismatch error", func() {
+				_, err := userJane.CallJSON("DescribeWith", []json.RawMessage{
+					json.RawMessage(`"Hello"`), json.RawMessage(`"forty two"`), json.RawMessage(`1.5`),
+					json.RawMessage(`[]`), json.RawMessage(`{}`)})
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+				_, err = userJane.CallJSON("DescribeWith", []json.RawMessage{json.RawMessage(`"Hello"`)})
+				So(errors.Is(err, ErrTypeMismatch), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	Convey("Testing RPC dispatch", t, func() {
+		var (
+			janeID   int64
+			janeName string
+		)
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			janeID = userJane.Ids()[0]
+			janeName = userJane.Get("Name").(string)
+		})
+		rawArgs := func(args ...string) []json.RawMessage {
+			res := make([]json.RawMessage, len(args))
+			for i, arg := range args {
+				res[i] = json.RawMessage(arg)
+			}
+			return res
+		}
+		Convey("Dispatching a method with mixed type arguments", func() {
+			resp := Dispatch(security.SuperUserID, RPCRequest{
+				Model:  "User",
+				Method: "DescribeWith",
+				IDs:    []int64{janeID},
+				Args:   rawArgs(`"Hello"`, `3`, `0.5`, `["a", "b"]`, `{"Comment": "ok"}`),
+			})
+			So(resp.Error, ShouldBeNil)
+			So(string(resp.Result), ShouldEqual, fmt.Sprintf(`"Hello %s: 3 0.5 [a b] ok"`, janeName))
+		})
+		Convey("Dispatching a method returning a RecordSet", func() {
+			resp := Dispatch(security.SuperUserID, RPCRequest{
+				Model:  "User",
+				Method: "Search",
+				Args:   rawArgs(`[["Email", "=", "jane.smith@example.com"]]`),
+			})
+			So(resp.Error, ShouldBeNil)
+			var ids []int64
+			So(json.Unmarshal(resp.Result, &ids), ShouldBeNil)
+			So(ids, ShouldResemble, []int64{janeID})
+		})
+		Convey("Limits of RPC calls should be capped at MaxLimit", func() {
+			maxLimit := MaxLimit
+			MaxLimit = 1
+			defer func() { MaxLimit = maxLimit }()
+			resp := Dispatch(security.SuperUserID, RPCRequest{
+				Model:  "User",
+				Method: "SearchByName",
+				Args:   rawArgs(`"Smith"`, `"ilike"`, `[["Email", "ilike", "example.com"]]`, `0`),
+			})
+			So(resp.Error, ShouldBeNil)
+			var ids []int64
+			So(json.Unmarshal(resp.Result, &ids), ShouldBeNil)
+			So(ids, ShouldHaveLength, 1)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				So(users.Search(users.Model().Field("Name").IContains("Smith")).Limit(0).Len(), ShouldBeGreaterThan, 1)
+			})
+		})
+		Convey("Unknown methods should return a method not found error", func() {
+			resp := Dispatch(security.SuperUserID, RPCRequest{Model: "User", Method: "UnknownMethod"})
+			So(resp.Result, ShouldBeNil)
+			So(resp.Error.Code, ShouldEqual, RPCMethodNotFound)
+		})
+		Convey("Invalid arguments should return an invalid params error", func() {
+			resp := Dispatch(security.SuperUserID, RPCRequest{
+				Model:  "User",
+				Method: "DescribeWith",
+				Args:   rawArgs(`"Hello"`, `"three"`, `0.5`, `[]`, `{}`),
+			})
+			So(resp.Error.Code, ShouldEqual, RPCInvalidParams)
+			resp = Dispatch(security.SuperUserID, RPCRequest{Model: "User", Method: "DescribeWith", Args: rawArgs(`"Hello"`)})
+			So(resp.Error.Code, ShouldEqual, RPCInvalidParams)
+			resp = Dispatch(security.SuperUserID, RPCRequest{
+				Model:  "User",
+				Method: "Search",
+				Args:   rawArgs(`["&", ["Email", "=", "jane.smith@example.com"]]`),
+			})
+			So(resp.Error.Code, ShouldEqual, RPCInvalidParams)
+			So(resp.Error.Data.Kind, ShouldEqual, ErrTypeMismatch.Error())
+		})
+		Convey("ORM errors should be returned as structured errors", func() {
+			resp := Dispatch(2, RPCRequest{
+				Model:  "User",
+				Method: "DescribeWith",
+				IDs:    []int64{janeID},
+				Args:   rawArgs(`"Hello"`, `3`, `0.5`, `[]`, `{}`),
+			})
+			So(resp.Result, ShouldBeNil)
+			So(resp.Error.Code, ShouldEqual, RPCServerError)
+			So(resp.Error.Data.Kind, ShouldEqual, ErrAccessDenied.Error())
+			So(resp.Error.Data.Model, ShouldEqual, "User")
+			data, err := json.Marshal(resp)
+			So(err, ShouldBeNil)
+			var respMap map[string]interface{}
+			So(json.Unmarshal(data, &respMap), ShouldBeNil)
+			So(respMap, ShouldNotContainKey, "result")
+			So(respMap["error"], ShouldContainKey, "code")
+			So(respMap["error"], ShouldContainKey, "message")
+			So(respMap["error"].(map[string]interface{})["data"], ShouldContainKey, "kind")
+		})
+		Convey("Reserved context keys should be stripped from client contexts", func() {
+			ctx := sanitizeRPCContext(types.NewContext().
+				WithKey("lang", "fr_FR").
+				WithKey("hexya_force_compute_write", true).
+				WithKey("hexya_allow_without_inverse", true))
+			So(ctx.Get("lang"), ShouldEqual, "fr_FR")
+			So(ctx.HasKey("hexya_force_compute_write"), ShouldBeFalse)
+			So(ctx.HasKey("hexya_allow_without_inverse"), ShouldBeFalse)
+		})
+		Convey("Debug information should only be returned in debug mode", func() {
+			userErr := exceptions.UserError{Message: "Error", Debug: "stack trace"}
+			resp := newRPCErrorResponse(RPCServerError, "Hexya Server Error", userErr)
+			So(resp.Error.Data.Debug, ShouldBeEmpty)
+			RPCDebug = true
+			defer func() { RPCDebug = false }()
+			resp = newRPCErrorResponse(RPCServerError, "Hexya Server Error", userErr)
+			So(resp.Error.Data.Debug, ShouldEqual, "stack trace")
+		})
+	})
+}
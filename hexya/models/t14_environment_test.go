@@ -15,13 +15,94 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
 	"github.com/hexya-erp/hexya/hexya/models/types"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+	"github.com/lib/pq"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// cronTestRecorder records the executions of the RunCronTest method
+type cronTestRecorder struct {
+	sync.Mutex
+	uids                []int64
+	running, maxRunning int
+}
+
+var cronTestRuns = new(cronTestRecorder)
+
+func (r *cronTestRecorder) start(uid int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.uids = append(r.uids, uid)
+	r.running++
+	if r.running > r.maxRunning {
+		r.maxRunning = r.running
+	}
+}
+
+func (r *cronTestRecorder) end() {
+	r.Lock()
+	defer r.Unlock()
+	r.running--
+}
+
+func (r *cronTestRecorder) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.uids, r.running, r.maxRunning = nil, 0, 0
+}
+
+func (r *cronTestRecorder) runs() ([]int64, int) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]int64(nil), r.uids...), r.maxRunning
+}
+
+type testMetricsCollector struct {
+	started, finished, begun, committed, rolledBack, retried int
+	queries                                                  []string
+}
+
+func (tmc *testMetricsCollector) QueryStarted(query string) {
+	tmc.started++
+	tmc.queries = append(tmc.queries, query)
+}
+
+func (tmc *testMetricsCollector) QueryFinished(query string, duration time.Duration, err error) {
+	tmc.finished++
+}
+
+func (tmc *testMetricsCollector) TransactionBegun() {
+	tmc.begun++
+}
+
+func (tmc *testMetricsCollector) TransactionCommitted() {
+	tmc.committed++
+}
+
+func (tmc *testMetricsCollector) TransactionRolledBack() {
+	tmc.rolledBack++
+}
+
+func (tmc *testMetricsCollector) SerializationRetried(attempt uint8) {
+	tmc.retried++
+}
+
+func (tmc *testMetricsCollector) DeadlockRetried(attempt uint8) {
+	tmc.retried++
+}
+
+var _ MetricsCollector = new(testMetricsCollector)
+
 func TestEnvironment(t *testing.T) {
 	Convey("Testing Environment Modifications", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
@@ -39,6 +120,21 @@ func TestEnvironment(t *testing.T) {
 				So(userJane1.Env().callStack, ShouldBeEmpty)
 				env2.rollback()
 			})
+			Convey("Operations after WithEnv should use the new transaction", func() {
+				userJane.Load()
+				env2 := newEnvironment(security.SuperUserID)
+				defer env2.rollback()
+				userJane2 := userJane.WithEnv(env2)
+				So(env2.cache.data, ShouldBeEmpty)
+				userJane2.Set("Nums", 999)
+				env2.Flush()
+				var nums int
+				env2.Cr().Get(&nums, "SELECT nums FROM \"user\" WHERE id = ?", userJane2.Ids()[0])
+				So(nums, ShouldEqual, 999)
+				env.Cr().Get(&nums, "SELECT nums FROM \"user\" WHERE id = ?", userJane.Ids()[0])
+				So(nums, ShouldNotEqual, 999)
+				So(userJane.Get("Nums"), ShouldNotEqual, 999)
+			})
 			Convey("Checking WithContext", func() {
 				userJane1 := userJane.Call("WithContext", "newKey", "This is a different key").(RecordSet).Collection()
 				So(userJane1.Env().Context().HasKey("key"), ShouldBeTrue)
@@ -98,6 +194,523 @@ func TestEnvironment(t *testing.T) {
 			})
 		})
 	})
+	Convey("Testing advisory locks", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			Convey("Transaction locks cannot be held by two environments", func() {
+				_, err := env.AdvisoryLock("test-lock")
+				So(err, ShouldBeNil)
+				_, acquired, err := env.TryAdvisoryLock("test-lock")
+				So(err, ShouldBeNil)
+				So(acquired, ShouldBeTrue)
+				SimulateInNewEnvironment(security.SuperUserID, func(env2 Environment) {
+					_, acquired, err := env2.TryAdvisoryLock("test-lock")
+					So(err, ShouldBeNil)
+					So(acquired, ShouldBeFalse)
+					_, acquired, err = env2.TryAdvisoryLock("other-lock")
+					So(err, ShouldBeNil)
+					So(acquired, ShouldBeTrue)
+				})
+			})
+			Convey("Session locks are held until released", func() {
+				unlock, acquired, err := env.TryAdvisoryLock("test-session-lock", SessionLockScope)
+				So(err, ShouldBeNil)
+				So(acquired, ShouldBeTrue)
+				SimulateInNewEnvironment(security.SuperUserID, func(env2 Environment) {
+					_, acquired, err := env2.TryAdvisoryLock("test-session-lock")
+					So(err, ShouldBeNil)
+					So(acquired, ShouldBeFalse)
+				})
+				unlock()
+				SimulateInNewEnvironment(security.SuperUserID, func(env2 Environment) {
+					_, acquired, err := env2.TryAdvisoryLock("test-session-lock")
+					So(err, ShouldBeNil)
+					So(acquired, ShouldBeTrue)
+				})
+			})
+			Convey("Waiting for a lock should stop when the context is done", func() {
+				unlock, err := env.AdvisoryLock("test-wait-lock", SessionLockScope)
+				So(err, ShouldBeNil)
+				defer unlock()
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				var lockErr error
+				ExecuteInNewEnvironment(security.SuperUserID, func(env2 Environment) {
+					_, lockErr = env2.AdvisoryLock("test-wait-lock")
+				}, ctx)
+				So(lockErr, ShouldNotBeNil)
+			})
+		})
+	})
+	Convey("Testing Simulate inside an existing transaction", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			userJane.Set("Nums", 42)
+			Convey("Changes made during the simulation should be discarded", func() {
+				err := env.Simulate(func(env Environment) {
+					userJane.Set("Nums", 7)
+					env.Pool("User").Call("Create", FieldMap{
+						"Name":  "Simulated User",
+						"Email": "simulated@example.com",
+					})
+					env.Flush()
+					So(userJane.Get("Nums"), ShouldEqual, 7)
+				})
+				So(err, ShouldBeNil)
+				So(userJane.Get("Nums"), ShouldEqual, 42)
+				So(users.Search(users.Model().Field("Email").Equals("simulated@example.com")).Len(), ShouldEqual, 0)
+				env.Flush()
+				var nums int
+				env.Cr().Get(&nums, "SELECT nums FROM \"user\" WHERE id = ?", userJane.Ids()[0])
+				So(nums, ShouldEqual, 42)
+			})
+			Convey("A panic during the simulation should be returned as an error", func() {
+				err := env.Simulate(func(env Environment) {
+					userJane.Set("Nums", 7)
+					env.Pool("User").Union(env.Pool("Post"))
+				})
+				So(err, ShouldNotBeNil)
+				So(userJane.Get("Nums"), ShouldEqual, 42)
+			})
+		})
+	})
+	Convey("Testing user groups", t, func() {
+		baseGroup := security.Registry.NewGroup("test_base_group", "Test Base Group")
+		childGroup := security.Registry.NewGroup("test_child_group", "Test Child Group", baseGroup)
+		security.Registry.AddMembership(2, childGroup)
+		Convey("Users should belong to their groups and the inherited ones", func() {
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(env.UserGroups(), ShouldContain, "test_child_group")
+				So(env.UserGroups(), ShouldContain, "test_base_group")
+				So(env.UserGroups(), ShouldContain, security.GroupEveryoneID)
+				So(env.HasGroup("test_base_group"), ShouldBeTrue)
+				So(env.HasGroup(security.GroupAdminID), ShouldBeFalse)
+			})
+		})
+		Convey("Groups should be cached in the environment", func() {
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(env.HasGroup("test_child_group"), ShouldBeTrue)
+				security.Registry.RemoveMembership(2, childGroup)
+				So(env.HasGroup("test_child_group"), ShouldBeTrue)
+			})
+			SimulateInNewEnvironment(2, func(env Environment) {
+				So(env.HasGroup("test_child_group"), ShouldBeFalse)
+				So(env.HasGroup("test_base_group"), ShouldBeFalse)
+			})
+		})
+		Convey("The superuser should belong to all groups", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.HasGroup("test_child_group"), ShouldBeTrue)
+				So(env.HasGroup(security.GroupAdminID), ShouldBeTrue)
+				So(env.Pool("User").Sudo(2).Env().HasGroup(security.GroupAdminID), ShouldBeFalse)
+			})
+		})
+		Reset(func() {
+			security.Registry.UnregisterGroup(childGroup)
+			security.Registry.UnregisterGroup(baseGroup)
+		})
+	})
+	Convey("Testing the audit of privileged accesses", t, func() {
+		var events []PrivilegeEvent
+		SetAuditHook(func(event PrivilegeEvent) {
+			events = append(events, event)
+		})
+		Convey("A sudo search should fire the audit hook", func() {
+			SimulateInNewEnvironment(2, func(env Environment) {
+				users := env.Pool("User").Sudo()
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+			})
+			So(events, ShouldNotBeEmpty)
+			So(events[0], ShouldResemble, PrivilegeEvent{
+				Model:     "User",
+				Operation: "read",
+				UID:       security.SuperUserID,
+				RealUID:   2,
+				Reason:    ReasonSudo,
+			})
+		})
+		Convey("A search without sudo should not fire the audit hook", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+				users.Sudo().Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+			})
+			So(events, ShouldBeEmpty)
+		})
+		Convey("A sudo to a user with fewer privileges should not fire the audit hook", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User").Sudo(2)
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+			})
+			So(events, ShouldBeEmpty)
+		})
+		Reset(func() {
+			SetAuditHook(nil)
+		})
+	})
+	Convey("Testing batch calls", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			createCall := CallSpec{
+				Model:  "User",
+				Method: "Create",
+				Args: []interface{}{FieldMap{
+					"Name":  "Batch User",
+					"Email": "batch@example.com",
+				}},
+			}
+			writeCall := CallSpec{
+				Model:  "User",
+				IDs:    userJane.Ids(),
+				Method: "Write",
+				Args:   []interface{}{FieldMap{"Nums": 13}},
+			}
+			failingCall := CallSpec{
+				Model:  "User",
+				Method: "Union",
+				Args:   []interface{}{env.Pool("Post")},
+			}
+			Convey("Calls should be executed in order and return their results", func() {
+				res, err := env.BatchCall([]CallSpec{createCall, writeCall})
+				So(err, ShouldBeNil)
+				So(res, ShouldHaveLength, 2)
+				So(res[0].(RecordSet).Collection().Get("Name"), ShouldEqual, "Batch User")
+				So(res[1], ShouldBeTrue)
+				So(userJane.Get("Nums"), ShouldEqual, 13)
+			})
+			Convey("A failing call should roll back the previous calls", func() {
+				nums := userJane.Get("Nums")
+				res, err := env.BatchCall([]CallSpec{createCall, writeCall, failingCall})
+				So(err, ShouldNotBeNil)
+				So(res, ShouldBeNil)
+				So(userJane.Get("Nums"), ShouldEqual, nums)
+				So(users.Search(users.Model().Field("Email").Equals("batch@example.com")).Len(), ShouldEqual, 0)
+			})
+			Convey("A failing call with ContinueOnError should only roll back itself", func() {
+				failingCall.ContinueOnError = true
+				res, err := env.BatchCall([]CallSpec{createCall, failingCall, writeCall})
+				So(err, ShouldBeNil)
+				So(res, ShouldHaveLength, 3)
+				So(res[1], ShouldImplement, (*error)(nil))
+				So(userJane.Get("Nums"), ShouldEqual, 13)
+				So(users.Search(users.Model().Field("Email").Equals("batch@example.com")).Len(), ShouldEqual, 1)
+			})
+			Convey("Database errors should be reported for the call that caused them", func() {
+				duplicateCall := CallSpec{
+					Model:           "User",
+					IDs:             userJane.Ids(),
+					Method:          "Write",
+					Args:            []interface{}{FieldMap{"Name": "John Smith"}},
+					ContinueOnError: true,
+				}
+				res, err := env.BatchCall([]CallSpec{createCall, duplicateCall, writeCall})
+				So(err, ShouldBeNil)
+				So(res, ShouldHaveLength, 3)
+				So(res[1], ShouldImplement, (*error)(nil))
+				So(res[2], ShouldBeTrue)
+				So(userJane.Get("Name"), ShouldEqual, "Jane Smith")
+				So(userJane.Get("Nums"), ShouldEqual, 13)
+				So(users.Search(users.Model().Field("Email").Equals("batch@example.com")).Len(), ShouldEqual, 1)
+			})
+		})
+	})
+	Convey("Testing dead connections replacement", t, func() {
+		env1 := newEnvironment(security.SuperUserID)
+		env2 := newEnvironment(security.SuperUserID)
+		var deadPid int
+		env2.Cr().Get(&deadPid, "SELECT pg_backend_pid()")
+		env2.rollback()
+		env1.Cr().Execute("SELECT pg_terminate_backend(?)", deadPid)
+		for i := 0; i < 100; i++ {
+			var count int
+			env1.Cr().Get(&count, "SELECT COUNT(*) FROM pg_stat_activity WHERE pid = ?", deadPid)
+			if count == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		env1.rollback()
+		Convey("Dead connections should be replaced when opening new environments", func() {
+			// Open two environments at the same time to be sure to get the dead connection
+			var envA, envB Environment
+			So(func() { envA = newEnvironment(security.SuperUserID) }, ShouldNotPanic)
+			defer envA.rollback()
+			So(func() { envB = newEnvironment(security.SuperUserID) }, ShouldNotPanic)
+			defer envB.rollback()
+			var pidA, pidB int
+			envA.Cr().Get(&pidA, "SELECT pg_backend_pid()")
+			envB.Cr().Get(&pidB, "SELECT pg_backend_pid()")
+			So(pidA, ShouldNotEqual, deadPid)
+			So(pidB, ShouldNotEqual, deadPid)
+		})
+	})
+	Convey("Testing read only environments", t, func() {
+		DBConnectReplica(dbArgs.Driver, fmt.Sprintf("dbname=%s sslmode=disable user=%s password=%s", dbArgs.DB, dbArgs.User, dbArgs.Password))
+		defer func() {
+			replica.Close()
+			replica = nil
+		}()
+		Convey("Reads should be sent to the replica", func() {
+			err := ExecuteReadOnly(security.SuperUserID, func(env Environment) {
+				So(replica.Stats().InUse, ShouldEqual, 1)
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				So(userJane.Len(), ShouldEqual, 1)
+				So(userJane.Get("Email"), ShouldEqual, "jane.smith@example.com")
+			})
+			So(err, ShouldBeNil)
+		})
+		Convey("Writes should be rejected", func() {
+			err := ExecuteReadOnly(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				userJane.Set("Nums", 3)
+			})
+			So(err, ShouldNotBeNil)
+			So(errors.Is(err, ErrReadOnly), ShouldBeTrue)
+		})
+		Convey("Queries should see a single snapshot", func() {
+			var first, second time.Time
+			err := ExecuteReadOnly(security.SuperUserID, func(env Environment) {
+				env.Cr().Get(&first, "SELECT transaction_timestamp()")
+				time.Sleep(10 * time.Millisecond)
+				env.Cr().Get(&second, "SELECT transaction_timestamp()")
+			})
+			So(err, ShouldBeNil)
+			So(second.Equal(first), ShouldBeTrue)
+		})
+		Convey("Autocommit queries should be executed without transaction", func() {
+			collector := new(testMetricsCollector)
+			SetMetricsCollector(collector)
+			defer SetMetricsCollector(nil)
+			var first, second time.Time
+			err := ExecuteReadOnlyAutocommit(security.SuperUserID, func(env Environment) {
+				env.Cr().Get(&first, "SELECT transaction_timestamp()")
+				time.Sleep(10 * time.Millisecond)
+				env.Cr().Get(&second, "SELECT transaction_timestamp()")
+			})
+			So(err, ShouldBeNil)
+			So(second.After(first), ShouldBeTrue)
+			So(collector.begun, ShouldEqual, 0)
+			So(collector.rolledBack, ShouldEqual, 0)
+		})
+		Convey("Autocommit writes should be rejected", func() {
+			err := ExecuteReadOnlyAutocommit(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Set("Nums", 3)
+			})
+			So(errors.Is(err, ErrReadOnly), ShouldBeTrue)
+		})
+		Convey("Raw SQL writes should be rejected by the database", func() {
+			err := ExecuteReadOnlyAutocommit(security.SuperUserID, func(env Environment) {
+				env.Cr().Execute(`UPDATE "user" SET nums = 3 WHERE email = ?`, "jane.smith@example.com")
+			})
+			So(errors.Is(err, ErrDatabase), ShouldBeTrue)
+		})
+	})
+	Convey("Testing read only environments without replica", t, func() {
+		Convey("Connections should be writable again once released", func() {
+			So(ExecuteReadOnlyAutocommit(security.SuperUserID, func(env Environment) {
+				So(env.Pool("User").SearchAll().SearchCount(), ShouldBeGreaterThan, 0)
+			}), ShouldBeNil)
+			So(db.Stats().InUse, ShouldEqual, 0)
+			err := SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("Tag").Call("Create", FieldMap{"Name": "After read only"})
+				env.Flush()
+			})
+			So(err, ShouldBeNil)
+		})
+		Convey("Autocommit reads should not leak connections", func() {
+			maxOpen := db.Stats().MaxOpenConnections
+			db.SetMaxOpenConns(1)
+			defer db.SetMaxOpenConns(maxOpen)
+			done := make(chan error)
+			go func() {
+				for i := 0; i < 20; i++ {
+					err := ExecuteReadOnlyAutocommit(security.SuperUserID, func(env Environment) {
+						env.Pool("User").SearchAll().SearchCount()
+					})
+					if err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}()
+			select {
+			case err := <-done:
+				So(err, ShouldBeNil)
+			case <-time.After(5 * time.Second):
+				So("autocommit reads blocked waiting for a connection", ShouldBeEmpty)
+			}
+			So(db.Stats().InUse, ShouldEqual, 0)
+		})
+	})
+	Convey("Testing query timeouts", t, func() {
+		Convey("A slow query should be cancelled when the context deadline passes", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Cr().Execute("SELECT pg_sleep(5)")
+			}, ctx)
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+		Convey("A single query can be given its own deadline", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				start := time.Now()
+				So(func() { env.Cr().ExecuteContext(ctx, "SELECT pg_sleep(5)") }, ShouldPanic)
+				So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			})
+		})
+	})
+	Convey("Testing transaction cancellation", t, func() {
+		Convey("Cancelling the context should roll back the transaction", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var janeID int64
+			err := ExecuteInNewEnvironmentCtx(ctx, security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				janeID = userJane.Ids()[0]
+				env.Cr().Execute("UPDATE \"user\" SET nums = ? WHERE id = ?", 1234, janeID)
+				cancel()
+				userJane.Set("Nums", 4321)
+			})
+			So(err, ShouldEqual, context.Canceled)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				var nums int
+				env.Cr().Get(&nums, "SELECT nums FROM \"user\" WHERE id = ?", janeID)
+				So(nums, ShouldNotEqual, 1234)
+				So(nums, ShouldNotEqual, 4321)
+			})
+		})
+		Convey("A cancelled context should be returned even if fnct ends normally", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			err := ExecuteInNewEnvironmentCtx(ctx, security.SuperUserID, func(env Environment) {
+				cancel()
+			})
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+	Convey("Testing metrics hooks", t, func() {
+		collector := new(testMetricsCollector)
+		SetMetricsCollector(collector)
+		defer SetMetricsCollector(nil)
+		Convey("Hooks should fire for a transaction with one retry", func() {
+			var attempts int
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				attempts++
+				env.Cr().Execute("SELECT 1")
+				if attempts == 1 {
+					panic(&pq.Error{Code: "40001", Message: "could not serialize access"})
+				}
+			})
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 2)
+			So(collector.begun, ShouldEqual, 2)
+			So(collector.rolledBack, ShouldEqual, 1)
+			So(collector.committed, ShouldEqual, 1)
+			So(collector.retried, ShouldEqual, 1)
+			// SET TRANSACTION and SELECT 1 in each attempt
+			So(collector.started, ShouldEqual, 4)
+			So(collector.finished, ShouldEqual, collector.started)
+		})
+	})
+	Convey("Testing serialization retries", t, func() {
+		Convey("Retries should be spaced and the final error should report the attempts", func() {
+			policy := RetryPolicy{MaxRetries: 2, BaseDelay: 20 * time.Millisecond}
+			var attempts []time.Time
+			err := ExecuteInNewEnvironmentWithPolicy(context.Background(), security.SuperUserID, policy, func(env Environment) {
+				attempts = append(attempts, time.Now())
+				panic(&pq.Error{Code: "40001", Message: "could not serialize access"})
+			})
+			So(attempts, ShouldHaveLength, 3)
+			So(attempts[1].Sub(attempts[0]), ShouldBeGreaterThanOrEqualTo, 10*time.Millisecond)
+			So(attempts[2].Sub(attempts[1]), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+			var retryErr *RetryError
+			So(errors.As(err, &retryErr), ShouldBeTrue)
+			So(retryErr.Attempts, ShouldEqual, 3)
+			So(err.Error(), ShouldContainSubstring, "after 3 attempts")
+		})
+		Convey("Other errors should not be retried", func() {
+			var attempts int
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				attempts++
+				env.Pool("User").Union(env.Pool("Post"))
+			})
+			So(err, ShouldNotBeNil)
+			So(attempts, ShouldEqual, 1)
+		})
+		Convey("Deadlocks should be retried", func() {
+			var attempts int
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				attempts++
+				if attempts == 1 {
+					panic(&pq.Error{Code: "40P01", Message: "deadlock detected"})
+				}
+			})
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 2)
+		})
+		Convey("Deadlocks should be retried up to their own limit", func() {
+			policy := RetryPolicy{MaxRetries: 5, MaxDeadlockRetries: 1}
+			var attempts int
+			err := ExecuteInNewEnvironmentWithPolicy(context.Background(), security.SuperUserID, policy, func(env Environment) {
+				attempts++
+				panic(&pq.Error{Code: "40P01", Message: "deadlock detected"})
+			})
+			So(attempts, ShouldEqual, 2)
+			var retryErr *RetryError
+			So(errors.As(err, &retryErr), ShouldBeTrue)
+			So(retryErr.Attempts, ShouldEqual, 2)
+		})
+		Convey("Non retryable database errors should not be retried", func() {
+			var attempts int
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				attempts++
+				panic(&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"})
+			})
+			So(err, ShouldNotBeNil)
+			So(attempts, ShouldEqual, 1)
+		})
+	})
+	Convey("Testing prepared statements cache", t, func() {
+		DBPreparedStatements = true
+		defer func() { DBPreparedStatements = false }()
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User")
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+			userJane.Fetch()
+			query := "UPDATE \"user\" SET nums = ? WHERE id = ?"
+			Convey("Identical queries should reuse the same prepared statement", func() {
+				env.Cr().Execute(query, 3, userJane.ids[0])
+				sanitized, _ := sanitizeQuery(query, 3, userJane.ids[0])
+				So(env.cr.stmts, ShouldContainKey, sanitized)
+				stmt := env.cr.stmts[sanitized]
+				env.Cr().Execute(query, 4, userJane.ids[0])
+				So(env.cr.stmts[sanitized], ShouldEqual, stmt)
+			})
+			Convey("Prepared statements should be renewed after a schema change", func() {
+				env.Cr().Execute(query, 3, userJane.ids[0])
+				So(env.cr.stmts, ShouldNotBeEmpty)
+				env.Cr().Execute("CREATE TEMPORARY TABLE prepared_test (id integer)")
+				env.Cr().Execute(query, 4, userJane.ids[0])
+				So(env.cr.stmts, ShouldHaveLength, 1)
+				So(env.cr.schemaVersion, ShouldEqual, schemaVersion)
+			})
+			Convey("Disabling prepared statements should not cache queries", func() {
+				DBPreparedStatements = false
+				defer func() { DBPreparedStatements = true }()
+				env.Cr().Execute(query, 3, userJane.ids[0])
+				So(env.cr.stmts, ShouldBeEmpty)
+			})
+		})
+	})
 	Convey("Testing cache operation", t, func() {
 		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
 			users := env.Pool("User")
@@ -148,6 +761,62 @@ func TestEnvironment(t *testing.T) {
 				}
 				So(userJane.Get("Posts").(RecordSet).Collection().Len(), ShouldEqual, 2)
 			})
+			Convey("Reparenting a child in cache should update both parents' O2M fields", func() {
+				postModel := env.Pool("Post").Model()
+				post1 := env.Pool("Post").Search(postModel.Field("Title").Equals("1st Post"))
+				post3 := env.Pool("Post").Search(postModel.Field("Title").Equals("3rd Post"))
+				newUser := users.Call("Create", FieldMap{
+					"Name":  "New Parent",
+					"Email": "newparent@example.com",
+				}).(RecordSet).Collection()
+				env.Flush()
+				newUserID := newUser.persistedIds()[0]
+				newParent := users.Browse(newUserID)
+				Convey("When the old parent's O2M is already in cache", func() {
+					So(userJane.Get("Posts").(RecordSet).Collection().Len(), ShouldEqual, 2)
+					So(newParent.Get("Posts").(RecordSet).Collection().Len(), ShouldEqual, 0)
+					post1.Load()
+					post1.Set("User", newParent)
+					janePosts := userJane.Get("Posts").(RecordSet).Collection()
+					So(janePosts.Ids(), ShouldResemble, post3.Ids())
+					So(newParent.Get("Posts").(RecordSet).Collection().Ids(), ShouldResemble, post1.Ids())
+				})
+				Convey("When the old parent's O2M is loaded after the change", func() {
+					*env.cache = *newCache()
+					post1.Load()
+					post1.Set("User", newParent)
+					So(env.cache.checkIfInCache(userJane.model, userJane.Ids(), []string{"posts_ids"}), ShouldBeFalse)
+					janePosts := userJane.Get("Posts").(RecordSet).Collection()
+					So(janePosts.Ids(), ShouldResemble, post3.Ids())
+					So(newParent.Get("Posts").(RecordSet).Collection().Ids(), ShouldResemble, post1.Ids())
+					So(post1.Get("User").(RecordSet).Collection().Ids(), ShouldResemble, []int64{newUserID})
+				})
+				Convey("When the child's FK is invalidated", func() {
+					So(userJane.Get("Posts").(RecordSet).Collection().Len(), ShouldEqual, 2)
+					post1.Load()
+					post1.InvalidateCache("User")
+					So(env.cache.checkIfInCache(userJane.model, userJane.Ids(), []string{"posts_ids"}), ShouldBeFalse)
+					So(userJane.Get("Posts").(RecordSet).Collection().Len(), ShouldEqual, 2)
+				})
+			})
+			Convey("M2M links orientation should not depend on the link fields names", func() {
+				postTags := env.Pool("Post").Model().fields.MustGet("Tags")
+				tagPosts := env.Pool("Tag").Model().fields.MustGet("Posts")
+				ourName, theirName := postTags.m2mOurField.name, postTags.m2mTheirField.name
+				Reset(func() {
+					postTags.m2mOurField.name, postTags.m2mTheirField.name = ourName, theirName
+				})
+				c := newCache()
+				c.addM2MLink(postTags, 1, []int64{2, 3})
+				// Rename the link fields so that their alphabetical order is swapped
+				postTags.m2mOurField.name, postTags.m2mTheirField.name = "Z"+ourName, "A"+theirName
+				So(c.getM2MLinks(postTags, 1), ShouldHaveLength, 2)
+				So(c.getM2MLinks(postTags, 1), ShouldContain, int64(2))
+				So(c.getM2MLinks(postTags, 1), ShouldContain, int64(3))
+				So(c.getM2MLinks(tagPosts, 2), ShouldResemble, []int64{1})
+				c.removeM2MLinks(tagPosts, 3)
+				So(c.getM2MLinks(postTags, 1), ShouldResemble, []int64{2})
+			})
 			Convey("Reading M2M fields should work both ways", func() {
 				postModel := env.Pool("Post").Model()
 				tagModel := env.Pool("Tag").Model()
@@ -181,6 +850,101 @@ func TestEnvironment(t *testing.T) {
 				So(tags.Records()[1].Get("Posts").(RecordSet).Collection().Ids(), ShouldHaveLength, 1)
 				So(tags.Records()[1].Get("Posts").(RecordSet).Collection().Ids(), ShouldContain, post2.ids[0])
 			})
+			Convey("Dumping the cache should show pending inserts and dirty fields", func() {
+				userJane.Load()
+				userJane.Set("Nums", 12)
+				newUser := users.Call("Create", FieldMap{
+					"Name":  "Cache Dump User",
+					"Email": "dump@example.com",
+				}).(RecordSet).Collection()
+				dump := env.DumpCache()
+				So(dump, ShouldContainSubstring, fmt.Sprintf("User(%d): pending", newUser.ids[0]))
+				So(dump, ShouldContainSubstring, "name: Cache Dump User")
+				So(dump, ShouldContainSubstring, fmt.Sprintf("User(%d): {", userJane.ids[0]))
+				So(dump, ShouldContainSubstring, "nums: 12")
+				updates := dump[strings.Index(dump, "Scheduled updates:"):]
+				So(updates, ShouldContainSubstring, fmt.Sprintf("User(%d):", userJane.ids[0]))
+				So(updates, ShouldContainSubstring, "nums")
+			})
+			Convey("Invalidating a model should fetch its records again", func() {
+				userJane.Load()
+				So(userJane.Get("Nums"), ShouldEqual, 2)
+				env.Cr().Execute("UPDATE \"user\" SET nums = ? WHERE id = ?", 25, userJane.ids[0])
+				So(userJane.Get("Nums"), ShouldEqual, 2)
+				env.InvalidateModel("User")
+				So(env.cache.data, ShouldNotContainKey, userJane.getFirstCacheRef())
+				So(env.cache.scheduledUpdate, ShouldNotContainKey, userJane.getFirstCacheRef())
+				So(userJane.Get("Nums"), ShouldEqual, 25)
+			})
+			Convey("Invalidating fields should only reload these fields", func() {
+				userJane.Load()
+				name := userJane.Get("Name")
+				env.Cr().Execute("UPDATE \"user\" SET nums = ?, name = ? WHERE id = ?", 26, "Jane Changed", userJane.ids[0])
+				userJane.InvalidateCache("Nums")
+				So(env.cache.checkIfInCache(userJane.model, userJane.ids, []string{"nums"}), ShouldBeFalse)
+				So(env.cache.checkIfInCache(userJane.model, userJane.ids, []string{"name", "email"}), ShouldBeTrue)
+				So(env.cache.get(userJane.model, userJane.ids[0], "name"), ShouldEqual, name)
+				So(userJane.Get("Nums"), ShouldEqual, 26)
+			})
+			Convey("Invalidating fields should flush their pending changes first", func() {
+				userJane.Load()
+				userJane.Set("Nums", 27)
+				userJane.InvalidateCache("Nums")
+				So(userJane.Get("Nums"), ShouldEqual, 27)
+			})
+			Convey("Invalidating a model with pending inserts should panic", func() {
+				users.Call("Create", FieldMap{
+					"Name":  "Pending User",
+					"Email": "pending@example.com",
+				})
+				So(func() { env.InvalidateModel("User") }, ShouldPanic)
+			})
+			Convey("Cache stats should count the cached records", func() {
+				*env.cache = *newCache()
+				So(env.CacheStats(), ShouldResemble, CacheStats{})
+				allUsers := users.SearchAll().Load()
+				stats := env.CacheStats()
+				So(stats.Records, ShouldEqual, allUsers.Len())
+				So(stats.Values, ShouldBeGreaterThan, stats.Records)
+				So(stats.ScheduledInserts, ShouldEqual, 0)
+				So(stats.Bytes, ShouldBeGreaterThan, 0)
+				users.Call("Create", FieldMap{
+					"Name":  "Stats User",
+					"Email": "stats@example.com",
+				})
+				created := env.CacheStats()
+				So(created.Records, ShouldBeGreaterThan, stats.Records)
+				So(created.ScheduledInserts, ShouldBeGreaterThan, 0)
+				So(created.Bytes, ShouldBeGreaterThan, stats.Bytes)
+				env.Flush()
+				So(env.CacheStats().Records, ShouldEqual, created.Records)
+				userJane.Set("Nums", 3)
+				So(env.CacheStats().ScheduledUpdates, ShouldBeGreaterThan, 0)
+			})
+			Convey("Flushing a RecordSet should only write its own changes", func() {
+				user1 := users.Call("Create", FieldMap{
+					"Name":  "Flushed User",
+					"Email": "flushed@example.com",
+				}).(RecordSet).Collection()
+				users.Call("Create", FieldMap{
+					"Name":  "Not Flushed User",
+					"Email": "notflushed@example.com",
+				})
+				userJane.Load()
+				userJane.Set("Nums", 14)
+				user1.Flush()
+				var count int
+				env.Cr().Get(&count, "SELECT COUNT(*) FROM \"user\" WHERE email = ?", "flushed@example.com")
+				So(count, ShouldEqual, 1)
+				env.Cr().Get(&count, "SELECT COUNT(*) FROM \"user\" WHERE email = ?", "notflushed@example.com")
+				So(count, ShouldEqual, 0)
+				So(env.cache.scheduledUpdate, ShouldContainKey, userJane.getFirstCacheRef())
+				userJane.Flush()
+				So(env.cache.scheduledUpdate, ShouldNotContainKey, userJane.getFirstCacheRef())
+				var nums int
+				env.Cr().Get(&nums, "SELECT nums FROM \"user\" WHERE id = ?", userJane.ids[0])
+				So(nums, ShouldEqual, 14)
+			})
 			Convey("Check that computed fields are stored and read in cache", func() {
 				userJane.Load()
 				janeCacheRef := cacheRef{model: users.model, id: userJane.ids[0]}
@@ -195,3 +959,380 @@ func TestEnvironment(t *testing.T) {
 		})
 	})
 }
+
+func BenchmarkRepeatedUpdates(b *testing.B) {
+	for _, prepared := range []bool{true, false} {
+		b.Run(fmt.Sprintf("prepared=%t", prepared), func(b *testing.B) {
+			DBPreparedStatements = prepared
+			defer func() { DBPreparedStatements = false }()
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				users := env.Pool("User")
+				userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com"))
+				userJane.Fetch()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					env.Cr().Execute("UPDATE \"user\" SET nums = ? WHERE id = ?", i, userJane.ids[0])
+				}
+			})
+		})
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	Convey("Testing the transactional outbox", t, func() {
+		topic := "test.outbox"
+		outboxModel := Registry.MustGet("OutboxEvent")
+		topicEvents := func(env Environment) *RecordCollection {
+			return env.Pool("OutboxEvent").Sudo().Search(outboxModel.Field("Topic").Equals(topic))
+		}
+		Reset(func() {
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				topicEvents(env).Call("Unlink")
+			})
+		})
+		Convey("Events emitted in a rolled back transaction should not be stored", func() {
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.EmitEvent(topic, FieldMap{"step": "rolled back"})
+				So(topicEvents(env).Len(), ShouldEqual, 1)
+				panic("rolling back")
+			})
+			So(err, ShouldNotBeNil)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(topicEvents(env).IsEmpty(), ShouldBeTrue)
+			})
+		})
+		Convey("Events emitted in a committed transaction should be relayed once", func() {
+			var eventID int64
+			err := ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				eventID = env.EmitEvent(topic, map[string]int{"id": 1})
+			})
+			So(err, ShouldBeNil)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				events := env.PendingOutboxEvents(100)
+				So(events, ShouldNotBeEmpty)
+				So(events[len(events)-1].ID, ShouldEqual, eventID)
+				So(events[len(events)-1].Payload, ShouldEqual, `{"id":1}`)
+			})
+			var received []OutboxEvent
+			relay := func(event OutboxEvent) error {
+				if event.Topic == topic {
+					received = append(received, event)
+				}
+				return nil
+			}
+			_, err = RelayOutboxEvents(1, relay)
+			So(err, ShouldBeNil)
+			So(received, ShouldHaveLength, 1)
+			So(received[0].ID, ShouldEqual, eventID)
+			_, err = RelayOutboxEvents(10, relay)
+			So(err, ShouldBeNil)
+			So(received, ShouldHaveLength, 1)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(topicEvents(env).Get("Sent"), ShouldBeTrue)
+				So(env.PruneOutboxEvents(-time.Minute), ShouldBeGreaterThanOrEqualTo, 1)
+				So(topicEvents(env).IsEmpty(), ShouldBeTrue)
+			})
+		})
+		Convey("Events that failed to be sent should stay pending", func() {
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.EmitEvent(topic, "first")
+				env.EmitEvent(topic, "second")
+			})
+			errSend := errors.New("unavailable")
+			sent, err := RelayOutboxEvents(10, func(event OutboxEvent) error {
+				if event.Topic == topic && event.Payload == `"second"` {
+					return errSend
+				}
+				return nil
+			})
+			So(err, ShouldEqual, errSend)
+			So(sent, ShouldBeGreaterThanOrEqualTo, 1)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				pending := topicEvents(env).Search(outboxModel.Field("Sent").Equals(false))
+				So(pending.Len(), ShouldEqual, 1)
+				So(pending.Get("Payload"), ShouldEqual, `"second"`)
+			})
+		})
+	})
+}
+
+func TestCronJobs(t *testing.T) {
+	Convey("Testing cron jobs", t, func() {
+		cronTestRuns.reset()
+		method := Registry.MustGet("User").methods.MustGet("RunCronTest")
+		method.AllowGroup(security.GroupEveryone)
+		register := func(name string, delay int64, fail bool, uid int64) {
+			RegisterCronJob(CronJob{
+				Name:     name,
+				Model:    "User",
+				Method:   "RunCronTest",
+				Args:     []interface{}{delay, fail},
+				Schedule: Every(10 * time.Millisecond),
+				UID:      uid,
+			})
+		}
+		Reset(func() {
+			StopCronJobs()
+			cron.Lock()
+			cron.jobs = make(map[string]*CronJob)
+			cron.Unlock()
+			method.RevokeGroup(security.GroupEveryone)
+		})
+		Convey("A job should run as its user", func() {
+			register("test-uid", 0, false, 2)
+			register("test-superuser", 0, false, 0)
+			So(RunCronJob("test-uid"), ShouldBeNil)
+			So(RunCronJob("test-superuser"), ShouldBeNil)
+			uids, _ := cronTestRuns.runs()
+			So(uids, ShouldResemble, []int64{2, security.SuperUserID})
+		})
+		Convey("Overlapping runs of a job should be serialized", func() {
+			register("test-overlap", 100, false, 0)
+			var wg sync.WaitGroup
+			errs := make([]error, 3)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = RunCronJob("test-overlap")
+				}(i)
+			}
+			wg.Wait()
+			So(errs, ShouldResemble, []error{nil, nil, nil})
+			uids, maxRunning := cronTestRuns.runs()
+			So(uids, ShouldHaveLength, 3)
+			So(maxRunning, ShouldEqual, 1)
+		})
+		Convey("Failing jobs should return an error and be run again", func() {
+			register("test-failure", 0, true, 0)
+			So(RunCronJob("test-failure"), ShouldNotBeNil)
+			StartCronJobs()
+			time.Sleep(100 * time.Millisecond)
+			StopCronJobs()
+			uids, _ := cronTestRuns.runs()
+			So(len(uids), ShouldBeGreaterThan, 2)
+		})
+		Convey("Registering a job twice should panic", func() {
+			register("test-twice", 0, false, 0)
+			So(func() { register("test-twice", 0, false, 0) }, ShouldPanic)
+		})
+	})
+}
+
+func TestQueueJobs(t *testing.T) {
+	Convey("Testing the job queue", t, func() {
+		queueModel := Registry.MustGet("QueueJob")
+		userModel := Registry.MustGet("User")
+		var jobIDs []int64
+		Reset(func() {
+			DefaultQueueJobMaxRetries = 3
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("QueueJob").Browse(jobIDs...).Call("Unlink")
+				env.Pool("User").Search(userModel.Field("Email").Equals("queued@example.com")).Call("Unlink")
+			})
+		})
+		Convey("Enqueued method calls should be executed with their arguments", func() {
+			So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				jobIDs = append(jobIDs, env.Pool("User").Enqueue("Create", FieldMap{
+					"Name":  "Queued User",
+					"Email": "queued@example.com",
+					"Nums":  3,
+				}))
+			}), ShouldBeNil)
+			So(RunQueueJobs(10), ShouldBeGreaterThanOrEqualTo, 1)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				user := env.Pool("User").Search(userModel.Field("Email").Equals("queued@example.com"))
+				So(user.Len(), ShouldEqual, 1)
+				So(user.Get("Name"), ShouldEqual, "Queued User")
+				So(user.Get("Nums"), ShouldEqual, 3)
+				jobIDs = append(jobIDs, user.Enqueue("Write", FieldMap{"Nums": 7}))
+				So(env.Pool("QueueJob").Browse(jobIDs[0]).Get("State"), ShouldEqual, QueueJobDone)
+			})
+			So(RunQueueJobs(10), ShouldBeGreaterThanOrEqualTo, 1)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				user := env.Pool("User").Search(userModel.Field("Email").Equals("queued@example.com"))
+				So(user.Get("Nums"), ShouldEqual, 7)
+				So(env.Pool("QueueJob").Browse(jobIDs[1]).Get("State"), ShouldEqual, QueueJobDone)
+			})
+		})
+		Convey("Jobs enqueued in a rolled back transaction should not be executed", func() {
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").Enqueue("Create", FieldMap{"Name": "Queued User", "Email": "queued@example.com"})
+			})
+			RunQueueJobs(10)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				So(env.Pool("User").Search(userModel.Field("Email").Equals("queued@example.com")).IsEmpty(), ShouldBeTrue)
+			})
+		})
+		Convey("Failing jobs should be retried and then marked as failed", func() {
+			DefaultQueueJobMaxRetries = 1
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				jobIDs = append(jobIDs, env.Pool("User").Enqueue("RunCronTest", int64(0), true))
+			})
+			So(RunQueueJobs(10), ShouldEqual, 0)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				job := env.Pool("QueueJob").Browse(jobIDs[0])
+				So(job.Get("State"), ShouldEqual, QueueJobPending)
+				So(job.Get("Attempts"), ShouldEqual, 1)
+				So(job.Get("Error"), ShouldContainSubstring, "Cron test failure")
+			})
+			RunQueueJobs(10)
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				job := env.Pool("QueueJob").Browse(jobIDs[0])
+				So(job.Get("State"), ShouldEqual, QueueJobFailed)
+				So(job.Get("Attempts"), ShouldEqual, 2)
+				So(env.Pool("QueueJob").Search(queueModel.Field("State").Equals(QueueJobPending)).IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestDelayedCalls(t *testing.T) {
+	Convey("Testing delayed method calls", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			userModel := Registry.MustGet("User")
+			userJane := env.Pool("User").Search(userModel.Field("Email").Equals("jane.smith@example.com"))
+			Convey("Delayed calls should be enqueued with their arguments and options", func() {
+				eta := dates.Now().Add(time.Hour)
+				jobID := userJane.WithDelay(DelayOptions{
+					Priority:   5,
+					ETA:        eta,
+					MaxRetries: -1,
+					DedupKey:   "update-jane",
+				}).Call("Write", FieldMap{"Nums": 12})
+				job := env.Pool("QueueJob").Browse(jobID)
+				So(job.Get("ResModel"), ShouldEqual, "User")
+				So(job.Get("ResIDs"), ShouldEqual, fmt.Sprintf("[%d]", userJane.Ids()[0]))
+				So(job.Get("Method"), ShouldEqual, "Write")
+				So(job.Get("Args"), ShouldEqual, `[{"Nums":12}]`)
+				So(job.Get("Priority"), ShouldEqual, 5)
+				So(job.Get("MaxRetries"), ShouldEqual, 0)
+				So(job.Get("DedupKey"), ShouldEqual, "update-jane")
+				So(job.Get("State"), ShouldEqual, QueueJobPending)
+				Convey("Calls with the same dedup key should be coalesced", func() {
+					So(userJane.WithDelay(DelayOptions{DedupKey: "update-jane"}).Call("Write", FieldMap{"Nums": 13}), ShouldEqual, jobID)
+					So(userJane.WithDelay(DelayOptions{DedupKey: "other"}).Call("Write", FieldMap{"Nums": 13}), ShouldNotEqual, jobID)
+				})
+			})
+			Convey("Delayed calls should be validated when enqueued", func() {
+				So(func() { userJane.WithDelay().Call("UnknownMethod") }, ShouldPanic)
+				So(func() { userJane.WithDelay().Call("RunCronTest", int64(0)) }, ShouldPanic)
+				So(func() { userJane.WithDelay().Call("RunCronTest", "slow", true) }, ShouldPanic)
+				So(userJane.WithDelay().Call("RunCronTest", int64(0), true), ShouldBeGreaterThan, 0)
+			})
+		})
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	Convey("Testing write batches", t, func() {
+		SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+			users := env.Pool("User").SearchAll().Fetch()
+			userJane := users.Search(users.Model().Field("Email").Equals("jane.smith@example.com")).Fetch()
+			*env.cache = *newCache()
+			collector := new(testMetricsCollector)
+			SetMetricsCollector(collector)
+			defer SetMetricsCollector(nil)
+			hasUpdateQuery := func() bool {
+				for _, query := range collector.queries {
+					if strings.HasPrefix(query, "UPDATE") {
+						return true
+					}
+				}
+				return false
+			}
+			Convey("Writes should be read back from cache before being flushed", func() {
+				env.WriteBatch(func(env Environment) {
+					users.Set("Nums", 5)
+					for _, rec := range users.Records() {
+						So(rec.Get("Nums"), ShouldEqual, 5)
+					}
+					userJane.Set("Nums", 6)
+					userJane.Set("Name", "Jane Batched")
+					So(userJane.Get("Nums"), ShouldEqual, 6)
+					So(userJane.Get("Name"), ShouldEqual, "Jane Batched")
+					env.WriteBatch(func(env Environment) {
+						userJane.Set("Nums", 7)
+					})
+					So(userJane.Get("Nums"), ShouldEqual, 7)
+					So(hasUpdateQuery(), ShouldBeFalse)
+					So(env.cache.scheduledUpdate, ShouldContainKey, userJane.getFirstCacheRef())
+				})
+				So(hasUpdateQuery(), ShouldBeTrue)
+				So(env.cache.scheduledUpdate, ShouldBeEmpty)
+				So(env.cache.writeBatch, ShouldEqual, 0)
+				var nums int64
+				var name string
+				env.cr.Get(&nums, `SELECT nums FROM "user" WHERE id = ?`, userJane.ids[0])
+				env.cr.Get(&name, `SELECT name FROM "user" WHERE id = ?`, userJane.ids[0])
+				So(nums, ShouldEqual, 7)
+				So(name, ShouldEqual, "Jane Batched")
+				var count int
+				env.cr.Get(&count, `SELECT count(*) FROM "user" WHERE nums = 5`)
+				So(count, ShouldEqual, users.Len()-1)
+			})
+			Convey("Reading other fields should not overwrite batched writes", func() {
+				env.WriteBatch(func(env Environment) {
+					userJane.Set("Nums", 9)
+					So(userJane.Get("Email"), ShouldEqual, "jane.smith@example.com")
+					So(userJane.Get("Nums"), ShouldEqual, 9)
+				})
+				var nums int64
+				env.cr.Get(&nums, `SELECT nums FROM "user" WHERE id = ?`, userJane.ids[0])
+				So(nums, ShouldEqual, 9)
+			})
+			Convey("Writing non existent records in a batch should fail immediately", func() {
+				var err error
+				env.WriteBatch(func(env Environment) {
+					err = TryCall(func() { env.Pool("User").Browse(userJane.ids[0], 999999999).Set("Nums", 3) })
+				})
+				So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+				So(hasUpdateQuery(), ShouldBeFalse)
+			})
+			Convey("Writes outside of a batch should not be deferred for records not in cache", func() {
+				userJane.Set("Nums", 8)
+				So(hasUpdateQuery(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestQueryInterceptors(t *testing.T) {
+	Convey("Testing query interceptors", t, func() {
+		collector := new(testMetricsCollector)
+		SetMetricsCollector(collector)
+		defer SetMetricsCollector(nil)
+		defer func() { queryInterceptors = nil }()
+		RegisterQueryInterceptor(func(query string, args []interface{}) string {
+			return "/* app=hexya-test */ " + query
+		})
+		Convey("A tagging interceptor should prepend its comment to executed SQL", func() {
+			var count int
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				count = env.Pool("User").SearchAll().SearchCount()
+				env.Pool("Tag").Call("Create", FieldMap{"Name": "Intercepted"})
+				env.Flush()
+			})
+			So(count, ShouldBeGreaterThan, 0)
+			So(collector.queries, ShouldNotBeEmpty)
+			for _, query := range collector.queries {
+				So(query, ShouldStartWith, "/* app=hexya-test */ ")
+			}
+		})
+		Convey("Interceptors should be called in registration order", func() {
+			RegisterQueryInterceptor(func(query string, args []interface{}) string {
+				return "/* second */ " + query
+			})
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				env.Pool("User").SearchAll().SearchCount()
+			})
+			So(collector.queries, ShouldNotBeEmpty)
+			So(collector.queries[len(collector.queries)-1], ShouldStartWith, "/* second */ /* app=hexya-test */ ")
+		})
+		Convey("Comments should not hide the verb of a query", func() {
+			So(queryVerb("/* app=hexya-test */ CREATE TABLE foo (id int)"), ShouldEqual, "CREATE")
+			So(queryVerb(" /* a */ /* b */ select 1"), ShouldEqual, "SELECT")
+			So(queryVerb("/* unterminated"), ShouldEqual, "")
+		})
+	})
+}
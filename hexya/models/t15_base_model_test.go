@@ -116,6 +116,27 @@ func TestBaseModelMethods(t *testing.T) {
 				So(browsedUser.Ids(), ShouldHaveLength, 1)
 				So(browsedUser.Ids(), ShouldContain, userJane.Ids()[0])
 			})
+			Convey("Browse with ids should not query the database", func() {
+				allUsers := env.Pool("User").SearchAll()
+				ids := allUsers.Ids()
+				emails := make([]string, len(ids))
+				for i, rec := range allUsers.Records() {
+					emails[i] = rec.Get("Email").(string)
+				}
+				env2 := newEnvironment(security.SuperUserID)
+				defer env2.rollback()
+				collector := new(testMetricsCollector)
+				SetMetricsCollector(collector)
+				browsedUsers := env2.Pool("User").Browse(ids...)
+				envBrowsedUser := env2.Browse("User", ids[0])
+				SetMetricsCollector(nil)
+				So(collector.started, ShouldEqual, 0)
+				So(browsedUsers.Ids(), ShouldResemble, ids)
+				for i, rec := range browsedUsers.Records() {
+					So(rec.Get("Email"), ShouldEqual, emails[i])
+				}
+				So(envBrowsedUser.Get("Email"), ShouldEqual, emails[0])
+			})
 			Convey("Equals", func() {
 				browsedUser := env.Pool("User").Call("Browse", []int64{userJane.Ids()[0]}).(RecordSet).Collection()
 				So(browsedUser.Call("Equals", userJane), ShouldBeTrue)
@@ -127,6 +148,21 @@ func TestBaseModelMethods(t *testing.T) {
 					Field("Name").Like("J% Smith")).(RecordSet).Collection()
 				So(usersJ.Records(), ShouldHaveLength, 2)
 				So(usersJ.Equals(johnAndJane), ShouldBeTrue)
+				janeAndJohn := env.Pool("User").Browse(userJane.Ids()[0], userJohn.Ids()[0])
+				So(johnAndJane.Equals(janeAndJohn), ShouldBeTrue)
+				So(janeAndJohn.Equals(userJane), ShouldBeFalse)
+				post := env.Pool("Post").Browse(userJane.Ids()[0])
+				So(post.Equals(userJane), ShouldBeFalse)
+			})
+			Convey("Hash", func() {
+				userJohn := env.Pool("User").Call("Search", env.Pool("User").Model().
+					Field("Name").Equals("John Smith")).(RecordSet).Collection()
+				johnAndJane := env.Pool("User").Browse(userJohn.Ids()[0], userJane.Ids()[0])
+				janeAndJohn := env.Pool("User").Browse(userJane.Ids()[0], userJohn.Ids()[0])
+				So(johnAndJane.Hash(), ShouldEqual, janeAndJohn.Hash())
+				So(johnAndJane.Call("Hash"), ShouldEqual, janeAndJohn.Hash())
+				So(userJane.Hash(), ShouldNotEqual, johnAndJane.Hash())
+				So(env.Pool("Post").Browse(userJane.Ids()[0]).Hash(), ShouldNotEqual, userJane.Hash())
 			})
 			Convey("Subtract", func() {
 				userJohn := env.Pool("User").Call("Search", env.Pool("User").Model().
@@ -135,6 +171,29 @@ func TestBaseModelMethods(t *testing.T) {
 				So(johnAndJane.Subtract(userJane).Equals(userJohn), ShouldBeTrue)
 				So(johnAndJane.Subtract(userJohn).Equals(userJane), ShouldBeTrue)
 			})
+			Convey("AddIds and SubtractIds", func() {
+				userJohn := env.Pool("User").Call("Search", env.Pool("User").Model().
+					Field("Name").Equals("John Smith")).(RecordSet).Collection()
+				johnAndJane := userJohn.AddIds(userJane.Ids()[0])
+				So(johnAndJane.Equals(userJohn.Union(userJane)), ShouldBeTrue)
+				So(johnAndJane.AddIds(userJane.Ids()[0], userJohn.Ids()[0]).Ids(), ShouldResemble, johnAndJane.Ids())
+				So(johnAndJane.SubtractIds(userJane.Ids()[0]).Equals(userJohn), ShouldBeTrue)
+				So(userJohn.SubtractIds(userJane.Ids()[0]).Equals(userJohn), ShouldBeTrue)
+				So(userJohn.SubtractIds(userJohn.Ids()[0]).IsEmpty(), ShouldBeTrue)
+				So(johnAndJane.Call("SubtractIds", []int64{userJohn.Ids()[0]}).(RecordSet).Collection().Equals(userJane), ShouldBeTrue)
+				So(userJohn.Ids(), ShouldHaveLength, 1)
+			})
+			Convey("IsEmpty and Len", func() {
+				users := env.Pool("User")
+				So(users.IsEmpty(), ShouldBeTrue)
+				So(users.Len(), ShouldEqual, 0)
+				So(userJane.IsEmpty(), ShouldBeFalse)
+				So(userJane.Len(), ShouldEqual, 1)
+				usersJ := users.Search(users.Model().Field("Name").Like("J% Smith"))
+				So(usersJ.Len(), ShouldEqual, 2)
+				So(usersJ.IsEmpty(), ShouldBeFalse)
+				So(users.Search(users.Model().Field("Name").Equals("Nobody")).IsEmpty(), ShouldBeTrue)
+			})
 			Convey("Intersect", func() {
 				userJohn := env.Pool("User").Call("Search", env.Pool("User").Model().
 					Field("Name").Equals("John Smith")).(RecordSet).Collection()
@@ -210,3 +269,45 @@ func TestBaseModelMethods(t *testing.T) {
 		})
 	})
 }
+
+func TestStoreComputedField(t *testing.T) {
+	Convey("Testing StoreComputedField", t, func() {
+		placeModel := Registry.MustGet("Place")
+		adapter := adapters[db.DriverName()]
+		var placeID int64
+		So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+			placeID = placeModel.Create(env, FieldMap{"City": "Paris", "Country": "France"}).Ids()[0]
+		}), ShouldBeNil)
+		Reset(func() {
+			ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+				placeModel.Browse(env, []int64{placeID}).Call("Unlink")
+			})
+		})
+		Convey("Location should not be stored yet", func() {
+			So(adapter.columns(placeModel.tableName), ShouldNotContainKey, "location")
+		})
+		Convey("Storing Location should back-fill existing records", func() {
+			So(placeModel.StoreComputedField("Location"), ShouldBeNil)
+			So(adapter.columns(placeModel.tableName), ShouldContainKey, "location")
+			var location string
+			dbGetNoTx(&location, "SELECT location FROM place WHERE id = ?", placeID)
+			So(location, ShouldEqual, "Paris, France")
+			Convey("Running it again should be harmless", func() {
+				So(placeModel.StoreComputedField("Location"), ShouldBeNil)
+				dbGetNoTx(&location, "SELECT location FROM place WHERE id = ?", placeID)
+				So(location, ShouldEqual, "Paris, France")
+			})
+			Convey("Subsequent writes should persist the computed value", func() {
+				So(ExecuteInNewEnvironment(security.SuperUserID, func(env Environment) {
+					placeModel.Browse(env, []int64{placeID}).Set("City", "Lyon")
+				}), ShouldBeNil)
+				dbGetNoTx(&location, "SELECT location FROM place WHERE id = ?", placeID)
+				So(location, ShouldEqual, "Lyon, France")
+			})
+		})
+		Convey("Storing a non computed field should fail", func() {
+			So(placeModel.StoreComputedField("City"), ShouldNotBeNil)
+			So(placeModel.StoreComputedField("Unknown"), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGraphQLParser(t *testing.T) {
+	Convey("Testing GraphQL parsing", t, func() {
+		Convey("Parsing a query with aliases, arguments and nested selections", func() {
+			op, err := parseGraphQL(`{
+				first: tag(id: "3") { id name }
+				# comment
+				searchTag(domain: "[]", first: 2) { edges { node { name } } }
+			}`)
+			So(err, ShouldBeNil)
+			So(op.kind, ShouldEqual, "query")
+			So(op.selections, ShouldHaveLength, 2)
+			So(op.selections[0].alias, ShouldEqual, "first")
+			So(op.selections[0].name, ShouldEqual, "tag")
+			So(op.selections[0].args["id"], ShouldEqual, "3")
+			So(op.selections[0].selections, ShouldHaveLength, 2)
+			So(op.selections[1].args["first"], ShouldEqual, int64(2))
+			So(op.selections[1].selections[0].selections[0].selections[0].name, ShouldEqual, "name")
+		})
+		Convey("Parsing a mutation with variables and input objects", func() {
+			op, err := parseGraphQL(`mutation CreateTag($rate: Float = 2.5, $ids: [ID!]) {
+				createTag(values: {name: "Foo", rate: $rate, posts: $ids, parent: null}) { id }
+			}`)
+			So(err, ShouldBeNil)
+			So(op.kind, ShouldEqual, "mutation")
+			So(op.defaults, ShouldContainKey, "rate")
+			So(op.defaults["rate"], ShouldEqual, 2.5)
+			values := op.selections[0].args["values"].(map[string]interface{})
+			So(values["name"], ShouldEqual, "Foo")
+			So(values["rate"], ShouldEqual, gqlVariable("rate"))
+			So(values["posts"], ShouldEqual, gqlVariable("ids"))
+			So(values["parent"], ShouldBeNil)
+		})
+		Convey("Parsing invalid queries should fail", func() {
+			_, err := parseGraphQL(`{ tag(id: 1) { id }`)
+			So(err, ShouldNotBeNil)
+			_, err = parseGraphQL(`subscription { tag }`)
+			So(err, ShouldNotBeNil)
+			_, err = parseGraphQL(`{ tag(name: "foo) { id } }`)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestGraphQL(t *testing.T) {
+	Convey("Testing GraphQL schema and execution", t, func() {
+		Convey("Models should be exposed as GraphQL types", func() {
+			schema := GraphQLSchema()
+			So(schema, ShouldContainSubstring, "type Tag {\n  id: ID!\n")
+			So(schema, ShouldContainSubstring, "  bestPost: Post\n")
+			So(schema, ShouldContainSubstring, "  posts: [Post!]!\n")
+			So(schema, ShouldContainSubstring, "  rate: Float\n")
+			So(schema, ShouldContainSubstring, "input TagInput {")
+			So(schema, ShouldContainSubstring, "type TagConnection {")
+			So(schema, ShouldContainSubstring, "  searchTag(domain: String, order: String, first: Int, after: String): TagConnection!")
+			So(schema, ShouldContainSubstring, "  createTag(values: TagInput!): Tag!")
+			So(schema, ShouldContainSubstring, "  unlinkTag(id: ID!): Boolean!")
+			So(schema, ShouldNotContainSubstring, "type CommonMixin {")
+			So(schema, ShouldNotContainSubstring, "type SavedSearch {")
+		})
+		Convey("Creating, querying and deleting a record", func() {
+			res := ExecuteGraphQL(security.SuperUserID, `mutation ($desc: String) {
+				tag: createTag(values: {name: "GraphQL", description: $desc, rate: 7.5}) { id name rate parent { id } posts { id } }
+			}`, map[string]interface{}{"desc": "Query language"})
+			So(res.Errors, ShouldBeEmpty)
+			tag := res.Data["tag"].(map[string]interface{})
+			So(tag["name"], ShouldEqual, "GraphQL")
+			So(tag["rate"], ShouldEqual, float32(7.5))
+			So(tag["parent"], ShouldBeNil)
+			So(tag["posts"], ShouldNotBeNil)
+			So(tag["posts"], ShouldBeEmpty)
+			tagID := tag["id"].(int64)
+			So(tagID, ShouldBeGreaterThan, 0)
+
+			res = ExecuteGraphQL(security.SuperUserID, `{
+				searchTag(domain: "[[\"name\", \"=\", \"GraphQL\"]]", first: 1) {
+					totalCount
+					edges { cursor node { id description } }
+					pageInfo { hasNextPage hasPreviousPage endCursor }
+				}
+			}`, nil)
+			So(res.Errors, ShouldBeEmpty)
+			conn := res.Data["searchTag"].(map[string]interface{})
+			So(conn["totalCount"], ShouldEqual, 1)
+			edges := conn["edges"].([]interface{})
+			So(edges, ShouldHaveLength, 1)
+			node := edges[0].(map[string]interface{})["node"].(map[string]interface{})
+			So(node["id"], ShouldEqual, tagID)
+			So(node["description"], ShouldEqual, "Query language")
+			pageInfo := conn["pageInfo"].(map[string]interface{})
+			So(pageInfo["hasNextPage"], ShouldBeFalse)
+			So(pageInfo["hasPreviousPage"], ShouldBeFalse)
+			So(pageInfo["endCursor"], ShouldEqual, edges[0].(map[string]interface{})["cursor"])
+
+			maxLimit := MaxLimit
+			MaxLimit = 1
+			res = ExecuteGraphQL(security.SuperUserID, `{
+				searchTag(domain: "[]") {
+					edges { node { id } }
+					pageInfo { hasNextPage }
+				}
+			}`, nil)
+			MaxLimit = maxLimit
+			So(res.Errors, ShouldBeEmpty)
+			conn = res.Data["searchTag"].(map[string]interface{})
+			So(conn["edges"], ShouldHaveLength, 1)
+			So(conn["pageInfo"].(map[string]interface{})["hasNextPage"], ShouldBeTrue)
+
+			res = ExecuteGraphQL(security.SuperUserID, `mutation { unlinkTag(id: $id) }`,
+				map[string]interface{}{"id": tagID})
+			So(res.Errors, ShouldBeEmpty)
+			So(res.Data["unlinkTag"], ShouldBeTrue)
+		})
+		Convey("Errors should be returned in the response", func() {
+			res := ExecuteGraphQL(security.SuperUserID, `mutation {
+				createTag(values: {name: "Same", description: "Same"}) { id }
+			}`, nil)
+			So(res.Data, ShouldBeNil)
+			So(res.Errors, ShouldHaveLength, 1)
+			res = ExecuteGraphQL(security.SuperUserID, `{ unknownField { id } }`, nil)
+			So(res.Errors, ShouldHaveLength, 1)
+			res = ExecuteGraphQL(security.SuperUserID, `{ tag(id: 1) { id }`, nil)
+			So(res.Errors, ShouldHaveLength, 1)
+			res = ExecuteGraphQL(security.SuperUserID, `mutation {
+				createTag(values: {name: "Bad Selection", description: "Unknown field"}) { id unknownField }
+			}`, nil)
+			So(res.Errors, ShouldHaveLength, 1)
+			So(res.Errors[0].Message, ShouldContainSubstring, "Unknown field in selection")
+		})
+	})
+}
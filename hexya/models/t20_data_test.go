@@ -4,6 +4,9 @@
 package models
 
 import (
+	"errors"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/hexya-erp/hexya/hexya/models/security"
@@ -117,3 +120,51 @@ func TestDataLoading(t *testing.T) {
 		})
 	})
 }
+
+func TestLoadData(t *testing.T) {
+	Convey("Testing YAML and JSON data loading", t, func() {
+		Convey("Two records referencing each other should be loaded", func() {
+			file, err := os.Open("testdata/Tags.yaml")
+			So(err, ShouldBeNil)
+			defer file.Close()
+			So(LoadData(file, "yaml"), ShouldBeNil)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				tagA := tags.Search(tags.Model().Field("HexyaExternalID").Equals("tag_fixture_a"))
+				tagB := tags.Search(tags.Model().Field("HexyaExternalID").Equals("tag_fixture_b"))
+				So(tagA.Len(), ShouldEqual, 1)
+				So(tagB.Len(), ShouldEqual, 1)
+				So(tagA.Get("Name"), ShouldEqual, "Fixture A")
+				So(tagA.Get("Rate"), ShouldEqual, 2)
+				So(tagA.Get("Parent").(RecordSet).Collection().Equals(tagB), ShouldBeTrue)
+				categories := env.Pool("Category")
+				categoryA := categories.Search(categories.Model().Field("HexyaExternalID").Equals("category_fixture_a"))
+				categoryB := categories.Search(categories.Model().Field("HexyaExternalID").Equals("category_fixture_b"))
+				So(categoryA.Get("RelatedCategories").(RecordSet).Collection().Equals(categoryB), ShouldBeTrue)
+				So(categoryB.Get("RelatedCategories").(RecordSet).Collection().Equals(categoryA), ShouldBeTrue)
+			})
+		})
+		Convey("Loading JSON data should update existing records", func() {
+			data := `[{"model": "Tag", "id": "tag_fixture_a", "values": {"Name": "Fixture A (updated)", "Parent": null}}]`
+			So(LoadData(strings.NewReader(data), "json"), ShouldBeNil)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				tagA := tags.Search(tags.Model().Field("HexyaExternalID").Equals("tag_fixture_a"))
+				So(tagA.Len(), ShouldEqual, 1)
+				So(tagA.Get("Name"), ShouldEqual, "Fixture A (updated)")
+				So(tagA.Get("Parent").(RecordSet).IsEmpty(), ShouldBeTrue)
+			})
+		})
+		Convey("Invalid data should not be loaded", func() {
+			So(LoadData(strings.NewReader("[]"), "xml"), ShouldNotBeNil)
+			So(LoadData(strings.NewReader("{"), "json"), ShouldNotBeNil)
+			data := `[{"model": "Tag", "id": "tag_fixture_c", "values": {"Name": "Fixture C", "Parent": "tag_unknown"}}]`
+			err := LoadData(strings.NewReader(data), "json")
+			So(errors.Is(err, ErrRecordNotFound), ShouldBeTrue)
+			SimulateInNewEnvironment(security.SuperUserID, func(env Environment) {
+				tags := env.Pool("Tag")
+				So(tags.Search(tags.Model().Field("HexyaExternalID").Equals("tag_fixture_c")).IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
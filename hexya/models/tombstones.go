@@ -0,0 +1,107 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"time"
+
+	"github.com/hexya-erp/hexya/hexya/models/security"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// A Tombstone records the deletion of a record of a model
+// declared with LogDeletions.
+type Tombstone struct {
+	Model string
+	ID    int64
+	UID   int64
+	Date  dates.DateTime
+}
+
+// declareTombstoneModel creates the Tombstone model which stores the
+// deletions of the records of the models declared with LogDeletions.
+func declareTombstoneModel() {
+	tombstone := createModel("Tombstone", SystemModel)
+	tombstone.InheritModel(Registry.MustGet("CommonMixin"))
+	tombstone.AddFields(map[string]FieldDefinition{
+		"ResModel": CharField{Required: true, Index: true},
+		"ResID":    IntegerField{Required: true},
+		"UID":      IntegerField{},
+		"Date":     DateTimeField{Index: true},
+	})
+	tombstone.SetDefaultOrder("Date", "id")
+}
+
+// LogDeletions makes Unlink keep a Tombstone of each deleted record of this
+// model, so that sync consumers can get them with DeletionsSince.
+//
+// Records deleted by the database through an ON DELETE CASCADE foreign key
+// are not logged.
+func (m *Model) LogDeletions() {
+	m.logDeletions = true
+}
+
+// logDeletions creates a Tombstone for each of the given ids of deleted
+// records of the given model, if the model is declared with LogDeletions.
+//
+// The records are inserted directly in the database, as the tracking values,
+// with a single query for a batch of ids.
+func (env Environment) logDeletions(mi *Model, ids []int64) {
+	if !mi.logDeletions || len(ids) == 0 {
+		return
+	}
+	now := dates.Now()
+	rows := make([]FieldMap, len(ids))
+	for i, id := range ids {
+		rows[i] = FieldMap{
+			"ResModel": mi.name,
+			"ResID":    id,
+			"UID":      env.uid,
+			"Date":     now,
+		}
+	}
+	env.insertRows("Tombstone", rows)
+}
+
+// DeletionsSince returns the Tombstones of the records of this RecordCollection's
+// model that have been deleted after t, ordered by deletion time.
+//
+// Combined with ChangesSince, it gives the complete delta of a model since t.
+// The model must be declared with LogDeletions for deletions to be logged.
+func (rc *RecordCollection) DeletionsSince(t time.Time) []Tombstone {
+	rc.checkModelAccess(security.Read)
+	tombstoneModel := Registry.MustGet("Tombstone")
+	tombstones := rc.env.Pool("Tombstone").Sudo().Search(
+		tombstoneModel.Field("ResModel").Equals(rc.model.name).
+			And().Field("Date").Greater(dates.DateTime{Time: t}))
+	var res []Tombstone
+	for _, rec := range tombstones.Records() {
+		res = append(res, Tombstone{
+			Model: rc.model.name,
+			ID:    rec.Get("ResID").(int64),
+			UID:   rec.Get("UID").(int64),
+			Date:  rec.Get("Date").(dates.DateTime),
+		})
+	}
+	return res
+}
+
+// PruneTombstones deletes the Tombstones that are older than the given age
+// and returns the number of deleted Tombstones.
+func (env Environment) PruneTombstones(age time.Duration) int64 {
+	tombstoneModel := Registry.MustGet("Tombstone")
+	limit := dates.DateTime{Time: time.Now().Add(-age)}
+	return env.Pool("Tombstone").Sudo().Search(tombstoneModel.Field("Date").Lower(limit)).Call("Unlink").(int64)
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hexya-erp/hexya/hexya/models/fieldtype"
+	"github.com/hexya-erp/hexya/hexya/models/types/dates"
+)
+
+// declareTrackingModel creates the TrackingValue model which stores the
+// history of the changes of the fields declared with Tracking.
+func declareTrackingModel() {
+	tracking := createModel("TrackingValue", SystemModel)
+	tracking.InheritModel(Registry.MustGet("CommonMixin"))
+	tracking.AddFields(map[string]FieldDefinition{
+		"ResModel": CharField{Required: true, Index: true},
+		"ResID":    IntegerField{Required: true, Index: true},
+		"Field":    CharField{Required: true},
+		"OldValue": TextField{},
+		"NewValue": TextField{},
+		"UID":      IntegerField{},
+		"Date":     DateTimeField{},
+	})
+	tracking.SetDefaultOrder("Date", "id")
+}
+
+// trackedFields returns the fields declared with Tracking among
+// the given field names of this model.
+func (m *Model) trackedFields(fieldNames []string) []*Field {
+	var res []*Field
+	for _, f := range fieldNames {
+		fi, ok := m.fields.Get(f)
+		if !ok || !fi.tracking || !fi.isStored() {
+			continue
+		}
+		res = append(res, fi)
+	}
+	return res
+}
+
+// trackedValues returns the values in the database of the given fields for the
+// records of the given model with the given ids. The result is indexed by id.
+func (env Environment) trackedValues(mi *Model, ids []int64, fields []*Field) map[int64]FieldMap {
+	adapter := adapters[db.DriverName()]
+	cols := []string{"id"}
+	for _, fi := range fields {
+		cols = append(cols, fi.json)
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE id IN (?)`, strings.Join(cols, ", "), adapter.quoteTableName(mi.tableName))
+	rows := env.cr.query(query, ids)
+	defer rows.Close()
+	res := make(map[int64]FieldMap)
+	for rows.Next() {
+		line := make(FieldMap)
+		if err := mi.scanToFieldMap(rows, &line); err != nil {
+			log.Panic(err.Error(), "model", mi.name, "fields", cols)
+		}
+		res[line["id"].(int64)] = line
+	}
+	return res
+}
+
+// logTrackingValues creates a TrackingValue record for each of the given
+// fields whose value differs between oldValues and newValues, for each record
+// of the given model whose old values are in oldValues.
+//
+// The records are inserted directly in the database with a single query since
+// this method is called while the cache is being flushed. The display names
+// of the related records are fetched once per related model beforehand.
+func (env Environment) logTrackingValues(mi *Model, fields []*Field, oldValues map[int64]FieldMap, newValues FieldMap) {
+	ids := make([]int64, 0, len(oldValues))
+	for id := range oldValues {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	names := env.trackingDisplayNames(fields, oldValues, newValues)
+	var rows []FieldMap
+	for _, id := range ids {
+		for _, fi := range fields {
+			newValue, ok := newValues[fi.json]
+			if !ok {
+				continue
+			}
+			oldValue := oldValues[id][fi.json]
+			oldLabel := trackingLabel(fi, oldValue, names)
+			newLabel := trackingLabel(fi, newValue, names)
+			if fi.fieldType.IsFKRelationType() {
+				if sameIds(relationValueIds(oldValue), relationValueIds(newValue)) {
+					continue
+				}
+			} else if oldLabel == newLabel {
+				continue
+			}
+			rows = append(rows, FieldMap{
+				"ResModel": mi.name,
+				"ResID":    id,
+				"Field":    fi.name,
+				"OldValue": oldLabel,
+				"NewValue": newLabel,
+				"UID":      env.uid,
+				"Date":     dates.Now(),
+			})
+		}
+	}
+	env.insertRows("TrackingValue", rows)
+}
+
+// trackingDisplayNames returns the display names of all the records referenced
+// by the given relation fields in oldValues and newValues, indexed by related
+// model name and id. Display names are fetched with a single call per related
+// model, and are read from the cache when they are already there.
+func (env Environment) trackingDisplayNames(fields []*Field, oldValues map[int64]FieldMap, newValues FieldMap) map[string]map[int64]string {
+	relIds := make(map[string]map[int64]bool)
+	addIds := func(modelName string, value interface{}) {
+		if relIds[modelName] == nil {
+			relIds[modelName] = make(map[int64]bool)
+		}
+		for _, id := range relationValueIds(value) {
+			relIds[modelName][id] = true
+		}
+	}
+	for _, fi := range fields {
+		if !fi.fieldType.IsFKRelationType() {
+			continue
+		}
+		newValue, ok := newValues[fi.json]
+		if !ok {
+			continue
+		}
+		addIds(fi.relatedModelName, newValue)
+		for _, old := range oldValues {
+			addIds(fi.relatedModelName, old[fi.json])
+		}
+	}
+	res := make(map[string]map[int64]string)
+	for modelName, idSet := range relIds {
+		ids := make([]int64, 0, len(idSet))
+		for id := range idSet {
+			ids = append(ids, id)
+		}
+		res[modelName] = env.Pool(modelName).Sudo().Browse(ids...).DisplayNames()
+	}
+	return res
+}
+
+// trackingLabel returns the human readable representation of the given value
+// of the given field. Relation fields are represented by the display name of
+// the related record taken from names and selection fields by the label of
+// the value.
+func trackingLabel(fi *Field, value interface{}, names map[string]map[int64]string) string {
+	switch {
+	case value == nil:
+		return ""
+	case fi.fieldType.IsFKRelationType():
+		ids := relationValueIds(value)
+		if len(ids) == 0 {
+			return ""
+		}
+		return names[fi.relatedModelName][ids[0]]
+	case fi.fieldType == fieldtype.Selection:
+		if label, ok := fi.selection[fmt.Sprintf("%v", value)]; ok {
+			return label
+		}
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -219,6 +219,26 @@ type FieldNamer interface {
 	FieldName() FieldName
 }
 
+// GroupCount is the name of the pseudo field holding the number of records
+// of a group in the conditions given to Having.
+const GroupCount = "__count"
+
+// A NullPolicy defines how the null values of scalar fields are returned
+// when records are read into FieldMaps.
+type NullPolicy uint8
+
+const (
+	// NullAsZero returns null values as the zero value of the field's
+	// type, such as 0, "", false or a zero date.
+	NullAsZero NullPolicy = iota + 1
+	// NullAsNil returns null values as nil.
+	NullAsNil
+)
+
+// DefaultNullPolicy is the NullPolicy of RecordCollections that have not
+// been given one with WithNullPolicy.
+var DefaultNullPolicy = NullAsZero
+
 // A GroupAggregateRow holds a row of results of a query with a group by clause
 // - Values holds the values of the actual query
 // - Count is the number of lines aggregated into this one
@@ -227,6 +247,18 @@ type GroupAggregateRow struct {
 	Values    FieldMap
 	Count     int
 	Condition *Condition
+	pool      *RecordCollection
+}
+
+// Records returns the records aggregated into this row, searched with the
+// row's Condition. Grouped queries do not load the records of their groups:
+// they are only loaded from the database when the returned RecordCollection
+// is accessed, so that groups can be expanded on demand.
+func (gar GroupAggregateRow) Records() *RecordCollection {
+	if gar.pool == nil {
+		log.Panic("GroupAggregateRow does not come from a grouped query")
+	}
+	return gar.pool.Search(gar.Condition)
 }
 
 // A FieldMapper is an object that can convert itself into a FieldMap
@@ -17,6 +17,7 @@ package models
 import (
 	"errors"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -140,7 +141,26 @@ func jsonizePath(mi *Model, path string) string {
 }
 
 // MapToStruct populates the given structPtr with the values in fMap.
+//
+// Relation fields of structPtr can be RecordSets, or pointers to structs (or
+// slices of pointers to structs for one2many and many2many fields) which are
+// then hydrated with the fields of the related records, recursively. Fields of
+// nested structs that are not fields of the related model are left untouched.
+// Related records are loaded if they are not in the cache. A record that is already
+// being hydrated higher in the struct tree is not hydrated again, so that
+// circular relations end with a nil pointer.
 func MapToStruct(rc *RecordCollection, structPtr interface{}, fMap FieldMap) {
+	visited := make(map[cacheRef]bool)
+	if id, ok := fMap.JSONized(rc.model)["id"].(int64); ok {
+		visited[rc.model.toRef(id)] = true
+	}
+	mapToStruct(rc, structPtr, fMap, visited, false)
+}
+
+// mapToStruct populates the given structPtr with the values in fMap. visited
+// holds the records being hydrated in the calling structs. If nested is true,
+// fields of structPtr that are not fields of the model are left untouched.
+func mapToStruct(rc *RecordCollection, structPtr interface{}, fMap FieldMap, visited map[cacheRef]bool, nested bool) {
 	fMap = fMap.JSONized(rc.model)
 	fMap = nestMap(fMap)
 	rc.model.convertValuesToFieldType(&fMap)
@@ -154,6 +174,9 @@ func MapToStruct(rc *RecordCollection, structPtr interface{}, fMap FieldMap) {
 		sf := ind.Type().Field(i)
 		fi, ok := rc.model.fields.Get(sf.Name)
 		if !ok {
+			if nested {
+				continue
+			}
 			log.Panic("Unregistered field in model", "field", sf.Name, "model", rc.ModelName())
 		}
 
@@ -180,6 +203,10 @@ func MapToStruct(rc *RecordCollection, structPtr interface{}, fMap FieldMap) {
 			fVal.Set(convertedValue)
 			continue
 		}
+		if fi.isRelationField() && hydratedStructType(sf.Type) != nil {
+			hydrateRelation(rc, fVal, fi, mValue, visited)
+			continue
+		}
 		if mValExists && mValue != nil {
 			convertedValue = reflect.ValueOf(mValue).Convert(fVal.Type())
 			fVal.Set(convertedValue)
@@ -187,6 +214,80 @@ func MapToStruct(rc *RecordCollection, structPtr interface{}, fMap FieldMap) {
 	}
 }
 
+// hydratedStructType returns the struct type of the records hydrated into a
+// struct field of type typ, i.e. a pointer to a struct or a slice of pointers
+// to structs. It returns nil if typ is not such a type or is a RecordSet.
+func hydratedStructType(typ reflect.Type) reflect.Type {
+	if typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct ||
+		typ.Implements(reflect.TypeOf((*RecordSet)(nil)).Elem()) {
+		return nil
+	}
+	return typ.Elem()
+}
+
+// modelStructFieldNames returns the names of the fields of the given
+// struct type that are fields of the given model.
+func modelStructFieldNames(mi *Model, typ reflect.Type) []string {
+	var res []string
+	for i := 0; i < typ.NumField(); i++ {
+		if _, ok := mi.fields.Get(typ.Field(i).Name); ok {
+			res = append(res, typ.Field(i).Name)
+		}
+	}
+	return res
+}
+
+// relationIds returns the ids of the given cached value of a relation field
+func relationIds(value interface{}) []int64 {
+	switch v := value.(type) {
+	case int64:
+		if v != 0 {
+			return []int64{v}
+		}
+	case []int64:
+		return v
+	}
+	return nil
+}
+
+// hydrateRelation sets fVal, a struct field for the relation field fi, to
+// pointers to structs populated with the records whose ids are given by the
+// cached value mValue.
+func hydrateRelation(rc *RecordCollection, fVal reflect.Value, fi *Field, mValue interface{}, visited map[cacheRef]bool) {
+	structType := hydratedStructType(fVal.Type())
+	relRC := rc.env.Pool(fi.relatedModelName).Browse(relationIds(mValue)...)
+	fields := modelStructFieldNames(relRC.model, structType)
+	if !rc.env.cache.checkIfInCache(relRC.model, relRC.ids, fields) {
+		relRC.Load(fields...)
+	}
+	var ptrs []reflect.Value
+	for _, id := range relRC.ids {
+		ref := relRC.model.toRef(id)
+		if visited[ref] {
+			continue
+		}
+		visited[ref] = true
+		ptr := reflect.New(structType)
+		mapToStruct(relRC, ptr.Interface(), rc.env.cache.getRecord(relRC.model, id), visited, true)
+		delete(visited, ref)
+		ptrs = append(ptrs, ptr)
+	}
+	if fVal.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(fVal.Type(), len(ptrs), len(ptrs))
+		for i, ptr := range ptrs {
+			slice.Index(i).Set(ptr)
+		}
+		fVal.Set(slice)
+		return
+	}
+	if len(ptrs) > 0 {
+		fVal.Set(ptrs[0])
+	}
+}
+
 // nestMap returns a nested FieldMap from a flat FieldMap with dotted
 // field names. nestMap is lazy and only nests the first level.
 func nestMap(fMap FieldMap) FieldMap {
@@ -246,17 +347,39 @@ func filterOnDBFields(mi *Model, fields []string, dontAddID ...bool) []string {
 }
 
 // filterMapOnStoredFields returns a new FieldMap from fMap
-// with only stored fields keys.
+// with only stored fields keys. Fields generated by the
+// database are left out since they cannot be written.
 func filterMapOnStoredFields(mi *Model, fMap FieldMap) FieldMap {
 	newFMap := make(FieldMap)
 	for field, value := range fMap {
-		if fi := mi.getRelatedFieldInfo(field); fi.isStored() {
+		if fi := mi.getRelatedFieldInfo(field); fi.isStored() && !fi.sqlGenerated {
 			newFMap[field] = value
 		}
 	}
 	return newFMap
 }
 
+// sortedFieldMapKeys returns the keys of the given FieldMap sorted by
+// the JSON name of their field in the given model, so that queries built
+// from the FieldMap are always the same for the same fields.
+func sortedFieldMapKeys(mi *Model, fMap FieldMap) []string {
+	keys := fMap.Keys()
+	sort.Slice(keys, func(i, j int) bool {
+		return mi.fields.MustGet(keys[i]).json < mi.fields.MustGet(keys[j]).json
+	})
+	return keys
+}
+
+// isNullValue returns true if the given FieldMap value represents
+// a NULL value in the database, that is nil or a nil pointer.
+func isNullValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	val := reflect.ValueOf(value)
+	return val.Kind() == reflect.Ptr && val.IsNil()
+}
+
 // addIDIfNotPresent returns a new fields slice including ID if it
 // is not already present. Otherwise returns the original slice.
 func addIDIfNotPresent(fields []string) []string {
@@ -292,10 +415,15 @@ func ConvertToFieldNameSlice(fields []string) []FieldNamer {
 
 // getGroupCondition returns the condition to retrieve the individual aggregated rows in vals
 // knowing that they were grouped by groups and that we had the given initial condition
-func getGroupCondition(groups []string, vals map[string]interface{}, initialCondition *Condition) *Condition {
+func getGroupCondition(mi *Model, groups []string, vals map[string]interface{}, initialCondition *Condition) *Condition {
 	res := initialCondition
 	for _, group := range groups {
-		res = res.And().Field(group).Equals(vals[group])
+		val := vals[strings.Join(jsonizeExpr(mi, strings.Split(group, ExprSep)), sqlSep)]
+		if val == nil {
+			res = res.And().Field(group).IsNull()
+			continue
+		}
+		res = res.And().Field(group).Equals(val)
 	}
 	return res
 }
@@ -342,10 +470,17 @@ func consumeAndPredicates(i int, predicates []predicate, res []interface{}) ([]i
 // appendPredicateToSerial appends the given predicate to the given serialized
 // predicate list and returns the result.
 func appendPredicateToSerial(res []interface{}, predicate predicate) []interface{} {
+	if predicate.isNot {
+		res = append(res, "!")
+	}
 	if predicate.isCond {
 		res = append(res, serializePredicates(predicate.cond.predicates)...)
 	} else {
-		res = append(res, []interface{}{strings.Join(predicate.exprs, ExprSep), predicate.operator, predicate.arg})
+		arg := predicate.arg
+		if subQuery, ok := arg.(*RecordCollection); ok {
+			arg = subQuery.Ids()
+		}
+		res = append(res, []interface{}{strings.Join(predicate.exprs, ExprSep), predicate.operator, arg})
 	}
 	return res
 }
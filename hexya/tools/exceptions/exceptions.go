@@ -8,9 +8,13 @@ import "fmt"
 
 // UserError is an error that must rollback the current transaction and
 // be displayed as a warning to the user.
+//
+// Err is the underlying error, if any. It can be retrieved with
+// errors.Is and errors.As.
 type UserError struct {
 	Message string
 	Debug   string
+	Err     error
 }
 
 // Error method for the UserError type.
@@ -18,3 +22,8 @@ type UserError struct {
 func (u UserError) Error() string {
 	return fmt.Sprintf("%s\n----------------------------------\n%s", u.Message, u.Debug)
 }
+
+// Unwrap returns the underlying error of this UserError
+func (u UserError) Unwrap() error {
+	return u.Err
+}
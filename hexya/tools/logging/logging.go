@@ -73,6 +73,21 @@ func (l *Logger) Panic(msg string, ctx ...interface{}) {
 	})
 }
 
+// PanicWithError logs as an error the given message and context and then
+// panics with a UserError wrapping err.
+func (l *Logger) PanicWithError(err error, msg string, ctx ...interface{}) {
+	pc, _, _, _ := runtime.Caller(1)
+	ctx = append(ctx, "caller", string(function(pc)))
+	l.Error(msg, ctx...)
+
+	fullMsg := fmt.Sprintf("%s, %v\n", msg, ctx)
+	panic(exceptions.UserError{
+		Message: msg,
+		Debug:   fullMsg,
+		Err:     err,
+	})
+}
+
 // Initialize starts the base logger used by all Hexya components
 func Initialize() {
 	logLevel, err := log15.LvlFromString(viper.GetString("LogLevel"))
@@ -122,9 +137,11 @@ func LogPanicData(panicData interface{}) error {
 	log.Error(fmt.Sprintf("Stack trace:\n%s", stackTrace))
 
 	fullMsg := fmt.Sprintf("%s\n\n%s", msg, stackTrace)
+	err, _ := panicData.(error)
 	return exceptions.UserError{
 		Message: msg,
 		Debug:   fullMsg,
+		Err:     err,
 	}
 }
 